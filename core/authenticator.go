@@ -0,0 +1,381 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/ronaldalds/gorote-core-rsa/gorote"
+	"gorm.io/gorm"
+)
+
+// Errors an Authenticator returns for refused logins.
+var (
+	// ErrUnknownIdentity means the provider does not know the email, so the
+	// next authenticator of the chain is tried.
+	ErrUnknownIdentity = errors.New("unknown identity")
+	// ErrInvalidCredentials means the provider knows the email but refused
+	// the password, which ends the chain.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+const localProvider = "local"
+
+// Identity is a user as asserted by an authentication provider.
+type Identity struct {
+	// Subject is the stable id of the user at the provider, such as the iss
+	// and sub of an id_token. Users are matched on it before their email, and
+	// keep it when the provider changes their email.
+	Subject string
+	Email   string
+	// EmailVerified must be set for the identity to be linked by email to a
+	// registered user or created by JIT provisioning.
+	EmailVerified bool
+	FirstName     string
+	LastName      string
+	// Groups are mapped to roles through ProvisioningPolicy.GroupRoles.
+	Groups []string
+
+	// user is set by the local authenticator, whose users need no provisioning.
+	user *User
+}
+
+// Authenticator is a source of users. Config.Authenticators lists them in
+// the order /auth/login tries them.
+type Authenticator interface {
+	// Provider names the source; users it provisions keep it in User.Provider
+	// and can only log in through it.
+	Provider() string
+	Provisioning() ProvisioningPolicy
+}
+
+// PasswordAuthenticator checks the email and password of /auth/login.
+type PasswordAuthenticator interface {
+	Authenticator
+	Authenticate(ctx context.Context, email, password string) (*Identity, error)
+}
+
+// RedirectAuthenticator logs users in on a page of the provider, through
+// /auth/providers/{provider}/login and its callback.
+type RedirectAuthenticator interface {
+	Authenticator
+	// AuthCodeURL is the provider page the browser is sent to.
+	AuthCodeURL(ctx context.Context, redirectURI, state, nonce, codeChallenge string) (string, error)
+	// Exchange redeems the code the provider sent back to redirectURI.
+	Exchange(ctx context.Context, redirectURI, code, codeVerifier, nonce string) (*Identity, error)
+}
+
+// ProvisioningPolicy tells how the identities of an external provider become
+// users. It is embedded by the authenticators of this package.
+type ProvisioningPolicy struct {
+	// JIT creates the user on the first login. Otherwise only users already
+	// registered for the provider may log in.
+	JIT bool
+	// GroupRoles maps provider groups, compared case-insensitively, to role
+	// names. When set, the roles of the user are replaced on every login by
+	// the roles of its groups.
+	GroupRoles map[string][]string
+}
+
+func (p ProvisioningPolicy) Provisioning() ProvisioningPolicy {
+	return p
+}
+
+// LocalAuthenticator checks the password hashes stored with the users. It is
+// the only authenticator when Config.Authenticators is empty.
+type LocalAuthenticator struct{}
+
+func (*LocalAuthenticator) Provider() string {
+	return localProvider
+}
+
+func (*LocalAuthenticator) Provisioning() ProvisioningPolicy {
+	return ProvisioningPolicy{}
+}
+
+func isLocal(user *User) bool {
+	return user.Provider == "" || user.Provider == localProvider
+}
+
+// authenticator returns the authenticator of provider.
+func (s *appService) authenticator(provider string) (Authenticator, bool) {
+	for _, auth := range s.authenticators() {
+		if auth.Provider() == provider {
+			return auth, true
+		}
+	}
+	return nil, false
+}
+
+// authenticate runs the password chain and returns the identity together with
+// the authenticator that accepted it.
+func (s *appService) authenticate(email, password string) (Authenticator, *Identity, error) {
+	for _, auth := range s.authenticators() {
+		var identity *Identity
+		var err error
+		switch auth := auth.(type) {
+		case *LocalAuthenticator:
+			identity, err = s.localAuthenticate(email, password)
+		case PasswordAuthenticator:
+			identity, err = auth.Authenticate(context.Background(), email, password)
+		default:
+			continue
+		}
+		if errors.Is(err, ErrUnknownIdentity) {
+			continue
+		}
+		if err != nil {
+			return auth, nil, err
+		}
+		return auth, identity, nil
+	}
+	return nil, nil, ErrUnknownIdentity
+}
+
+func (s *appService) localAuthenticate(email, password string) (*Identity, error) {
+	var user User
+	if err := s.db().
+		Preload("Roles.Permissions").
+		Preload("Tenants").
+		Where("email = ?", email).
+		First(&user).Error; err != nil {
+		return nil, ErrUnknownIdentity
+	}
+	if !isLocal(&user) {
+		return nil, ErrUnknownIdentity
+	}
+	if ok, _ := s.passwordHasher().Verify(password, user.Password); !ok {
+		return nil, ErrInvalidCredentials
+	}
+	s.rehashPassword(&user, password)
+	return &Identity{Email: user.Email, EmailVerified: user.EmailVerified, user: &user}, nil
+}
+
+// provision returns the user of an identity, creating it when the policy of
+// auth allows. Identities with a Subject are matched on it first; matching by
+// email needs a verified email, so an unverified address can't take over a
+// user or be claimed by JIT. Names, email and its verification follow the
+// provider; they are written with UpdateColumns so other sessions keep their
+// refresh tokens.
+func (s *appService) provision(auth Authenticator, identity *Identity) (*User, error) {
+	if identity.user != nil {
+		return identity.user, nil
+	}
+	policy := auth.Provisioning()
+	var user User
+	err := gorm.ErrRecordNotFound
+	if identity.Subject != "" {
+		err = s.db().Where("provider = ? AND subject = ?", auth.Provider(), identity.Subject).First(&user).Error
+	}
+	linked := err == nil
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !identity.EmailVerified {
+			return nil, &loginFailure{reasonEmailNotVerified, fmt.Errorf("failed to login: provider did not verify the email")}
+		}
+		err = s.db().Where("email = ?", identity.Email).First(&user).Error
+	}
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		if !policy.JIT {
+			return nil, &loginFailure{reasonUnknownUser, fmt.Errorf("failed to login: user is not registered")}
+		}
+		user = User{
+			Email:         identity.Email,
+			EmailVerified: identity.EmailVerified,
+			FirstName:     identity.FirstName,
+			LastName:      identity.LastName,
+			Provider:      auth.Provider(),
+			Subject:       identity.Subject,
+			Active:        true,
+		}
+		if err := s.db().Create(&user).Error; err != nil {
+			return nil, fmt.Errorf("failed to create user: %v", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to query user: %v", err)
+	case user.Provider != auth.Provider():
+		return nil, &loginFailure{reasonProviderMismatch, fmt.Errorf("failed to login: user belongs to another provider")}
+	case !linked && user.Subject != "":
+		return nil, &loginFailure{reasonProviderMismatch, fmt.Errorf("failed to login: user belongs to another identity")}
+	default:
+		changes := map[string]any{}
+		if identity.Subject != user.Subject {
+			changes["subject"] = identity.Subject
+		}
+		if identity.EmailVerified && identity.Email != user.Email {
+			changes["email"] = identity.Email
+		}
+		if identity.FirstName != "" && identity.FirstName != user.FirstName {
+			changes["first_name"] = identity.FirstName
+		}
+		if identity.LastName != "" && identity.LastName != user.LastName {
+			changes["last_name"] = identity.LastName
+		}
+		if identity.EmailVerified != user.EmailVerified {
+			changes["email_verified"] = identity.EmailVerified
+		}
+		if len(changes) > 0 {
+			if err := s.db().Model(&user).UpdateColumns(changes).Error; err != nil {
+				return nil, fmt.Errorf("failed to update user: %v", err)
+			}
+		}
+	}
+	if policy.GroupRoles != nil {
+		if err := s.syncGroupRoles(&user, policy.GroupRoles, identity.Groups); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.db().
+		Preload("Roles.Permissions").
+		Preload("Tenants").
+		First(&user, "id = ?", user.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to query user: %v", err)
+	}
+	return &user, nil
+}
+
+// syncGroupRoles replaces the roles of user by the roles its groups map to.
+// Roles that don't exist are ignored. Nothing is written when the roles are
+// the same, since a change bumps UpdatedAt and so ends the other sessions.
+func (s *appService) syncGroupRoles(user *User, groupRoles map[string][]string, groups []string) error {
+	mapped := make(map[string][]string, len(groupRoles))
+	for group, roles := range groupRoles {
+		key := strings.ToLower(group)
+		mapped[key] = append(mapped[key], roles...)
+	}
+	var names []string
+	for _, group := range groups {
+		names = append(names, mapped[strings.ToLower(group)]...)
+	}
+	roles := []Role{}
+	if len(names) > 0 {
+		if err := s.db().Where("name IN ?", names).Find(&roles).Error; err != nil {
+			return fmt.Errorf("failed to query roles: %v", err)
+		}
+	}
+	var current []Role
+	if err := s.db().Model(user).Association("Roles").Find(&current); err != nil {
+		return fmt.Errorf("failed to query roles: %v", err)
+	}
+	if sameRoles(current, roles) {
+		return nil
+	}
+	return s.db().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Association("Roles").Replace(roles); err != nil {
+			return fmt.Errorf("failed to update roles: %v", err)
+		}
+		if err := tx.Model(user).Update("updated_at", time.Now()).Error; err != nil {
+			return fmt.Errorf("failed to update user: %v", err)
+		}
+		return nil
+	})
+}
+
+func sameRoles(a, b []Role) bool {
+	ids := func(roles []Role) []uuid.UUID {
+		out := make([]uuid.UUID, 0, len(roles))
+		for _, role := range roles {
+			out = append(out, role.ID)
+		}
+		slices.SortFunc(out, func(x, y uuid.UUID) int { return strings.Compare(x.String(), y.String()) })
+		return slices.Compact(out)
+	}
+	return slices.Equal(ids(a), ids(b))
+}
+
+var errProviderNotFound = errors.New("provider not found")
+
+var errProviderUnavailable = errors.New("authentication provider is unavailable")
+
+// logProviderError keeps why a provider failed in the server log; clients
+// only get a generic error, since the cause may name its upstream.
+func logProviderError(provider string, err error) {
+	log.Printf("login through %s failed: %v", provider, err)
+}
+
+func (s *appService) redirectAuthenticator(provider string) (RedirectAuthenticator, error) {
+	auth, ok := s.authenticator(provider)
+	if !ok {
+		return nil, errProviderNotFound
+	}
+	redirect, ok := auth.(RedirectAuthenticator)
+	if !ok {
+		return nil, errProviderNotFound
+	}
+	return redirect, nil
+}
+
+// startProviderLogin returns the provider page the browser is sent to and the
+// signed flow it keeps until the callback.
+func (s *appService) startProviderLogin(provider, redirectURI string) (string, string, error) {
+	auth, err := s.redirectAuthenticator(provider)
+	if err != nil {
+		return "", "", err
+	}
+	var values [3]string
+	for i := range values {
+		if values[i], err = gorote.RandomToken(32); err != nil {
+			return "", "", err
+		}
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+	link, err := auth.AuthCodeURL(context.Background(), redirectURI, state, nonce, gorote.CodeChallengeS256(verifier))
+	if err != nil {
+		logProviderError(provider, err)
+		return "", "", errProviderUnavailable
+	}
+	now := s.now()
+	flow, err := s.keys.Sign(providerLoginClaims{
+		Provider: provider,
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		Type:     "provider_login",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.name(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(providerLoginExpire)),
+		},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to sign login flow")
+	}
+	return link, flow, nil
+}
+
+// providerLogin finishes an external login: the state must match the flow
+// started by this browser before the code is redeemed.
+func (s *appService) providerLogin(req *providerCallback, redirectURI, flow string) (*User, error) {
+	auth, err := s.redirectAuthenticator(req.Provider)
+	if err != nil {
+		return nil, err
+	}
+	var claims providerLoginClaims
+	if err := s.claims(&claims, flow); err != nil || claims.Type != "provider_login" || claims.Provider != req.Provider ||
+		subtle.ConstantTimeCompare([]byte(claims.State), []byte(req.State)) != 1 {
+		return nil, &loginFailure{reasonInvalidToken, fmt.Errorf("failed to login: invalid state")}
+	}
+	if req.Error != "" {
+		return nil, &loginFailure{reasonProviderError, fmt.Errorf("failed to login: provider returned %s", req.Error)}
+	}
+	if req.Code == "" {
+		return nil, &loginFailure{reasonInvalidToken, fmt.Errorf("failed to login: code is required")}
+	}
+	identity, err := auth.Exchange(context.Background(), redirectURI, req.Code, claims.Verifier, claims.Nonce)
+	if err != nil {
+		logProviderError(req.Provider, err)
+		return nil, &loginFailure{reasonProviderError, fmt.Errorf("failed to login: provider refused the code")}
+	}
+	user, err := s.provision(auth, identity)
+	if err != nil {
+		return nil, err
+	}
+	return user, s.loginAllowed(user)
+}
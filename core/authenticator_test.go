@@ -0,0 +1,597 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/ronaldalds/gorote-core-rsa/gorote"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestAuthLDAP(t *testing.T) {
+	directory := newFakeLDAP(t)
+	directory.add("cn=joao,ou=people,dc=ralds", "Ldap@123", map[string][]string{
+		"mail":      {"joao@ralds.com.br"},
+		"givenName": {"Joao"},
+		"sn":        {"Silva"},
+		"memberOf":  {"CN=Engenharia,OU=Groups,DC=ralds", "cn=outros,ou=groups,dc=ralds"},
+	})
+	directory.add("cn=maria,ou=people,dc=ralds", "Ldap@123", map[string][]string{
+		"mail": {"maria@ralds.com.br"},
+	})
+	directory.add("cn=ana,ou=people,dc=ralds", "Ldap@123", map[string][]string{
+		"mail": {"ana@ralds.com.br"},
+	})
+
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:ldap?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	directoryAuth := &LDAPAuthenticator{
+		ProvisioningPolicy: ProvisioningPolicy{
+			JIT:        true,
+			GroupRoles: map[string][]string{"cn=engenharia,ou=groups,dc=ralds": {"engenharia"}},
+		},
+		URL:          directory.url,
+		BindDN:       "cn=service,dc=ralds",
+		BindPassword: "service",
+		BaseDN:       "ou=people,dc=ralds",
+	}
+	auth := Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+		Authenticators:   []Authenticator{&LocalAuthenticator{}, directoryAuth},
+	}
+	router, err := New(&auth)
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	var permission Permission
+	if err := db.Where("code = ?", string(PermissionViewUser)).First(&permission).Error; err != nil {
+		t.Fatalf("err on query permission: %v", err.Error())
+	}
+	if err := db.Create(&Role{Name: "engenharia", Permissions: []Permission{permission}}).Error; err != nil {
+		t.Fatalf("err on create role: %v", err.Error())
+	}
+
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	body := `{"email": "maria@ralds.com.br", "password": "Senha@123", "active": true}`
+	if resp := request(t, app, "POST", "/test/users", body, admin.AccessToken); resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+
+	permissions := func(accessToken string) []string {
+		t.Helper()
+		var claims JwtClaims
+		if _, _, err := jwt.NewParser().ParseUnverified(accessToken, &claims); err != nil {
+			t.Fatalf("err on parse: %v", err.Error())
+		}
+		return claims.Permissions
+	}
+
+	joao := loginAs(t, app, "joao@ralds.com.br", "Ldap@123")
+	if !slices.Contains(permissions(joao.AccessToken), string(PermissionViewUser)) {
+		t.Error("esperava permissao do grupo mapeado no token")
+	}
+	var user User
+	if err := db.Preload("Roles").Where("email = ?", "joao@ralds.com.br").First(&user).Error; err != nil {
+		t.Fatalf("usuario ldap nao provisionado: %v", err.Error())
+	}
+	if user.Provider != "ldap" || user.FirstName != "Joao" || user.LastName != "Silva" || !user.EmailVerified || user.Password != "" {
+		t.Errorf("usuario provisionado incorreto: %+v", user)
+	}
+	if len(user.Roles) != 1 || user.Roles[0].Name != "engenharia" {
+		t.Errorf("esperava papel engenharia, recebeu %+v", user.Roles)
+	}
+
+	updatedAt := user.UpdatedAt
+	loginAs(t, app, "joao@ralds.com.br", "Ldap@123")
+	if err := db.First(&user, "id = ?", user.ID).Error; err != nil {
+		t.Fatalf("err on query user: %v", err.Error())
+	}
+	if !user.UpdatedAt.Equal(updatedAt) {
+		t.Error("login com os mesmos grupos nao deveria alterar updated_at")
+	}
+	resp := request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, joao.RefreshToken), "")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("esperava refresh valido apos novo login, recebeu %d", resp.StatusCode)
+	}
+
+	resp = request(t, app, "POST", "/test/auth/login", `{"email": "joao@ralds.com.br", "password": "Errada@123"}`, "")
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 com senha errada, recebeu %d", resp.StatusCode)
+	}
+	var event LoginEvent
+	if err := db.Order("created_at DESC").First(&event).Error; err != nil {
+		t.Fatalf("err on query event: %v", err.Error())
+	}
+	if event.Reason != reasonBadPassword || event.UserID == nil || *event.UserID != user.ID {
+		t.Errorf("evento de senha errada incorreto: %+v", event)
+	}
+
+	resp = request(t, app, "POST", "/test/auth/login", `{"email": "naoexiste@ralds.com.br", "password": "Ldap@123"}`, "")
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 para email desconhecido, recebeu %d", resp.StatusCode)
+	}
+
+	// The local account is checked first and its password ends the chain, so
+	// the directory password can't take it over.
+	resp = request(t, app, "POST", "/test/auth/login", `{"email": "maria@ralds.com.br", "password": "Ldap@123"}`, "")
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("senha do diretorio nao deveria entrar na conta local, recebeu %d", resp.StatusCode)
+	}
+	loginAs(t, app, "maria@ralds.com.br", "Senha@123")
+
+	directory.set("cn=joao,ou=people,dc=ralds", "memberOf", "cn=outros,ou=groups,dc=ralds")
+	joao = loginAs(t, app, "joao@ralds.com.br", "Ldap@123")
+	if slices.Contains(permissions(joao.AccessToken), string(PermissionViewUser)) {
+		t.Error("permissao do grupo removido nao deveria estar no token")
+	}
+
+	directoryAuth.JIT = false
+	resp = request(t, app, "POST", "/test/auth/login", `{"email": "ana@ralds.com.br", "password": "Ldap@123"}`, "")
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 sem provisionamento, recebeu %d", resp.StatusCode)
+	}
+	if resp := request(t, app, "POST", "/test/users", `{"email": "ana@ralds.com.br", "provider": "saml", "active": true}`, admin.AccessToken); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 para provedor desconhecido, recebeu %d", resp.StatusCode)
+	}
+	if resp := request(t, app, "POST", "/test/users", `{"email": "ana@ralds.com.br", "provider": "ldap", "active": true}`, admin.AccessToken); resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	loginAs(t, app, "ana@ralds.com.br", "Ldap@123")
+	if resp := request(t, app, "POST", "/test/auth/login", `{"email": "ana@ralds.com.br", "password": ""}`, ""); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 com senha vazia, recebeu %d", resp.StatusCode)
+	}
+}
+
+func TestAuthOIDC(t *testing.T) {
+	issuer := newFakeIssuer(t, "corp-app", "corp-secret")
+
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:oidc?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	auth := Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+		Authenticators: []Authenticator{
+			&LocalAuthenticator{},
+			&OIDCAuthenticator{
+				ProvisioningPolicy: ProvisioningPolicy{
+					JIT:        true,
+					GroupRoles: map[string][]string{"engenharia": {"engenharia"}},
+				},
+				Name:         "corp",
+				Issuer:       issuer.url,
+				ClientID:     "corp-app",
+				ClientSecret: "corp-secret",
+			},
+		},
+	}
+	router, err := New(&auth)
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	var permission Permission
+	if err := db.Where("code = ?", string(PermissionViewUser)).First(&permission).Error; err != nil {
+		t.Fatalf("err on query permission: %v", err.Error())
+	}
+	if err := db.Create(&Role{Name: "engenharia", Permissions: []Permission{permission}}).Error; err != nil {
+		t.Fatalf("err on create role: %v", err.Error())
+	}
+
+	if resp := request(t, app, "GET", "/test/auth/providers/outro/login", "", ""); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("esperava status 404 para provedor desconhecido, recebeu %d", resp.StatusCode)
+	}
+
+	// start follows the redirect to the fake issuer, which logs claims in
+	// and returns the callback URL and the flow cookie.
+	start := func(claims jwt.MapClaims) (*url.URL, string) {
+		t.Helper()
+		resp := request(t, app, "GET", "/test/auth/providers/corp/login", "", "")
+		if resp.StatusCode != fiber.StatusFound {
+			t.Fatalf("esperava status 302, recebeu %d", resp.StatusCode)
+		}
+		var flow string
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == "provider_login" {
+				flow = cookie.Value
+			}
+		}
+		if flow == "" {
+			t.Fatal("cookie provider_login nao definido")
+		}
+		location, err := url.Parse(resp.Header.Get(fiber.HeaderLocation))
+		if err != nil {
+			t.Fatalf("err on parse: %v", err.Error())
+		}
+		if !strings.HasPrefix(location.String(), issuer.url+"/authorize?") {
+			t.Fatalf("redirecionamento inesperado: %s", location)
+		}
+		query := location.Query()
+		if query.Get("client_id") != "corp-app" || query.Get("code_challenge_method") != "S256" ||
+			query.Get("redirect_uri") != "http://example.com/test/auth/providers/corp/callback" {
+			t.Fatalf("parametros de autorizacao incorretos: %s", location)
+		}
+		callback, err := url.Parse(issuer.authorize(query, claims))
+		if err != nil {
+			t.Fatalf("err on parse: %v", err.Error())
+		}
+		return callback, flow
+	}
+	callback := func(uri *url.URL, flow string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("GET", uri.RequestURI(), nil)
+		if flow != "" {
+			req.AddCookie(&http.Cookie{Name: "provider_login", Value: flow})
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("err on request: %v", err.Error())
+		}
+		return resp
+	}
+
+	claims := jwt.MapClaims{
+		"sub":            "carla",
+		"email":          "carla@corp.com",
+		"email_verified": true,
+		"given_name":     "Carla",
+		"groups":         []string{"Engenharia"},
+	}
+	uri, flow := start(claims)
+	if resp := callback(uri, ""); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 sem cookie, recebeu %d", resp.StatusCode)
+	}
+	forged := *uri
+	query := forged.Query()
+	query.Set("state", "forjado")
+	forged.RawQuery = query.Encode()
+	if resp := callback(&forged, flow); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 com state diferente, recebeu %d", resp.StatusCode)
+	}
+	resp := callback(uri, flow)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200 no callback, recebeu %d", resp.StatusCode)
+	}
+	var tk token
+	if err := json.NewDecoder(resp.Body).Decode(&tk); err != nil {
+		t.Fatalf("err on decode: %v", err.Error())
+	}
+	var accessClaims JwtClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tk.AccessToken, &accessClaims); err != nil {
+		t.Fatalf("err on parse: %v", err.Error())
+	}
+	if !slices.Contains(accessClaims.Permissions, string(PermissionViewUser)) {
+		t.Error("esperava permissao do grupo mapeado no token")
+	}
+	var user User
+	if err := db.Where("email = ?", "carla@corp.com").First(&user).Error; err != nil {
+		t.Fatalf("usuario oidc nao provisionado: %v", err.Error())
+	}
+	if user.Provider != "corp" || user.FirstName != "Carla" || !user.EmailVerified {
+		t.Errorf("usuario provisionado incorreto: %+v", user)
+	}
+	var session Session
+	if err := db.Where("user_id = ?", user.ID).First(&session).Error; err != nil || session.Device != "corp" {
+		t.Errorf("esperava sessao do dispositivo corp: %+v", session)
+	}
+	if resp := callback(uri, flow); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 ao reutilizar o codigo, recebeu %d", resp.StatusCode)
+	}
+
+	uri, flow = start(jwt.MapClaims{"email": "admin@admin.com", "email_verified": true})
+	if resp := callback(uri, flow); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("provedor externo nao deveria entrar na conta local, recebeu %d", resp.StatusCode)
+	}
+	var event LoginEvent
+	if err := db.Order("created_at DESC").First(&event).Error; err != nil {
+		t.Fatalf("err on query event: %v", err.Error())
+	}
+	if event.Kind != "provider" || event.Reason != reasonProviderMismatch {
+		t.Errorf("evento de provedor incorreto: %+v", event)
+	}
+
+	uri, flow = start(jwt.MapClaims{"sub": "nova", "email": "nova@corp.com"})
+	if resp := callback(uri, flow); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("email nao verificado nao deveria ser provisionado, recebeu %d", resp.StatusCode)
+	}
+	if err := db.Where("reason = ?", reasonEmailNotVerified).First(&LoginEvent{}).Error; err != nil {
+		t.Errorf("evento de email nao verificado nao registrado: %v", err.Error())
+	}
+	if err := db.Where("email = ?", "nova@corp.com").First(&User{}).Error; err == nil {
+		t.Error("usuario com email nao verificado foi criado")
+	}
+
+	uri, flow = start(jwt.MapClaims{"sub": "intrusa", "email": "carla@corp.com", "email_verified": true})
+	if resp := callback(uri, flow); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("outra identidade nao deveria entrar na conta pelo email, recebeu %d", resp.StatusCode)
+	}
+
+	uri, flow = start(jwt.MapClaims{"sub": "carla", "email": "carla.souza@corp.com", "email_verified": true})
+	if resp := callback(uri, flow); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200 com email alterado no provedor, recebeu %d", resp.StatusCode)
+	}
+	var renamed User
+	if err := db.First(&renamed, "id = ?", user.ID).Error; err != nil {
+		t.Fatalf("err on query user: %v", err.Error())
+	}
+	if renamed.Email != "carla.souza@corp.com" {
+		t.Errorf("esperava email atualizado pelo sub, recebeu %s", renamed.Email)
+	}
+
+	uri, flow = start(jwt.MapClaims{"email": "carla@corp.com", "nonce": "outro"})
+	if resp := callback(uri, flow); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 com nonce diferente, recebeu %d", resp.StatusCode)
+	}
+}
+
+// fakeLDAP answers the bind, search and unbind requests of the LDAP
+// authenticator from an in-memory directory.
+type fakeLDAP struct {
+	url     string
+	mu      sync.Mutex
+	entries map[string]*fakeLDAPEntry
+}
+
+type fakeLDAPEntry struct {
+	password   string
+	attributes map[string][]string
+}
+
+func newFakeLDAP(t *testing.T) *fakeLDAP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err on listen: %v", err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+	directory := &fakeLDAP{
+		url:     "ldap://" + listener.Addr().String(),
+		entries: map[string]*fakeLDAPEntry{},
+	}
+	directory.add("cn=service,dc=ralds", "service", nil)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go directory.serve(conn)
+		}
+	}()
+	return directory
+}
+
+func (d *fakeLDAP) add(dn, password string, attributes map[string][]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[dn] = &fakeLDAPEntry{password: password, attributes: attributes}
+}
+
+func (d *fakeLDAP) set(dn, attribute string, values ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[dn].attributes[attribute] = values
+}
+
+func (d *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := op.Children[1].Value.(string)
+			code := int64(ldap.LDAPResultSuccess)
+			d.mu.Lock()
+			if entry, ok := d.entries[dn]; !ok || entry.password != op.Children[2].Data.String() {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			d.mu.Unlock()
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationBindResponse, code)).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+			mail := strings.TrimSuffix(strings.TrimPrefix(filter, "(mail="), ")")
+			d.mu.Lock()
+			for dn, entry := range d.entries {
+				if !slices.Contains(entry.attributes["mail"], mail) {
+					continue
+				}
+				result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+				attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for name, values := range entry.attributes {
+					attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, value := range values {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+					}
+					attribute.AppendChild(set)
+					attributes.AppendChild(attribute)
+				}
+				result.AppendChild(attributes)
+				conn.Write(ldapMessage(id, result).Bytes())
+			}
+			d.mu.Unlock()
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)).Bytes())
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	packet.AppendChild(op)
+	return packet
+}
+
+func ldapResult(tag ber.Tag, code int64) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return result
+}
+
+// fakeIssuer is an OpenID provider that skips its login page: authorize
+// issues a code for the given claims right away.
+type fakeIssuer struct {
+	url          string
+	clientID     string
+	clientSecret string
+	keys         *gorote.KeyRing
+	mu           sync.Mutex
+	codes        map[string]fakeIssuerCode
+}
+
+type fakeIssuerCode struct {
+	redirectURI string
+	challenge   string
+	claims      jwt.MapClaims
+}
+
+func newFakeIssuer(t *testing.T, clientID, clientSecret string) *fakeIssuer {
+	t.Helper()
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	keys, err := gorote.NewKeyRing(privateKey)
+	if err != nil {
+		t.Fatalf("err on key ring: %v", err.Error())
+	}
+	issuer := &fakeIssuer{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		keys:         keys,
+		codes:        map[string]fakeIssuerCode{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                issuer.url,
+			AuthorizationEndpoint: issuer.url + "/authorize",
+			TokenEndpoint:         issuer.url + "/token",
+			JWKSURI:               issuer.url + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwks, _ := keys.JWKS()
+		json.NewEncoder(w).Encode(jwks)
+	})
+	mux.HandleFunc("/token", issuer.token)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	issuer.url = server.URL
+	return issuer
+}
+
+// authorize returns the redirect of the provider back to the client.
+func (f *fakeIssuer) authorize(query url.Values, claims jwt.MapClaims) string {
+	code, _ := gorote.RandomToken(16)
+	idClaims := jwt.MapClaims{
+		"iss":   f.url,
+		"aud":   query.Get("client_id"),
+		"sub":   code,
+		"nonce": query.Get("nonce"),
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}
+	for name, value := range claims {
+		idClaims[name] = value
+	}
+	f.mu.Lock()
+	f.codes[code] = fakeIssuerCode{
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		claims:      idClaims,
+	}
+	f.mu.Unlock()
+	return query.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+}
+
+func (f *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != f.clientID || clientSecret != f.clientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	f.mu.Lock()
+	code, ok := f.codes[r.PostFormValue("code")]
+	delete(f.codes, r.PostFormValue("code"))
+	f.mu.Unlock()
+	if !ok || code.redirectURI != r.PostFormValue("redirect_uri") ||
+		code.challenge != gorote.CodeChallengeS256(r.PostFormValue("code_verifier")) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	idToken, err := f.keys.Sign(code.claims)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "upstream",
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
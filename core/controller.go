@@ -1,24 +1,89 @@
 package core
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"log"
+	"net/url"
+	"path"
 	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/ronaldalds/gorote-core-rsa/gorote"
 )
 
 type controller interface {
 	healthHandler(*fiber.Ctx) error
+	jwksHandler(*fiber.Ctx) error
+	openidConfigurationHandler(*fiber.Ctx) error
+	userInfoHandler(*fiber.Ctx) error
 	loginHandler(*fiber.Ctx) error
 	refreshTokenHandler(*fiber.Ctx) error
+	logoutHandler(*fiber.Ctx) error
+	logoutAllHandler(*fiber.Ctx) error
+	forgotPasswordHandler(*fiber.Ctx) error
+	magicLinkHandler(*fiber.Ctx) error
+	magicLinkPageHandler(*fiber.Ctx) error
+	magicLinkCallbackHandler(*fiber.Ctx) error
+	providerLoginHandler(*fiber.Ctx) error
+	providerCallbackHandler(*fiber.Ctx) error
+	verifyEmailHandler(*fiber.Ctx) error
+	resendVerificationHandler(*fiber.Ctx) error
+	resetPasswordHandler(*fiber.Ctx) error
+	mfaVerifyHandler(*fiber.Ctx) error
+	mfaEnrollHandler(*fiber.Ctx) error
+	mfaConfirmHandler(*fiber.Ctx) error
+	mfaDisableHandler(*fiber.Ctx) error
+	listLoginEventsHandler(*fiber.Ctx) error
+	impersonateHandler(*fiber.Ctx) error
+	listImpersonationEventsHandler(*fiber.Ctx) error
+	tokenHandler(*fiber.Ctx) error
+	introspectHandler(*fiber.Ctx) error
+	authorizeHandler(*fiber.Ctx) error
+	authorizeLoginHandler(*fiber.Ctx) error
+	listServiceClientsHandler(*fiber.Ctx) error
+	createServiceClientHandler(*fiber.Ctx) error
 	listUsersHandler(*fiber.Ctx) error
 	listPermissiontHandler(*fiber.Ctx) error
+	recievePermissionHandler(*fiber.Ctx) error
+	createPermissionHandler(*fiber.Ctx) error
+	updatePermissionHandler(*fiber.Ctx) error
+	activatePermissionHandler(*fiber.Ctx) error
+	deactivatePermissionHandler(*fiber.Ctx) error
+	deletePermissionHandler(*fiber.Ctx) error
 	listRolesHandler(*fiber.Ctx) error
 	createRoleHandler(*fiber.Ctx) error
+	recieveRoleHandler(*fiber.Ctx) error
+	updateRoleHandler(*fiber.Ctx) error
+	patchRoleHandler(*fiber.Ctx) error
+	addRolePermissionsHandler(*fiber.Ctx) error
+	removeRolePermissionHandler(*fiber.Ctx) error
+	addRoleParentsHandler(*fiber.Ctx) error
+	removeRoleParentHandler(*fiber.Ctx) error
+	activateRoleHandler(*fiber.Ctx) error
+	deactivateRoleHandler(*fiber.Ctx) error
+	deleteRoleHandler(*fiber.Ctx) error
 	createUserHandler(*fiber.Ctx) error
 	updateUserHandler(*fiber.Ctx) error
+	unlockUserHandler(*fiber.Ctx) error
+	listSessionsHandler(*fiber.Ctx) error
+	revokeSessionHandler(*fiber.Ctx) error
+	listUserSessionsHandler(*fiber.Ctx) error
+	revokeUserSessionHandler(*fiber.Ctx) error
+	revokeUserSessionsHandler(*fiber.Ctx) error
+	listPersonalTokensHandler(*fiber.Ctx) error
+	createPersonalTokenHandler(*fiber.Ctx) error
+	revokePersonalTokenHandler(*fiber.Ctx) error
 	recieveUserHandler(*fiber.Ctx) error
+	personalTokenScope(jwt.Claims) *fiber.Error
 }
 
 // Login godoc
@@ -28,18 +93,82 @@ type controller interface {
 // @Accept       json
 // @Produce      json
 // @Param        credentials body login true "User login credentials (email and password required)"
-// @Success      200 {object} token "Login successful - returns access_token and refresh_token"
+// @Success      200 {object} token "Login successful - returns access_token, refresh_token and id_token, or an mfaChallenge when MFA is required"
 // @Failure      400 {object} map[string]string "Bad request - validation error, invalid body, invalid credentials, or user inactive"
-// @Failure      429 {object} map[string]string "Too many requests - rate limit exceeded (60 requests per window)"
+// @Failure      429 {object} map[string]string "Too many requests - rate limit exceeded or account/IP locked, see Retry-After"
 // @Router       /auth/login [post]
 func (c *appController) loginHandler(ctx *fiber.Ctx) error {
 	req := ctx.Locals("validatedData").(*login)
-	user, err := c.service.login(req)
+	user, err := c.service.login(req, ctx.IP())
 	if err != nil {
+		c.audit(ctx, "login", req.Email, user, outcomeFailure, failureReason(err))
+		if lockedRetry(ctx, err) {
+			return fiber.NewError(fiber.StatusTooManyRequests, err.Error())
+		}
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
+	return c.completeLogin(ctx, "login", req.Email, user, req.Device)
+}
+
+// completeLogin answers a successful first factor: an MFA challenge when the
+// user needs one, the token pair otherwise.
+func (c *appController) completeLogin(ctx *fiber.Ctx, kind, email string, user *User, device string) error {
+	if c.service.mfaRequired(user) {
+		c.audit(ctx, kind, email, user, outcomeMFARequired, "")
+		mfaToken, err := c.service.generateMFAToken(user)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		return ctx.Status(fiber.StatusOK).JSON(mfaChallenge{
+			MFARequired:        true,
+			EnrollmentRequired: !user.MFAEnabled,
+			MFAToken:           mfaToken,
+		})
+	}
+	c.audit(ctx, kind, email, user, outcomeSuccess, "")
+	return c.loginResponse(ctx, user, device)
+}
+
+// audit records a LoginEvent for the request. A failure to write it is
+// logged and never changes the response.
+func (c *appController) audit(ctx *fiber.Ctx, kind, email string, user *User, outcome, reason string) {
+	event := &LoginEvent{
+		Kind:      kind,
+		Email:     email,
+		IP:        ctx.IP(),
+		UserAgent: ctx.Get(fiber.HeaderUserAgent),
+		Outcome:   outcome,
+		Reason:    reason,
+	}
+	if user != nil {
+		id := user.ID
+		event.UserID = &id
+		event.Email = user.Email
+	}
+	if err := c.service.recordLoginEvent(event); err != nil {
+		log.Printf("audit of %s %s: %v", kind, outcome, err)
+	}
+}
+
+// lockedRetry sets Retry-After when err is a lockout.
+func lockedRetry(ctx *fiber.Ctx, err error) bool {
+	var locked *lockedError
+	if !errors.As(err, &locked) {
+		return false
+	}
+	ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(locked.seconds()))
+	return true
+}
+
+// loginResponse opens a session for a fully authenticated user and writes its
+// token pair, their cookies and the id_token.
+func (c *appController) loginResponse(ctx *fiber.Ctx, user *User, device string) error {
+	session, err := c.service.createSession(user, device, ctx.IP(), ctx.Get(fiber.HeaderUserAgent))
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
 
-	accessToken, err := c.service.generateJwt(user, "access_token")
+	accessToken, err := c.service.generateJwt(user, "access_token", session.ID.String())
 	if err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
@@ -48,7 +177,7 @@ func (c *appController) loginHandler(ctx *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
 
-	refreshToken, err := c.service.generateJwt(user, "refresh_token")
+	refreshToken, err := c.service.generateJwt(user, "refresh_token", session.ID.String())
 	if err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
@@ -57,22 +186,480 @@ func (c *appController) loginHandler(ctx *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
 
+	idToken, err := c.service.generateIDToken(user, "", "")
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
 	return ctx.Status(fiber.StatusOK).JSON(token{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
+		IDToken:      idToken,
+	})
+}
+
+// ForgotPassword godoc
+// @Summary      Request password reset
+// @Description  Mail a single-use reset token to the user. Always answers 202 so it does not reveal which emails are registered
+// @Tags         Authentication
+// @Accept       json
+// @Param        email body forgotPassword true "Account email"
+// @Success      202 "Reset requested"
+// @Failure      400 {object} map[string]string "Bad request - validation error"
+// @Router       /auth/password/forgot [post]
+func (c *appController) forgotPasswordHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*forgotPassword)
+	if err := c.service.forgotPassword(req.Email); err != nil {
+		log.Printf("failed to send password reset: %v", err)
+	}
+	return ctx.SendStatus(fiber.StatusAccepted)
+}
+
+// MagicLink godoc
+// @Summary      Request magic link
+// @Description  Mail a single-use login link valid for 15 minutes. Always answers 202 so it does not reveal which emails are registered
+// @Tags         Authentication
+// @Accept       json
+// @Param        email body magicLink true "Account email"
+// @Success      202 "Link requested"
+// @Failure      404 {object} map[string]string "Magic link login is disabled"
+// @Router       /auth/magic-link [post]
+func (c *appController) magicLinkHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*magicLink)
+	if err := c.service.sendMagicLink(req.Email); err != nil {
+		if errors.Is(err, errMagicLinkDisabled) {
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+		log.Printf("failed to send magic link: %v", err)
+	}
+	return ctx.SendStatus(fiber.StatusAccepted)
+}
+
+// MagicLinkPage godoc
+// @Summary      Magic link landing page
+// @Description  Page opened from the mailed link when no MagicLinkURL is configured. It only posts the token back, so mail scanners that prefetch links do not spend it
+// @Tags         Authentication
+// @Produce      html
+// @Param        token query string true "Token from the mailed link"
+// @Param        device query string false "Name of the session"
+// @Success      200 {string} string "Landing page"
+// @Failure      404 {object} map[string]string "Magic link login is disabled"
+// @Router       /auth/magic-link/callback [get]
+func (c *appController) magicLinkPageHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*magicLinkLanding)
+	if !c.service.magicLink() {
+		return fiber.NewError(fiber.StatusNotFound, errMagicLinkDisabled.Error())
+	}
+	csrf, err := formCSRF(ctx, "magic_link_csrf", magicLinkExpire)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	var page bytes.Buffer
+	if err := magicLinkPage.Execute(&page, magicLinkPageData{Token: req.Token, Device: req.Device, CSRFToken: csrf}); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to render magic link page")
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	ctx.Set(fiber.HeaderXFrameOptions, "DENY")
+	ctx.Set(fiber.HeaderReferrerPolicy, "no-referrer")
+	ctx.Type("html", "utf-8")
+	return ctx.Status(fiber.StatusOK).Send(page.Bytes())
+}
+
+// MagicLinkCallback godoc
+// @Summary      Magic link login
+// @Description  Exchange the token of the mailed link for the same response as the login: access and refresh tokens with their cookies, or an MFA challenge. The link can only be used once. A form post must come from the landing page, with csrf_token matching the magic_link_csrf cookie; frontends post JSON
+// @Tags         Authentication
+// @Accept       json,x-www-form-urlencoded
+// @Produce      json
+// @Param        callback body magicLinkCallback true "Token from the mailed link and optional device name"
+// @Success      200 {object} token "Login successful, or an mfaChallenge when MFA is required"
+// @Failure      400 {object} map[string]string "Bad request - invalid, used or expired token, or user inactive"
+// @Failure      403 {object} map[string]string "Form not posted from the landing page"
+// @Failure      404 {object} map[string]string "Magic link login is disabled"
+// @Router       /auth/magic-link/callback [post]
+func (c *appController) magicLinkCallbackHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*magicLinkCallback)
+	// Browsers only post JSON across sites after a CORS preflight, while any
+	// site can post a form, so forms must carry the landing page cookie.
+	if !ctx.Is("json") && !validCSRF(ctx, "magic_link_csrf", req.CSRFToken) {
+		return fiber.NewError(fiber.StatusForbidden, "invalid or expired magic link page, open the link again")
+	}
+	user, err := c.service.magicLinkLogin(req.Token)
+	if errors.Is(err, errMagicLinkDisabled) {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		c.audit(ctx, "magic_link", "", user, outcomeFailure, failureReason(err))
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return c.completeLogin(ctx, "magic_link", user.Email, user, req.Device)
+}
+
+// ProviderLogin godoc
+// @Summary      External provider login
+// @Description  Redirect the browser to the login page of an OpenID Connect provider, keeping the state of the flow in the provider_login cookie
+// @Tags         Authentication
+// @Param        provider path string true "Provider name"
+// @Success      302 "Redirect to the provider"
+// @Failure      404 {object} map[string]string "Provider not found"
+// @Failure      502 {object} map[string]string "Provider is unavailable"
+// @Router       /auth/providers/{provider}/login [get]
+func (c *appController) providerLoginHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*providerLogin)
+	link, flow, err := c.service.startProviderLogin(req.Provider, providerRedirectURI(ctx, req.Provider))
+	if errors.Is(err, errProviderNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if errors.Is(err, errProviderUnavailable) {
+		return fiber.NewError(fiber.StatusBadGateway, err.Error())
+	}
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	ctx.Cookie(&fiber.Cookie{
+		Name:     "provider_login",
+		Value:    flow,
+		HTTPOnly: true,
+		Secure:   ctx.Protocol() == "https",
+		SameSite: "Lax",
+		Path:     "/",
+		MaxAge:   int(providerLoginExpire.Seconds()),
+	})
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Redirect(link, fiber.StatusFound)
+}
+
+// ProviderCallback godoc
+// @Summary      External provider callback
+// @Description  Redeem the code sent back by the provider for the same response as the login: access and refresh tokens with their cookies, or an MFA challenge. Unknown users are created when the provider allows just-in-time provisioning
+// @Tags         Authentication
+// @Produce      json
+// @Param        provider path string true "Provider name"
+// @Param        code query string false "Authorization code"
+// @Param        state query string true "State of the flow"
+// @Param        device query string false "Name of the session"
+// @Success      200 {object} token "Login successful, or an mfaChallenge when MFA is required"
+// @Failure      400 {object} map[string]string "Bad request - invalid state, code refused, user inactive or of another provider"
+// @Failure      404 {object} map[string]string "Provider not found"
+// @Router       /auth/providers/{provider}/callback [get]
+func (c *appController) providerCallbackHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*providerCallback)
+	ctx.Cookie(&fiber.Cookie{
+		Name:     "provider_login",
+		HTTPOnly: true,
+		Secure:   ctx.Protocol() == "https",
+		SameSite: "Lax",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+	})
+	user, err := c.service.providerLogin(req, providerRedirectURI(ctx, req.Provider), ctx.Cookies("provider_login"))
+	if errors.Is(err, errProviderNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		c.audit(ctx, "provider", "", user, outcomeFailure, failureReason(err))
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return c.completeLogin(ctx, "provider", user.Email, user, withDefault(req.Device, req.Provider))
+}
+
+// providerRedirectURI is the callback registered with the provider.
+func providerRedirectURI(ctx *fiber.Ctx, provider string) string {
+	return mountURL(ctx, "/auth/providers/:provider/"+path.Base(ctx.Route().Path)) + "/auth/providers/" + provider + "/callback"
+}
+
+// VerifyEmail godoc
+// @Summary      Verify email
+// @Description  Confirm the email address with the signed token from the verification mail
+// @Tags         Authentication
+// @Produce      json
+// @Param        token query string true "Verification token"
+// @Success      204 "Email verified"
+// @Failure      400 {object} map[string]string "Bad request - invalid or expired token"
+// @Router       /auth/verify-email [get]
+func (c *appController) verifyEmailHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*verifyEmail)
+	if err := c.service.verifyEmail(req.Token); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// ResendVerification godoc
+// @Summary      Resend verification email
+// @Description  Mail a new verification link. Always answers 202 so it does not reveal which emails are registered
+// @Tags         Authentication
+// @Accept       json
+// @Param        email body resendVerification true "Account email"
+// @Success      202 "Verification requested"
+// @Router       /auth/verify-email/resend [post]
+func (c *appController) resendVerificationHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*resendVerification)
+	if err := c.service.resendVerification(req.Email); err != nil {
+		log.Printf("failed to send email verification: %v", err)
+	}
+	return ctx.SendStatus(fiber.StatusAccepted)
+}
+
+// ResetPassword godoc
+// @Summary      Reset password
+// @Description  Set a new password with the token from the reset mail. All sessions of the user are ended
+// @Tags         Authentication
+// @Accept       json
+// @Param        reset body resetPassword true "Reset token and new password"
+// @Success      204 "Password changed"
+// @Failure      400 {object} passwordRejected "Bad request - invalid, used or expired token, or password refused by the policy (the token stays valid)"
+// @Router       /auth/password/reset [post]
+func (c *appController) resetPasswordHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*resetPassword)
+	if err := c.service.resetPassword(req); err != nil {
+		return passwordError(ctx, err)
+	}
+	if err := c.clearCookies(ctx); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// passwordError answers 400 with every policy violation, so clients can show
+// them as a checklist. Other errors keep the default error body.
+func passwordError(ctx *fiber.Ctx, err error) error {
+	var policyErr *gorote.PasswordError
+	if !errors.As(err, &policyErr) {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return ctx.Status(fiber.StatusBadRequest).JSON(passwordRejected{
+		Error:      policyErr.Error(),
+		Violations: policyErr.Violations,
+	})
+}
+
+// MFAVerify godoc
+// @Summary      Complete login with MFA
+// @Description  Exchange the mfa_token returned by /auth/login plus a TOTP code or an unused recovery code for the token pair
+// @Tags         Authentication
+// @Accept       json
+// @Produce      json
+// @Param        mfa body mfaVerify true "MFA challenge token and code or recovery_code"
+// @Success      200 {object} token "Login successful - returns access_token, refresh_token and id_token"
+// @Failure      401 {object} map[string]string "Unauthorized - invalid or used mfa_token, code or recovery code"
+// @Failure      429 {object} map[string]string "Too many wrong codes - see Retry-After"
+// @Router       /auth/mfa/verify [post]
+func (c *appController) mfaVerifyHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*mfaVerify)
+	user, err := c.service.verifyMFA(req)
+	if err != nil {
+		if lockedRetry(ctx, err) {
+			c.audit(ctx, "mfa", "", nil, outcomeFailure, reasonLocked)
+			return fiber.NewError(fiber.StatusTooManyRequests, err.Error())
+		}
+		c.audit(ctx, "mfa", "", nil, outcomeFailure, reasonInvalidMFA)
+		return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+	}
+	c.audit(ctx, "mfa", "", user, outcomeSuccess, "")
+	return c.loginResponse(ctx, user, req.Device)
+}
+
+// ListLoginEvents godoc
+// @Summary      List login events
+// @Description  Audit log of login, MFA and refresh attempts, newest first. Filter by user_id, outcome (success, failure, mfa_required) and an RFC 3339 from/to range
+// @Tags         Authentication
+// @Produce      json
+// @Param        page query int true "Page"
+// @Param        limit query int true "Page size (max 1000)"
+// @Param        user_id query string false "User ID"
+// @Param        outcome query string false "success, failure or mfa_required"
+// @Param        from query string false "Start time (inclusive, RFC 3339)"
+// @Param        to query string false "End time (exclusive, RFC 3339)"
+// @Success      200 {object} listLoginEvent "Events page"
+// @Failure      401 {object} map[string]string "Unauthorized - missing admin_user permission"
+// @Failure      404 {object} map[string]string "No events found"
+// @Router       /auth/events [get]
+func (c *appController) listLoginEventsHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*listLoginEvents)
+	events, total, err := c.service.loginEvents(req)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if len(events) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "no login events found")
+	}
+	return ctx.Status(fiber.StatusOK).JSON(&listLoginEvent{
+		paginateRes: paginateRes{
+			Page:  req.Page,
+			Limit: req.Limit,
+			Total: uint(total),
+		},
+		Data: events,
+	})
+}
+
+// Impersonate godoc
+// @Summary      Impersonate user
+// @Description  Issue a 15 minute access token for another user with an RFC 8693 act claim naming the caller. No refresh token is issued, no cookie is set and every request made with the token is recorded
+// @Tags         Authentication
+// @Produce      json
+// @Param        userId path string true "User ID"
+// @Success      200 {object} oauthToken "Impersonation access token"
+// @Failure      401 {object} map[string]string "Unauthorized - missing impersonate_user permission"
+// @Failure      403 {object} map[string]string "Forbidden - already impersonating, not an interactive token, self, a superuser target or a target with permissions the caller lacks"
+// @Failure      404 {object} map[string]string "User not found or inactive"
+// @Router       /auth/impersonate/{userId} [post]
+func (c *appController) impersonateHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*impersonate)
+	actor := ctx.Locals("claimsData").(*JwtClaims)
+	claims, token, err := c.service.impersonate(actor, req.UserID)
+	switch {
+	case errors.Is(err, errImpersonationNotFound):
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	case errors.Is(err, errImpersonationDenied):
+		return fiber.NewError(fiber.StatusForbidden, err.Error())
+	case err != nil:
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	c.recordImpersonation(ctx, claims, fiber.StatusOK)
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Status(fiber.StatusOK).JSON(oauthToken{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(impersonationExpire.Seconds()),
+	})
+}
+
+// recordImpersonation records the issuance of an impersonation token. The
+// requests made with it are recorded by JwtClaims.Audit.
+func (c *appController) recordImpersonation(ctx *fiber.Ctx, claims *JwtClaims, status int) {
+	event := impersonationEvent(ctx, claims, status)
+	if event == nil {
+		return
+	}
+	if err := c.service.recordImpersonation(event); err != nil {
+		log.Printf("audit of impersonation token: %v", err)
+	}
+}
+
+// impersonationEvent describes the request made with claims, or returns nil
+// when they carry no valid actor and subject.
+func impersonationEvent(ctx *fiber.Ctx, claims *JwtClaims, status int) *ImpersonationEvent {
+	actorID, err := uuid.Parse(claims.Actor.Subject)
+	if err != nil {
+		return nil
+	}
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return nil
+	}
+	return &ImpersonationEvent{
+		ActorID: actorID,
+		UserID:  userID,
+		TokenID: claims.ID,
+		Method:  ctx.Method(),
+		Path:    ctx.Path(),
+		Status:  status,
+		IP:      ctx.IP(),
+	}
+}
+
+// ListImpersonationEvents godoc
+// @Summary      List impersonation events
+// @Description  Audit log of impersonation tokens issued and the requests made with them, newest first. Filter by actor_id and user_id
+// @Tags         Authentication
+// @Produce      json
+// @Param        page query int true "Page"
+// @Param        limit query int true "Page size (max 1000)"
+// @Param        actor_id query string false "Impersonating user ID"
+// @Param        user_id query string false "Impersonated user ID"
+// @Success      200 {object} listImpersonationEvent "Events page"
+// @Failure      401 {object} map[string]string "Unauthorized - missing admin_user permission"
+// @Failure      404 {object} map[string]string "No events found"
+// @Router       /auth/impersonations [get]
+func (c *appController) listImpersonationEventsHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*listImpersonationEvents)
+	events, total, err := c.service.impersonationEvents(req)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if len(events) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "no impersonation events found")
+	}
+	return ctx.Status(fiber.StatusOK).JSON(&listImpersonationEvent{
+		paginateRes: paginateRes{
+			Page:  req.Page,
+			Limit: req.Limit,
+			Total: uint(total),
+		},
+		Data: events,
 	})
 }
 
+// MFAEnroll godoc
+// @Summary      Start TOTP enrollment
+// @Description  Generate a TOTP secret and its otpauth URI. Accepts an access token or the mfa_token of a login that requires enrollment
+// @Tags         Authentication
+// @Produce      json
+// @Success      200 {object} mfaEnrollment "Secret and otpauth URI"
+// @Failure      400 {object} map[string]string "Bad request - mfa already enabled"
+// @Router       /auth/mfa/enroll [post]
+func (c *appController) mfaEnrollHandler(ctx *fiber.Ctx) error {
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	res, err := c.service.enrollMFA(claims.Subject)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Status(fiber.StatusOK).JSON(res)
+}
+
+// MFAConfirm godoc
+// @Summary      Confirm TOTP enrollment
+// @Description  Enable MFA with a code from the authenticator app. The recovery codes are only returned in this response
+// @Tags         Authentication
+// @Accept       json
+// @Produce      json
+// @Param        code body mfaCode true "TOTP code"
+// @Success      200 {object} mfaRecoveryCodes "MFA enabled"
+// @Failure      400 {object} map[string]string "Bad request - enrollment not started or invalid code"
+// @Router       /auth/mfa/confirm [post]
+func (c *appController) mfaConfirmHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*mfaCode)
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	codes, err := c.service.confirmMFA(claims.Subject, req.Code)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Status(fiber.StatusOK).JSON(mfaRecoveryCodes{RecoveryCodes: codes})
+}
+
+// MFADisable godoc
+// @Summary      Disable MFA
+// @Description  Turn MFA off with a code from the authenticator app. Refused while a role or MFASuperUser requires it, and for impersonation tokens
+// @Tags         Authentication
+// @Accept       json
+// @Param        code body mfaCode true "TOTP code"
+// @Success      204 "MFA disabled"
+// @Failure      400 {object} map[string]string "Bad request - mfa not enabled, required for the account or invalid code"
+// @Failure      403 {object} map[string]string "Forbidden - impersonation token"
+// @Router       /auth/mfa/disable [post]
+func (c *appController) mfaDisableHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*mfaCode)
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	if err := c.service.disableMFA(claims.Subject, req.Code); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
 // RefreshToken godoc
 // @Summary      Refresh access token
-// @Description  Generate new access token using refresh token (can be sent in body or cookie)
+// @Description  Rotate the refresh token (can be sent in body or cookie) and generate a new access token. Presenting an already used refresh token revokes its whole family
 // @Tags         Authentication
 // @Accept       json
 // @Produce      json
 // @Param        refresh_token body refreshToken true "Refresh token data (optional if sent as cookie)"
-// @Success      200 {object} token "Token refreshed successfully - returns new access_token and same refresh_token"
+// @Success      200 {object} token "Token refreshed successfully - returns new access_token and new refresh_token"
 // @Failure      400 {object} map[string]string "Bad request - validation error, invalid body, user not found, or user inactive"
-// @Failure      401 {object} map[string]string "Unauthorized - invalid or expired refresh token"
+// @Failure      401 {object} map[string]string "Unauthorized - invalid, expired, revoked or reused refresh token"
 // @Failure      429 {object} map[string]string "Too many requests - rate limit exceeded (60 requests per window)"
 // @Router       /auth/refresh [post]
 func (c *appController) refreshTokenHandler(ctx *fiber.Ctx) error {
@@ -81,28 +668,47 @@ func (c *appController) refreshTokenHandler(ctx *fiber.Ctx) error {
 	if refreshToken == "" {
 		refreshToken = ctx.Cookies("refresh_token")
 	}
-	var claims JwtClaims
-	if err := c.service.claims(&claims, refreshToken); err != nil {
+	claims := AcceptTokens("refresh_token")
+	if err := c.service.claims(claims, refreshToken); err != nil {
+		c.audit(ctx, "refresh", "", nil, outcomeFailure, reasonInvalidToken)
 		return fiber.NewError(fiber.StatusUnauthorized, err.Error())
 	}
+	if claims.Type != "refresh_token" {
+		c.audit(ctx, "refresh", "", nil, outcomeFailure, reasonInvalidToken)
+		return fiber.NewError(fiber.StatusUnauthorized, "token is not refresh token")
+	}
 
-	users, err := c.service.users(claims.ID)
+	users, err := c.service.users(claims.Subject)
 	if err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
 	if len(users) == 0 {
+		c.audit(ctx, "refresh", "", nil, outcomeFailure, reasonUnknownUser)
 		return fiber.NewError(fiber.StatusBadRequest, "id user not found")
 	}
 	user := users[0]
 	if !user.Active {
+		c.audit(ctx, "refresh", "", &user, outcomeFailure, reasonInactive)
 		return fiber.NewError(fiber.StatusBadRequest, "failed to refrash token: user is inactive")
 	}
 
 	if user.UpdatedAt.Unix() > claims.IssuedAt.Unix() {
+		c.audit(ctx, "refresh", "", &user, outcomeFailure, reasonStaleToken)
 		return fiber.NewError(fiber.StatusBadRequest, "failed to refrash token: user is inactive")
 	}
 
-	accessToken, err := c.service.generateJwt(&user, "access_token")
+	newRefreshToken, err := c.service.rotateRefreshToken(&user, claims)
+	if err != nil {
+		c.audit(ctx, "refresh", "", &user, outcomeFailure, reasonInvalidToken)
+		return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+	}
+	c.audit(ctx, "refresh", "", &user, outcomeSuccess, "")
+
+	if err := c.service.setCookie(ctx, "refresh_token", newRefreshToken); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	accessToken, err := c.service.generateJwt(&user, "access_token", claims.SessionID)
 	if err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
@@ -113,10 +719,363 @@ func (c *appController) refreshTokenHandler(ctx *fiber.Ctx) error {
 
 	return ctx.Status(fiber.StatusOK).JSON(token{
 		AccessToken:  accessToken,
-		RefreshToken: req.RefreshToken,
+		RefreshToken: newRefreshToken,
 	})
 }
 
+// Logout godoc
+// @Summary      Logout current session
+// @Description  Revoke the access token and the refresh token family of the current session (refresh token can be sent in body or cookie) and clear the auth cookies
+// @Tags         Authentication
+// @Accept       json
+// @Produce      json
+// @Param        refresh_token body refreshToken false "Refresh token of the session (optional if sent as cookie)"
+// @Success      204 "Logout successful"
+// @Failure      400 {object} map[string]string "Bad request - invalid body"
+// @Failure      401 {object} map[string]string "Unauthorized - invalid, expired or revoked access token"
+// @Router       /auth/logout [post]
+func (c *appController) logoutHandler(ctx *fiber.Ctx) error {
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	var req refreshToken
+	if len(ctx.Body()) > 0 {
+		if err := ctx.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("invalid body: %s", err.Error()))
+		}
+	}
+	if req.RefreshToken == "" {
+		req.RefreshToken = ctx.Cookies("refresh_token")
+	}
+	if err := c.service.logout(claims, req.RefreshToken); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := c.clearCookies(ctx); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// LogoutAll godoc
+// @Summary      Logout all sessions
+// @Description  Revoke every access and refresh token issued to the user and clear the auth cookies
+// @Tags         Authentication
+// @Produce      json
+// @Success      204 "Logout successful"
+// @Failure      400 {object} map[string]string "Bad request - failed to revoke tokens"
+// @Failure      401 {object} map[string]string "Unauthorized - invalid, expired or revoked access token"
+// @Router       /auth/logout/all [post]
+func (c *appController) logoutAllHandler(ctx *fiber.Ctx) error {
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	if err := c.service.logoutAll(claims); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := c.clearCookies(ctx); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// Token godoc
+// @Summary      OAuth2 token endpoint
+// @Description  Issue tokens for an OAuth2 grant. grant_type=client_credentials authenticates a service client with HTTP Basic or client_id/client_secret in the body. grant_type=authorization_code exchanges a code from /oauth/authorize plus its PKCE code_verifier for the same pair returned by /auth/login
+// @Tags         Authentication
+// @Accept       x-www-form-urlencoded
+// @Produce      json
+// @Param        grant_type formData string true "Grant type (client_credentials or authorization_code)"
+// @Param        client_id formData string false "Client id, when not sent with HTTP Basic"
+// @Param        client_secret formData string false "Client secret, when not sent with HTTP Basic (not used by public clients)"
+// @Param        scope formData string false "Space separated permission codes, must be granted to the client"
+// @Param        code formData string false "Authorization code (authorization_code)"
+// @Param        redirect_uri formData string false "Redirect URI used on /oauth/authorize (authorization_code)"
+// @Param        code_verifier formData string false "PKCE code verifier (authorization_code)"
+// @Success      200 {object} oauthToken "Token issued"
+// @Failure      400 {object} map[string]string "Bad request - unsupported_grant_type, invalid_grant or invalid_scope"
+// @Failure      401 {object} map[string]string "Unauthorized - invalid_client"
+// @Router       /auth/token [post]
+func (c *appController) tokenHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*tokenRequest)
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	switch req.GrantType {
+	case "client_credentials":
+		return c.clientCredentialsGrant(ctx, req)
+	case "authorization_code":
+		return c.authorizationCodeGrant(ctx, req)
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "unsupported_grant_type")
+	}
+}
+
+func (c *appController) clientCredentialsGrant(ctx *fiber.Ctx, req *tokenRequest) error {
+	clientID, clientSecret := clientCredentials(ctx, req.ClientID, req.ClientSecret)
+	client, err := c.service.authenticateClient(clientID, clientSecret)
+	if err != nil {
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Basic realm="token"`)
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid_client")
+	}
+	res, err := c.service.clientCredentialsToken(client, strings.Fields(req.Scope))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid_scope")
+	}
+	return ctx.Status(fiber.StatusOK).JSON(res)
+}
+
+func (c *appController) authorizationCodeGrant(ctx *fiber.Ctx, req *tokenRequest) error {
+	clientID, clientSecret := clientCredentials(ctx, req.ClientID, req.ClientSecret)
+	client, err := c.service.oauthClient(clientID, clientSecret)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid_client")
+	}
+	user, code, err := c.service.redeemAuthorizationCode(client, req)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid_grant")
+	}
+	session, err := c.service.createSession(user, client.Name, ctx.IP(), ctx.Get(fiber.HeaderUserAgent))
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	res, err := c.service.authorizationCodeToken(client, user, code, session)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return ctx.Status(fiber.StatusOK).JSON(res)
+}
+
+// clientCredentials reads the client from HTTP Basic (RFC 6749 section 2.3.1),
+// falling back to client_id and client_secret in the body.
+func clientCredentials(ctx *fiber.Ctx, clientID, clientSecret string) (string, string) {
+	if encoded, ok := strings.CutPrefix(ctx.Get(fiber.HeaderAuthorization), "Basic "); ok {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			if id, secret, ok := strings.Cut(string(decoded), ":"); ok {
+				id, errID := url.QueryUnescape(id)
+				secret, errSecret := url.QueryUnescape(secret)
+				if errID == nil && errSecret == nil {
+					return id, secret
+				}
+			}
+		}
+	}
+	return clientID, clientSecret
+}
+
+// Introspect godoc
+// @Summary      OAuth2 token introspection
+// @Description  RFC 7662 introspection for gateways that can't verify signatures. The caller authenticates as a confidential service client (HTTP Basic or client_id/client_secret). Revoked, expired, stale or foreign tokens, and tokens of inactive users or clients, return only {"active": false}
+// @Tags         Authentication
+// @Accept       x-www-form-urlencoded
+// @Produce      json
+// @Param        token formData string true "Access or personal access token"
+// @Param        token_type_hint formData string false "Ignored, only access tokens are introspected"
+// @Success      200 {object} introspection "Token state and claims"
+// @Failure      401 {object} map[string]string "invalid_client"
+// @Router       /oauth/introspect [post]
+func (c *appController) introspectHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*introspectRequest)
+	clientID, clientSecret := clientCredentials(ctx, req.ClientID, req.ClientSecret)
+	if _, err := c.service.authenticateClient(clientID, clientSecret); err != nil {
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Basic realm="introspect"`)
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid_client")
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Status(fiber.StatusOK).JSON(c.service.introspect(strings.TrimPrefix(req.Token, "Bearer ")))
+}
+
+// Authorize godoc
+// @Summary      OAuth2 authorization endpoint
+// @Description  Render the login page of the authorization code flow. client_id and redirect_uri must match a registered client, and PKCE with S256 is required
+// @Tags         Authentication
+// @Produce      html
+// @Param        response_type query string true "Must be code"
+// @Param        client_id query string true "Registered client id"
+// @Param        redirect_uri query string true "Redirect URI registered for the client"
+// @Param        code_challenge query string true "PKCE code challenge"
+// @Param        code_challenge_method query string true "Must be S256"
+// @Param        scope query string false "Requested scope, openid adds an id_token"
+// @Param        state query string false "Opaque value returned to the client"
+// @Param        nonce query string false "Nonce copied into the id_token"
+// @Success      200 {string} string "Login page"
+// @Failure      302 {string} string "Redirect to redirect_uri with an error"
+// @Failure      400 {object} map[string]string "Bad request - unknown client or unregistered redirect_uri"
+// @Router       /oauth/authorize [get]
+func (c *appController) authorizeHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*authorizeRequest)
+	client, err := c.service.authorizeClient(req.ClientID, req.RedirectURI)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if code := authorizeError(req); code != "" {
+		return ctx.Redirect(authorizeRedirect(req, url.Values{"error": {code}}), fiber.StatusFound)
+	}
+	csrf, err := formCSRF(ctx, "authorize_csrf", authorizeFormExpire)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	return renderAuthorize(ctx, fiber.StatusOK, authorizePageData{
+		authorizeRequest: *req,
+		ClientName:       client.Name,
+		CSRFToken:        csrf,
+	})
+}
+
+// AuthorizeLogin godoc
+// @Summary      OAuth2 authorization login
+// @Description  Authenticate the user from the login page and redirect to redirect_uri with code and state
+// @Tags         Authentication
+// @Accept       x-www-form-urlencoded
+// @Produce      html
+// @Param        email formData string false "User email"
+// @Param        password formData string false "User password"
+// @Param        mfa_token formData string false "MFA challenge issued by the previous step"
+// @Param        code formData string false "TOTP code, sent with mfa_token"
+// @Param        csrf_token formData string true "Token rendered in the login page, matched against the authorize_csrf cookie"
+// @Success      302 {string} string "Redirect to redirect_uri with code and state"
+// @Failure      400 {object} map[string]string "Bad request - unknown client or unregistered redirect_uri"
+// @Failure      401 {string} string "Login page with the error"
+// @Failure      403 {string} string "Login page reloaded - the form did not come from this server"
+// @Router       /oauth/authorize [post]
+func (c *appController) authorizeLoginHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*authorizeLogin)
+	client, err := c.service.authorizeClient(req.ClientID, req.RedirectURI)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if code := authorizeError(&req.authorizeRequest); code != "" {
+		return ctx.Redirect(authorizeRedirect(&req.authorizeRequest, url.Values{"error": {code}}), fiber.StatusFound)
+	}
+	page := authorizePageData{
+		authorizeRequest: req.authorizeRequest,
+		ClientName:       client.Name,
+		Email:            req.Email,
+		CSRFToken:        req.CSRFToken,
+	}
+	if !validCSRF(ctx, "authorize_csrf", req.CSRFToken) {
+		if page.CSRFToken, err = formCSRF(ctx, "authorize_csrf", authorizeFormExpire); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		page.Email = ""
+		page.Error = "login form expired, sign in again"
+		return renderAuthorize(ctx, fiber.StatusForbidden, page)
+	}
+	var user *User
+	if req.MFAToken != "" {
+		user, err = c.service.verifyMFA(&mfaVerify{MFAToken: req.MFAToken, Code: req.Code})
+		if err != nil {
+			page.MFAToken = req.MFAToken
+			page.Error = err.Error()
+			if lockedRetry(ctx, err) {
+				c.audit(ctx, "mfa", "", nil, outcomeFailure, reasonLocked)
+				return renderAuthorize(ctx, fiber.StatusTooManyRequests, page)
+			}
+			c.audit(ctx, "mfa", "", nil, outcomeFailure, reasonInvalidMFA)
+			return renderAuthorize(ctx, fiber.StatusUnauthorized, page)
+		}
+	} else {
+		user, err = c.service.login(&login{Email: req.Email, Password: req.Password}, ctx.IP())
+		if err != nil {
+			c.audit(ctx, "authorize", req.Email, user, outcomeFailure, failureReason(err))
+			page.Error = err.Error()
+			if lockedRetry(ctx, err) {
+				return renderAuthorize(ctx, fiber.StatusTooManyRequests, page)
+			}
+			return renderAuthorize(ctx, fiber.StatusUnauthorized, page)
+		}
+		if c.service.mfaRequired(user) {
+			c.audit(ctx, "authorize", req.Email, user, outcomeMFARequired, "")
+			if !user.MFAEnabled {
+				page.Error = "mfa enrollment required, enroll through /auth/login first"
+				return renderAuthorize(ctx, fiber.StatusForbidden, page)
+			}
+			if page.MFAToken, err = c.service.generateMFAToken(user); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+			}
+			return renderAuthorize(ctx, fiber.StatusOK, page)
+		}
+	}
+	c.audit(ctx, "authorize", req.Email, user, outcomeSuccess, "")
+	code, err := c.service.createAuthorizationCode(client, user, &req.authorizeRequest)
+	if err != nil {
+		return ctx.Redirect(authorizeRedirect(&req.authorizeRequest, url.Values{"error": {"server_error"}}), fiber.StatusFound)
+	}
+	return ctx.Redirect(authorizeRedirect(&req.authorizeRequest, url.Values{"code": {code}}), fiber.StatusFound)
+}
+
+// authorizeError returns the RFC 6749 error code for a request whose client
+// and redirect_uri are already trusted.
+func authorizeError(req *authorizeRequest) string {
+	if req.ResponseType != "code" {
+		return "unsupported_response_type"
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return "invalid_request"
+	}
+	return ""
+}
+
+func authorizeRedirect(req *authorizeRequest, params url.Values) string {
+	target, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		return req.RedirectURI
+	}
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+// formCSRF sets a fresh CSRF cookie and returns the value the page must post
+// back. Being SameSite=Strict, the cookie is not sent with a form posted from
+// another site, which rules out login CSRF.
+func formCSRF(ctx *fiber.Ctx, name string, expire time.Duration) (string, error) {
+	token, err := gorote.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	ctx.Cookie(&fiber.Cookie{
+		Name:     name,
+		Value:    token,
+		HTTPOnly: true,
+		Secure:   ctx.Protocol() == "https",
+		SameSite: "Strict",
+		Path:     "/",
+		MaxAge:   int(expire.Seconds()),
+	})
+	return token, nil
+}
+
+// validCSRF reports whether token matches the cookie set by formCSRF.
+func validCSRF(ctx *fiber.Ctx, name, token string) bool {
+	cookie := ctx.Cookies(name)
+	return token != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(token)) == 1
+}
+
+func renderAuthorize(ctx *fiber.Ctx, status int, data authorizePageData) error {
+	var page bytes.Buffer
+	if err := authorizePage.Execute(&page, data); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to render login page")
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	ctx.Set(fiber.HeaderXFrameOptions, "DENY")
+	ctx.Type("html", "utf-8")
+	return ctx.Status(status).Send(page.Bytes())
+}
+
+// mountURL returns the absolute URL where core routes are mounted, given the
+// path of the current route relative to that mount point.
+func mountURL(ctx *fiber.Ctx, route string) string {
+	return ctx.BaseURL() + strings.TrimSuffix(strings.TrimSuffix(ctx.Route().Path, "/"), route)
+}
+
+func (c *appController) clearCookies(ctx *fiber.Ctx) error {
+	if err := c.service.clearCookie(ctx, "access_token"); err != nil {
+		return err
+	}
+	return c.service.clearCookie(ctx, "refresh_token")
+}
+
 func (c *appController) healthHandler(ctx *fiber.Ctx) error {
 	res, err := c.service.health()
 	if err != nil {
@@ -125,6 +1084,53 @@ func (c *appController) healthHandler(ctx *fiber.Ctx) error {
 	return ctx.Status(fiber.StatusOK).JSON(res)
 }
 
+// JWKS godoc
+// @Summary      JSON Web Key Set
+// @Description  Public keys used to verify the tokens issued by this service, identified by kid (RFC 7638 thumbprint)
+// @Tags         Authentication
+// @Produce      json
+// @Success      200 {object} gorote.JWKS "Key set"
+// @Failure      500 {object} map[string]string "Internal server error - failed to build key set"
+// @Router       /.well-known/jwks.json [get]
+func (c *appController) jwksHandler(ctx *fiber.Ctx) error {
+	res, err := c.service.jwks()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	ctx.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return ctx.Status(fiber.StatusOK).JSON(res)
+}
+
+// OpenIDConfiguration godoc
+// @Summary      OpenID Connect discovery
+// @Description  OpenID Provider metadata; the issuer is the configured AppName
+// @Tags         Authentication
+// @Produce      json
+// @Success      200 {object} openidConfiguration "Provider metadata"
+// @Router       /.well-known/openid-configuration [get]
+func (c *appController) openidConfigurationHandler(ctx *fiber.Ctx) error {
+	ctx.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return ctx.Status(fiber.StatusOK).JSON(c.service.openidConfiguration(mountURL(ctx, "/.well-known/openid-configuration")))
+}
+
+// UserInfo godoc
+// @Summary      OpenID Connect userinfo
+// @Description  Standard claims of the authenticated user
+// @Tags         Authentication
+// @Produce      json
+// @Success      200 {object} userInfo "User claims"
+// @Failure      400 {object} map[string]string "Bad request - user not found"
+// @Failure      401 {object} map[string]string "Unauthorized - invalid, expired or revoked access token"
+// @Router       /userinfo [get]
+func (c *appController) userInfoHandler(ctx *fiber.Ctx) error {
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	res, err := c.service.userInfo(claims.Subject)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return ctx.Status(fiber.StatusOK).JSON(res)
+}
+
 func (c *appController) recieveUserHandler(ctx *fiber.Ctx) error {
 	req := ctx.Locals("validatedData").(*recieveUser)
 
@@ -165,18 +1171,26 @@ func (c *appController) listUsersHandler(ctx *fiber.Ctx) error {
 func (c *appController) createUserHandler(ctx *fiber.Ctx) error {
 	req := ctx.Locals("validatedData").(*createUser)
 	claims := ctx.Locals("claimsData").(*JwtClaims)
-	if err := gorote.ValidatePassword(req.Password); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, err.Error())
-	}
-	hashedPassword, err := gorote.HashPassword(req.Password)
-	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("crypting password failed: %s", err.Error()))
+	candidate := User{Email: req.Email, FirstName: req.FirstName, LastName: req.LastName, Provider: req.Provider}
+	if isLocal(&candidate) {
+		if err := c.service.checkPassword(&candidate, req.Password); err != nil {
+			return passwordError(ctx, err)
+		}
+		hashedPassword, err := c.service.hashPassword(req.Password)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("crypting password failed: %s", err.Error()))
+		}
+		req.Password = hashedPassword
+	} else {
+		req.Password = ""
 	}
-	req.Password = hashedPassword
-	_, err = c.service.createUser(req, claims.IsSuperUser)
+	user, err := c.service.createUser(req, claims.IsSuperUser)
 	if err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
+	if err := c.service.sendVerificationEmail(user); err != nil {
+		log.Printf("failed to send email verification: %v", err)
+	}
 	return ctx.SendStatus(fiber.StatusCreated)
 }
 
@@ -199,6 +1213,196 @@ func (c *appController) updateUserHandler(ctx *fiber.Ctx) error {
 	return ctx.Status(fiber.StatusOK).JSON(res)
 }
 
+// UnlockUser godoc
+// @Summary      Unlock user
+// @Description  Clear the failed login counter of a locked account
+// @Tags         Users
+// @Param        id path string true "User ID"
+// @Success      204
+// @Failure      401 {object} map[string]string "Unauthorized - missing update_user permission"
+// @Failure      404 {object} map[string]string "User not found"
+// @Router       /users/{id}/unlock [post]
+func (c *appController) unlockUserHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*recieveUser)
+	if err := c.service.unlockUser(req.ID); err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// ListSessions godoc
+// @Summary      List my sessions
+// @Description  Active sessions of the authenticated user, most recently used first; current marks the session of the request token
+// @Tags         Users
+// @Produce      json
+// @Success      200 {array} sessionInfo "Active sessions"
+// @Failure      401 {object} map[string]string "Unauthorized - invalid, expired or revoked access token"
+// @Router       /users/me/sessions [get]
+func (c *appController) listSessionsHandler(ctx *fiber.Ctx) error {
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	return c.sessionsResponse(ctx, claims.Subject, claims.SessionID)
+}
+
+// RevokeSession godoc
+// @Summary      Revoke my session
+// @Description  End one session of the authenticated user; its refresh token stops working and its access tokens are denied
+// @Tags         Users
+// @Param        sessionId path string true "Session ID"
+// @Success      204
+// @Failure      404 {object} map[string]string "Session not found"
+// @Router       /users/me/sessions/{sessionId} [delete]
+func (c *appController) revokeSessionHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*mySession)
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	if err := c.service.revokeSession(claims.Subject, req.SessionID); err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// ListUserSessions godoc
+// @Summary      List user sessions
+// @Description  Active sessions of any user
+// @Tags         Users
+// @Produce      json
+// @Param        id path string true "User ID"
+// @Success      200 {array} sessionInfo "Active sessions"
+// @Failure      401 {object} map[string]string "Unauthorized - missing view_user permission"
+// @Router       /users/{id}/sessions [get]
+func (c *appController) listUserSessionsHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*recieveUser)
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	return c.sessionsResponse(ctx, req.ID, claims.SessionID)
+}
+
+func (c *appController) sessionsResponse(ctx *fiber.Ctx, userID, currentID string) error {
+	sessions, err := c.service.sessions(userID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	res := make([]sessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		res = append(res, sessionInfo{
+			Session: session,
+			Current: session.ID.String() == currentID,
+		})
+	}
+	return ctx.Status(fiber.StatusOK).JSON(res)
+}
+
+// RevokeUserSession godoc
+// @Summary      Revoke user session
+// @Description  End one session of any user
+// @Tags         Users
+// @Param        id path string true "User ID"
+// @Param        sessionId path string true "Session ID"
+// @Success      204
+// @Failure      401 {object} map[string]string "Unauthorized - missing update_user permission"
+// @Failure      404 {object} map[string]string "Session not found"
+// @Router       /users/{id}/sessions/{sessionId} [delete]
+func (c *appController) revokeUserSessionHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*userSession)
+	if err := c.service.revokeSession(req.ID, req.SessionID); err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// RevokeUserSessions godoc
+// @Summary      Revoke all user sessions
+// @Description  End every session of any user and revoke all of its tokens
+// @Tags         Users
+// @Param        id path string true "User ID"
+// @Success      204
+// @Failure      401 {object} map[string]string "Unauthorized - missing update_user permission"
+// @Failure      404 {object} map[string]string "User not found"
+// @Router       /users/{id}/sessions [delete]
+func (c *appController) revokeUserSessionsHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*recieveUser)
+	users, err := c.service.users(req.ID)
+	if err != nil || len(users) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "user not found")
+	}
+	if err := c.service.revokeUserTokens(req.ID); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// ListPersonalTokens godoc
+// @Summary      List my personal access tokens
+// @Description  Usable personal access tokens of the authenticated user, newest first. The tokens themselves are never returned again
+// @Tags         Users
+// @Produce      json
+// @Success      200 {array} PersonalAccessToken "Personal access tokens"
+// @Failure      401 {object} map[string]string "Unauthorized - invalid, expired or revoked access token"
+// @Router       /users/me/tokens [get]
+func (c *appController) listPersonalTokensHandler(ctx *fiber.Ctx) error {
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	tokens, err := c.service.personalTokens(claims.Subject)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return ctx.Status(fiber.StatusOK).JSON(tokens)
+}
+
+// CreatePersonalToken godoc
+// @Summary      Create personal access token
+// @Description  Issue a long-lived token limited to permissions of the authenticated user, sent as Authorization: Bearer. The token is only returned in this response
+// @Tags         Users
+// @Accept       json
+// @Produce      json
+// @Param        token body createPersonalToken true "Token name, permission codes and expiry"
+// @Success      201 {object} personalTokenSecret "Token created"
+// @Failure      400 {object} map[string]string "Bad request - validation error, invalid expiry or permission not held"
+// @Failure      401 {object} map[string]string "Unauthorized - invalid, expired or revoked access token"
+// @Router       /users/me/tokens [post]
+func (c *appController) createPersonalTokenHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*createPersonalToken)
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	token, secret, err := c.service.createPersonalToken(claims.Subject, req)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return ctx.Status(fiber.StatusCreated).JSON(personalTokenSecret{
+		PersonalAccessToken: *token,
+		Token:               secret,
+	})
+}
+
+// RevokePersonalToken godoc
+// @Summary      Revoke my personal access token
+// @Description  The token is denied immediately and can't be restored
+// @Tags         Users
+// @Param        tokenId path string true "Token ID"
+// @Success      204
+// @Failure      404 {object} map[string]string "Token not found"
+// @Router       /users/me/tokens/{tokenId} [delete]
+func (c *appController) revokePersonalTokenHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*myPersonalToken)
+	claims := ctx.Locals("claimsData").(*JwtClaims)
+	if err := c.service.revokePersonalToken(claims.Subject, req.TokenID); err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// personalTokenScope runs after ProtectedRoute on core routes and checks a
+// personal access token against its row and the current roles of the owner.
+func (c *appController) personalTokenScope(jwtClaims jwt.Claims) *fiber.Error {
+	claims, ok := jwtClaims.(*JwtClaims)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid claims type")
+	}
+	if claims.Type != "personal_access_token" {
+		return nil
+	}
+	if err := c.service.checkPersonalToken(claims); err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+	}
+	return nil
+}
+
 func (c *appController) listRolesHandler(ctx *fiber.Ctx) error {
 	req := ctx.Locals("validatedData").(*paginateReq)
 	roles, err := c.service.roles()
@@ -212,6 +1416,9 @@ func (c *appController) listRolesHandler(ctx *fiber.Ctx) error {
 	if err := gorote.Pagination(req.Page, req.Limit, &roles); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
+	if err := c.service.effectivePermissions(roles); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
 	res := &listRole{
 		paginateRes: paginateRes{
 			Page:  req.Page,
@@ -232,6 +1439,168 @@ func (c *appController) createRoleHandler(ctx *fiber.Ctx) error {
 	return ctx.Status(fiber.StatusCreated).JSON(role)
 }
 
+func (c *appController) recieveRoleHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*recieveRole)
+	role, err := c.service.role(req.ID)
+	if err != nil {
+		return roleError(err)
+	}
+	return ctx.Status(fiber.StatusOK).JSON(role)
+}
+
+func (c *appController) updateRoleHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*updateRole)
+	role, err := c.service.updateRole(&patchRole{
+		ID:          req.ID,
+		Name:        &req.Name,
+		Description: &req.Description,
+		RequireMFA:  req.RequireMFA,
+	})
+	if err != nil {
+		return roleError(err)
+	}
+	return ctx.Status(fiber.StatusOK).JSON(role)
+}
+
+func (c *appController) patchRoleHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*patchRole)
+	role, err := c.service.updateRole(req)
+	if err != nil {
+		return roleError(err)
+	}
+	return ctx.Status(fiber.StatusOK).JSON(role)
+}
+
+func (c *appController) addRolePermissionsHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*rolePermissions)
+	role, err := c.service.addRolePermissions(req.ID, req.Permissions)
+	if err != nil {
+		return roleError(err)
+	}
+	return ctx.Status(fiber.StatusOK).JSON(role)
+}
+
+func (c *appController) removeRolePermissionHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*rolePermission)
+	role, err := c.service.removeRolePermission(req.ID, req.PermissionID)
+	if err != nil {
+		return roleError(err)
+	}
+	return ctx.Status(fiber.StatusOK).JSON(role)
+}
+
+func (c *appController) addRoleParentsHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*roleParents)
+	role, err := c.service.addRoleParents(req.ID, req.Parents)
+	if err != nil {
+		return roleError(err)
+	}
+	return ctx.Status(fiber.StatusOK).JSON(role)
+}
+
+func (c *appController) removeRoleParentHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*roleParent)
+	role, err := c.service.removeRoleParent(req.ID, req.ParentID)
+	if err != nil {
+		return roleError(err)
+	}
+	return ctx.Status(fiber.StatusOK).JSON(role)
+}
+
+func (c *appController) activateRoleHandler(ctx *fiber.Ctx) error {
+	return c.setRoleActive(ctx, true)
+}
+
+func (c *appController) deactivateRoleHandler(ctx *fiber.Ctx) error {
+	return c.setRoleActive(ctx, false)
+}
+
+func (c *appController) setRoleActive(ctx *fiber.Ctx, active bool) error {
+	req := ctx.Locals("validatedData").(*recieveRole)
+	role, err := c.service.updateRole(&patchRole{ID: req.ID, Active: &active})
+	if err != nil {
+		return roleError(err)
+	}
+	return ctx.Status(fiber.StatusOK).JSON(role)
+}
+
+func (c *appController) deleteRoleHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*recieveRole)
+	if err := c.service.deleteRole(req.ID); err != nil {
+		return roleError(err)
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+func roleError(err error) error {
+	if errors.Is(err, errRoleNotFound) || errors.Is(err, errPermissionNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	return fiber.NewError(fiber.StatusBadRequest, err.Error())
+}
+
+func (c *appController) recievePermissionHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*recievePermission)
+	permission, err := c.service.permission(req.ID)
+	if err != nil {
+		return permissionError(err)
+	}
+	return ctx.Status(fiber.StatusOK).JSON(permission)
+}
+
+func (c *appController) createPermissionHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*createPermission)
+	permission, err := c.service.createPermission(req)
+	if err != nil {
+		return permissionError(err)
+	}
+	return ctx.Status(fiber.StatusCreated).JSON(permission)
+}
+
+func (c *appController) updatePermissionHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*updatePermission)
+	permission, err := c.service.updatePermission(req)
+	if err != nil {
+		return permissionError(err)
+	}
+	return ctx.Status(fiber.StatusOK).JSON(permission)
+}
+
+func (c *appController) activatePermissionHandler(ctx *fiber.Ctx) error {
+	return c.setPermissionActive(ctx, true)
+}
+
+func (c *appController) deactivatePermissionHandler(ctx *fiber.Ctx) error {
+	return c.setPermissionActive(ctx, false)
+}
+
+func (c *appController) setPermissionActive(ctx *fiber.Ctx, active bool) error {
+	req := ctx.Locals("validatedData").(*recievePermission)
+	permission, err := c.service.setPermissionActive(req.ID, active)
+	if err != nil {
+		return permissionError(err)
+	}
+	return ctx.Status(fiber.StatusOK).JSON(permission)
+}
+
+func (c *appController) deletePermissionHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*recievePermission)
+	if err := c.service.deletePermission(req.ID); err != nil {
+		return permissionError(err)
+	}
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+func permissionError(err error) error {
+	switch {
+	case errors.Is(err, errPermissionNotFound):
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	case errors.Is(err, errRegisteredPermission):
+		return fiber.NewError(fiber.StatusForbidden, err.Error())
+	}
+	return fiber.NewError(fiber.StatusBadRequest, err.Error())
+}
+
 func (c *appController) listPermissiontHandler(ctx *fiber.Ctx) error {
 	req := ctx.Locals("validatedData").(*paginateReq)
 	permissions, err := c.service.permissions()
@@ -255,3 +1624,52 @@ func (c *appController) listPermissiontHandler(ctx *fiber.Ctx) error {
 	}
 	return ctx.Status(fiber.StatusOK).JSON(res)
 }
+
+func (c *appController) listServiceClientsHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*paginateReq)
+	clients, err := c.service.serviceClients()
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if len(clients) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "no service clients found")
+	}
+	countClients := uint(len(clients))
+	if err := gorote.Pagination(req.Page, req.Limit, &clients); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	res := &listServiceClient{
+		paginateRes: paginateRes{
+			Page:  req.Page,
+			Limit: req.Limit,
+			Total: countClients,
+		},
+		Data: clients,
+	}
+	return ctx.Status(fiber.StatusOK).JSON(res)
+}
+
+// CreateServiceClient godoc
+// @Summary      Create service client
+// @Description  Register a machine client for the client_credentials grant. The secret is only returned in this response
+// @Tags         Clients
+// @Accept       json
+// @Produce      json
+// @Param        client body createServiceClient true "Client name, description and role ids"
+// @Success      201 {object} serviceClientSecret "Client created"
+// @Failure      400 {object} map[string]string "Bad request - validation error or duplicated name"
+// @Failure      401 {object} map[string]string "Unauthorized - missing create_client permission"
+// @Router       /clients [post]
+func (c *appController) createServiceClientHandler(ctx *fiber.Ctx) error {
+	req := ctx.Locals("validatedData").(*createServiceClient)
+	client, secret, err := c.service.createServiceClient(req)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.Status(fiber.StatusCreated).JSON(serviceClientSecret{
+		ServiceClient: *client,
+		ClientID:      client.ID.String(),
+		ClientSecret:  secret,
+	})
+}
@@ -1,18 +1,28 @@
 package core
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/glebarez/sqlite"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/ronaldalds/gorote-core-rsa/gorote"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
@@ -31,14 +41,19 @@ func TestAuthintegration(t *testing.T) {
 		t.Fatalf("err on read private key: %v", err.Error())
 	}
 
+	mailer := gorote.NewMemoryMailer()
 	auth := Config{
 		DB:               db,
+		AppName:          "test",
 		PrivateKey:       privateKey,
 		JwtExpireAccess:  time.Hour,
 		JwtExpireRefresh: time.Hour * 24,
 		SuperEmail:       "admin@admin.com",
 		SuperPass:        "Senha@123",
 		Domain:           ".ralds.com.br,.ralds.br",
+		Mailer:           mailer,
+		PublicURL:        "https://api.ralds.com.br/test",
+		PasswordResetURL: "https://app.ralds.com.br/reset",
 	}
 	router, err := New(&auth)
 	if err != nil {
@@ -74,7 +89,7 @@ func TestAuthintegration(t *testing.T) {
 		if !ok {
 			t.Error("err on validate token")
 		}
-		req := httptest.NewRequest("GET", fmt.Sprintf("/test/users/%s", claims.ID), strings.NewReader(""))
+		req := httptest.NewRequest("GET", fmt.Sprintf("/test/users/%s", claims.Subject), strings.NewReader(""))
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Authorization", Token.AccessToken)
 		resp, err := app.Test(req)
@@ -98,4 +113,2997 @@ func TestAuthintegration(t *testing.T) {
 			t.Errorf("esperava status 200, recebeu %d", resp.StatusCode)
 		}
 	})
+
+	t.Run("refresh token rotation", func(t *testing.T) {
+		body := fmt.Sprintf(`{"refresh_token": "%s"}`, Token.RefreshToken)
+		req := httptest.NewRequest("POST", "/test/auth/refresh", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("err on test: %v", err.Error())
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		var rotated token
+		if err := json.NewDecoder(resp.Body).Decode(&rotated); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if rotated.RefreshToken == "" || rotated.RefreshToken == Token.RefreshToken {
+			t.Fatalf("esperava novo refresh token")
+		}
+
+		req = httptest.NewRequest("POST", "/test/auth/refresh", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err = app.Test(req)
+		if err != nil {
+			t.Fatalf("err on test: %v", err.Error())
+		}
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava status 401 no reuso, recebeu %d", resp.StatusCode)
+		}
+
+		body = fmt.Sprintf(`{"refresh_token": "%s"}`, rotated.RefreshToken)
+		req = httptest.NewRequest("POST", "/test/auth/refresh", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err = app.Test(req)
+		if err != nil {
+			t.Fatalf("err on test: %v", err.Error())
+		}
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava família revogada, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("refresh retried after a failed rotation", func(t *testing.T) {
+		session := loginAs(t, app, "admin@admin.com", "Senha@123")
+		failRotation := true
+		if err := db.Callback().Create().Before("gorm:create").Register("test:fail_rotation", func(tx *gorm.DB) {
+			if failRotation && tx.Statement.Table == "refresh_tokens" {
+				tx.AddError(fmt.Errorf("falha simulada"))
+			}
+		}); err != nil {
+			t.Fatalf("err on register callback: %v", err.Error())
+		}
+		defer db.Callback().Create().Remove("test:fail_rotation")
+
+		body := fmt.Sprintf(`{"refresh_token": "%s"}`, session.RefreshToken)
+		if resp := request(t, app, "POST", "/test/auth/refresh", body, ""); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Fatalf("esperava falha ao salvar o novo refresh token, recebeu %d", resp.StatusCode)
+		}
+		failRotation = false
+		if resp := request(t, app, "POST", "/test/auth/refresh", body, ""); resp.StatusCode != fiber.StatusOK {
+			t.Errorf("refresh com rotacao falha nao deveria ser tratado como reuso, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("logout current session", func(t *testing.T) {
+		session := loginAs(t, app, "admin@admin.com", "Senha@123")
+		body := fmt.Sprintf(`{"refresh_token": "%s"}`, session.RefreshToken)
+		resp := request(t, app, "POST", "/test/auth/logout", body, session.AccessToken)
+		if resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("esperava status 204, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "POST", "/test/auth/logout", "", session.AccessToken)
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava access token revogado, recebeu %d", resp.StatusCode)
+		}
+		module := fiber.New()
+		module.Get("/", gorote.JWTProtectedRevocable(&JwtClaims{}, router.KeyRing(), router.Revocations()), func(ctx *fiber.Ctx) error {
+			return ctx.SendStatus(fiber.StatusNoContent)
+		})
+		if resp := request(t, module, "GET", "/", "", session.AccessToken); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava access token revogado no modulo do mesmo processo, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "POST", "/test/auth/refresh", body, "")
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava refresh token revogado, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "GET", "/test/permissions?page=1&limit=10", "", Token.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("esperava outra sessão ativa, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("logout all sessions", func(t *testing.T) {
+		body := `{"email": "logout@ralds.com.br", "password": "Senha@123", "active": true}`
+		resp := request(t, app, "POST", "/test/users", body, Token.AccessToken)
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+		}
+		first := loginAs(t, app, "logout@ralds.com.br", "Senha@123")
+		second := loginAs(t, app, "logout@ralds.com.br", "Senha@123")
+		resp = request(t, app, "POST", "/test/auth/logout/all", "", first.AccessToken)
+		if resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("esperava status 204, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "POST", "/test/auth/logout", "", second.AccessToken)
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava access token revogado, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, second.RefreshToken), "")
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava refresh token revogado, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("jwks", func(t *testing.T) {
+		resp := request(t, app, "GET", "/test/.well-known/jwks.json", "", "")
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		var jwks gorote.JWKS
+		if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		tk, _, err := jwt.NewParser().ParseUnverified(Token.AccessToken, &JwtClaims{})
+		if err != nil {
+			t.Fatalf("err on parse token: %v", err.Error())
+		}
+		kid, _ := tk.Header["kid"].(string)
+		if _, err := jwks.Key(kid); err != nil {
+			t.Errorf("kid do token não publicado no jwks: %v", err)
+		}
+	})
+
+	t.Run("promote signing key", func(t *testing.T) {
+		newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("err on generate key: %v", err.Error())
+		}
+		if err := router.PromoteKey(newKey); err != nil {
+			t.Fatalf("err on promote key: %v", err.Error())
+		}
+		resp := request(t, app, "GET", "/test/permissions?page=1&limit=10", "", Token.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("esperava token da chave anterior válido, recebeu %d", resp.StatusCode)
+		}
+		session := loginAs(t, app, "admin@admin.com", "Senha@123")
+		tk, _, err := jwt.NewParser().ParseUnverified(session.AccessToken, &JwtClaims{})
+		if err != nil {
+			t.Fatalf("err on parse token: %v", err.Error())
+		}
+		if tk.Header["kid"] != router.KeyRing().Current().ID {
+			t.Errorf("esperava token assinado com a nova chave")
+		}
+		resp = request(t, app, "GET", "/test/.well-known/jwks.json", "", "")
+		var jwks gorote.JWKS
+		if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if len(jwks.Keys) != 2 {
+			t.Errorf("esperava 2 chaves no jwks, recebeu %d", len(jwks.Keys))
+		}
+	})
+
+	t.Run("openid connect", func(t *testing.T) {
+		resp := request(t, app, "GET", "/test/.well-known/openid-configuration", "", "")
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		var discovery openidConfiguration
+		if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if discovery.Issuer != "test" || !strings.HasSuffix(discovery.JwksURI, "/test/.well-known/jwks.json") {
+			t.Errorf("discovery inesperado: %+v", discovery)
+		}
+
+		session := loginAs(t, app, "admin@admin.com", "Senha@123")
+		var idClaims IDTokenClaims
+		if err := gorote.ValidateOrGetJWTKeySet(&idClaims, session.IDToken, router.KeyRing()); err != nil {
+			t.Fatalf("id_token inválido: %v", err)
+		}
+		if idClaims.Email != "admin@admin.com" || idClaims.Issuer != "test" {
+			t.Errorf("claims inesperadas no id_token: %+v", idClaims)
+		}
+		resp = request(t, app, "GET", "/test/users?page=1&limit=10", "", session.IDToken)
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("id_token não deveria valer como access token, recebeu %d", resp.StatusCode)
+		}
+
+		resp = request(t, app, "GET", "/test/userinfo", "", session.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		var info userInfo
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if info.Email != "admin@admin.com" || info.Subject != idClaims.Subject {
+			t.Errorf("userinfo inesperado: %+v", info)
+		}
+	})
+
+	t.Run("client credentials", func(t *testing.T) {
+		resp := request(t, app, "GET", "/test/permissions?page=1&limit=100", "", Token.AccessToken)
+		var permissions listPermission
+		if err := json.NewDecoder(resp.Body).Decode(&permissions); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		var viewUser string
+		for _, permission := range permissions.Data {
+			if permission.Code == string(PermissionViewUser) {
+				viewUser = permission.ID.String()
+			}
+		}
+		body := fmt.Sprintf(`{"name": "worker", "permissions": ["%s"]}`, viewUser)
+		resp = request(t, app, "POST", "/test/roles", body, Token.AccessToken)
+		var role Role
+		if err := json.NewDecoder(resp.Body).Decode(&role); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		body = fmt.Sprintf(`{"name": "queue-worker", "roles": ["%s"]}`, role.ID)
+		resp = request(t, app, "POST", "/test/clients", body, Token.AccessToken)
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+		}
+		var client serviceClientSecret
+		if err := json.NewDecoder(resp.Body).Decode(&client); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if client.ClientSecret == "" {
+			t.Fatalf("segredo do client inesperado: %+v", client)
+		}
+		var stored ServiceClient
+		if err := db.First(&stored, "id = ?", client.ID).Error; err != nil {
+			t.Fatalf("err on query client: %v", err.Error())
+		}
+		if stored.SecretHash == client.ClientSecret || !gorote.CompareTokenHash(client.ClientSecret, stored.SecretHash) {
+			t.Error("esperava apenas o hash do segredo salvo no banco")
+		}
+
+		tokenRequest := func(secret string) *http.Response {
+			req := httptest.NewRequest("POST", "/test/auth/token", strings.NewReader("grant_type=client_credentials"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(client.ClientID, secret)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("err on test: %v", err.Error())
+			}
+			return resp
+		}
+		if resp := tokenRequest("errado"); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava status 401 com segredo errado, recebeu %d", resp.StatusCode)
+		}
+		resp = tokenRequest(client.ClientSecret)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		var tk oauthToken
+		if err := json.NewDecoder(resp.Body).Decode(&tk); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if tk.TokenType != "Bearer" || tk.RefreshToken != "" || tk.ExpiresIn <= 0 {
+			t.Errorf("resposta de token inesperada: %+v", tk)
+		}
+		var claims JwtClaims
+		if _, _, err := jwt.NewParser().ParseUnverified(tk.AccessToken, &claims); err != nil {
+			t.Fatalf("err on parse: %v", err.Error())
+		}
+		if !claims.Machine || claims.Subject != client.ClientID {
+			t.Errorf("claims de maquina inesperadas: %+v", claims)
+		}
+
+		resp = request(t, app, "GET", "/test/users?page=1&limit=10", "", "Bearer "+tk.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("esperava status 200 com permissao do client, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "GET", "/test/permissions?page=1&limit=10", "", "Bearer "+tk.AccessToken)
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava status 401 sem permissao, recebeu %d", resp.StatusCode)
+		}
+
+		body = fmt.Sprintf("grant_type=client_credentials&client_id=%s&client_secret=%s&scope=view_permission", client.ClientID, url.QueryEscape(client.ClientSecret))
+		req := httptest.NewRequest("POST", "/test/auth/token", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("err on test: %v", err.Error())
+		}
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("esperava status 400 com escopo nao concedido, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("authorization code with pkce", func(t *testing.T) {
+		body := `{"name": "spa", "public": true, "redirect_uris": ["https://spa.ralds.com.br/callback"]}`
+		resp := request(t, app, "POST", "/test/clients", body, Token.AccessToken)
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+		}
+		var client serviceClientSecret
+		if err := json.NewDecoder(resp.Body).Decode(&client); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if client.ClientSecret != "" {
+			t.Errorf("client publico nao deveria ter segredo")
+		}
+
+		verifier := "dBjftJeZ4CVP-mJ92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		params := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {client.ClientID},
+			"redirect_uri":          {"https://spa.ralds.com.br/callback"},
+			"scope":                 {"openid"},
+			"state":                 {"xyz"},
+			"nonce":                 {"n-0S6"},
+			"code_challenge":        {gorote.CodeChallengeS256(verifier)},
+			"code_challenge_method": {"S256"},
+		}
+		var csrf *http.Cookie
+		authorize := func(params url.Values, email, password string) *http.Response {
+			form := url.Values{"email": {email}, "password": {password}}
+			for key, values := range params {
+				form[key] = values
+			}
+			if csrf != nil {
+				form.Set("csrf_token", csrf.Value)
+			}
+			req := httptest.NewRequest("POST", "/test/oauth/authorize", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if csrf != nil {
+				req.AddCookie(csrf)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("err on test: %v", err.Error())
+			}
+			return resp
+		}
+		exchange := func(code, verifier string) *http.Response {
+			form := url.Values{
+				"grant_type":    {"authorization_code"},
+				"client_id":     {client.ClientID},
+				"code":          {code},
+				"redirect_uri":  {"https://spa.ralds.com.br/callback"},
+				"code_verifier": {verifier},
+			}
+			req := httptest.NewRequest("POST", "/test/auth/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("err on test: %v", err.Error())
+			}
+			return resp
+		}
+		codeFrom := func(resp *http.Response) string {
+			if resp.StatusCode != fiber.StatusFound {
+				t.Fatalf("esperava status 302, recebeu %d", resp.StatusCode)
+			}
+			location, err := url.Parse(resp.Header.Get("Location"))
+			if err != nil {
+				t.Fatalf("err on parse: %v", err.Error())
+			}
+			if location.Host != "spa.ralds.com.br" || location.Query().Get("state") != "xyz" {
+				t.Errorf("redirect inesperado: %s", location)
+			}
+			return location.Query().Get("code")
+		}
+
+		wrongRedirect := url.Values{}
+		for key, values := range params {
+			wrongRedirect[key] = values
+		}
+		wrongRedirect.Set("redirect_uri", "https://evil.com/callback")
+		resp = request(t, app, "GET", "/test/oauth/authorize?"+wrongRedirect.Encode(), "", "")
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("esperava status 400 com redirect_uri nao registrada, recebeu %d", resp.StatusCode)
+		}
+		withoutPKCE := url.Values{}
+		for key, values := range params {
+			withoutPKCE[key] = values
+		}
+		withoutPKCE.Del("code_challenge")
+		resp = request(t, app, "GET", "/test/oauth/authorize?"+withoutPKCE.Encode(), "", "")
+		if resp.StatusCode != fiber.StatusFound || !strings.Contains(resp.Header.Get("Location"), "error=invalid_request") {
+			t.Errorf("esperava redirect com invalid_request, recebeu %d %s", resp.StatusCode, resp.Header.Get("Location"))
+		}
+		resp = request(t, app, "GET", "/test/oauth/authorize?"+params.Encode(), "", "")
+		if resp.StatusCode != fiber.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			t.Fatalf("esperava pagina de login, recebeu %d", resp.StatusCode)
+		}
+		if resp := authorize(params, "admin@admin.com", "Senha@123"); resp.StatusCode != fiber.StatusForbidden {
+			t.Errorf("esperava status 403 sem o token csrf da pagina, recebeu %d", resp.StatusCode)
+		}
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == "authorize_csrf" {
+				csrf = cookie
+			}
+		}
+		if csrf == nil || csrf.SameSite != http.SameSiteStrictMode {
+			t.Fatalf("esperava cookie authorize_csrf SameSite=Strict: %+v", csrf)
+		}
+		page, _ := io.ReadAll(resp.Body)
+		if !strings.Contains(string(page), `name="csrf_token" value="`+csrf.Value+`"`) {
+			t.Errorf("pagina de login deveria trazer o token csrf do cookie")
+		}
+		if resp := authorize(params, "admin@admin.com", "errada"); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava status 401 com senha errada, recebeu %d", resp.StatusCode)
+		}
+
+		code := codeFrom(authorize(params, "admin@admin.com", "Senha@123"))
+		resp = exchange(code, verifier)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		var tk oauthToken
+		if err := json.NewDecoder(resp.Body).Decode(&tk); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if tk.AccessToken == "" || tk.RefreshToken == "" || tk.IDToken == "" {
+			t.Fatalf("esperava par de tokens e id_token: %+v", tk)
+		}
+		var idClaims IDTokenClaims
+		if _, _, err := jwt.NewParser().ParseUnverified(tk.IDToken, &idClaims); err != nil {
+			t.Fatalf("err on parse: %v", err.Error())
+		}
+		if idClaims.Nonce != "n-0S6" || len(idClaims.Audience) != 1 || idClaims.Audience[0] != client.ClientID {
+			t.Errorf("id_token inesperado: %+v", idClaims)
+		}
+		resp = request(t, app, "GET", "/test/users?page=1&limit=10", "", "Bearer "+tk.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("esperava status 200 com access token do fluxo, recebeu %d", resp.StatusCode)
+		}
+		if resp := exchange(code, verifier); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("esperava status 400 reutilizando o code, recebeu %d", resp.StatusCode)
+		}
+
+		code = codeFrom(authorize(params, "admin@admin.com", "Senha@123"))
+		if resp := exchange(code, strings.Repeat("a", 43)); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("esperava status 400 com code_verifier errado, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("password reset", func(t *testing.T) {
+		body := `{"email": "reset@ralds.com.br", "password": "Senha@123", "active": true}`
+		resp := request(t, app, "POST", "/test/users", body, Token.AccessToken)
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+		}
+		session := loginAs(t, app, "reset@ralds.com.br", "Senha@123")
+
+		router.mails.wait()
+		sent := len(mailer.Mails())
+		resp = request(t, app, "POST", "/test/auth/password/forgot", `{"email": "naoexiste@ralds.com.br"}`, "")
+		if resp.StatusCode != fiber.StatusAccepted {
+			t.Errorf("esperava status 202 para email desconhecido, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "POST", "/test/auth/password/forgot", `{"email": "reset@ralds.com.br"}`, "")
+		if resp.StatusCode != fiber.StatusAccepted {
+			t.Fatalf("esperava status 202, recebeu %d", resp.StatusCode)
+		}
+		mail := waitMail(t, mailer, sent, "reset@ralds.com.br")
+		router.mails.wait()
+		if _, ok := mailer.Last("naoexiste@ralds.com.br"); ok {
+			t.Error("nao deveria enviar email para conta inexistente")
+		}
+		start := strings.Index(mail.Body, "https://app.ralds.com.br/reset?token=")
+		if start < 0 {
+			t.Fatalf("link de redefinicao nao encontrado: %s", mail.Body)
+		}
+		link, err := url.Parse(strings.Fields(mail.Body[start:])[0])
+		if err != nil {
+			t.Fatalf("err on parse: %v", err.Error())
+		}
+		resetToken := link.Query().Get("token")
+
+		resp = request(t, app, "POST", "/test/auth/password/reset", fmt.Sprintf(`{"token": "%s", "password": "fraca"}`, resetToken), "")
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("esperava status 400 com senha fraca, recebeu %d", resp.StatusCode)
+		}
+		body = fmt.Sprintf(`{"token": "%s", "password": "Nova@1234"}`, resetToken)
+		resp = request(t, app, "POST", "/test/auth/password/reset", body, "")
+		if resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("esperava status 204, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "POST", "/test/auth/password/reset", body, "")
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("token de redefinicao deveria ser de uso unico, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, session.RefreshToken), "")
+		if resp.StatusCode == fiber.StatusOK {
+			t.Error("refresh token anterior a redefinicao deveria ser rejeitado")
+		}
+		resp = request(t, app, "POST", "/test/auth/login", `{"email": "reset@ralds.com.br", "password": "Senha@123"}`, "")
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("senha antiga nao deveria funcionar, recebeu %d", resp.StatusCode)
+		}
+		loginAs(t, app, "reset@ralds.com.br", "Nova@1234")
+	})
+}
+
+func TestAuthEd25519(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:ed25519?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+
+	if _, err := New(&Config{DB: db, SigningKey: privateKey, Algorithm: "RS256"}); err == nil {
+		t.Error("esperava erro com algoritmo diferente da chave")
+	}
+
+	router, err := New(&Config{
+		DB:               db,
+		SigningKey:       privateKey,
+		Algorithm:        "EdDSA",
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+	})
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	session := loginAs(t, app, "admin@admin.com", "Senha@123")
+	tk, _, err := jwt.NewParser().ParseUnverified(session.AccessToken, &JwtClaims{})
+	if err != nil {
+		t.Fatalf("err on parse token: %v", err.Error())
+	}
+	if tk.Method.Alg() != "EdDSA" {
+		t.Errorf("esperava alg EdDSA, recebeu %s", tk.Method.Alg())
+	}
+	resp := request(t, app, "GET", "/test/permissions?page=1&limit=10", "", session.AccessToken)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("esperava status 200, recebeu %d", resp.StatusCode)
+	}
+	resp = request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, session.RefreshToken), "")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("esperava status 200 no refresh, recebeu %d", resp.StatusCode)
+	}
+}
+
+func TestAuthMFA(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:mfa?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	clock := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	router, err := New(&Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+		MFASuperUser:     true,
+		Now:              func() time.Time { return clock },
+	})
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	challenge := func() mfaChallenge {
+		t.Helper()
+		resp := request(t, app, "POST", "/test/auth/login", `{"email": "admin@admin.com", "password": "Senha@123"}`, "")
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200 no login, recebeu %d", resp.StatusCode)
+		}
+		var res mfaChallenge
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if !res.MFARequired || res.MFAToken == "" {
+			t.Fatalf("esperava desafio de mfa: %+v", res)
+		}
+		return res
+	}
+	verify := func(body string) *http.Response {
+		return request(t, app, "POST", "/test/auth/mfa/verify", body, "")
+	}
+
+	first := challenge()
+	if !first.EnrollmentRequired {
+		t.Error("esperava enrollment obrigatorio para superusuario")
+	}
+	resp := request(t, app, "GET", "/test/users?page=1&limit=10", "", "Bearer "+first.MFAToken)
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("mfa_token nao deveria acessar rotas protegidas, recebeu %d", resp.StatusCode)
+	}
+	keys := gorote.NewStaticKeySet(privateKey.Public())
+	service := fiber.New()
+	service.Get("/relatorios", gorote.JWTProtectedKeySet(&JwtClaims{}, keys), func(ctx *fiber.Ctx) error {
+		return ctx.SendStatus(fiber.StatusNoContent)
+	})
+	service.Get("/desafio", gorote.JWTProtectedKeySet(AcceptTokens("mfa_token"), keys), func(ctx *fiber.Ctx) error {
+		return ctx.SendStatus(fiber.StatusNoContent)
+	})
+	if resp := request(t, service, "GET", "/relatorios", "", "Bearer "+first.MFAToken); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("mfa_token nao deveria acessar rota de microservico sem ProtectedRoute, recebeu %d", resp.StatusCode)
+	}
+	if resp := request(t, service, "GET", "/desafio", "", "Bearer "+first.MFAToken); resp.StatusCode != fiber.StatusNoContent {
+		t.Errorf("rota que aceita mfa_token deveria recebe-lo, recebeu %d", resp.StatusCode)
+	}
+
+	resp = request(t, app, "POST", "/test/auth/mfa/enroll", "", "Bearer "+first.MFAToken)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200 no enroll, recebeu %d", resp.StatusCode)
+	}
+	var enrollment mfaEnrollment
+	if err := json.NewDecoder(resp.Body).Decode(&enrollment); err != nil {
+		t.Fatalf("err on decode: %v", err.Error())
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/test:admin@admin.com?") {
+		t.Errorf("otpauth uri inesperada: %s", enrollment.URI)
+	}
+	code := func() string {
+		code, err := gorote.TOTPCode(enrollment.Secret, gorote.TOTPStep(clock))
+		if err != nil {
+			t.Fatalf("err on totp: %v", err.Error())
+		}
+		return code
+	}
+
+	resp = request(t, app, "POST", "/test/auth/mfa/confirm", `{"code": "000000"}`, "Bearer "+first.MFAToken)
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 com codigo errado, recebeu %d", resp.StatusCode)
+	}
+	resp = request(t, app, "POST", "/test/auth/mfa/confirm", fmt.Sprintf(`{"code": "%s"}`, code()), "Bearer "+first.MFAToken)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200 no confirm, recebeu %d", resp.StatusCode)
+	}
+	var recovery mfaRecoveryCodes
+	if err := json.NewDecoder(resp.Body).Decode(&recovery); err != nil {
+		t.Fatalf("err on decode: %v", err.Error())
+	}
+	if len(recovery.RecoveryCodes) != 10 {
+		t.Fatalf("esperava 10 codigos de recuperacao, recebeu %d", len(recovery.RecoveryCodes))
+	}
+
+	body := fmt.Sprintf(`{"mfa_token": "%s", "code": "%s"}`, first.MFAToken, code())
+	if resp := verify(body); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("codigo ja usado no confirm nao deveria ser aceito, recebeu %d", resp.StatusCode)
+	}
+	clock = clock.Add(30 * time.Second)
+	body = fmt.Sprintf(`{"mfa_token": "%s", "code": "%s"}`, first.MFAToken, code())
+	resp = verify(body)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200 no verify, recebeu %d", resp.StatusCode)
+	}
+	var session token
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		t.Fatalf("err on decode: %v", err.Error())
+	}
+	if session.AccessToken == "" || session.RefreshToken == "" {
+		t.Fatalf("esperava par de tokens: %+v", session)
+	}
+	clock = clock.Add(30 * time.Second)
+	body = fmt.Sprintf(`{"mfa_token": "%s", "code": "%s"}`, first.MFAToken, code())
+	if resp := verify(body); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("mfa_token nao deveria ser reutilizado, recebeu %d", resp.StatusCode)
+	}
+
+	second := challenge()
+	if second.EnrollmentRequired {
+		t.Error("usuario ja cadastrado nao deveria precisar de enrollment")
+	}
+	body = fmt.Sprintf(`{"mfa_token": "%s", "recovery_code": "%s"}`, second.MFAToken, recovery.RecoveryCodes[0])
+	if resp := verify(body); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("esperava status 200 com codigo de recuperacao, recebeu %d", resp.StatusCode)
+	}
+	third := challenge()
+	body = fmt.Sprintf(`{"mfa_token": "%s", "recovery_code": "%s"}`, third.MFAToken, recovery.RecoveryCodes[0])
+	if resp := verify(body); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("codigo de recuperacao deveria ser de uso unico, recebeu %d", resp.StatusCode)
+	}
+
+	resp = request(t, app, "POST", "/test/auth/mfa/disable", fmt.Sprintf(`{"code": "%s"}`, code()), session.AccessToken)
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("mfa obrigatorio nao deveria ser desativado, recebeu %d", resp.StatusCode)
+	}
+
+	reset := challenge()
+	body = fmt.Sprintf(`{"mfa_token": "%s", "recovery_code": "%s"}`, reset.MFAToken, recovery.RecoveryCodes[1])
+	if resp := verify(body); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200 com codigo de recuperacao, recebeu %d", resp.StatusCode)
+	}
+	fourth := challenge()
+	wrong := fmt.Sprintf(`{"mfa_token": "%s", "code": "000000"}`, fourth.MFAToken)
+	for i := 0; i < 4; i++ {
+		if resp := verify(wrong); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava status 401 com codigo errado, recebeu %d", resp.StatusCode)
+		}
+	}
+	resp = verify(wrong)
+	if resp.StatusCode != fiber.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("esperava status 429 com Retry-After apos codigos errados, recebeu %d", resp.StatusCode)
+	}
+	clock = clock.Add(time.Second)
+	if resp := verify(wrong); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("esperava status 401 com codigo errado, recebeu %d", resp.StatusCode)
+	}
+	clock = clock.Add(30 * time.Second)
+	body = fmt.Sprintf(`{"mfa_token": "%s", "code": "%s"}`, fourth.MFAToken, code())
+	if resp := verify(body); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("mfa_token deveria ser revogado apos %d codigos errados, recebeu %d", mfaMaxFailures, resp.StatusCode)
+	}
+	fifth := challenge()
+	body = fmt.Sprintf(`{"mfa_token": "%s", "code": "%s"}`, fifth.MFAToken, code())
+	if resp := verify(body); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("esperava status 200 com novo desafio, recebeu %d", resp.StatusCode)
+	}
+}
+
+func TestAuthEmailVerification(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:verification?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	auth := Config{
+		DB:                       db,
+		AppName:                  "test",
+		SigningKey:               privateKey,
+		JwtExpireAccess:          time.Hour,
+		JwtExpireRefresh:         time.Hour * 24,
+		SuperEmail:               "admin@admin.com",
+		SuperPass:                "Senha@123",
+		RequireEmailVerification: true,
+		PublicURL:                "https://api.ralds.com.br/test/",
+	}
+	if _, err := New(&auth); err == nil {
+		t.Error("esperava erro sem mailer configurado")
+	}
+	mailer := gorote.NewMemoryMailer()
+	auth.Mailer = mailer
+	noURL := auth
+	noURL.PublicURL = ""
+	if _, err := New(&noURL); err == nil {
+		t.Error("esperava erro sem PublicURL nem EmailVerificationURL")
+	}
+	router, err := New(&auth)
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	body := `{"email": "verify@ralds.com.br", "password": "Senha@123", "active": true}`
+	resp := request(t, app, "POST", "/test/users", body, admin.AccessToken)
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	resp = request(t, app, "POST", "/test/auth/login", `{"email": "verify@ralds.com.br", "password": "Senha@123"}`, "")
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava login recusado sem email verificado, recebeu %d", resp.StatusCode)
+	}
+
+	resp = request(t, app, "POST", "/test/auth/verify-email/resend", `{"email": "verify@ralds.com.br"}`, "")
+	if resp.StatusCode != fiber.StatusAccepted {
+		t.Errorf("esperava status 202 no reenvio, recebeu %d", resp.StatusCode)
+	}
+	router.mails.wait()
+	if len(mailer.Mails()) != 2 {
+		t.Fatalf("esperava 2 emails de verificacao, recebeu %d", len(mailer.Mails()))
+	}
+	mail, _ := mailer.Last("verify@ralds.com.br")
+	start := strings.Index(mail.Body, "https://api.ralds.com.br/test/auth/verify-email?token=")
+	if start < 0 {
+		t.Fatalf("link de verificacao nao encontrado: %s", mail.Body)
+	}
+	link, err := url.Parse(strings.Fields(mail.Body[start:])[0])
+	if err != nil {
+		t.Fatalf("err on parse: %v", err.Error())
+	}
+
+	resp = request(t, app, "GET", "/test/auth/verify-email?token=invalido", "", "")
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 com token invalido, recebeu %d", resp.StatusCode)
+	}
+	resp = request(t, app, "GET", link.RequestURI(), "", "")
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("esperava status 204 na verificacao, recebeu %d", resp.StatusCode)
+	}
+	session := loginAs(t, app, "verify@ralds.com.br", "Senha@123")
+	var claims JwtClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(session.AccessToken, &claims); err != nil {
+		t.Fatalf("err on parse: %v", err.Error())
+	}
+	if !claims.EmailVerified {
+		t.Error("esperava email_verified no access token")
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:lockout?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	attempts, err := gorote.NewGormAttemptStore(db)
+	if err != nil {
+		t.Fatalf("err on attempt store: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	clock := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	router, err := New(&Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+		Attempts:         attempts,
+		Lockout: LockoutPolicy{
+			FreeAttempts:    2,
+			MaxAttempts:     5,
+			IPFreeAttempts:  5,
+			IPMaxAttempts:   7,
+			BaseDelay:       time.Second,
+			MaxDelay:        4 * time.Second,
+			LockoutDuration: 10 * time.Minute,
+		},
+		Now: func() time.Time { return clock },
+	})
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	body := `{"email": "lock@ralds.com.br", "password": "Senha@123", "active": true}`
+	resp := request(t, app, "POST", "/test/users", body, admin.AccessToken)
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	var user User
+	if err := db.Where("email = ?", "lock@ralds.com.br").First(&user).Error; err != nil {
+		t.Fatalf("err on query user: %v", err.Error())
+	}
+	login := func(email, password string, status int, retryAfter string) {
+		t.Helper()
+		body := fmt.Sprintf(`{"email": "%s", "password": "%s"}`, email, password)
+		resp := request(t, app, "POST", "/test/auth/login", body, "")
+		if resp.StatusCode != status {
+			t.Fatalf("esperava status %d no login de %s, recebeu %d", status, email, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Retry-After"); got != retryAfter {
+			t.Errorf("esperava Retry-After %q, recebeu %q", retryAfter, got)
+		}
+	}
+
+	login("lock@ralds.com.br", "errada", fiber.StatusBadRequest, "")
+	login("lock@ralds.com.br", "errada", fiber.StatusBadRequest, "")
+	login("lock@ralds.com.br", "errada", fiber.StatusBadRequest, "")
+	login("lock@ralds.com.br", "Senha@123", fiber.StatusTooManyRequests, "1")
+
+	clock = clock.Add(time.Second)
+	login("LOCK@ralds.com.br", "errada", fiber.StatusBadRequest, "")
+	login("lock@ralds.com.br", "errada", fiber.StatusTooManyRequests, "2")
+	clock = clock.Add(2 * time.Second)
+	login("lock@ralds.com.br", "errada", fiber.StatusBadRequest, "")
+
+	clock = clock.Add(5 * time.Minute)
+	login("lock@ralds.com.br", "Senha@123", fiber.StatusTooManyRequests, "300")
+
+	resp = request(t, app, "POST", "/test/users/"+user.ID.String()+"/unlock", "", "")
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("esperava status 401 sem token, recebeu %d", resp.StatusCode)
+	}
+	resp = request(t, app, "POST", "/test/users/"+user.ID.String()+"/unlock", "", admin.AccessToken)
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("esperava status 204 no desbloqueio, recebeu %d", resp.StatusCode)
+	}
+	login("lock@ralds.com.br", "Senha@123", fiber.StatusOK, "")
+
+	// The IP still holds 5 failures: unknown emails push it over its limit.
+	login("ninguem@ralds.com.br", "errada", fiber.StatusBadRequest, "")
+	login("ninguem@ralds.com.br", "errada", fiber.StatusTooManyRequests, "1")
+	clock = clock.Add(time.Second)
+	login("ninguem@ralds.com.br", "errada", fiber.StatusBadRequest, "")
+	login("admin@admin.com", "Senha@123", fiber.StatusTooManyRequests, "600")
+}
+
+func TestAuthLoginEvents(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:events?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	clock := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	router, err := New(&Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+		Now:              func() time.Time { return clock },
+	})
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	body := `{"email": "audit@ralds.com.br", "password": "Senha@123", "active": true}`
+	resp := request(t, app, "POST", "/test/users", body, admin.AccessToken)
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	var user User
+	if err := db.Where("email = ?", "audit@ralds.com.br").First(&user).Error; err != nil {
+		t.Fatalf("err on query user: %v", err.Error())
+	}
+
+	clock = clock.Add(time.Hour)
+	resp = request(t, app, "POST", "/test/auth/login", `{"email": "audit@ralds.com.br", "password": "errada"}`, "")
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("esperava status 400, recebeu %d", resp.StatusCode)
+	}
+	session := loginAs(t, app, "audit@ralds.com.br", "Senha@123")
+	resp = request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, session.RefreshToken), "")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200 no refresh, recebeu %d", resp.StatusCode)
+	}
+	resp = request(t, app, "POST", "/test/auth/refresh", `{"refresh_token": "invalido"}`, "")
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Fatalf("esperava status 401 no refresh invalido, recebeu %d", resp.StatusCode)
+	}
+	clock = clock.Add(time.Hour)
+	if err := db.Model(&User{}).Where("id = ?", user.ID).UpdateColumn("active", false).Error; err != nil {
+		t.Fatalf("err on update user: %v", err.Error())
+	}
+	resp = request(t, app, "POST", "/test/auth/login", `{"email": "audit@ralds.com.br", "password": "Senha@123"}`, "")
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("esperava status 400 com usuario inativo, recebeu %d", resp.StatusCode)
+	}
+
+	events := func(query string, status int) listLoginEvent {
+		t.Helper()
+		resp := request(t, app, "GET", "/test/auth/events?page=1&limit=50"+query, "", admin.AccessToken)
+		if resp.StatusCode != status {
+			t.Fatalf("esperava status %d em /auth/events%s, recebeu %d", status, query, resp.StatusCode)
+		}
+		var res listLoginEvent
+		if status == fiber.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatalf("err on decode: %v", err.Error())
+			}
+		}
+		return res
+	}
+	all := events("", fiber.StatusOK)
+	if all.Total != 6 || len(all.Data) != 6 {
+		t.Fatalf("esperava 6 eventos, recebeu %d", all.Total)
+	}
+	if latest := all.Data[0]; latest.Reason != "inactive" || latest.Outcome != "failure" || latest.UserID == nil || *latest.UserID != user.ID {
+		t.Errorf("evento mais recente inesperado: %+v", latest)
+	}
+	if all.Data[0].IP == "" {
+		t.Errorf("esperava ip registrado: %+v", all.Data[0])
+	}
+
+	failures := events("&outcome=failure&user_id="+user.ID.String(), fiber.StatusOK)
+	reasons := func(list listLoginEvent) []string {
+		reasons := []string{}
+		for _, event := range list.Data {
+			reasons = append(reasons, event.Kind+":"+event.Reason)
+		}
+		slices.Sort(reasons)
+		return reasons
+	}
+	if got := reasons(failures); !slices.Equal(got, []string{"login:bad_password", "login:inactive"}) {
+		t.Errorf("falhas inesperadas: %v", got)
+	}
+	window := events("&outcome=failure&from=2025-01-01T13:00:00Z&to=2025-01-01T14:00:00Z", fiber.StatusOK)
+	if got := reasons(window); !slices.Equal(got, []string{"login:bad_password", "refresh:invalid_token"}) {
+		t.Errorf("falhas inesperadas no intervalo: %v", got)
+	}
+	success := events("&outcome=success&user_id="+user.ID.String(), fiber.StatusOK)
+	if success.Total != 2 {
+		t.Errorf("esperava login e refresh com sucesso, recebeu %d", success.Total)
+	}
+	events("&from=2025-01-02T00:00:00Z", fiber.StatusNotFound)
+	events("&outcome=talvez", fiber.StatusBadRequest)
+
+	resp = request(t, app, "GET", "/test/auth/events?page=1&limit=50", "", session.AccessToken)
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("usuario sem admin_user nao deveria listar eventos, recebeu %d", resp.StatusCode)
+	}
+}
+
+func TestAuthSessions(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:sessions?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	router, err := New(&Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+	})
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	body := `{"email": "sessions@ralds.com.br", "password": "Senha@123", "active": true}`
+	resp := request(t, app, "POST", "/test/users", body, admin.AccessToken)
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	var user User
+	if err := db.Where("email = ?", "sessions@ralds.com.br").First(&user).Error; err != nil {
+		t.Fatalf("err on query user: %v", err.Error())
+	}
+	loginDevice := func(device string) token {
+		t.Helper()
+		body := fmt.Sprintf(`{"email": "sessions@ralds.com.br", "password": "Senha@123", "device": "%s"}`, device)
+		resp := request(t, app, "POST", "/test/auth/login", body, "")
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200 no login, recebeu %d", resp.StatusCode)
+		}
+		var tk token
+		if err := json.NewDecoder(resp.Body).Decode(&tk); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		return tk
+	}
+	listSessions := func(url, accessToken string) []sessionInfo {
+		t.Helper()
+		resp := request(t, app, "GET", url, "", accessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200 em %s, recebeu %d", url, resp.StatusCode)
+		}
+		var res []sessionInfo
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		return res
+	}
+	refresh := func(tk token) *http.Response {
+		return request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, tk.RefreshToken), "")
+	}
+
+	laptop := loginDevice("laptop")
+	phone := loginDevice("phone")
+	var claims JwtClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(laptop.AccessToken, &claims); err != nil {
+		t.Fatalf("err on parse: %v", err.Error())
+	}
+	if claims.SessionID == "" {
+		t.Fatal("esperava sid no access token")
+	}
+
+	sessions := listSessions("/test/users/me/sessions", laptop.AccessToken)
+	if len(sessions) != 2 {
+		t.Fatalf("esperava 2 sessoes, recebeu %d", len(sessions))
+	}
+	var phoneID string
+	for _, session := range sessions {
+		if session.Current != (session.ID.String() == claims.SessionID) || session.Current != (session.Device == "laptop") {
+			t.Errorf("sessao atual inesperada: %+v", session)
+		}
+		if session.Device == "phone" {
+			phoneID = session.ID.String()
+		}
+	}
+
+	resp = request(t, app, "DELETE", "/test/users/me/sessions/"+phoneID, "", laptop.AccessToken)
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("esperava status 204 ao revogar sessao, recebeu %d", resp.StatusCode)
+	}
+	resp = request(t, app, "GET", "/test/users/me/sessions", "", phone.AccessToken)
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("access token da sessao revogada deveria ser negado, recebeu %d", resp.StatusCode)
+	}
+	if resp := refresh(phone); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("refresh da sessao revogada deveria falhar, recebeu %d", resp.StatusCode)
+	}
+
+	resp = refresh(laptop)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200 no refresh, recebeu %d", resp.StatusCode)
+	}
+	var rotated token
+	if err := json.NewDecoder(resp.Body).Decode(&rotated); err != nil {
+		t.Fatalf("err on decode: %v", err.Error())
+	}
+	sessions = listSessions("/test/users/me/sessions", rotated.AccessToken)
+	if len(sessions) != 1 || !sessions[0].Current || sessions[0].ID.String() != claims.SessionID {
+		t.Errorf("esperava apenas a sessao atual apos o refresh: %+v", sessions)
+	}
+
+	adminSessions := listSessions("/test/users/me/sessions", admin.AccessToken)
+	resp = request(t, app, "DELETE", "/test/users/me/sessions/"+adminSessions[0].ID.String(), "", rotated.AccessToken)
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("nao deveria revogar sessao de outro usuario, recebeu %d", resp.StatusCode)
+	}
+	resp = request(t, app, "DELETE", "/test/users/"+adminSessions[0].UserID.String()+"/sessions", "", rotated.AccessToken)
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("usuario sem update_user nao deveria revogar sessoes, recebeu %d", resp.StatusCode)
+	}
+
+	userSessions := "/test/users/" + user.ID.String() + "/sessions"
+	if sessions := listSessions(userSessions, admin.AccessToken); len(sessions) != 1 {
+		t.Fatalf("admin esperava 1 sessao do usuario, recebeu %d", len(sessions))
+	}
+	resp = request(t, app, "DELETE", userSessions+"/"+claims.SessionID, "", admin.AccessToken)
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("esperava status 204 na revogacao pelo admin, recebeu %d", resp.StatusCode)
+	}
+	if resp := refresh(rotated); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("refresh apos revogacao pelo admin deveria falhar, recebeu %d", resp.StatusCode)
+	}
+
+	loginDevice("tablet")
+	resp = request(t, app, "DELETE", userSessions, "", admin.AccessToken)
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("esperava status 204 ao revogar todas as sessoes, recebeu %d", resp.StatusCode)
+	}
+	if sessions := listSessions(userSessions, admin.AccessToken); len(sessions) != 0 {
+		t.Errorf("esperava nenhuma sessao ativa, recebeu %d", len(sessions))
+	}
+}
+
+func TestAuthPasswordPolicy(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:policy?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	mailer := gorote.NewMemoryMailer()
+	router, err := New(&Config{
+		DB:               db,
+		AppName:          "gorote",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+		Mailer:           mailer,
+		PublicURL:        "https://api.ralds.com.br/test",
+		PasswordResetURL: "https://app.ralds.com.br/reset",
+		PasswordPolicy: &gorote.PasswordPolicy{
+			MinLength:     10,
+			RequireUpper:  true,
+			RequireDigit:  true,
+			RequireSymbol: true,
+			Dictionary:    gorote.PasswordDictionary{"senhaforte#2025": {}},
+			History:       2,
+		},
+	})
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+
+	rejected := func(resp *http.Response) []string {
+		t.Helper()
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Fatalf("esperava status 400, recebeu %d", resp.StatusCode)
+		}
+		var res passwordRejected
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		var codes []string
+		for _, violation := range res.Violations {
+			codes = append(codes, violation.Code)
+		}
+		return codes
+	}
+	createUser := func(password string) *http.Response {
+		body := fmt.Sprintf(`{"email": "maria.souza@ralds.com.br", "first_name": "Maria", "password": "%s", "active": true}`, password)
+		return request(t, app, "POST", "/test/users", body, admin.AccessToken)
+	}
+
+	if codes := rejected(createUser("abc")); !slices.Equal(codes, []string{"min_length", "uppercase", "digit", "symbol"}) {
+		t.Errorf("violacoes inesperadas: %v", codes)
+	}
+	if codes := rejected(createUser("Maria.Souza#2025")); !slices.Equal(codes, []string{"banned_substring"}) {
+		t.Errorf("esperava recusa por conter o email: %v", codes)
+	}
+	if codes := rejected(createUser("Gorote#2025!")); !slices.Equal(codes, []string{"banned_substring"}) {
+		t.Errorf("esperava recusa por conter o nome da aplicacao: %v", codes)
+	}
+	if codes := rejected(createUser("SenhaForte#2025")); !slices.Equal(codes, []string{"common"}) {
+		t.Errorf("esperava recusa por senha comum: %v", codes)
+	}
+	if resp := createUser("Cavalo#Bateria9"); resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+
+	resetToken := func() string {
+		t.Helper()
+		router.mails.wait()
+		sent := len(mailer.Mails())
+		resp := request(t, app, "POST", "/test/auth/password/forgot", `{"email": "maria.souza@ralds.com.br"}`, "")
+		if resp.StatusCode != fiber.StatusAccepted {
+			t.Fatalf("esperava status 202, recebeu %d", resp.StatusCode)
+		}
+		mail := waitMail(t, mailer, sent, "maria.souza@ralds.com.br")
+		start := strings.Index(mail.Body, "https://app.ralds.com.br/reset?token=")
+		if start < 0 {
+			t.Fatalf("link de redefinicao nao encontrado: %s", mail.Body)
+		}
+		link, err := url.Parse(strings.Fields(mail.Body[start:])[0])
+		if err != nil {
+			t.Fatalf("err on parse: %v", err.Error())
+		}
+		return link.Query().Get("token")
+	}
+	reset := func(token, password string) *http.Response {
+		return request(t, app, "POST", "/test/auth/password/reset", fmt.Sprintf(`{"token": "%s", "password": "%s"}`, token, password), "")
+	}
+
+	token := resetToken()
+	if codes := rejected(reset(token, "Cavalo#Bateria9")); !slices.Equal(codes, []string{"reused"}) {
+		t.Errorf("esperava recusa da senha atual: %v", codes)
+	}
+	if codes := rejected(reset(token, "curta")); !slices.Equal(codes, []string{"min_length", "uppercase", "digit", "symbol"}) {
+		t.Errorf("violacoes inesperadas: %v", codes)
+	}
+	if resp := reset(token, "Girafa#Azul2025"); resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("token deveria continuar valido apos senha recusada, recebeu %d", resp.StatusCode)
+	}
+	token = resetToken()
+	if codes := rejected(reset(token, "Cavalo#Bateria9")); !slices.Equal(codes, []string{"reused"}) {
+		t.Errorf("esperava recusa de senha do historico: %v", codes)
+	}
+	if resp := reset(token, "Tucano#Verde77"); resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("esperava status 204, recebeu %d", resp.StatusCode)
+	}
+	token = resetToken()
+	if resp := reset(token, "Cavalo#Bateria9"); resp.StatusCode != fiber.StatusNoContent {
+		t.Errorf("senha fora do historico deveria ser aceita, recebeu %d", resp.StatusCode)
+	}
+	var history int64
+	db.Model(&PasswordHistory{}).Count(&history)
+	if history != 2 {
+		t.Errorf("esperava 2 senhas no historico, recebeu %d", history)
+	}
+}
+
+func TestAuthPasswordRehash(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:rehash?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	router, err := New(&Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+		PasswordPepper:   "pepper-do-servidor",
+	})
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	passwordOf := func(email string) User {
+		t.Helper()
+		var user User
+		if err := db.Where("email = ?", email).First(&user).Error; err != nil {
+			t.Fatalf("err on query user: %v", err.Error())
+		}
+		return user
+	}
+	if admin := passwordOf("admin@admin.com"); !strings.HasPrefix(admin.Password, "$argon2id$v=19$") || !strings.Contains(admin.Password, ",keyid=") {
+		t.Errorf("esperava hash argon2id com pepper: %s", admin.Password)
+	}
+
+	legacyHash, err := gorote.HashPassword("Senha@123")
+	if err != nil {
+		t.Fatalf("err on hash: %v", err.Error())
+	}
+	if err := db.Create(&User{Email: "legado@ralds.com.br", Password: legacyHash, Active: true}).Error; err != nil {
+		t.Fatalf("err on create user: %v", err.Error())
+	}
+	before := passwordOf("legado@ralds.com.br")
+	time.Sleep(time.Second)
+
+	session := loginAs(t, app, "legado@ralds.com.br", "Senha@123")
+	after := passwordOf("legado@ralds.com.br")
+	if !strings.HasPrefix(after.Password, "$argon2id$") || !strings.Contains(after.Password, ",keyid=") {
+		t.Fatalf("esperava rehash para argon2id no login: %s", after.Password)
+	}
+	if !after.UpdatedAt.Equal(before.UpdatedAt) {
+		t.Error("rehash nao deveria alterar updated_at")
+	}
+	resp := request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, session.RefreshToken), "")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("refresh deveria continuar valido apos o rehash, recebeu %d", resp.StatusCode)
+	}
+
+	loginAs(t, app, "legado@ralds.com.br", "Senha@123")
+	if again := passwordOf("legado@ralds.com.br"); again.Password != after.Password {
+		t.Error("hash atualizado nao deveria ser refeito")
+	}
+	resp = request(t, app, "POST", "/test/auth/login", `{"email": "legado@ralds.com.br", "password": "senha@123"}`, "")
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("esperava status 400 com senha errada, recebeu %d", resp.StatusCode)
+	}
+}
+
+func TestAuthPersonalTokens(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:personaltokens?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	newApp := func() *fiber.App {
+		t.Helper()
+		app := fiber.New(fiber.Config{AppName: "test"})
+		router, err := New(&Config{
+			DB:                       db,
+			AppName:                  "test",
+			SigningKey:               privateKey,
+			JwtExpireAccess:          time.Hour,
+			JwtExpireRefresh:         time.Hour * 24,
+			SuperEmail:               "admin@admin.com",
+			SuperPass:                "Senha@123",
+			PersonalTokenMaxLifetime: 90 * 24 * time.Hour,
+		})
+		if err != nil {
+			t.Fatalf("err on new auth: %v", err.Error())
+		}
+		router.RegisterRouter(app.Group("/test"))
+		return app
+	}
+	app := newApp()
+
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	createToken := func(accessToken, body string) personalTokenSecret {
+		t.Helper()
+		resp := request(t, app, "POST", "/test/users/me/tokens", body, accessToken)
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201 ao criar token, recebeu %d", resp.StatusCode)
+		}
+		var res personalTokenSecret
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		return res
+	}
+	tokenBody := func(name string, expiresAt time.Time, permissions ...string) string {
+		codes, _ := json.Marshal(permissions)
+		return fmt.Sprintf(`{"name": "%s", "permissions": %s, "expires_at": "%s"}`, name, codes, expiresAt.Format(time.RFC3339))
+	}
+
+	ci := createToken(admin.AccessToken, tokenBody("ci", time.Now().Add(30*24*time.Hour), "view_user"))
+	if ci.Token == "" {
+		t.Fatal("esperava o token na resposta de criacao")
+	}
+	var stored PersonalAccessToken
+	if err := db.Where("id = ?", ci.ID).First(&stored).Error; err != nil {
+		t.Fatalf("err on query token: %v", err.Error())
+	}
+	if stored.TokenHash != gorote.HashToken(ci.Token) {
+		t.Error("esperava apenas o hash do token no banco")
+	}
+
+	t.Run("Escopo reduzido", func(t *testing.T) {
+		resp := request(t, app, "GET", "/test/users?page=1&limit=10", "", "Bearer "+ci.Token)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("esperava status 200 com permissao do token, recebeu %d", resp.StatusCode)
+		}
+		body := `{"email": "pat@ralds.com.br", "password": "Senha@123", "active": true}`
+		resp = request(t, app, "POST", "/test/users", body, "Bearer "+ci.Token)
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("token de superusuario nao deveria passar do escopo, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "GET", "/test/users/me/tokens", "", "Bearer "+ci.Token)
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("token pessoal nao deveria acessar rotas sem permissao, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, ci.Token), "")
+		if resp.StatusCode == fiber.StatusOK {
+			t.Error("token pessoal nao deveria servir como refresh token")
+		}
+	})
+
+	t.Run("Validacao", func(t *testing.T) {
+		body := `{"email": "pat@ralds.com.br", "password": "Senha@123", "active": true}`
+		if resp := request(t, app, "POST", "/test/users", body, admin.AccessToken); resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+		}
+		user := loginAs(t, app, "pat@ralds.com.br", "Senha@123")
+		cases := map[string]string{
+			"permissao nao concedida": tokenBody("ci", time.Now().Add(time.Hour), "view_user"),
+			"sem permissoes":          tokenBody("ci", time.Now().Add(time.Hour)),
+			"expirado":                tokenBody("ci", time.Now().Add(-time.Hour), "view_user"),
+		}
+		for name, body := range cases {
+			if resp := request(t, app, "POST", "/test/users/me/tokens", body, user.AccessToken); resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("%s: esperava status 400, recebeu %d", name, resp.StatusCode)
+			}
+		}
+		body = tokenBody("ci", time.Now().Add(120*24*time.Hour), "view_user")
+		if resp := request(t, app, "POST", "/test/users/me/tokens", body, admin.AccessToken); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("esperava status 400 acima da validade maxima, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Escopo retirado do usuario", func(t *testing.T) {
+		var permission Permission
+		if err := db.Where("code = ?", PermissionViewUser).First(&permission).Error; err != nil {
+			t.Fatalf("err on query permission: %v", err.Error())
+		}
+		resp := request(t, app, "POST", "/test/roles", fmt.Sprintf(`{"name": "leitor", "permissions": ["%s"]}`, permission.ID), admin.AccessToken)
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+		}
+		var role Role
+		if err := json.NewDecoder(resp.Body).Decode(&role); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		body := fmt.Sprintf(`{"email": "leitor@ralds.com.br", "password": "Senha@123", "active": true, "roles": ["%s"]}`, role.ID)
+		if resp := request(t, app, "POST", "/test/users", body, admin.AccessToken); resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+		}
+		reader := loginAs(t, app, "leitor@ralds.com.br", "Senha@123")
+		pat := createToken(reader.AccessToken, tokenBody("relatorio", time.Now().Add(24*time.Hour), "view_user"))
+		if resp := request(t, app, "GET", "/test/users?page=1&limit=10", "", "Bearer "+pat.Token); resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200 com permissao do papel, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "POST", "/test/roles/"+role.ID.String()+"/deactivate", "", admin.AccessToken); resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200 ao desativar o papel, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "GET", "/test/users?page=1&limit=10", "", "Bearer "+pat.Token); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("token pessoal deveria perder a permissao retirada do usuario, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Listar e revogar", func(t *testing.T) {
+		resp := request(t, app, "GET", "/test/users/me/tokens", "", admin.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		raw, _ := io.ReadAll(resp.Body)
+		var tokens []PersonalAccessToken
+		if err := json.Unmarshal(raw, &tokens); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if len(tokens) != 1 || tokens[0].ID != ci.ID || len(tokens[0].Permissions) != 1 {
+			t.Fatalf("esperava apenas o token ci, recebeu %+v", tokens)
+		}
+		if strings.Contains(string(raw), ci.Token) {
+			t.Error("a listagem nao deveria expor o token")
+		}
+
+		url := "/test/users/me/tokens/" + ci.ID.String()
+		if resp := request(t, app, "DELETE", url, "", admin.AccessToken); resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("esperava status 204, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "GET", "/test/users?page=1&limit=10", "", "Bearer "+ci.Token); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("token revogado deveria ser recusado, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "DELETE", url, "", admin.AccessToken); resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("esperava status 404 ao revogar de novo, recebeu %d", resp.StatusCode)
+		}
+
+		restarted := newApp()
+		if resp := request(t, restarted, "GET", "/test/users?page=1&limit=10", "", "Bearer "+ci.Token); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("revogacao deveria sobreviver ao reinicio, recebeu %d", resp.StatusCode)
+		}
+		app = restarted
+	})
+
+	t.Run("Logout de todas as sessoes", func(t *testing.T) {
+		admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+		deploy := createToken(admin.AccessToken, tokenBody("deploy", time.Now().Add(24*time.Hour), "view_user"))
+		if resp := request(t, app, "POST", "/test/auth/logout/all", "", admin.AccessToken); resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("esperava logout de todas as sessoes, recebeu %d", resp.StatusCode)
+		}
+		var revoked PersonalAccessToken
+		if err := db.Where("id = ?", deploy.ID).First(&revoked).Error; err != nil {
+			t.Fatalf("err on query token: %v", err.Error())
+		}
+		if revoked.RevokedAt == nil {
+			t.Error("logout de todas as sessoes deveria revogar os tokens pessoais")
+		}
+	})
+}
+
+func TestAuthImpersonation(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:impersonation?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	router, err := New(&Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+	})
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	var permission Permission
+	if err := db.Where("code = ?", string(PermissionImpersonate)).First(&permission).Error; err != nil {
+		t.Fatalf("esperava a permissao %s: %v", PermissionImpersonate, err.Error())
+	}
+	support := Role{Name: "suporte", Permissions: []Permission{permission}}
+	if err := db.Create(&support).Error; err != nil {
+		t.Fatalf("err on create role: %v", err.Error())
+	}
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	createUser := func(email string, roles ...string) User {
+		t.Helper()
+		ids, _ := json.Marshal(roles)
+		body := fmt.Sprintf(`{"email": "%s", "password": "Senha@123", "active": true, "roles": %s}`, email, ids)
+		if resp := request(t, app, "POST", "/test/users", body, admin.AccessToken); resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+		}
+		var user User
+		if err := db.Where("email = ?", email).First(&user).Error; err != nil {
+			t.Fatalf("err on query user: %v", err.Error())
+		}
+		return user
+	}
+	customer := createUser("cliente@ralds.com.br")
+	supportUser := createUser("suporte@ralds.com.br", support.ID.String())
+	var superuser User
+	if err := db.Where("email = ?", "admin@admin.com").First(&superuser).Error; err != nil {
+		t.Fatalf("err on query user: %v", err.Error())
+	}
+
+	impersonate := func(accessToken string, userID uuid.UUID) *http.Response {
+		return request(t, app, "POST", "/test/auth/impersonate/"+userID.String(), "", accessToken)
+	}
+	resp := impersonate(admin.AccessToken, customer.ID)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+	}
+	var res oauthToken
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("err on decode: %v", err.Error())
+	}
+	if res.RefreshToken != "" || res.ExpiresIn != int(impersonationExpire.Seconds()) {
+		t.Errorf("esperava apenas access token de curta duracao: %+v", res)
+	}
+	var claims JwtClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(res.AccessToken, &claims); err != nil {
+		t.Fatalf("err on parse: %v", err.Error())
+	}
+	if claims.Subject != customer.ID.String() || claims.Actor == nil || claims.Actor.Subject != superuser.ID.String() {
+		t.Fatalf("esperava sub do cliente e act do admin: %+v", claims)
+	}
+	if claims.IsSuperUser || claims.ExpiresAt.Sub(claims.IssuedAt.Time) != impersonationExpire {
+		t.Errorf("claims inesperados no token de personificacao: %+v", claims)
+	}
+
+	t.Run("Rotas sensiveis", func(t *testing.T) {
+		if resp := request(t, app, "GET", "/test/userinfo", "", "Bearer "+res.AccessToken); resp.StatusCode != fiber.StatusOK {
+			t.Errorf("esperava status 200 no userinfo, recebeu %d", resp.StatusCode)
+		}
+		body := fmt.Sprintf(`{"name": "ci", "permissions": ["view_user"], "expires_at": "%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		if resp := request(t, app, "POST", "/test/users/me/tokens", body, "Bearer "+res.AccessToken); resp.StatusCode != fiber.StatusForbidden {
+			t.Errorf("esperava status 403 ao criar token personificando, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "POST", "/test/auth/mfa/enroll", "", "Bearer "+res.AccessToken); resp.StatusCode != fiber.StatusForbidden {
+			t.Errorf("esperava status 403 no mfa personificando, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Microservico", func(t *testing.T) {
+		keys := gorote.NewStaticKeySet(privateKey.Public())
+		service := fiber.New()
+		service.Get("/relatorios", gorote.JWTProtectedKeySet(&JwtClaims{}, keys, ProtectedRoute()), func(ctx *fiber.Ctx) error {
+			return ctx.SendStatus(fiber.StatusNoContent)
+		})
+		service.Delete("/relatorios", gorote.JWTProtectedKeySet(&JwtClaims{}, keys, ProtectedRoute(), NoImpersonation()), func(ctx *fiber.Ctx) error {
+			return ctx.SendStatus(fiber.StatusNoContent)
+		})
+		if resp := request(t, service, "GET", "/relatorios", "", "Bearer "+res.AccessToken); resp.StatusCode != fiber.StatusNoContent {
+			t.Errorf("esperava status 204 no microservico, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, service, "DELETE", "/relatorios", "", "Bearer "+res.AccessToken); resp.StatusCode != fiber.StatusForbidden {
+			t.Errorf("esperava status 403 no microservico, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, service, "GET", "/relatorios", "", admin.AccessToken); resp.StatusCode != fiber.StatusNoContent {
+			t.Errorf("esperava status 204 com token comum, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Permissao", func(t *testing.T) {
+		customerToken := loginAs(t, app, "cliente@ralds.com.br", "Senha@123")
+		if resp := impersonate(customerToken.AccessToken, superuser.ID); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava status 401 sem permissao, recebeu %d", resp.StatusCode)
+		}
+		supportToken := loginAs(t, app, "suporte@ralds.com.br", "Senha@123")
+		if resp := impersonate(supportToken.AccessToken, customer.ID); resp.StatusCode != fiber.StatusOK {
+			t.Errorf("esperava status 200 com impersonate_user, recebeu %d", resp.StatusCode)
+		}
+		if resp := impersonate(supportToken.AccessToken, superuser.ID); resp.StatusCode != fiber.StatusForbidden {
+			t.Errorf("suporte nao deveria personificar superusuario, recebeu %d", resp.StatusCode)
+		}
+		var viewUser Permission
+		if err := db.Where("code = ?", string(PermissionViewUser)).First(&viewUser).Error; err != nil {
+			t.Fatalf("err on query permission: %v", err.Error())
+		}
+		manager := Role{Name: "gerente", Permissions: []Permission{viewUser}}
+		if err := db.Create(&manager).Error; err != nil {
+			t.Fatalf("err on create role: %v", err.Error())
+		}
+		managerUser := createUser("gerente@ralds.com.br", manager.ID.String())
+		if resp := impersonate(supportToken.AccessToken, managerUser.ID); resp.StatusCode != fiber.StatusForbidden {
+			t.Errorf("suporte nao deveria personificar usuario com permissoes que nao tem, recebeu %d", resp.StatusCode)
+		}
+		peer := createUser("suporte2@ralds.com.br", support.ID.String())
+		if resp := impersonate(supportToken.AccessToken, peer.ID); resp.StatusCode != fiber.StatusOK {
+			t.Errorf("esperava status 200 com as mesmas permissoes, recebeu %d", resp.StatusCode)
+		}
+		if resp := impersonate(admin.AccessToken, managerUser.ID); resp.StatusCode != fiber.StatusOK {
+			t.Errorf("superusuario deveria personificar qualquer usuario comum, recebeu %d", resp.StatusCode)
+		}
+		if resp := impersonate(admin.AccessToken, uuid.New()); resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("esperava status 404, recebeu %d", resp.StatusCode)
+		}
+		resp := impersonate(admin.AccessToken, supportUser.ID)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		var chained oauthToken
+		if err := json.NewDecoder(resp.Body).Decode(&chained); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if resp := impersonate("Bearer "+chained.AccessToken, customer.ID); resp.StatusCode != fiber.StatusForbidden {
+			t.Errorf("esperava status 403 ao personificar em cadeia, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Registro", func(t *testing.T) {
+		var events []ImpersonationEvent
+		if err := db.Where("token_id = ?", claims.ID).Order("created_at").Find(&events).Error; err != nil {
+			t.Fatalf("err on query events: %v", err.Error())
+		}
+		var got []string
+		for _, event := range events {
+			if event.ActorID != superuser.ID || event.UserID != customer.ID {
+				t.Errorf("evento com ator ou usuario errado: %+v", event)
+			}
+			got = append(got, fmt.Sprintf("%s %s %d", event.Method, event.Path, event.Status))
+		}
+		slices.Sort(got)
+		want := []string{
+			"DELETE /relatorios 403",
+			"GET /relatorios 204",
+			"GET /test/userinfo 200",
+			"POST /test/auth/impersonate/" + customer.ID.String() + " 200",
+			"POST /test/auth/mfa/enroll 403",
+			"POST /test/users/me/tokens 403",
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("eventos esperados %v, recebeu %v", want, got)
+		}
+
+		url := fmt.Sprintf("/test/auth/impersonations?page=1&limit=10&actor_id=%s&user_id=%s", superuser.ID, customer.ID)
+		resp := request(t, app, "GET", url, "", admin.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		var list listImpersonationEvent
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if list.Total != uint(len(want)) {
+			t.Errorf("esperava %d eventos do admin, recebeu %d", len(want), list.Total)
+		}
+	})
+}
+
+func TestAuthIntrospection(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:introspection?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	router, err := New(&Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+	})
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	resp := request(t, app, "POST", "/test/clients", `{"name": "gateway"}`, admin.AccessToken)
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	var gateway serviceClientSecret
+	if err := json.NewDecoder(resp.Body).Decode(&gateway); err != nil {
+		t.Fatalf("err on decode: %v", err.Error())
+	}
+	introspectAs := func(clientSecret, token string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/test/oauth/introspect", strings.NewReader("token="+url.QueryEscape(token)))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(gateway.ClientID, clientSecret)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("err on test: %v", err.Error())
+		}
+		return resp
+	}
+	introspect := func(token string) introspection {
+		t.Helper()
+		resp := introspectAs(gateway.ClientSecret, token)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200 na introspeccao, recebeu %d", resp.StatusCode)
+		}
+		var res introspection
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		return res
+	}
+
+	if resp := introspectAs("errado", admin.AccessToken); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("esperava status 401 com segredo errado, recebeu %d", resp.StatusCode)
+	}
+
+	res := introspect(admin.AccessToken)
+	if !res.Active || res.Username != "admin@admin.com" || !res.IsSuperUser || res.TokenType != "Bearer" || res.Type != "access_token" {
+		t.Errorf("introspeccao inesperada do admin: %+v", res)
+	}
+	if res.SessionID == "" || res.Exp == 0 || res.Iat == 0 || res.Jti == "" || res.Iss != "test" {
+		t.Errorf("esperava os claims do token: %+v", res)
+	}
+	if res := introspect(admin.RefreshToken); res.Active {
+		t.Error("refresh token nao deveria ser ativo na introspeccao")
+	}
+	if res := introspect("nao.e.jwt"); res.Active || res.Sub != "" {
+		t.Errorf("token invalido deveria voltar apenas active false: %+v", res)
+	}
+
+	body := `{"email": "gateway@ralds.com.br", "password": "Senha@123", "active": true}`
+	if resp := request(t, app, "POST", "/test/users", body, admin.AccessToken); resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	var user User
+	if err := db.Where("email = ?", "gateway@ralds.com.br").First(&user).Error; err != nil {
+		t.Fatalf("err on query user: %v", err.Error())
+	}
+
+	t.Run("Revogado", func(t *testing.T) {
+		session := loginAs(t, app, "gateway@ralds.com.br", "Senha@123")
+		if !introspect(session.AccessToken).Active {
+			t.Fatal("esperava token ativo antes do logout")
+		}
+		if resp := request(t, app, "POST", "/test/auth/logout", "", session.AccessToken); resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("esperava logout, recebeu %d", resp.StatusCode)
+		}
+		if introspect(session.AccessToken).Active {
+			t.Error("token revogado deveria ser inativo")
+		}
+	})
+
+	t.Run("Usuario alterado", func(t *testing.T) {
+		session := loginAs(t, app, "gateway@ralds.com.br", "Senha@123")
+		time.Sleep(time.Second)
+		body := `{"first_name": "Gateway", "active": true}`
+		if resp := request(t, app, "PUT", "/test/users/"+user.ID.String(), body, admin.AccessToken); resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		if introspect(session.AccessToken).Active {
+			t.Error("token emitido antes da alteracao do usuario deveria ser inativo")
+		}
+	})
+
+	t.Run("Usuario inativo", func(t *testing.T) {
+		session := loginAs(t, app, "gateway@ralds.com.br", "Senha@123")
+		if err := db.Model(&User{}).Where("id = ?", user.ID).UpdateColumn("active", false).Error; err != nil {
+			t.Fatalf("err on update user: %v", err.Error())
+		}
+		if introspect(session.AccessToken).Active {
+			t.Error("token de usuario inativo deveria ser inativo")
+		}
+	})
+
+	t.Run("Token de maquina e pessoal", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/test/auth/token", strings.NewReader("grant_type=client_credentials"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(gateway.ClientID, gateway.ClientSecret)
+		resp, err := app.Test(req)
+		if err != nil || resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava token de maquina: %v", err)
+		}
+		var machine oauthToken
+		if err := json.NewDecoder(resp.Body).Decode(&machine); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if res := introspect(machine.AccessToken); !res.Active || !res.Machine || res.ClientID != gateway.ClientID {
+			t.Errorf("introspeccao inesperada do token de maquina: %+v", res)
+		}
+
+		body := fmt.Sprintf(`{"name": "ci", "permissions": ["view_user"], "expires_at": "%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		resp = request(t, app, "POST", "/test/users/me/tokens", body, admin.AccessToken)
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+		}
+		var pat personalTokenSecret
+		if err := json.NewDecoder(resp.Body).Decode(&pat); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if res := introspect(pat.Token); !res.Active || res.Scope != "view_user" || res.IsSuperUser {
+			t.Errorf("introspeccao inesperada do token pessoal: %+v", res)
+		}
+	})
+}
+
+func TestAuthMagicLink(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:magiclink?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	auth := Config{
+		DB:                       db,
+		AppName:                  "test",
+		SigningKey:               privateKey,
+		JwtExpireAccess:          time.Hour,
+		JwtExpireRefresh:         time.Hour * 24,
+		SuperEmail:               "admin@admin.com",
+		SuperPass:                "Senha@123",
+		Domain:                   "example.com",
+		RequireEmailVerification: true,
+		MagicLink:                true,
+		PublicURL:                "http://example.com/test",
+		MailTemplates: MailTemplates{
+			MagicLink: func(c MailContent) (string, string) {
+				return c.AppName + " - link de acesso", fmt.Sprintf("Acesse o link abaixo para entrar. Ele expira em %d minutos.\n\n%s\n", int(c.Expires.Minutes()), c.Link)
+			},
+		},
+	}
+	if _, err := New(&auth); err == nil {
+		t.Error("esperava erro sem mailer configurado")
+	}
+	mailer := gorote.NewMemoryMailer()
+	auth.Mailer = mailer
+	noURL := auth
+	noURL.PublicURL = ""
+	noURL.EmailVerificationURL = "https://app.ralds.com.br/verify"
+	if _, err := New(&noURL); err == nil {
+		t.Error("esperava erro sem MagicLinkURL nem PublicURL")
+	}
+	router, err := New(&auth)
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	body := `{"email": "magic@ralds.com.br", "password": "Senha@123", "active": true}`
+	if resp := request(t, app, "POST", "/test/users", body, admin.AccessToken); resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	router.mails.wait()
+	sent := len(mailer.Mails())
+
+	requestLink := func(email string) *url.URL {
+		t.Helper()
+		resp := request(t, app, "POST", "/test/auth/magic-link", fmt.Sprintf(`{"email": "%s"}`, email), "")
+		if resp.StatusCode != fiber.StatusAccepted {
+			t.Fatalf("esperava status 202, recebeu %d", resp.StatusCode)
+		}
+		router.mails.wait()
+		mail, ok := mailer.Last(email)
+		if !ok || !strings.Contains(mail.Subject, "link de acesso") {
+			t.Fatalf("email com link de acesso nao enviado para %s", email)
+		}
+		start := strings.Index(mail.Body, "http://example.com/test/auth/magic-link/callback?token=")
+		if start < 0 {
+			t.Fatalf("link de acesso nao encontrado: %s", mail.Body)
+		}
+		link, err := url.Parse(strings.Fields(mail.Body[start:])[0])
+		if err != nil {
+			t.Fatalf("err on parse: %v", err.Error())
+		}
+		return link
+	}
+
+	if resp := request(t, app, "POST", "/test/auth/magic-link", `{"email": "naoexiste@ralds.com.br"}`, ""); resp.StatusCode != fiber.StatusAccepted {
+		t.Errorf("esperava status 202 para email desconhecido, recebeu %d", resp.StatusCode)
+	}
+	router.mails.wait()
+	if len(mailer.Mails()) != sent {
+		t.Error("nao deveria enviar email para conta inexistente")
+	}
+	external := User{Email: "externo@ralds.com.br", Active: true, Provider: "corp"}
+	if err := db.Create(&external).Error; err != nil {
+		t.Fatalf("err on create user: %v", err.Error())
+	}
+	if resp := request(t, app, "POST", "/test/auth/magic-link", `{"email": "externo@ralds.com.br"}`, ""); resp.StatusCode != fiber.StatusAccepted {
+		t.Errorf("esperava status 202 para usuario externo, recebeu %d", resp.StatusCode)
+	}
+	router.mails.wait()
+	if len(mailer.Mails()) != sent {
+		t.Error("nao deveria enviar link de acesso para usuario de provedor externo")
+	}
+	redeem := func(token string) *http.Response {
+		return request(t, app, "POST", "/test/auth/magic-link/callback", fmt.Sprintf(`{"token": "%s"}`, token), "")
+	}
+
+	link := requestLink("magic@ralds.com.br")
+	resp := request(t, app, "GET", link.RequestURI()+"&device=notebook", "", "")
+	if resp.StatusCode != fiber.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("esperava pagina do link de acesso, recebeu %d", resp.StatusCode)
+	}
+	var csrf *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "magic_link_csrf" {
+			csrf = cookie
+		}
+	}
+	if csrf == nil || csrf.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("esperava cookie magic_link_csrf SameSite=Strict: %+v", csrf)
+	}
+	form := url.Values{"token": {link.Query().Get("token")}, "device": {"notebook"}}
+	post := func(form url.Values, cookie *http.Cookie) *http.Response {
+		req := httptest.NewRequest("POST", "/test/auth/magic-link/callback", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("err on test: %v", err.Error())
+		}
+		return resp
+	}
+	if resp := post(form, nil); resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("formulario de outro site deveria ser recusado, recebeu %d", resp.StatusCode)
+	}
+	form.Set("csrf_token", csrf.Value)
+	resp = post(form, csrf)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200 no callback, recebeu %d", resp.StatusCode)
+	}
+	var tk token
+	if err := json.NewDecoder(resp.Body).Decode(&tk); err != nil {
+		t.Fatalf("err on decode: %v", err.Error())
+	}
+	if tk.AccessToken == "" || tk.RefreshToken == "" || tk.IDToken == "" {
+		t.Errorf("esperava o mesmo par de tokens do login: %+v", tk)
+	}
+	cookies := map[string]bool{}
+	for _, cookie := range resp.Cookies() {
+		cookies[cookie.Name] = cookie.Value != ""
+	}
+	if !cookies["access_token"] || !cookies["refresh_token"] {
+		t.Errorf("esperava cookies de access e refresh token, recebeu %v", cookies)
+	}
+	var claims JwtClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tk.AccessToken, &claims); err != nil {
+		t.Fatalf("err on parse: %v", err.Error())
+	}
+	if !claims.EmailVerified {
+		t.Error("o link de acesso deveria confirmar o email")
+	}
+	var session Session
+	if err := db.Where("id = ?", claims.SessionID).First(&session).Error; err != nil || session.Device != "notebook" {
+		t.Errorf("esperava sessao do dispositivo notebook: %+v", session)
+	}
+	if resp := request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, tk.RefreshToken), ""); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("esperava refresh valido, recebeu %d", resp.StatusCode)
+	}
+
+	if resp := redeem(link.Query().Get("token")); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("link reutilizado deveria ser recusado, recebeu %d", resp.StatusCode)
+	}
+	expired := requestLink("magic@ralds.com.br")
+	if err := db.Model(&UserToken{}).
+		Where("token_hash = ?", gorote.HashToken(expired.Query().Get("token"))).
+		Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatalf("err on update token: %v", err.Error())
+	}
+	if resp := redeem(expired.Query().Get("token")); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("link expirado deveria ser recusado, recebeu %d", resp.StatusCode)
+	}
+
+	var events []LoginEvent
+	if err := db.Where("kind = ?", "magic_link").Find(&events).Error; err != nil {
+		t.Fatalf("err on query events: %v", err.Error())
+	}
+	outcomes := map[string]int{}
+	for _, event := range events {
+		outcomes[event.Outcome+":"+event.Reason]++
+	}
+	if outcomes["success:"] != 1 || outcomes["failure:invalid_token"] != 2 {
+		t.Errorf("eventos de auditoria inesperados: %v", outcomes)
+	}
+
+	disabled := fiber.New(fiber.Config{AppName: "test"})
+	auth.MagicLink = false
+	router, err = New(&auth)
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(disabled.Group("/test"))
+	if resp := request(t, disabled, "POST", "/test/auth/magic-link", `{"email": "magic@ralds.com.br"}`, ""); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("esperava status 404 com link de acesso desabilitado, recebeu %d", resp.StatusCode)
+	}
+}
+
+func TestAuthRoles(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:roles?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	auth := Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+	}
+	router, err := New(&auth)
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	permissionID := func(code PermissionCode) string {
+		t.Helper()
+		var permission Permission
+		if err := db.Where("code = ?", string(code)).First(&permission).Error; err != nil {
+			t.Fatalf("err on query permission: %v", err.Error())
+		}
+		return permission.ID.String()
+	}
+	decodeRole := func(resp *http.Response) Role {
+		t.Helper()
+		var role Role
+		if err := json.NewDecoder(resp.Body).Decode(&role); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		return role
+	}
+	codes := func(role Role) []string {
+		var codes []string
+		for _, permission := range role.Permissions {
+			codes = append(codes, permission.Code)
+		}
+		return codes
+	}
+	permissions := func(accessToken string) []string {
+		t.Helper()
+		var claims JwtClaims
+		if _, _, err := jwt.NewParser().ParseUnverified(accessToken, &claims); err != nil {
+			t.Fatalf("err on parse: %v", err.Error())
+		}
+		return claims.Permissions
+	}
+
+	body := fmt.Sprintf(`{"name": "suporte", "permissions": ["%s"]}`, permissionID(PermissionViewUser))
+	resp := request(t, app, "POST", "/test/roles", body, admin.AccessToken)
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	role := decodeRole(resp)
+	roleURL := "/test/roles/" + role.ID.String()
+	if resp := request(t, app, "POST", "/test/roles", `{"name": "outro"}`, admin.AccessToken); resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	body = fmt.Sprintf(`{"email": "suporte@ralds.com.br", "password": "Senha@123", "active": true, "roles": ["%s"]}`, role.ID)
+	if resp := request(t, app, "POST", "/test/users", body, admin.AccessToken); resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	support := loginAs(t, app, "suporte@ralds.com.br", "Senha@123")
+	if !slices.Contains(permissions(support.AccessToken), string(PermissionViewUser)) {
+		t.Fatal("esperava permissao do papel no token")
+	}
+
+	t.Run("Consultar papel", func(t *testing.T) {
+		resp := request(t, app, "GET", roleURL, "", admin.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		if got := decodeRole(resp); got.Name != "suporte" || !slices.Equal(codes(got), []string{string(PermissionViewUser)}) {
+			t.Errorf("papel inesperado: %+v", got)
+		}
+		if resp := request(t, app, "GET", "/test/roles/"+uuid.NewString(), "", admin.AccessToken); resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("esperava status 404, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "GET", roleURL, "", support.AccessToken); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava status 401 sem view_role, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "PATCH", roleURL, `{"description": "x"}`, support.AccessToken); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("esperava status 401 sem update_role, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Renomear papel", func(t *testing.T) {
+		session := loginAs(t, app, "suporte@ralds.com.br", "Senha@123")
+		body := fmt.Sprintf(`{"name": "ci", "permissions": ["%s"], "expires_at": "%s"}`, PermissionViewUser, time.Now().Add(time.Hour).Format(time.RFC3339))
+		resp := request(t, app, "POST", "/test/users/me/tokens", body, session.AccessToken)
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201 ao criar token, recebeu %d", resp.StatusCode)
+		}
+		var ci personalTokenSecret
+		if err := json.NewDecoder(resp.Body).Decode(&ci); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		resp = request(t, app, "POST", "/test/clients", fmt.Sprintf(`{"name": "relatorios", "roles": ["%s"]}`, role.ID), admin.AccessToken)
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201 ao criar cliente, recebeu %d", resp.StatusCode)
+		}
+		var client serviceClientSecret
+		if err := json.NewDecoder(resp.Body).Decode(&client); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		oauth := func(path, form string) *http.Response {
+			t.Helper()
+			req := httptest.NewRequest("POST", path, strings.NewReader(form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(client.ClientID, client.ClientSecret)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("err on test: %v", err.Error())
+			}
+			return resp
+		}
+		resp = oauth("/test/auth/token", "grant_type=client_credentials")
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava token de maquina, recebeu %d", resp.StatusCode)
+		}
+		var machine oauthToken
+		if err := json.NewDecoder(resp.Body).Decode(&machine); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		time.Sleep(time.Second)
+		resp = request(t, app, "PUT", roleURL, `{"name": "atendimento", "description": "Time de atendimento"}`, admin.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		if got := decodeRole(resp); got.Name != "atendimento" || got.Description != "Time de atendimento" || len(got.Permissions) != 1 {
+			t.Errorf("papel inesperado: %+v", got)
+		}
+		if resp := request(t, app, "GET", "/test/users?page=1&limit=10", "", session.AccessToken); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("access token da sessao deveria ser revogado com a alteracao do papel, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "GET", "/test/users?page=1&limit=10", "", "Bearer "+ci.Token); resp.StatusCode != fiber.StatusOK {
+			t.Errorf("token pessoal com escopo ainda concedido deveria sobreviver a alteracao do papel, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, session.RefreshToken), "")
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("refresh emitido antes da alteracao do papel deveria ser recusado, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "GET", "/test/users?page=1&limit=10", "", "Bearer "+machine.AccessToken); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("token de maquina deveria ser revogado com a alteracao do papel, recebeu %d", resp.StatusCode)
+		}
+		var res introspection
+		if err := json.NewDecoder(oauth("/test/oauth/introspect", "token="+url.QueryEscape(machine.AccessToken)).Body).Decode(&res); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if res.Active {
+			t.Error("introspeccao deveria reportar inativo o token de maquina emitido antes da alteracao do papel")
+		}
+
+		if resp := request(t, app, "PUT", roleURL, `{"name": "outro"}`, admin.AccessToken); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("esperava status 400 com nome repetido, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "PATCH", roleURL, `{"require_mfa": false}`, admin.AccessToken)
+		if got := decodeRole(resp); resp.StatusCode != fiber.StatusOK || got.Name != "atendimento" || got.Description != "Time de atendimento" {
+			t.Errorf("patch nao deveria alterar outros campos: %d %+v", resp.StatusCode, got)
+		}
+		resp = request(t, app, "PATCH", roleURL, `{"require_mfa": true}`, admin.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		resp = request(t, app, "PUT", roleURL, `{"name": "atendimento", "description": "Time de atendimento"}`, admin.AccessToken)
+		if got := decodeRole(resp); resp.StatusCode != fiber.StatusOK || !got.RequireMFA {
+			t.Errorf("put sem require_mfa deveria manter o MFA do papel: %d %+v", resp.StatusCode, got)
+		}
+		resp = request(t, app, "PUT", roleURL, `{"name": "atendimento", "description": "Time de atendimento", "require_mfa": false}`, admin.AccessToken)
+		if got := decodeRole(resp); resp.StatusCode != fiber.StatusOK || got.RequireMFA {
+			t.Errorf("put com require_mfa falso deveria desligar o MFA do papel: %d %+v", resp.StatusCode, got)
+		}
+	})
+
+	t.Run("Permissoes do papel", func(t *testing.T) {
+		body := fmt.Sprintf(`{"permissions": ["%s", "%s"]}`, permissionID(PermissionCreateUser), permissionID(PermissionViewUser))
+		resp := request(t, app, "POST", roleURL+"/permissions", body, admin.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		if got := codes(decodeRole(resp)); len(got) != 2 || !slices.Contains(got, string(PermissionCreateUser)) {
+			t.Errorf("permissoes inesperadas: %v", got)
+		}
+		body = fmt.Sprintf(`{"permissions": ["%s"]}`, uuid.NewString())
+		if resp := request(t, app, "POST", roleURL+"/permissions", body, admin.AccessToken); resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("esperava status 404 para permissao inexistente, recebeu %d", resp.StatusCode)
+		}
+		session := loginAs(t, app, "suporte@ralds.com.br", "Senha@123")
+		if !slices.Contains(permissions(session.AccessToken), string(PermissionCreateUser)) {
+			t.Error("esperava permissao adicionada no token")
+		}
+
+		resp = request(t, app, "DELETE", roleURL+"/permissions/"+permissionID(PermissionCreateUser), "", admin.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		if got := codes(decodeRole(resp)); slices.Contains(got, string(PermissionCreateUser)) {
+			t.Errorf("permissao removida ainda presente: %v", got)
+		}
+		if resp := request(t, app, "DELETE", roleURL+"/permissions/"+permissionID(PermissionCreateUser), "", admin.AccessToken); resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("esperava status 404, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Ativacao do papel", func(t *testing.T) {
+		time.Sleep(time.Second)
+		issued := loginAs(t, app, "suporte@ralds.com.br", "Senha@123")
+		if resp := request(t, app, "GET", "/test/users?page=1&limit=10", "", issued.AccessToken); resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200 antes de desativar o papel, recebeu %d", resp.StatusCode)
+		}
+		resp := request(t, app, "POST", roleURL+"/deactivate", "", admin.AccessToken)
+		if got := decodeRole(resp); resp.StatusCode != fiber.StatusOK || got.Active {
+			t.Fatalf("esperava papel inativo: %d %+v", resp.StatusCode, got)
+		}
+		if resp := request(t, app, "GET", "/test/users?page=1&limit=10", "", issued.AccessToken); resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("access token emitido antes da mudanca do papel deveria ser revogado, recebeu %d", resp.StatusCode)
+		}
+		session := loginAs(t, app, "suporte@ralds.com.br", "Senha@123")
+		if len(permissions(session.AccessToken)) != 0 {
+			t.Errorf("papel inativo nao deveria conceder permissoes: %v", permissions(session.AccessToken))
+		}
+		resp = request(t, app, "POST", roleURL+"/activate", "", admin.AccessToken)
+		if got := decodeRole(resp); resp.StatusCode != fiber.StatusOK || !got.Active {
+			t.Fatalf("esperava papel ativo: %d %+v", resp.StatusCode, got)
+		}
+		session = loginAs(t, app, "suporte@ralds.com.br", "Senha@123")
+		if !slices.Contains(permissions(session.AccessToken), string(PermissionViewUser)) {
+			t.Error("papel reativado deveria conceder permissoes")
+		}
+	})
+
+	t.Run("Excluir papel", func(t *testing.T) {
+		if resp := request(t, app, "DELETE", roleURL, "", admin.AccessToken); resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("esperava status 204, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "GET", roleURL, "", admin.AccessToken); resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("esperava status 404 apos exclusao, recebeu %d", resp.StatusCode)
+		}
+		var deleted Role
+		if err := db.Unscoped().First(&deleted, "id = ?", role.ID).Error; err != nil || !deleted.DeletedAt.Valid {
+			t.Errorf("esperava exclusao logica do papel")
+		}
+		var holders int64
+		if err := db.Table("users_roles").Where("role_id = ?", role.ID).Count(&holders).Error; err != nil || holders != 0 {
+			t.Errorf("esperava usuarios desvinculados, restam %d", holders)
+		}
+		session := loginAs(t, app, "suporte@ralds.com.br", "Senha@123")
+		if len(permissions(session.AccessToken)) != 0 {
+			t.Errorf("papel excluido nao deveria conceder permissoes: %v", permissions(session.AccessToken))
+		}
+	})
+}
+
+func TestAuthPermissions(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:permissions?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	auth := Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+	}
+	router, err := New(&auth)
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	decodePermission := func(resp *http.Response) Permission {
+		t.Helper()
+		var permission Permission
+		if err := json.NewDecoder(resp.Body).Decode(&permission); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		return permission
+	}
+	permissions := func(accessToken string) []string {
+		t.Helper()
+		var claims JwtClaims
+		if _, _, err := jwt.NewParser().ParseUnverified(accessToken, &claims); err != nil {
+			t.Fatalf("err on parse: %v", err.Error())
+		}
+		return claims.Permissions
+	}
+
+	resp := request(t, app, "POST", "/test/permissions", `{"code": "view_report", "description": "Ver relatorios"}`, admin.AccessToken)
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	report := decodePermission(resp)
+	if report.Code != "view_report" || !report.Active {
+		t.Errorf("permissao inesperada: %+v", report)
+	}
+	reportURL := "/test/permissions/" + report.ID.String()
+	for _, body := range []string{`{"code": "view-report"}`, `{"code": "ver relatorio"}`, `{"code": ""}`, `{"code": "view_report"}`} {
+		if resp := request(t, app, "POST", "/test/permissions", body, admin.AccessToken); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("esperava status 400 para %s, recebeu %d", body, resp.StatusCode)
+		}
+	}
+
+	body := fmt.Sprintf(`{"name": "relatorios", "permissions": ["%s"]}`, report.ID)
+	resp = request(t, app, "POST", "/test/roles", body, admin.AccessToken)
+	var role Role
+	if err := json.NewDecoder(resp.Body).Decode(&role); err != nil {
+		t.Fatalf("err on decode: %v", err.Error())
+	}
+	body = fmt.Sprintf(`{"email": "analista@ralds.com.br", "password": "Senha@123", "active": true, "roles": ["%s"]}`, role.ID)
+	if resp := request(t, app, "POST", "/test/users", body, admin.AccessToken); resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	analyst := loginAs(t, app, "analista@ralds.com.br", "Senha@123")
+	if !slices.Contains(permissions(analyst.AccessToken), "view_report") {
+		t.Fatal("esperava permissao customizada no token")
+	}
+	if resp := request(t, app, "POST", "/test/permissions", `{"code": "outra"}`, analyst.AccessToken); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("esperava status 401 sem create_permission, recebeu %d", resp.StatusCode)
+	}
+
+	t.Run("Editar permissao", func(t *testing.T) {
+		resp := request(t, app, "PUT", reportURL, `{"description": "Relatorios gerenciais"}`, admin.AccessToken)
+		if got := decodePermission(resp); resp.StatusCode != fiber.StatusOK || got.Description != "Relatorios gerenciais" || got.Code != "view_report" {
+			t.Errorf("edicao inesperada: %d %+v", resp.StatusCode, got)
+		}
+		resp = request(t, app, "GET", reportURL, "", admin.AccessToken)
+		if got := decodePermission(resp); resp.StatusCode != fiber.StatusOK || got.Description != "Relatorios gerenciais" {
+			t.Errorf("consulta inesperada: %d %+v", resp.StatusCode, got)
+		}
+		if resp := request(t, app, "GET", "/test/permissions/"+uuid.NewString(), "", admin.AccessToken); resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("esperava status 404, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Ativacao da permissao", func(t *testing.T) {
+		session := loginAs(t, app, "analista@ralds.com.br", "Senha@123")
+		time.Sleep(time.Second)
+		resp := request(t, app, "POST", reportURL+"/deactivate", "", admin.AccessToken)
+		if got := decodePermission(resp); resp.StatusCode != fiber.StatusOK || got.Active {
+			t.Fatalf("esperava permissao inativa: %d %+v", resp.StatusCode, got)
+		}
+		resp = request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, session.RefreshToken), "")
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("refresh emitido antes da desativacao deveria ser recusado, recebeu %d", resp.StatusCode)
+		}
+		session = loginAs(t, app, "analista@ralds.com.br", "Senha@123")
+		if slices.Contains(permissions(session.AccessToken), "view_report") {
+			t.Error("permissao inativa nao deveria estar no token")
+		}
+		if resp := request(t, app, "POST", reportURL+"/activate", "", admin.AccessToken); resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		session = loginAs(t, app, "analista@ralds.com.br", "Senha@123")
+		if !slices.Contains(permissions(session.AccessToken), "view_report") {
+			t.Error("permissao reativada deveria estar no token")
+		}
+	})
+
+	t.Run("Permissoes do sistema", func(t *testing.T) {
+		var system Permission
+		if err := db.Where("code = ?", string(PermissionAdmin)).First(&system).Error; err != nil {
+			t.Fatalf("err on query permission: %v", err.Error())
+		}
+		if resp := request(t, app, "POST", "/test/permissions/"+system.ID.String()+"/deactivate", "", admin.AccessToken); resp.StatusCode != fiber.StatusForbidden {
+			t.Errorf("esperava status 403 ao desativar permissao do sistema, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "DELETE", "/test/permissions/"+system.ID.String(), "", admin.AccessToken); resp.StatusCode != fiber.StatusForbidden {
+			t.Errorf("esperava status 403 ao excluir permissao do sistema, recebeu %d", resp.StatusCode)
+		}
+		resp := request(t, app, "PUT", "/test/permissions/"+system.ID.String(), `{"description": "Administrador"}`, admin.AccessToken)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("descricao da permissao do sistema deveria ser editavel, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Excluir permissao", func(t *testing.T) {
+		if resp := request(t, app, "DELETE", reportURL, "", admin.AccessToken); resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("esperava status 204, recebeu %d", resp.StatusCode)
+		}
+		if resp := request(t, app, "GET", reportURL, "", admin.AccessToken); resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("esperava status 404 apos exclusao, recebeu %d", resp.StatusCode)
+		}
+		var granted int64
+		if err := db.Table("roles_permissions").Where("permission_id = ?", report.ID).Count(&granted).Error; err != nil || granted != 0 {
+			t.Errorf("esperava papeis desvinculados, restam %d", granted)
+		}
+		if resp := request(t, app, "POST", "/test/permissions", `{"code": "view_report"}`, admin.AccessToken); resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("codigo excluido nao deveria ser reutilizado, recebeu %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestAuthPermissionRegistry(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:permission_registry?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	newApp := func() (*fiber.App, error) {
+		app := fiber.New(fiber.Config{AppName: "test"})
+		router, err := New(&Config{
+			DB:               db,
+			AppName:          "test",
+			SigningKey:       privateKey,
+			JwtExpireAccess:  time.Hour,
+			JwtExpireRefresh: time.Hour * 24,
+			SuperEmail:       "admin@admin.com",
+			SuperPass:        "Senha@123",
+		})
+		if err != nil {
+			return nil, err
+		}
+		router.RegisterRouter(app.Group("/test"))
+		return app, nil
+	}
+	permission := func(code string) Permission {
+		t.Helper()
+		var permission Permission
+		if err := db.Unscoped().Where("code = ?", code).First(&permission).Error; err != nil {
+			t.Fatalf("err on query permission %s: %v", code, err.Error())
+		}
+		return permission
+	}
+	viewReport := PermissionDef{Code: "view_report", Description: "Ver relatorios", Group: "relatorios"}
+	exportReport := PermissionDef{Code: "export_report", Description: "Exportar relatorios", Group: "relatorios"}
+	RegisterPermissions("relatorios", viewReport, exportReport)
+	t.Cleanup(func() { RegisterPermissions("relatorios") })
+
+	app, err := newApp()
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	report := permission("view_report")
+	if report.Module != "relatorios" || report.Group != "relatorios" || report.Description != "Ver relatorios" || !report.Active || report.Orphaned {
+		t.Errorf("permissao registrada inesperada: %+v", report)
+	}
+	if core := permission(string(PermissionAdmin)); core.Module != "core" || core.Group != "admin" {
+		t.Errorf("permissao do core inesperada: %+v", core)
+	}
+	reportURL := "/test/permissions/" + report.ID.String()
+	if resp := request(t, app, "DELETE", reportURL, "", admin.AccessToken); resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("esperava status 403 ao excluir permissao registrada, recebeu %d", resp.StatusCode)
+	}
+	if resp := request(t, app, "PUT", reportURL, `{"description": "Relatorios gerenciais"}`, admin.AccessToken); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("esperava status 200, recebeu %d", resp.StatusCode)
+	}
+
+	t.Run("Registro idempotente", func(t *testing.T) {
+		if _, err := newApp(); err != nil {
+			t.Fatalf("err on new auth: %v", err.Error())
+		}
+		var count int64
+		if err := db.Unscoped().Model(&Permission{}).Where("code = ?", "view_report").Count(&count).Error; err != nil || count != 1 {
+			t.Errorf("esperava uma permissao view_report, encontrou %d", count)
+		}
+		if got := permission("view_report"); got.ID != report.ID || got.Description != "Relatorios gerenciais" {
+			t.Errorf("descricao editada deveria ser mantida: %+v", got)
+		}
+	})
+
+	t.Run("Permissao orfa", func(t *testing.T) {
+		RegisterPermissions("relatorios", viewReport)
+		if _, err := newApp(); err != nil {
+			t.Fatalf("err on new auth: %v", err.Error())
+		}
+		orphan := permission("export_report")
+		if !orphan.Orphaned {
+			t.Fatalf("esperava permissao orfa: %+v", orphan)
+		}
+		if permission("view_report").Orphaned {
+			t.Error("permissao ainda registrada nao deveria ser orfa")
+		}
+		resp := request(t, app, "GET", "/test/permissions/"+orphan.ID.String(), "", admin.AccessToken)
+		var got Permission
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || !got.Orphaned {
+			t.Errorf("esperava permissao orfa na api: %+v", got)
+		}
+		if resp := request(t, app, "DELETE", "/test/permissions/"+orphan.ID.String(), "", admin.AccessToken); resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("esperava status 204 ao excluir permissao orfa, recebeu %d", resp.StatusCode)
+		}
+
+		RegisterPermissions("relatorios", viewReport, exportReport)
+		if _, err := newApp(); err != nil {
+			t.Fatalf("err on new auth: %v", err.Error())
+		}
+		restored := permission("export_report")
+		if restored.ID != orphan.ID || restored.DeletedAt.Valid || restored.Orphaned || !restored.Active {
+			t.Errorf("permissao registrada de novo deveria ser restaurada: %+v", restored)
+		}
+	})
+
+	t.Run("Registro invalido", func(t *testing.T) {
+		t.Cleanup(func() { RegisterPermissions("invalido") })
+		RegisterPermissions("invalido", PermissionDef{Code: "ver-relatorio"})
+		if _, err := newApp(); err == nil {
+			t.Error("esperava erro para codigo invalido")
+		}
+		RegisterPermissions("invalido", PermissionDef{Code: "view_report"})
+		if _, err := newApp(); err == nil {
+			t.Error("esperava erro para codigo registrado por dois modulos")
+		}
+	})
+}
+
+func TestAuthRoleHierarchy(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:role_hierarchy?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	auth := Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+	}
+	router, err := New(&auth)
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+
+	admin := loginAs(t, app, "admin@admin.com", "Senha@123")
+	permissionID := func(code PermissionCode) string {
+		t.Helper()
+		var permission Permission
+		if err := db.Where("code = ?", string(code)).First(&permission).Error; err != nil {
+			t.Fatalf("err on query permission: %v", err.Error())
+		}
+		return permission.ID.String()
+	}
+	decodeRole := func(resp *http.Response) Role {
+		t.Helper()
+		var role Role
+		if err := json.NewDecoder(resp.Body).Decode(&role); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		return role
+	}
+	codes := func(permissions []Permission) []string {
+		var codes []string
+		for _, permission := range permissions {
+			codes = append(codes, permission.Code)
+		}
+		return codes
+	}
+	permissions := func(accessToken string) []string {
+		t.Helper()
+		var claims JwtClaims
+		if _, _, err := jwt.NewParser().ParseUnverified(accessToken, &claims); err != nil {
+			t.Fatalf("err on parse: %v", err.Error())
+		}
+		return claims.Permissions
+	}
+	createRole := func(name string, permission PermissionCode, parents ...Role) Role {
+		t.Helper()
+		var ids []string
+		for _, parent := range parents {
+			ids = append(ids, `"`+parent.ID.String()+`"`)
+		}
+		body := fmt.Sprintf(`{"name": "%s", "permissions": ["%s"], "parents": [%s]}`, name, permissionID(permission), strings.Join(ids, ","))
+		resp := request(t, app, "POST", "/test/roles", body, admin.AccessToken)
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+		}
+		return decodeRole(resp)
+	}
+
+	viewer := createRole("leitor", PermissionViewUser)
+	editor := createRole("editor", PermissionCreateUser, viewer)
+	manager := createRole("gestor", PermissionUpdateUser, editor)
+	body := fmt.Sprintf(`{"email": "gestor@ralds.com.br", "password": "Senha@123", "active": true, "roles": ["%s"]}`, manager.ID)
+	if resp := request(t, app, "POST", "/test/users", body, admin.AccessToken); resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("esperava status 201, recebeu %d", resp.StatusCode)
+	}
+	var user User
+	if err := db.Where("email = ?", "gestor@ralds.com.br").First(&user).Error; err != nil {
+		t.Fatalf("err on query user: %v", err.Error())
+	}
+	body = fmt.Sprintf(`{"active": true, "roles": ["%s"]}`, manager.ID)
+	resp := request(t, app, "PUT", "/test/users/"+user.ID.String(), body, admin.AccessToken)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		t.Fatalf("err on decode: %v", err.Error())
+	}
+	if len(user.Roles) != 1 || len(user.Roles[0].Parents) != 1 || user.Roles[0].Parents[0].ID != editor.ID {
+		t.Errorf("esperava papel com o pai na resposta: %+v", user.Roles)
+	}
+	session := loginAs(t, app, "gestor@ralds.com.br", "Senha@123")
+	want := []string{string(PermissionCreateUser), string(PermissionUpdateUser), string(PermissionViewUser)}
+	if got := permissions(session.AccessToken); !slices.Equal(got, want) {
+		t.Fatalf("esperava permissoes herdadas %v, recebeu %v", want, got)
+	}
+
+	t.Run("Permissoes diretas e efetivas", func(t *testing.T) {
+		resp := request(t, app, "GET", "/test/roles/"+editor.ID.String(), "", admin.AccessToken)
+		role := decodeRole(resp)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		if got := codes(role.Permissions); !slices.Equal(got, []string{string(PermissionCreateUser)}) {
+			t.Errorf("permissoes diretas inesperadas: %v", got)
+		}
+		if got := codes(role.EffectivePermissions); !slices.Equal(got, []string{string(PermissionCreateUser), string(PermissionViewUser)}) {
+			t.Errorf("permissoes efetivas inesperadas: %v", got)
+		}
+		if len(role.Parents) != 1 || role.Parents[0].ID != viewer.ID {
+			t.Errorf("papel pai inesperado: %+v", role.Parents)
+		}
+		resp = request(t, app, "GET", "/test/roles?page=1&limit=100", "", admin.AccessToken)
+		var list listRole
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		index := slices.IndexFunc(list.Data, func(r Role) bool { return r.ID == manager.ID })
+		if index < 0 || len(list.Data[index].EffectivePermissions) != 3 {
+			t.Errorf("esperava permissoes efetivas na listagem: %+v", list.Data)
+		}
+	})
+
+	t.Run("Ciclos", func(t *testing.T) {
+		for _, parent := range []Role{viewer, manager} {
+			body := fmt.Sprintf(`{"parents": ["%s"]}`, parent.ID)
+			if resp := request(t, app, "POST", "/test/roles/"+viewer.ID.String()+"/parents", body, admin.AccessToken); resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("esperava status 400 para ciclo com %s, recebeu %d", parent.Name, resp.StatusCode)
+			}
+		}
+		body := fmt.Sprintf(`{"parents": ["%s"]}`, uuid.NewString())
+		if resp := request(t, app, "POST", "/test/roles/"+viewer.ID.String()+"/parents", body, admin.AccessToken); resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("esperava status 404 para papel pai inexistente, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("MFA herdado", func(t *testing.T) {
+		mfa := func(require bool) {
+			t.Helper()
+			body := fmt.Sprintf(`{"require_mfa": %t}`, require)
+			if resp := request(t, app, "PATCH", "/test/roles/"+viewer.ID.String(), body, admin.AccessToken); resp.StatusCode != fiber.StatusOK {
+				t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+			}
+		}
+		mfa(true)
+		defer mfa(false)
+		resp := request(t, app, "POST", "/test/auth/login", `{"email": "gestor@ralds.com.br", "password": "Senha@123"}`, "")
+		var challenge mfaChallenge
+		if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+			t.Fatalf("err on decode: %v", err.Error())
+		}
+		if resp.StatusCode != fiber.StatusOK || !challenge.MFARequired || !challenge.EnrollmentRequired {
+			t.Errorf("papel pai com require_mfa deveria exigir MFA do papel filho: %d %+v", resp.StatusCode, challenge)
+		}
+	})
+
+	t.Run("Alteracao no papel pai", func(t *testing.T) {
+		session := loginAs(t, app, "gestor@ralds.com.br", "Senha@123")
+		time.Sleep(time.Second)
+		if resp := request(t, app, "POST", "/test/roles/"+viewer.ID.String()+"/deactivate", "", admin.AccessToken); resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+		resp := request(t, app, "POST", "/test/auth/refresh", fmt.Sprintf(`{"refresh_token": "%s"}`, session.RefreshToken), "")
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("refresh emitido antes da alteracao do papel pai deveria ser recusado, recebeu %d", resp.StatusCode)
+		}
+		session = loginAs(t, app, "gestor@ralds.com.br", "Senha@123")
+		if slices.Contains(permissions(session.AccessToken), string(PermissionViewUser)) {
+			t.Error("papel pai inativo nao deveria conceder permissoes")
+		}
+		if resp := request(t, app, "POST", "/test/roles/"+viewer.ID.String()+"/activate", "", admin.AccessToken); resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("esperava status 200, recebeu %d", resp.StatusCode)
+		}
+
+		resp = request(t, app, "DELETE", "/test/roles/"+editor.ID.String()+"/parents/"+viewer.ID.String(), "", admin.AccessToken)
+		if role := decodeRole(resp); resp.StatusCode != fiber.StatusOK || len(role.Parents) != 0 {
+			t.Fatalf("esperava papel sem pai: %d %+v", resp.StatusCode, role.Parents)
+		}
+		session = loginAs(t, app, "gestor@ralds.com.br", "Senha@123")
+		if slices.Contains(permissions(session.AccessToken), string(PermissionViewUser)) {
+			t.Error("permissao do papel pai removido nao deveria estar no token")
+		}
+		if resp := request(t, app, "DELETE", "/test/roles/"+editor.ID.String()+"/parents/"+viewer.ID.String(), "", admin.AccessToken); resp.StatusCode != fiber.StatusNotFound {
+			t.Errorf("esperava status 404, recebeu %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Excluir papel pai", func(t *testing.T) {
+		if resp := request(t, app, "DELETE", "/test/roles/"+editor.ID.String(), "", admin.AccessToken); resp.StatusCode != fiber.StatusNoContent {
+			t.Fatalf("esperava status 204, recebeu %d", resp.StatusCode)
+		}
+		var inherited int64
+		if err := db.Table("roles_parents").Where("parent_id = ?", editor.ID).Count(&inherited).Error; err != nil || inherited != 0 {
+			t.Errorf("esperava hierarquia desvinculada, restam %d", inherited)
+		}
+		session := loginAs(t, app, "gestor@ralds.com.br", "Senha@123")
+		if got := permissions(session.AccessToken); !slices.Equal(got, []string{string(PermissionUpdateUser)}) {
+			t.Errorf("esperava apenas a permissao direta, recebeu %v", got)
+		}
+	})
+}
+
+// blockingMailer holds each mail until release is closed and fails the mails
+// to failTo.
+type blockingMailer struct {
+	*gorote.MemoryMailer
+	release chan struct{}
+	failTo  string
+}
+
+func (m *blockingMailer) Send(ctx context.Context, mail gorote.Mail) error {
+	<-m.release
+	if slices.Contains(mail.To, m.failTo) {
+		return errors.New("smtp indisponivel")
+	}
+	return m.MemoryMailer.Send(ctx, mail)
+}
+
+func TestAuthMailQueue(t *testing.T) {
+	app := fiber.New(fiber.Config{AppName: "test"})
+	db, err := gorm.Open(sqlite.Open("file:mailqueue?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err.Error())
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err on generate key: %v", err.Error())
+	}
+	mailer := &blockingMailer{MemoryMailer: gorote.NewMemoryMailer(), release: make(chan struct{}), failTo: "falha@ralds.com.br"}
+	var mu sync.Mutex
+	var failures []error
+	router, err := New(&Config{
+		DB:               db,
+		AppName:          "test",
+		SigningKey:       privateKey,
+		JwtExpireAccess:  time.Hour,
+		JwtExpireRefresh: time.Hour * 24,
+		SuperEmail:       "admin@admin.com",
+		SuperPass:        "Senha@123",
+		Mailer:           mailer,
+		PublicURL:        "https://api.ralds.com.br/test",
+		MailQueue: MailQueue{
+			Workers: 1,
+			Size:    1,
+			OnError: func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				failures = append(failures, err)
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err on new auth: %v", err.Error())
+	}
+	router.RegisterRouter(app.Group("/test"))
+	failed := func() []error {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(failures)
+	}
+
+	for _, email := range []string{"falha@ralds.com.br", "fila@ralds.com.br"} {
+		if err := db.Create(&User{Email: email, Active: true, EmailVerified: true}).Error; err != nil {
+			t.Fatalf("err on create user: %v", err.Error())
+		}
+	}
+	forgot := func(email string) {
+		t.Helper()
+		resp := request(t, app, "POST", "/test/auth/password/forgot", fmt.Sprintf(`{"email": "%s"}`, email), "")
+		if resp.StatusCode != fiber.StatusAccepted {
+			t.Fatalf("esperava status 202, recebeu %d", resp.StatusCode)
+		}
+	}
+
+	// The worker holds the first mail, the second waits in the queue and the
+	// third doesn't fit.
+	forgot("falha@ralds.com.br")
+	for deadline := time.Now().Add(2 * time.Second); len(router.mails.jobs) > 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	forgot("fila@ralds.com.br")
+	forgot("fila@ralds.com.br")
+	if got := failed(); len(got) != 1 || !errors.Is(got[0], errMailQueueFull) {
+		t.Fatalf("esperava descarte com a fila cheia: %v", got)
+	}
+
+	close(mailer.release)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := router.Shutdown(ctx); err != nil {
+		t.Fatalf("err on shutdown: %v", err.Error())
+	}
+	if mails := mailer.Mails(); len(mails) != 1 || !slices.Contains(mails[0].To, "fila@ralds.com.br") {
+		t.Errorf("esperava o email da fila enviado antes do encerramento: %+v", mails)
+	}
+	if got := failed(); len(got) != 2 || !strings.Contains(got[1].Error(), "smtp indisponivel") {
+		t.Errorf("esperava a falha do mailer reportada: %v", got)
+	}
+
+	forgot("fila@ralds.com.br")
+	if got := failed(); len(got) != 3 || !errors.Is(got[2], errMailQueueClosed) {
+		t.Errorf("esperava recusa depois do encerramento: %v", got)
+	}
+}
+
+// waitMail waits for a mail to the given address among those sent after the
+// first sent ones, for handlers that mail in the background.
+func waitMail(t *testing.T, mailer *gorote.MemoryMailer, sent int, to string) gorote.Mail {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mails := mailer.Mails()
+		for _, mail := range mails[min(sent, len(mails)):] {
+			if slices.Contains(mail.To, to) {
+				return mail
+			}
+		}
+	}
+	t.Fatalf("esperava email para %s", to)
+	return gorote.Mail{}
+}
+
+func request(t *testing.T, app *fiber.App, method, url, body, accessToken string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", accessToken)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("err on test: %v", err.Error())
+	}
+	return resp
+}
+
+func loginAs(t *testing.T, app *fiber.App, email, password string) token {
+	t.Helper()
+	body := fmt.Sprintf(`{"email": "%s", "password": "%s"}`, email, password)
+	resp := request(t, app, "POST", "/test/auth/login", body, "")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("esperava status 200 no login, recebeu %d", resp.StatusCode)
+	}
+	var tk token
+	if err := json.NewDecoder(resp.Body).Decode(&tk); err != nil {
+		t.Fatalf("err on decode: %v", err.Error())
+	}
+	return tk
 }
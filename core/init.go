@@ -1,9 +1,16 @@
 package core
 
 import (
+	"context"
+	"crypto"
 	"crypto/rsa"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
 	"time"
 
+	"github.com/ronaldalds/gorote-core-rsa/gorote"
 	"gorm.io/gorm"
 )
 
@@ -17,15 +24,210 @@ type super struct {
 	SuperPass  string
 }
 
+// LockoutPolicy throttles failed logins. After FreeAttempts failures on an
+// account (IPFreeAttempts from one IP) each new attempt waits BaseDelay,
+// doubled on every further failure up to MaxDelay. MaxAttempts failures on an
+// account, or IPMaxAttempts from one IP, lock it for LockoutDuration. Zero
+// fields take the defaults below.
+type LockoutPolicy struct {
+	FreeAttempts    int
+	MaxAttempts     int
+	IPFreeAttempts  int
+	IPMaxAttempts   int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+}
+
+func (p LockoutPolicy) withDefaults() LockoutPolicy {
+	if p.FreeAttempts == 0 {
+		p.FreeAttempts = 3
+	}
+	if p.BaseDelay == 0 {
+		p.BaseDelay = time.Second
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = time.Minute
+	}
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = 10
+	}
+	if p.IPFreeAttempts == 0 {
+		p.IPFreeAttempts = 20
+	}
+	if p.IPMaxAttempts == 0 {
+		p.IPMaxAttempts = 100
+	}
+	if p.LockoutDuration == 0 {
+		p.LockoutDuration = 15 * time.Minute
+	}
+	return p
+}
+
+// retryAfter is how long a key with the given attempts must wait before the
+// next login, or zero.
+func (p LockoutPolicy) retryAfter(attempts gorote.Attempts, free, limit int, now time.Time) time.Duration {
+	var until time.Time
+	switch {
+	case attempts.Failures >= limit:
+		until = attempts.LastFailure.Add(p.LockoutDuration)
+	case attempts.Failures > free:
+		delay := p.MaxDelay
+		if shift := attempts.Failures - free - 1; shift < 32 {
+			delay = min(p.BaseDelay<<shift, p.MaxDelay)
+		}
+		until = attempts.LastFailure.Add(delay)
+	default:
+		return 0
+	}
+	return max(until.Sub(now), 0)
+}
+
+// MailContent is what a MailTemplate gets to write one email: the link to
+// open, or only the Token when a password reset has no PasswordResetURL, and
+// how long it lasts.
+type MailContent struct {
+	AppName string
+	Link    string
+	Token   string
+	Expires time.Duration
+}
+
+// MailTemplate returns the subject and body of an email.
+type MailTemplate func(MailContent) (subject, body string)
+
+// MailTemplates write the emails core sends, for instance in the language of
+// the users. Nil fields take the English defaults below.
+type MailTemplates struct {
+	PasswordReset     MailTemplate
+	MagicLink         MailTemplate
+	EmailVerification MailTemplate
+}
+
+func (t MailTemplates) withDefaults() MailTemplates {
+	if t.PasswordReset == nil {
+		t.PasswordReset = passwordResetMail
+	}
+	if t.MagicLink == nil {
+		t.MagicLink = magicLinkMail
+	}
+	if t.EmailVerification == nil {
+		t.EmailVerification = emailVerificationMail
+	}
+	return t
+}
+
+// MailQueue sends the account mails in the background, so the answer of a
+// request takes as long whether the account exists or not. Workers send the
+// mails waiting in a queue of Size; a mail that doesn't fit is dropped.
+// OnError receives the failures and the dropped mails, and logs them by
+// default. Zero fields take the defaults below.
+type MailQueue struct {
+	Workers int
+	Size    int
+	OnError func(error)
+}
+
+func (q MailQueue) withDefaults() MailQueue {
+	if q.Workers == 0 {
+		q.Workers = 2
+	}
+	if q.Size == 0 {
+		q.Size = 100
+	}
+	if q.OnError == nil {
+		q.OnError = func(err error) { log.Printf("failed to send mail: %v", err) }
+	}
+	return q
+}
+
+func passwordResetMail(c MailContent) (string, string) {
+	body := fmt.Sprintf("Use the code below to reset your password. It expires in %d minutes.\n\n%s\n", int(c.Expires.Minutes()), c.Token)
+	if c.Link != "" {
+		body = fmt.Sprintf("Open the link below to reset your password. It expires in %d minutes.\n\n%s\n", int(c.Expires.Minutes()), c.Link)
+	}
+	body += "\nIf you did not ask for a password reset, ignore this email.\n"
+	return fmt.Sprintf("%s - password reset", c.AppName), body
+}
+
+func magicLinkMail(c MailContent) (string, string) {
+	return fmt.Sprintf("%s - sign-in link", c.AppName),
+		fmt.Sprintf("Open the link below to sign in. It expires in %d minutes and can only be used once.\n\n%s\n\nIf you did not ask to sign in, ignore this email.\n",
+			int(c.Expires.Minutes()), c.Link)
+}
+
+func emailVerificationMail(c MailContent) (string, string) {
+	return fmt.Sprintf("%s - confirm your email", c.AppName),
+		fmt.Sprintf("Open the link below to confirm your email. It expires in %d hours.\n\n%s\n",
+			int(c.Expires.Hours()), c.Link)
+}
+
 type Config struct {
 	*gorm.DB
 	AppName          string
 	PrivateKey       *rsa.PrivateKey
+	SigningKey       crypto.Signer
+	Algorithm        string
+	KeyRing          *gorote.KeyRing
 	JwtExpireAccess  time.Duration
 	JwtExpireRefresh time.Duration
 	SuperEmail       string
 	SuperPass        string
 	Domain           string
+	Revocation       gorote.RevocationStore
+	// MFASuperUser forces superusers to complete TOTP enrollment before
+	// receiving tokens. Roles opt in through Role.RequireMFA.
+	MFASuperUser bool
+	// Mailer delivers password reset and other account mails.
+	Mailer gorote.Mailer
+	// MailTemplates write the mails; unset ones are in English.
+	MailTemplates MailTemplates
+	// MailQueue bounds the background sending of those mails.
+	MailQueue MailQueue
+	// PublicURL is the absolute URL where the core routes are mounted, such as
+	// https://api.example.com/api/v1. Mailed links to core routes are built
+	// from it, never from the Host header of the request.
+	PublicURL string
+	// PasswordResetURL is the frontend page that receives ?token= from the
+	// reset mail. When empty the mail carries only the token.
+	PasswordResetURL string
+	// RequireEmailVerification makes login reject users that have not
+	// confirmed their email. It requires a Mailer.
+	RequireEmailVerification bool
+	// EmailVerificationURL is the frontend page that receives ?token= from the
+	// verification mail. When empty the link points to /auth/verify-email
+	// under PublicURL; with a Mailer one of them is required.
+	EmailVerificationURL string
+	// MagicLink enables passwordless login by a single-use link mailed from
+	// /auth/magic-link. It requires a Mailer. MagicLinkURL is the frontend
+	// page that receives ?token= and posts it to /auth/magic-link/callback;
+	// when empty the link opens the landing page of that route under
+	// PublicURL.
+	MagicLink    bool
+	MagicLinkURL string
+	// Lockout configures the failed login throttling, stored in Attempts
+	// (in memory by default).
+	Lockout  LockoutPolicy
+	Attempts gorote.AttemptStore
+	// PasswordPolicy validates new passwords; nil keeps the historical rule of
+	// 6 characters with one uppercase letter and one symbol.
+	PasswordPolicy *gorote.PasswordPolicy
+	// PasswordHasher hashes new passwords. nil uses Argon2id, peppered with
+	// PasswordPepper when set, and still accepts the older bcrypt hashes;
+	// outdated hashes are upgraded on the next successful login. A custom
+	// hasher takes its own pepper and PasswordPepper is ignored.
+	PasswordHasher gorote.PasswordHasher
+	PasswordPepper string
+	// Authenticators are the sources of users, tried in order by /auth/login;
+	// nil keeps only the local passwords. Include a LocalAuthenticator to
+	// keep them along LDAP or OpenID Connect providers.
+	Authenticators []Authenticator
+	// PersonalTokenMaxLifetime caps the expiry of personal access tokens;
+	// zero means one year.
+	PersonalTokenMaxLifetime time.Duration
+	// Now replaces time.Now for TOTP validation, login throttling and audit
+	// events, so tests can use a fake clock.
+	Now func() time.Time
 }
 
 func (c *Config) name() string {
@@ -57,22 +259,149 @@ func (c *Config) super() *super {
 	}
 }
 
-func (c *Config) privateKeyRSA() *rsa.PrivateKey {
-	return c.PrivateKey
+func (c *Config) signingKey() crypto.Signer {
+	if c.SigningKey != nil {
+		return c.SigningKey
+	}
+	if c.PrivateKey != nil {
+		return c.PrivateKey
+	}
+	return nil
+}
+
+func (c *Config) algorithm() string {
+	return c.Algorithm
+}
+
+func (c *Config) keyRing() *gorote.KeyRing {
+	return c.KeyRing
+}
+
+func (c *Config) revocation() gorote.RevocationStore {
+	return c.Revocation
+}
+
+func (c *Config) mfaSuperUser() bool {
+	return c.MFASuperUser
+}
+
+func (c *Config) passwordPolicy() *gorote.PasswordPolicy {
+	if c.PasswordPolicy == nil {
+		return &gorote.PasswordPolicy{MinLength: 6, RequireUpper: true, RequireSymbol: true}
+	}
+	return c.PasswordPolicy
+}
+
+func (c *Config) passwordHasher() gorote.PasswordHasher {
+	if c.PasswordHasher != nil {
+		return c.PasswordHasher
+	}
+	return gorote.NewPasswordHashers(
+		&gorote.Argon2idHasher{Pepper: []byte(c.PasswordPepper)},
+		&gorote.BcryptHasher{},
+	)
+}
+
+func (c *Config) mailer() gorote.Mailer {
+	return c.Mailer
+}
+
+func (c *Config) mailTemplates() MailTemplates {
+	return c.MailTemplates.withDefaults()
+}
+
+func (c *Config) mailQueue() MailQueue {
+	return c.MailQueue.withDefaults()
+}
+
+func (c *Config) publicURL() string {
+	return strings.TrimSuffix(c.PublicURL, "/")
+}
+
+func (c *Config) passwordResetURL() string {
+	return c.PasswordResetURL
+}
+
+func (c *Config) requireEmailVerification() bool {
+	return c.RequireEmailVerification
+}
+
+func (c *Config) emailVerificationURL() string {
+	return c.EmailVerificationURL
+}
+
+func (c *Config) magicLink() bool {
+	return c.MagicLink
+}
+
+func (c *Config) magicLinkURL() string {
+	return c.MagicLinkURL
+}
+
+func (c *Config) lockout() LockoutPolicy {
+	return c.Lockout.withDefaults()
+}
+
+func (c *Config) attempts() gorote.AttemptStore {
+	return c.Attempts
+}
+
+func (c *Config) authenticators() []Authenticator {
+	if c.Authenticators == nil {
+		return []Authenticator{&LocalAuthenticator{}}
+	}
+	return c.Authenticators
+}
+
+func (c *Config) personalTokenMaxLifetime() time.Duration {
+	if c.PersonalTokenMaxLifetime == 0 {
+		return 365 * 24 * time.Hour
+	}
+	return c.PersonalTokenMaxLifetime
+}
+
+func (c *Config) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
 }
 
 type configLoad interface {
 	db() *gorm.DB
 	name() string
-	privateKeyRSA() *rsa.PrivateKey
+	signingKey() crypto.Signer
+	algorithm() string
+	keyRing() *gorote.KeyRing
 	super() *super
 	jwt() *jwtConfig
 	domain() string
+	revocation() gorote.RevocationStore
+	mfaSuperUser() bool
+	mailer() gorote.Mailer
+	mailTemplates() MailTemplates
+	mailQueue() MailQueue
+	publicURL() string
+	passwordResetURL() string
+	requireEmailVerification() bool
+	emailVerificationURL() string
+	magicLink() bool
+	magicLinkURL() string
+	lockout() LockoutPolicy
+	passwordPolicy() *gorote.PasswordPolicy
+	passwordHasher() gorote.PasswordHasher
+	attempts() gorote.AttemptStore
+	authenticators() []Authenticator
+	personalTokenMaxLifetime() time.Duration
+	now() time.Time
 }
 
 type appRouter struct {
-	publicKey  *rsa.PublicKey
-	controller controller
+	keys        *gorote.KeyRing
+	revocations gorote.RevocationStore
+	retention   time.Duration
+	mails       *mailPool
+	controller  controller
 }
 
 type appController struct {
@@ -81,32 +410,134 @@ type appController struct {
 
 type appService struct {
 	configLoad
+	keys        *gorote.KeyRing
+	revocations gorote.RevocationStore
+	attempts    gorote.AttemptStore
+	mails       *mailPool
 }
 
 func New(config configLoad) (*appRouter, error) {
 	if err := migrate(config); err != nil {
 		return nil, err
 	}
+	if config.requireEmailVerification() && config.mailer() == nil {
+		return nil, fmt.Errorf("email verification requires a mailer")
+	}
+	if config.mailer() != nil && config.emailVerificationURL() == "" && config.publicURL() == "" {
+		return nil, fmt.Errorf("email verification links require EmailVerificationURL or PublicURL")
+	}
+	if config.magicLink() && config.mailer() == nil {
+		return nil, fmt.Errorf("magic link login requires a mailer")
+	}
+	if config.magicLink() && config.magicLinkURL() == "" && config.publicURL() == "" {
+		return nil, fmt.Errorf("magic link login requires MagicLinkURL or PublicURL")
+	}
+	providers := map[string]bool{}
+	for _, auth := range config.authenticators() {
+		name := auth.Provider()
+		if name == "" || name != url.PathEscape(name) {
+			return nil, fmt.Errorf("invalid authenticator provider %q", name)
+		}
+		if _, ok := auth.(*LocalAuthenticator); !ok && name == localProvider {
+			return nil, fmt.Errorf("authenticator provider %s is reserved", localProvider)
+		}
+		if providers[name] {
+			return nil, fmt.Errorf("duplicate authenticator provider %s", name)
+		}
+		providers[name] = true
+	}
 
 	if config.super() != nil {
 		if err := saveUserAdmin(config); err != nil {
 			return nil, err
 		}
 	}
-	if err := savePermissions(config); err != nil {
+	orphans, err := savePermissions(config)
+	if err != nil {
 		return nil, err
 	}
+	for _, orphan := range orphans {
+		log.Printf("permission %s of module %s is no longer registered", orphan.Code, orphan.Module)
+	}
 
-	service := appService{config}
+	keys := config.keyRing()
+	if keys == nil {
+		if config.signingKey() == nil {
+			return nil, fmt.Errorf("signing key is required")
+		}
+		ring, err := gorote.NewKeyRing(config.signingKey())
+		if err != nil {
+			return nil, err
+		}
+		keys = ring
+	}
+	if alg := config.algorithm(); alg != "" && keys.Current().Algorithm != alg {
+		return nil, fmt.Errorf("signing key does not match algorithm %s", alg)
+	}
+
+	revocations := config.revocation()
+	if revocations == nil {
+		revocations = gorote.NewMemoryRevocationStore()
+	}
+	// Core routes check revocations themselves. The store becomes the default
+	// of gorote only when none is set, so several apps in one process don't
+	// overwrite each other; Revocations hands it to the routes of other modules.
+	gorote.UseRevocationStoreIfUnset(revocations)
+	if err := restorePersonalTokenRevocations(config, revocations); err != nil {
+		return nil, err
+	}
+
+	attempts := config.attempts()
+	if attempts == nil {
+		attempts = gorote.NewMemoryAttemptStore()
+	}
+
+	mails := newMailPool(config.mailQueue())
+
+	service := appService{
+		configLoad:  config,
+		keys:        keys,
+		revocations: revocations,
+		attempts:    attempts,
+		mails:       mails,
+	}
+
+	useImpersonationRecorder(service.name(), service.recordImpersonation)
 
 	controller := appController{
 		service: &service,
 	}
 
 	router := appRouter{
-		publicKey:  &config.privateKeyRSA().PublicKey,
-		controller: &controller,
+		keys:        keys,
+		revocations: revocations,
+		retention:   max(config.jwt().JwtExpireAccess, config.jwt().JwtExpireRefresh),
+		mails:       mails,
+		controller:  &controller,
 	}
 
 	return &router, nil
 }
+
+func (r *appRouter) KeyRing() *gorote.KeyRing {
+	return r.keys
+}
+
+// Revocations returns the denylist of the app, for the routes of other
+// modules in the same process: gorote.JWTProtectedRevocable(claims,
+// router.KeyRing(), router.Revocations()).
+func (r *appRouter) Revocations() gorote.RevocationStore {
+	return r.revocations
+}
+
+// Shutdown stops taking account mails and waits for the queued ones to be
+// sent, or for ctx. Call it after the server stops taking requests.
+func (r *appRouter) Shutdown(ctx context.Context) error {
+	return r.mails.close(ctx)
+}
+
+// PromoteKey starts signing with privateKey while the previous key keeps
+// verifying already issued tokens until they expire.
+func (r *appRouter) PromoteKey(privateKey crypto.Signer) error {
+	return r.keys.Promote(privateKey, r.retention)
+}
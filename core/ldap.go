@@ -0,0 +1,137 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPAuthenticator checks passwords by binding as the directory entry of the
+// email, as in Active Directory or OpenLDAP. The entry is searched under
+// BaseDN, as BindDN when set and anonymously otherwise.
+type LDAPAuthenticator struct {
+	ProvisioningPolicy
+	// Name is the provider of the users; "ldap" when empty.
+	Name string
+	// URL is ldap://host:389 or ldaps://host:636.
+	URL       string
+	StartTLS  bool
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are the service account that searches users.
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds the entry of a login, %s being the escaped email;
+	// "(mail=%s)" when empty.
+	UserFilter string
+	// Attributes read from the entry; mail, givenName, sn and memberOf when
+	// empty. The values of GroupAttribute are the groups of the identity.
+	EmailAttribute     string
+	FirstNameAttribute string
+	LastNameAttribute  string
+	GroupAttribute     string
+	// Timeout bounds the dial and each request; 10 seconds when zero.
+	Timeout time.Duration
+}
+
+func (l *LDAPAuthenticator) Provider() string {
+	if l.Name == "" {
+		return "ldap"
+	}
+	return l.Name
+}
+
+func (l *LDAPAuthenticator) Authenticate(ctx context.Context, email, password string) (*Identity, error) {
+	if password == "" {
+		// An empty password is an unauthenticated bind, which servers accept.
+		return nil, ErrInvalidCredentials
+	}
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	conn, err := ldap.DialURL(l.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		ldap.DialWithTLSConfig(l.TLSConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ldap: %v", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(timeout)
+	if l.StartTLS {
+		config := l.TLSConfig
+		if config == nil {
+			host := l.URL
+			if u, err := url.Parse(l.URL); err == nil {
+				host = u.Hostname()
+			}
+			config = &tls.Config{ServerName: host}
+		}
+		if err := conn.StartTLS(config); err != nil {
+			return nil, fmt.Errorf("failed to start tls: %v", err)
+		}
+	}
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, fmt.Errorf("failed to bind ldap service account: %v", err)
+		}
+	}
+
+	emailAttr := withDefault(l.EmailAttribute, "mail")
+	firstNameAttr := withDefault(l.FirstNameAttribute, "givenName")
+	lastNameAttr := withDefault(l.LastNameAttribute, "sn")
+	groupAttr := withDefault(l.GroupAttribute, "memberOf")
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		int(timeout.Seconds()),
+		false,
+		fmt.Sprintf(withDefault(l.UserFilter, "(mail=%s)"), ldap.EscapeFilter(email)),
+		[]string{emailAttr, firstNameAttr, lastNameAttr, groupAttr},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search ldap: %v", err)
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrUnknownIdentity
+	case 1:
+	default:
+		return nil, fmt.Errorf("ldap search matched more than one entry")
+	}
+	entry := result.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("failed to bind ldap user: %v", err)
+	}
+
+	identity := &Identity{
+		Email:         entry.GetAttributeValue(emailAttr),
+		EmailVerified: true,
+		FirstName:     entry.GetAttributeValue(firstNameAttr),
+		LastName:      entry.GetAttributeValue(lastNameAttr),
+		Groups:        entry.GetAttributeValues(groupAttr),
+	}
+	if identity.Email == "" {
+		identity.Email = email
+	}
+	return identity, nil
+}
+
+func withDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
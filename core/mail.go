@@ -0,0 +1,88 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	errMailQueueFull   = errors.New("mail queue is full")
+	errMailQueueClosed = errors.New("mail queue is closed")
+)
+
+// mailPool runs the mail jobs on the fixed set of workers of MailQueue. Jobs
+// that fail, or don't fit in the queue, are handed to MailQueue.OnError.
+type mailPool struct {
+	mu      sync.RWMutex
+	jobs    chan func() error
+	closed  bool
+	onError func(error)
+	workers sync.WaitGroup
+	pending sync.WaitGroup
+}
+
+func newMailPool(queue MailQueue) *mailPool {
+	pool := &mailPool{
+		jobs:    make(chan func() error, queue.Size),
+		onError: queue.OnError,
+	}
+	pool.workers.Add(queue.Workers)
+	for range queue.Workers {
+		go pool.work()
+	}
+	return pool
+}
+
+func (p *mailPool) work() {
+	defer p.workers.Done()
+	for job := range p.jobs {
+		if err := job(); err != nil {
+			p.onError(err)
+		}
+		p.pending.Done()
+	}
+}
+
+// enqueue schedules job without waiting for a worker.
+func (p *mailPool) enqueue(job func() error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		p.onError(errMailQueueClosed)
+		return
+	}
+	p.pending.Add(1)
+	select {
+	case p.jobs <- job:
+	default:
+		p.pending.Done()
+		p.onError(errMailQueueFull)
+	}
+}
+
+// wait blocks until the queued jobs are done.
+func (p *mailPool) wait() {
+	p.pending.Wait()
+}
+
+// close stops taking jobs and waits for the queued ones, or for ctx.
+func (p *mailPool) close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -35,6 +35,17 @@ type Permission struct {
 	Description string `json:"description"`
 	Active      bool   `gorm:"default:true" json:"active"`
 	Roles       []Role `gorm:"many2many:roles_permissions" json:"roles"`
+	// Module registered the permission with RegisterPermissions; it is empty
+	// for the ones created through the API.
+	Module   string `gorm:"size:50;index" json:"module"`
+	Group    string `gorm:"column:group_name;size:50" json:"group"`
+	Orphaned bool   `gorm:"default:false" json:"orphaned"`
+}
+
+// registered reports whether a module still checks the permission, which
+// then can't be deactivated or deleted.
+func (p *Permission) registered() bool {
+	return p.Module != "" && !p.Orphaned
 }
 
 type Role struct {
@@ -42,19 +53,153 @@ type Role struct {
 	Name        string       `gorm:"uniqueIndex;size:100" validate:"required,min=3,max=100,regexp=^[a-zA-Z0-9._]+$" json:"name"`
 	Description string       `json:"description"`
 	Permissions []Permission `gorm:"many2many:roles_permissions" json:"permissions"`
+	RequireMFA  bool         `gorm:"default:false" json:"require_mfa"`
 	Active      bool         `gorm:"default:true" json:"active"`
+	// Parents are the roles whose permissions this role inherits.
+	Parents []Role `gorm:"many2many:roles_parents;joinForeignKey:RoleID;joinReferences:ParentID" json:"parents,omitempty"`
+	// EffectivePermissions are the permissions the role grants, inherited ones
+	// included; only the role API fills them.
+	EffectivePermissions []Permission `gorm:"-" json:"effective_permissions,omitempty"`
 }
 
 type User struct {
 	BaseModel
-	FirstName   string   `gorm:"size:50" validate:"omitempty,min=1,max=50" json:"first_name"`
-	LastName    string   `gorm:"size:50" validate:"omitempty,max=50" json:"last_name"`
-	Email       string   `gorm:"uniqueIndex" validate:"required,email" json:"email"`
-	Password    string   `validate:"required" json:"-"`
-	IsSuperUser bool     `gorm:"default:false" json:"is_super_user"`
-	Phone1      *string  `gorm:"type:varchar(20)" validate:"omitempty,e164" json:"phone1"`
-	Phone2      *string  `gorm:"type:varchar(20)" validate:"omitempty,e164" json:"phone2"`
-	Roles       []Role   `gorm:"many2many:users_roles" json:"roles"`
-	Tenants     []Tenant `gorm:"many2many:users_tenants" json:"tenants"`
-	Active      bool     `gorm:"default:true" json:"active"`
+	FirstName     string   `gorm:"size:50" validate:"omitempty,min=1,max=50" json:"first_name"`
+	LastName      string   `gorm:"size:50" validate:"omitempty,max=50" json:"last_name"`
+	Email         string   `gorm:"uniqueIndex" validate:"required,email" json:"email"`
+	EmailVerified bool     `gorm:"default:false" json:"email_verified"`
+	Password      string   `validate:"required" json:"-"`
+	IsSuperUser   bool     `gorm:"default:false" json:"is_super_user"`
+	Phone1        *string  `gorm:"type:varchar(20)" validate:"omitempty,e164" json:"phone1"`
+	Phone2        *string  `gorm:"type:varchar(20)" validate:"omitempty,e164" json:"phone2"`
+	Roles         []Role   `gorm:"many2many:users_roles" json:"roles"`
+	Tenants       []Tenant `gorm:"many2many:users_tenants" json:"tenants"`
+	Active        bool     `gorm:"default:true" json:"active"`
+	MFAEnabled    bool     `gorm:"default:false" json:"mfa_enabled"`
+	MFASecret     string   `json:"-"`
+	MFALastStep   int64    `json:"-"`
+	// Provider is the authenticator the user logs in with; "local" users
+	// have a password hash.
+	Provider string `gorm:"size:50;default:local" json:"provider"`
+	// Subject is the id of the user at its Provider, for providers that
+	// assert one; see Identity.Subject.
+	Subject string `gorm:"size:255;index" json:"-"`
+}
+
+// Session is a login on one device. Its id is the sid claim of every token
+// issued for it, and revoking it ends them all.
+type Session struct {
+	BaseModel
+	UserID     uuid.UUID  `gorm:"index" json:"user_id"`
+	Device     string     `gorm:"size:100" json:"device"`
+	IP         string     `gorm:"size:45" json:"ip"`
+	UserAgent  string     `gorm:"size:255" json:"user_agent"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type RefreshToken struct {
+	BaseModel
+	UserID    uuid.UUID  `gorm:"index" json:"user_id"`
+	SessionID *uuid.UUID `gorm:"index" json:"session_id"`
+	FamilyID  uuid.UUID  `gorm:"index" json:"family_id"`
+	ParentID  *uuid.UUID `json:"parent_id"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+// PersonalAccessToken is a long-lived token a user issues for scripts and
+// integrations. Its id is the jti of the signed token, which is only returned
+// on creation; the hash identifies a leaked token.
+type PersonalAccessToken struct {
+	BaseModel
+	UserID      uuid.UUID    `gorm:"index" json:"user_id"`
+	Name        string       `gorm:"size:100" json:"name"`
+	TokenHash   string       `gorm:"uniqueIndex;size:64" json:"-"`
+	Permissions []Permission `gorm:"many2many:personal_access_tokens_permissions" json:"permissions"`
+	ExpiresAt   time.Time    `json:"expires_at"`
+	RevokedAt   *time.Time   `json:"revoked_at"`
+}
+
+// PasswordHistory keeps previous password hashes to block their reuse.
+type PasswordHistory struct {
+	BaseModel
+	UserID       uuid.UUID `gorm:"index" json:"user_id"`
+	PasswordHash string    `json:"-"`
+}
+
+// UserToken is a hashed, single-use secret mailed to a user, such as a
+// password reset link.
+type UserToken struct {
+	BaseModel
+	UserID    uuid.UUID  `gorm:"index" json:"user_id"`
+	Purpose   string     `gorm:"index;size:30" json:"purpose"`
+	TokenHash string     `gorm:"uniqueIndex;size:64" json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+// LoginEvent is the audit record of a login, MFA or refresh attempt.
+type LoginEvent struct {
+	BaseModel
+	Kind      string     `gorm:"size:20" json:"kind"`
+	UserID    *uuid.UUID `gorm:"index" json:"user_id"`
+	Email     string     `gorm:"index;size:255" json:"email"`
+	IP        string     `gorm:"size:45" json:"ip"`
+	UserAgent string     `gorm:"size:255" json:"user_agent"`
+	Outcome   string     `gorm:"index;size:20" json:"outcome"`
+	Reason    string     `gorm:"size:30" json:"reason"`
+}
+
+// ImpersonationEvent records the issue of an impersonation token and every
+// request made with it.
+type ImpersonationEvent struct {
+	BaseModel
+	ActorID uuid.UUID `gorm:"index" json:"actor_id"`
+	UserID  uuid.UUID `gorm:"index" json:"user_id"`
+	TokenID string    `gorm:"index;size:36" json:"token_id"`
+	Method  string    `gorm:"size:10" json:"method"`
+	Path    string    `gorm:"size:255" json:"path"`
+	Status  int       `json:"status"`
+	IP      string    `gorm:"size:45" json:"ip"`
+}
+
+type MFARecoveryCode struct {
+	BaseModel
+	UserID   uuid.UUID  `gorm:"index" json:"user_id"`
+	CodeHash string     `gorm:"size:64" json:"-"`
+	UsedAt   *time.Time `json:"used_at"`
+}
+
+type ServiceClient struct {
+	BaseModel
+	Name         string              `gorm:"uniqueIndex;size:100" validate:"required,min=3,max=100" json:"name"`
+	Description  string              `json:"description"`
+	SecretHash   string              `json:"-"`
+	Public       bool                `gorm:"default:false" json:"public"`
+	RedirectURIs []ClientRedirectURI `gorm:"foreignKey:ClientID" json:"redirect_uris"`
+	Roles        []Role              `gorm:"many2many:service_clients_roles" json:"roles"`
+	Active       bool                `gorm:"default:true" json:"active"`
+}
+
+type ClientRedirectURI struct {
+	BaseModel
+	ClientID uuid.UUID `gorm:"index" json:"client_id"`
+	URI      string    `validate:"required,url" json:"uri"`
+}
+
+type AuthorizationCode struct {
+	BaseModel
+	CodeHash            string     `gorm:"uniqueIndex;size:64" json:"-"`
+	ClientID            uuid.UUID  `gorm:"index" json:"client_id"`
+	UserID              uuid.UUID  `gorm:"index" json:"user_id"`
+	RedirectURI         string     `json:"redirect_uri"`
+	Scope               string     `json:"scope"`
+	Nonce               string     `json:"nonce"`
+	CodeChallenge       string     `json:"-"`
+	CodeChallengeMethod string     `json:"code_challenge_method"`
+	ExpiresAt           time.Time  `json:"expires_at"`
+	UsedAt              *time.Time `json:"used_at"`
 }
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/ronaldalds/gorote-core-rsa/gorote"
+)
+
+// OIDCAuthenticator logs users in with an upstream OpenID Connect provider,
+// such as Keycloak, Entra ID or Google, by the authorization code flow with
+// PKCE. The provider metadata is discovered from Issuer, and the client must
+// allow {base}/auth/providers/{Name}/callback as redirect URI.
+type OIDCAuthenticator struct {
+	ProvisioningPolicy
+	// Name is the provider of the users and the {provider} of the routes.
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes requested; openid, email and profile when empty.
+	Scopes []string
+	// GroupsClaim is the id_token claim holding the groups; "groups" when
+	// empty.
+	GroupsClaim string
+	// HTTPClient calls the discovery and token endpoints; http.DefaultClient
+	// with a 10 seconds timeout when nil.
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      *gorote.RemoteKeySet
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func (o *OIDCAuthenticator) Provider() string {
+	return o.Name
+}
+
+func (o *OIDCAuthenticator) client() *http.Client {
+	if o.HTTPClient != nil {
+		return o.HTTPClient
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// discover fetches the provider metadata once; a failure is retried on the
+// next login.
+func (o *OIDCAuthenticator) discover(ctx context.Context) (*oidcDiscovery, *gorote.RemoteKeySet, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, o.keys, nil
+	}
+	issuer := strings.TrimSuffix(o.Issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid issuer: %v", err)
+	}
+	res, err := o.client().Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to discover %s: %v", o.Issuer, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("failed to discover %s: status %d", o.Issuer, res.StatusCode)
+	}
+	var discovery oidcDiscovery
+	if err := json.NewDecoder(res.Body).Decode(&discovery); err != nil {
+		return nil, nil, fmt.Errorf("invalid discovery document: %v", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, nil, fmt.Errorf("discovery issuer %s does not match %s", discovery.Issuer, o.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, nil, fmt.Errorf("incomplete discovery document")
+	}
+	o.discovery = &discovery
+	o.keys = gorote.NewRemoteKeySet(discovery.JWKSURI, time.Hour)
+	return o.discovery, o.keys, nil
+}
+
+func (o *OIDCAuthenticator) AuthCodeURL(ctx context.Context, redirectURI, state, nonce, codeChallenge string) (string, error) {
+	discovery, _, err := o.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	link, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint")
+	}
+	scopes := o.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	query := link.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", o.ClientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	link.RawQuery = query.Encode()
+	return link.String(), nil
+}
+
+func (o *OIDCAuthenticator) Exchange(ctx context.Context, redirectURI, code, codeVerifier, nonce string) (*Identity, error) {
+	discovery, keys, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid token endpoint")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	res, err := o.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem code: %v", err)
+	}
+	defer res.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to redeem code: %s %s", body.Error, body.ErrorDescription)
+	}
+
+	claims := jwt.MapClaims{}
+	if err := gorote.ValidateOrGetJWTKeySet(claims, body.IDToken, keys); err != nil {
+		return nil, fmt.Errorf("invalid id_token: %v", err)
+	}
+	if issuer, _ := claims.GetIssuer(); strings.TrimSuffix(issuer, "/") != strings.TrimSuffix(discovery.Issuer, "/") {
+		return nil, fmt.Errorf("invalid id_token issuer")
+	}
+	if audience, _ := claims.GetAudience(); !slices.Contains(audience, o.ClientID) {
+		return nil, fmt.Errorf("invalid id_token audience")
+	}
+	if value, _ := claims["nonce"].(string); value != nonce {
+		return nil, fmt.Errorf("invalid id_token nonce")
+	}
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		return nil, fmt.Errorf("id_token has no sub")
+	}
+	identity := &Identity{Subject: strings.TrimSuffix(discovery.Issuer, "/") + "#" + subject}
+	identity.Email, _ = claims["email"].(string)
+	identity.EmailVerified, _ = claims["email_verified"].(bool)
+	identity.FirstName, _ = claims["given_name"].(string)
+	identity.LastName, _ = claims["family_name"].(string)
+	if identity.Email == "" {
+		return nil, fmt.Errorf("id_token has no email")
+	}
+	groupsClaim := withDefault(o.GroupsClaim, "groups")
+	switch groups := claims[groupsClaim].(type) {
+	case string:
+		identity.Groups = []string{groups}
+	case []any:
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	}
+	return identity, nil
+}
@@ -0,0 +1,83 @@
+package core
+
+import "html/template"
+
+type authorizePageData struct {
+	authorizeRequest
+	ClientName string
+	Email      string
+	MFAToken   string
+	CSRFToken  string
+	Error      string
+}
+
+type magicLinkPageData struct {
+	Token     string
+	Device    string
+	CSRFToken string
+}
+
+// magicLinkPage only posts the token back, so a mail scanner opening the
+// link does not spend it.
+var magicLinkPage = template.Must(template.New("magic-link").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+<style>
+body{font-family:sans-serif;background:#f4f4f5;display:flex;justify-content:center;padding-top:10vh}
+form{background:#fff;padding:2rem;border-radius:8px;width:320px;box-shadow:0 1px 4px rgba(0,0,0,.1)}
+button{width:100%;padding:.6rem}
+</style>
+</head>
+<body>
+<form method="post">
+<h2>Sign in</h2>
+<p>Confirm to sign in with the link you received by email.</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="hidden" name="device" value="{{.Device}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in - {{.ClientName}}</title>
+<style>
+body{font-family:sans-serif;background:#f4f4f5;display:flex;justify-content:center;padding-top:10vh}
+form{background:#fff;padding:2rem;border-radius:8px;width:320px;box-shadow:0 1px 4px rgba(0,0,0,.1)}
+input{display:block;width:100%;box-sizing:border-box;margin:.25rem 0 1rem;padding:.5rem}
+button{width:100%;padding:.6rem}
+.error{color:#b91c1c}
+</style>
+</head>
+<body>
+<form method="post">
+<h2>{{.ClientName}}</h2>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<input type="hidden" name="response_type" value="{{.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.CodeChallengeMethod}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+{{if .MFAToken}}<input type="hidden" name="mfa_token" value="{{.MFAToken}}">
+<label>Authenticator code<input type="text" name="code" inputmode="numeric" autocomplete="one-time-code" required autofocus></label>
+{{else}}<label>Email<input type="email" name="email" value="{{.Email}}" autocomplete="username" required autofocus></label>
+<label>Password<input type="password" name="password" autocomplete="current-password" required></label>
+{{end}}
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
@@ -1,5 +1,12 @@
 package core
 
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+)
+
 type PermissionCode string
 
 const (
@@ -13,4 +20,75 @@ const (
 	PermissionCreateRole       PermissionCode = "create_role"
 	PermissionViewRole         PermissionCode = "view_role"
 	PermissionUpdateRole       PermissionCode = "update_role"
+	PermissionCreateClient     PermissionCode = "create_client"
+	PermissionViewClient       PermissionCode = "view_client"
+	PermissionImpersonate      PermissionCode = "impersonate_user"
 )
+
+// PermissionDef declares a permission a module checks in its routes.
+type PermissionDef struct {
+	Code        PermissionCode
+	Description string
+	// Group gathers related permissions, as shown to administrators.
+	Group string
+}
+
+var registry = struct {
+	sync.Mutex
+	modules map[string][]PermissionDef
+}{modules: map[string][]PermissionDef{}}
+
+// RegisterPermissions declares the permissions of module, usually from an
+// init function, so New seeds them. Registering a module again replaces its
+// list. Registered permissions can't be deactivated or deleted through the
+// API; the ones no module registers anymore are reported as orphaned.
+func RegisterPermissions(module string, codes ...PermissionDef) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.modules[module] = slices.Clone(codes)
+}
+
+// registeredPermissions returns the permissions of every module by code.
+func registeredPermissions() (map[string]registeredPermission, error) {
+	registry.Lock()
+	defer registry.Unlock()
+	permissions := map[string]registeredPermission{}
+	for module, codes := range registry.modules {
+		for _, def := range codes {
+			code := string(def.Code)
+			if !permissionCodePattern.MatchString(code) || len(code) > 50 {
+				return nil, fmt.Errorf("invalid permission code %q of module %s", code, module)
+			}
+			if other, ok := permissions[code]; ok && other.module != module {
+				return nil, fmt.Errorf("permission %s registered by modules %s and %s", code, other.module, module)
+			}
+			permissions[code] = registeredPermission{PermissionDef: def, module: module}
+		}
+	}
+	return permissions, nil
+}
+
+type registeredPermission struct {
+	PermissionDef
+	module string
+}
+
+var permissionCodePattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+func init() {
+	RegisterPermissions("core",
+		PermissionDef{Code: PermissionAdmin, Description: "Full access to the administration routes", Group: "admin"},
+		PermissionDef{Code: PermissionCreateUser, Description: "Create users", Group: "users"},
+		PermissionDef{Code: PermissionViewUser, Description: "View users and their sessions", Group: "users"},
+		PermissionDef{Code: PermissionUpdateUser, Description: "Update users, end their sessions and unlock them", Group: "users"},
+		PermissionDef{Code: PermissionImpersonate, Description: "Act as another user", Group: "users"},
+		PermissionDef{Code: PermissionCreatePermission, Description: "Create permissions", Group: "permissions"},
+		PermissionDef{Code: PermissionViewPermission, Description: "View permissions", Group: "permissions"},
+		PermissionDef{Code: PermissionUpdatePermission, Description: "Update, deactivate and delete permissions", Group: "permissions"},
+		PermissionDef{Code: PermissionCreateRole, Description: "Create roles", Group: "roles"},
+		PermissionDef{Code: PermissionViewRole, Description: "View roles", Group: "roles"},
+		PermissionDef{Code: PermissionUpdateRole, Description: "Update, deactivate and delete roles", Group: "roles"},
+		PermissionDef{Code: PermissionCreateClient, Description: "Create service clients", Group: "clients"},
+		PermissionDef{Code: PermissionViewClient, Description: "View service clients", Group: "clients"},
+	)
+}
@@ -1,7 +1,9 @@
 package core
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/ronaldalds/gorote-core-rsa/gorote"
 	"gorm.io/gorm"
@@ -13,56 +15,126 @@ func migrate(config configLoad) error {
 		&Role{},
 		&Permission{},
 		&Tenant{},
+		&Session{},
+		&RefreshToken{},
+		&PersonalAccessToken{},
+		&MFARecoveryCode{},
+		&UserToken{},
+		&PasswordHistory{},
+		&ServiceClient{},
+		&ClientRedirectURI{},
+		&AuthorizationCode{},
+		&LoginEvent{},
+		&ImpersonationEvent{},
 	); err != nil {
 		return err
 	}
 	return nil
 }
 
+// restorePersonalTokenRevocations denies again the revoked personal access
+// tokens that have not expired, since they outlive an in-memory store.
+func restorePersonalTokenRevocations(config configLoad, store gorote.RevocationStore) error {
+	var tokens []PersonalAccessToken
+	if err := config.db().
+		Where("revoked_at IS NOT NULL AND expires_at > ?", time.Now()).
+		Find(&tokens).Error; err != nil {
+		return fmt.Errorf("failed to query revoked personal tokens")
+	}
+	for _, token := range tokens {
+		if err := store.Revoke(context.Background(), token.ID.String(), token.ExpiresAt); err != nil {
+			return fmt.Errorf("failed to restore personal token revocation")
+		}
+	}
+	return nil
+}
+
 func saveUserAdmin(config configLoad) error {
-	hashPassword, err := gorote.HashPassword(config.super().SuperPass)
+	hashPassword, err := config.passwordHasher().Hash(config.super().SuperPass)
 	if err != nil {
 		return fmt.Errorf("failed to hash password: %s", err.Error())
 	}
 	if err := config.db().
 		FirstOrCreate(&User{
-			Email:       config.super().SuperEmail,
-			Password:    hashPassword,
-			Active:      true,
-			IsSuperUser: true,
+			Email:         config.super().SuperEmail,
+			Password:      hashPassword,
+			Active:        true,
+			IsSuperUser:   true,
+			EmailVerified: true,
 		}).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func savePermissions(config configLoad) error {
-	permissions := []PermissionCode{
-		PermissionAdmin,
-		PermissionCreateUser,
-		PermissionViewUser,
-		PermissionUpdateUser,
-		PermissionCreatePermission,
-		PermissionViewPermission,
-		PermissionUpdatePermission,
-		PermissionCreateRole,
-		PermissionViewRole,
-		PermissionUpdateRole,
+// savePermissions seeds the registered permissions, restoring deleted ones,
+// and marks as orphaned the module permissions no longer registered, which it
+// returns. Descriptions are only filled when empty, so edits made through the
+// API are kept.
+func savePermissions(config configLoad) ([]Permission, error) {
+	registered, err := registeredPermissions()
+	if err != nil {
+		return nil, err
 	}
-	for _, permission := range permissions {
+	codes := make([]string, 0, len(registered))
+	for code, def := range registered {
+		codes = append(codes, code)
 		var p Permission
-		if err := config.db().Where("code = ?", string(permission)).First(&p).Error; err != nil {
-			if err == gorm.ErrRecordNotFound {
-				p = Permission{Code: string(permission)}
-				if err := config.db().Create(&p).Error; err != nil {
-					return err
-				}
-			} else {
-				return err
+		if err := config.db().Unscoped().Where("code = ?", code).First(&p).Error; err != nil {
+			if err != gorm.ErrRecordNotFound {
+				return nil, err
+			}
+			p = Permission{
+				Code:        code,
+				Description: def.Description,
+				Group:       def.Group,
+				Module:      def.module,
+				Active:      true,
+			}
+			if err := config.db().Create(&p).Error; err != nil {
+				return nil, err
+			}
+			continue
+		}
+		changes := map[string]any{}
+		if p.DeletedAt.Valid {
+			changes["deleted_at"] = nil
+		}
+		if !p.Active {
+			changes["active"] = true
+		}
+		if p.Orphaned {
+			changes["orphaned"] = false
+		}
+		if p.Module != def.module {
+			changes["module"] = def.module
+		}
+		if p.Group != def.Group {
+			changes["group_name"] = def.Group
+		}
+		if p.Description == "" && def.Description != "" {
+			changes["description"] = def.Description
+		}
+		if len(changes) > 0 {
+			if err := config.db().Unscoped().Model(&p).UpdateColumns(changes).Error; err != nil {
+				return nil, err
 			}
-		} else {
+		}
+	}
+
+	var orphans []Permission
+	if err := config.db().
+		Where("module <> '' AND code NOT IN ?", codes).
+		Find(&orphans).Error; err != nil {
+		return nil, err
+	}
+	for _, orphan := range orphans {
+		if orphan.Orphaned {
 			continue
 		}
+		if err := config.db().Model(&orphan).UpdateColumn("orphaned", true).Error; err != nil {
+			return nil, err
+		}
 	}
-	return nil
+	return orphans, nil
 }
@@ -9,10 +9,28 @@ import (
 func (r *appRouter) RegisterRouter(router fiber.Router) {
 	r.Check(router.Group("/check"))
 	r.Health(router.Group("/health"))
+	r.WellKnown(router.Group("/.well-known"))
 	r.Auth(router.Group("/auth", gorote.Limited(60)))
+	r.OAuth(router.Group("/oauth"))
+	r.UserInfo(router.Group("/userinfo"))
 	r.User(router.Group("/users"))
 	r.Role(router.Group("/roles"))
 	r.Permission(router.Group("/permissions"))
+	r.Client(router.Group("/clients"))
+}
+
+// protected validates the access token of a core route. Personal access
+// tokens are also checked against their row and the current permissions of
+// the owner, which services validating tokens on their own only get through
+// introspection.
+func (r *appRouter) protected(handles ...gorote.HandlerJWTProtected) fiber.Handler {
+	return gorote.JWTProtectedRevocable(AcceptTokens("personal_access_token"), r.keys, r.revocations, append(handles, r.controller.personalTokenScope)...)
+}
+
+// mfaEnrollment protects the routes an enforced user reaches with the
+// mfa_token of their login, to set up TOTP before their first token pair.
+func (r *appRouter) mfaEnrollment() fiber.Handler {
+	return gorote.JWTProtectedRevocable(AcceptTokens("mfa_token"), r.keys, r.revocations, mfaEnrollmentRoute(), NoImpersonation())
 }
 
 func (r *appRouter) Check(router fiber.Router) {
@@ -23,6 +41,22 @@ func (r *appRouter) Health(router fiber.Router) {
 	router.Get("/", r.controller.healthHandler)
 }
 
+func (r *appRouter) WellKnown(router fiber.Router) {
+	router.Get("/jwks.json", r.controller.jwksHandler)
+	router.Get("/openid-configuration", r.controller.openidConfigurationHandler)
+}
+
+func (r *appRouter) UserInfo(router fiber.Router) {
+	router.Get("/",
+		r.protected(ProtectedRoute()),
+		r.controller.userInfoHandler,
+	)
+	router.Post("/",
+		r.protected(ProtectedRoute()),
+		r.controller.userInfoHandler,
+	)
+}
+
 func (r *appRouter) Auth(router fiber.Router) {
 	router.Post("/login",
 		gorote.ValidationMiddleware(&login{}),
@@ -32,50 +66,287 @@ func (r *appRouter) Auth(router fiber.Router) {
 		gorote.ValidationMiddleware(&refreshToken{}),
 		r.controller.refreshTokenHandler,
 	)
+	router.Post("/logout",
+		r.protected(ProtectedRoute()),
+		r.controller.logoutHandler,
+	)
+	router.Post("/logout/all",
+		r.protected(ProtectedRoute(), NoImpersonation()),
+		r.controller.logoutAllHandler,
+	)
+	router.Post("/token",
+		gorote.ValidationMiddleware(&tokenRequest{}),
+		r.controller.tokenHandler,
+	)
+	router.Post("/magic-link",
+		gorote.ValidationMiddleware(&magicLink{}),
+		r.controller.magicLinkHandler,
+	)
+	router.Get("/magic-link/callback",
+		gorote.ValidationMiddleware(&magicLinkLanding{}),
+		r.controller.magicLinkPageHandler,
+	)
+	router.Post("/magic-link/callback",
+		gorote.ValidationMiddleware(&magicLinkCallback{}),
+		r.controller.magicLinkCallbackHandler,
+	)
+	router.Get("/providers/:provider/login",
+		gorote.ValidationMiddleware(&providerLogin{}),
+		r.controller.providerLoginHandler,
+	)
+	router.Get("/providers/:provider/callback",
+		gorote.ValidationMiddleware(&providerCallback{}),
+		r.controller.providerCallbackHandler,
+	)
+	router.Get("/verify-email",
+		gorote.ValidationMiddleware(&verifyEmail{}),
+		r.controller.verifyEmailHandler,
+	)
+	router.Post("/verify-email/resend",
+		gorote.ValidationMiddleware(&resendVerification{}),
+		r.controller.resendVerificationHandler,
+	)
+	router.Post("/password/forgot",
+		gorote.ValidationMiddleware(&forgotPassword{}),
+		r.controller.forgotPasswordHandler,
+	)
+	router.Post("/password/reset",
+		gorote.ValidationMiddleware(&resetPassword{}),
+		r.controller.resetPasswordHandler,
+	)
+	router.Post("/mfa/verify",
+		gorote.ValidationMiddleware(&mfaVerify{}),
+		r.controller.mfaVerifyHandler,
+	)
+	router.Post("/mfa/enroll",
+		r.mfaEnrollment(),
+		r.controller.mfaEnrollHandler,
+	)
+	router.Post("/mfa/confirm",
+		gorote.ValidationMiddleware(&mfaCode{}),
+		r.mfaEnrollment(),
+		r.controller.mfaConfirmHandler,
+	)
+	router.Post("/mfa/disable",
+		gorote.ValidationMiddleware(&mfaCode{}),
+		r.protected(ProtectedRoute(), NoImpersonation()),
+		r.controller.mfaDisableHandler,
+	)
+	router.Get("/events",
+		gorote.ValidationMiddleware(&listLoginEvents{}),
+		r.protected(ProtectedRoute(PermissionAdmin)),
+		r.controller.listLoginEventsHandler,
+	)
+	router.Post("/impersonate/:userId",
+		gorote.ValidationMiddleware(&impersonate{}),
+		r.protected(ProtectedRoute(PermissionImpersonate), NoImpersonation()),
+		r.controller.impersonateHandler,
+	)
+	router.Get("/impersonations",
+		gorote.ValidationMiddleware(&listImpersonationEvents{}),
+		r.protected(ProtectedRoute(PermissionAdmin)),
+		r.controller.listImpersonationEventsHandler,
+	)
+}
+
+func (r *appRouter) OAuth(router fiber.Router) {
+	limited := gorote.Limited(60)
+	router.Get("/authorize",
+		limited,
+		gorote.ValidationMiddleware(&authorizeRequest{}),
+		r.controller.authorizeHandler,
+	)
+	router.Post("/authorize",
+		limited,
+		gorote.ValidationMiddleware(&authorizeLogin{}),
+		r.controller.authorizeLoginHandler,
+	)
+	// Gateways introspect on every request, so the endpoint is guarded by
+	// client authentication instead of the rate limit.
+	router.Post("/introspect",
+		gorote.ValidationMiddleware(&introspectRequest{}),
+		r.controller.introspectHandler,
+	)
 }
 
 func (r *appRouter) User(router fiber.Router) {
+	router.Get("/me/sessions",
+		r.protected(ProtectedRoute()),
+		r.controller.listSessionsHandler,
+	)
+	router.Delete("/me/sessions/:sessionId",
+		gorote.ValidationMiddleware(&mySession{}),
+		r.protected(ProtectedRoute(), NoImpersonation()),
+		r.controller.revokeSessionHandler,
+	)
+	router.Get("/me/tokens",
+		r.protected(ProtectedRoute()),
+		r.controller.listPersonalTokensHandler,
+	)
+	router.Post("/me/tokens",
+		gorote.ValidationMiddleware(&createPersonalToken{}),
+		r.protected(ProtectedRoute(), NoImpersonation()),
+		r.controller.createPersonalTokenHandler,
+	)
+	router.Delete("/me/tokens/:tokenId",
+		gorote.ValidationMiddleware(&myPersonalToken{}),
+		r.protected(ProtectedRoute(), NoImpersonation()),
+		r.controller.revokePersonalTokenHandler,
+	)
 	router.Get("/",
 		gorote.ValidationMiddleware(&paginateReq{}),
-		gorote.JWTProtectedRSA(&JwtClaims{}, r.publicKey, ProtectedRoute(PermissionViewUser)),
+		r.protected(ProtectedRoute(PermissionViewUser)),
 		r.controller.listUsersHandler,
 	)
 	router.Get("/:id",
 		gorote.ValidationMiddleware(&recieveUser{}),
-		gorote.JWTProtectedRSA(&JwtClaims{}, r.publicKey, ProtectedRoute(PermissionViewUser)),
+		r.protected(ProtectedRoute(PermissionViewUser)),
 		r.controller.recieveUserHandler,
 	)
 	router.Post("/",
 		gorote.ValidationMiddleware(&createUser{}),
-		gorote.JWTProtectedRSA(&JwtClaims{}, r.publicKey, ProtectedRoute(PermissionCreateUser)),
+		r.protected(ProtectedRoute(PermissionCreateUser)),
 		r.controller.createUserHandler,
 	)
 	router.Put("/:id",
 		gorote.ValidationMiddleware(&schemaUser{}),
-		gorote.JWTProtectedRSA(&JwtClaims{}, r.publicKey, ProtectedRoute()),
+		r.protected(ProtectedRoute(), NoImpersonation()),
 		r.controller.updateUserHandler,
 	)
+	router.Post("/:id/unlock",
+		gorote.ValidationMiddleware(&recieveUser{}),
+		r.protected(ProtectedRoute(PermissionUpdateUser)),
+		r.controller.unlockUserHandler,
+	)
+	router.Get("/:id/sessions",
+		gorote.ValidationMiddleware(&recieveUser{}),
+		r.protected(ProtectedRoute(PermissionViewUser)),
+		r.controller.listUserSessionsHandler,
+	)
+	router.Delete("/:id/sessions",
+		gorote.ValidationMiddleware(&recieveUser{}),
+		r.protected(ProtectedRoute(PermissionUpdateUser)),
+		r.controller.revokeUserSessionsHandler,
+	)
+	router.Delete("/:id/sessions/:sessionId",
+		gorote.ValidationMiddleware(&userSession{}),
+		r.protected(ProtectedRoute(PermissionUpdateUser)),
+		r.controller.revokeUserSessionHandler,
+	)
 }
 
 func (r *appRouter) Role(router fiber.Router) {
 	router.Get("/",
 		gorote.ValidationMiddleware(&paginateReq{}),
-		gorote.JWTProtectedRSA(&JwtClaims{}, r.publicKey, ProtectedRoute()),
+		r.protected(ProtectedRoute()),
 		r.controller.listRolesHandler,
 	)
 	router.Post("/",
 		gorote.ValidationMiddleware(&createRole{}),
-		gorote.JWTProtectedRSA(&JwtClaims{}, r.publicKey, ProtectedRoute(PermissionCreateRole)),
+		r.protected(ProtectedRoute(PermissionCreateRole)),
 		r.controller.createRoleHandler,
 	)
+	router.Get("/:id",
+		gorote.ValidationMiddleware(&recieveRole{}),
+		r.protected(ProtectedRoute(PermissionViewRole)),
+		r.controller.recieveRoleHandler,
+	)
+	router.Put("/:id",
+		gorote.ValidationMiddleware(&updateRole{}),
+		r.protected(ProtectedRoute(PermissionUpdateRole)),
+		r.controller.updateRoleHandler,
+	)
+	router.Patch("/:id",
+		gorote.ValidationMiddleware(&patchRole{}),
+		r.protected(ProtectedRoute(PermissionUpdateRole)),
+		r.controller.patchRoleHandler,
+	)
+	router.Delete("/:id",
+		gorote.ValidationMiddleware(&recieveRole{}),
+		r.protected(ProtectedRoute(PermissionUpdateRole)),
+		r.controller.deleteRoleHandler,
+	)
+	router.Post("/:id/activate",
+		gorote.ValidationMiddleware(&recieveRole{}),
+		r.protected(ProtectedRoute(PermissionUpdateRole)),
+		r.controller.activateRoleHandler,
+	)
+	router.Post("/:id/deactivate",
+		gorote.ValidationMiddleware(&recieveRole{}),
+		r.protected(ProtectedRoute(PermissionUpdateRole)),
+		r.controller.deactivateRoleHandler,
+	)
+	router.Post("/:id/permissions",
+		gorote.ValidationMiddleware(&rolePermissions{}),
+		r.protected(ProtectedRoute(PermissionUpdateRole)),
+		r.controller.addRolePermissionsHandler,
+	)
+	router.Delete("/:id/permissions/:permissionId",
+		gorote.ValidationMiddleware(&rolePermission{}),
+		r.protected(ProtectedRoute(PermissionUpdateRole)),
+		r.controller.removeRolePermissionHandler,
+	)
+	router.Post("/:id/parents",
+		gorote.ValidationMiddleware(&roleParents{}),
+		r.protected(ProtectedRoute(PermissionUpdateRole)),
+		r.controller.addRoleParentsHandler,
+	)
+	router.Delete("/:id/parents/:parentId",
+		gorote.ValidationMiddleware(&roleParent{}),
+		r.protected(ProtectedRoute(PermissionUpdateRole)),
+		r.controller.removeRoleParentHandler,
+	)
 }
 
 func (r *appRouter) Permission(router fiber.Router) {
 	router.Get("/",
 		gorote.ValidationMiddleware(&paginateReq{}),
-		gorote.JWTProtectedRSA(&JwtClaims{}, r.publicKey, ProtectedRoute(PermissionViewPermission)),
+		r.protected(ProtectedRoute(PermissionViewPermission)),
 		r.controller.listPermissiontHandler,
 	)
+	router.Post("/",
+		gorote.ValidationMiddleware(&createPermission{}),
+		r.protected(ProtectedRoute(PermissionCreatePermission)),
+		r.controller.createPermissionHandler,
+	)
+	router.Get("/:id",
+		gorote.ValidationMiddleware(&recievePermission{}),
+		r.protected(ProtectedRoute(PermissionViewPermission)),
+		r.controller.recievePermissionHandler,
+	)
+	router.Put("/:id",
+		gorote.ValidationMiddleware(&updatePermission{}),
+		r.protected(ProtectedRoute(PermissionUpdatePermission)),
+		r.controller.updatePermissionHandler,
+	)
+	router.Delete("/:id",
+		gorote.ValidationMiddleware(&recievePermission{}),
+		r.protected(ProtectedRoute(PermissionUpdatePermission)),
+		r.controller.deletePermissionHandler,
+	)
+	router.Post("/:id/activate",
+		gorote.ValidationMiddleware(&recievePermission{}),
+		r.protected(ProtectedRoute(PermissionUpdatePermission)),
+		r.controller.activatePermissionHandler,
+	)
+	router.Post("/:id/deactivate",
+		gorote.ValidationMiddleware(&recievePermission{}),
+		r.protected(ProtectedRoute(PermissionUpdatePermission)),
+		r.controller.deactivatePermissionHandler,
+	)
+}
+
+func (r *appRouter) Client(router fiber.Router) {
+	router.Get("/",
+		gorote.ValidationMiddleware(&paginateReq{}),
+		r.protected(ProtectedRoute(PermissionViewClient)),
+		r.controller.listServiceClientsHandler,
+	)
+	router.Post("/",
+		gorote.ValidationMiddleware(&createServiceClient{}),
+		r.protected(ProtectedRoute(PermissionCreateClient)),
+		r.controller.createServiceClientHandler,
+	)
 }
 
 func (r *appRouter) Swagger(router fiber.Router) {
@@ -1,8 +1,15 @@
 package core
 
+import (
+	"time"
+
+	"github.com/ronaldalds/gorote-core-rsa/gorote"
+)
+
 type login struct {
 	Email    string `json:"email" validate:"required"`
 	Password string `json:"password" validate:"required"`
+	Device   string `json:"device" validate:"omitempty,max=100"`
 }
 
 type refreshToken struct {
@@ -12,18 +19,260 @@ type refreshToken struct {
 type token struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+type forgotPassword struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type magicLink struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type magicLinkLanding struct {
+	Token  string `query:"token" validate:"required"`
+	Device string `query:"device" validate:"omitempty,max=100"`
+}
+
+type magicLinkCallback struct {
+	Token     string `json:"token" form:"token" validate:"required"`
+	Device    string `json:"device" form:"device" validate:"omitempty,max=100"`
+	CSRFToken string `json:"csrf_token" form:"csrf_token"`
+}
+
+type providerLogin struct {
+	Provider string `param:"provider" validate:"required"`
+}
+
+type providerCallback struct {
+	Provider string `param:"provider" validate:"required"`
+	Code     string `query:"code"`
+	State    string `query:"state" validate:"required"`
+	Error    string `query:"error"`
+	Device   string `query:"device" validate:"omitempty,max=100"`
+}
+
+type verifyEmail struct {
+	Token string `query:"token" validate:"required"`
+}
+
+type resendVerification struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type resetPassword struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type mfaChallenge struct {
+	MFARequired        bool   `json:"mfa_required"`
+	EnrollmentRequired bool   `json:"enrollment_required,omitempty"`
+	MFAToken           string `json:"mfa_token"`
+}
+
+type mfaVerify struct {
+	MFAToken     string `json:"mfa_token" validate:"required"`
+	Code         string `json:"code" validate:"required_without=RecoveryCode"`
+	RecoveryCode string `json:"recovery_code"`
+	Device       string `json:"device" validate:"omitempty,max=100"`
+}
+
+type mfaCode struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type mfaEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type mfaRecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type tokenRequest struct {
+	GrantType    string `json:"grant_type" form:"grant_type" validate:"required"`
+	ClientID     string `json:"client_id" form:"client_id"`
+	ClientSecret string `json:"client_secret" form:"client_secret"`
+	Scope        string `json:"scope" form:"scope"`
+	Code         string `json:"code" form:"code"`
+	RedirectURI  string `json:"redirect_uri" form:"redirect_uri"`
+	CodeVerifier string `json:"code_verifier" form:"code_verifier"`
+}
+
+type introspectRequest struct {
+	Token         string `json:"token" form:"token" validate:"required"`
+	TokenTypeHint string `json:"token_type_hint" form:"token_type_hint"`
+	ClientID      string `json:"client_id" form:"client_id"`
+	ClientSecret  string `json:"client_secret" form:"client_secret"`
+}
+
+// introspection is the RFC 7662 response followed by the JwtClaims fields.
+// Inactive tokens only carry active.
+type introspection struct {
+	Active        bool        `json:"active"`
+	Scope         string      `json:"scope,omitempty"`
+	ClientID      string      `json:"client_id,omitempty"`
+	Username      string      `json:"username,omitempty"`
+	TokenType     string      `json:"token_type,omitempty"`
+	Exp           int64       `json:"exp,omitempty"`
+	Iat           int64       `json:"iat,omitempty"`
+	Nbf           int64       `json:"nbf,omitempty"`
+	Sub           string      `json:"sub,omitempty"`
+	Aud           []string    `json:"aud,omitempty"`
+	Iss           string      `json:"iss,omitempty"`
+	Jti           string      `json:"jti,omitempty"`
+	IsSuperUser   bool        `json:"isSuperUser,omitempty"`
+	Permissions   []string    `json:"permissions,omitempty"`
+	Tenants       []string    `json:"tenants,omitempty"`
+	Type          string      `json:"type,omitempty"`
+	Machine       bool        `json:"machine,omitempty"`
+	EmailVerified bool        `json:"email_verified,omitempty"`
+	SessionID     string      `json:"sid,omitempty"`
+	Actor         *ActorClaim `json:"act,omitempty"`
+}
+
+type authorizeRequest struct {
+	ResponseType        string `query:"response_type" form:"response_type" validate:"required"`
+	ClientID            string `query:"client_id" form:"client_id" validate:"required"`
+	RedirectURI         string `query:"redirect_uri" form:"redirect_uri" validate:"required"`
+	Scope               string `query:"scope" form:"scope"`
+	State               string `query:"state" form:"state"`
+	Nonce               string `query:"nonce" form:"nonce"`
+	CodeChallenge       string `query:"code_challenge" form:"code_challenge"`
+	CodeChallengeMethod string `query:"code_challenge_method" form:"code_challenge_method"`
+}
+
+type authorizeLogin struct {
+	authorizeRequest
+	Email     string `json:"email" form:"email"`
+	Password  string `json:"password" form:"password"`
+	MFAToken  string `json:"mfa_token" form:"mfa_token"`
+	Code      string `json:"code" form:"code"`
+	CSRFToken string `json:"csrf_token" form:"csrf_token"`
+}
+
+type oauthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+type createServiceClient struct {
+	Name         string   `json:"name" validate:"required,min=3,max=100"`
+	Description  string   `json:"description"`
+	Roles        []string `json:"roles"`
+	Public       bool     `json:"public"`
+	RedirectURIs []string `json:"redirect_uris" validate:"dive,url"`
+}
+
+type serviceClientSecret struct {
+	ServiceClient
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+type openidConfiguration struct {
+	Issuer                           string   `json:"issuer"`
+	JwksURI                          string   `json:"jwks_uri"`
+	UserinfoEndpoint                 string   `json:"userinfo_endpoint"`
+	AuthorizationEndpoint            string   `json:"authorization_endpoint"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	IntrospectionEndpoint            string   `json:"introspection_endpoint"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	GrantTypesSupported              []string `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported    []string `json:"code_challenge_methods_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                  []string `json:"scopes_supported"`
+	ClaimsSupported                  []string `json:"claims_supported"`
+}
+
+type userInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	GivenName     string `json:"given_name,omitempty"`
+	FamilyName    string `json:"family_name,omitempty"`
+	PhoneNumber   string `json:"phone_number,omitempty"`
 }
 
 type createRole struct {
 	Name        string   `json:"name" validate:"required,min=3,max=100"`
 	Description string   `json:"description"`
 	Permissions []string `json:"permissions"`
+	Parents     []string `json:"parents" validate:"omitempty,dive,uuid"`
+	RequireMFA  bool     `json:"require_mfa"`
+}
+
+type recievePermission struct {
+	ID string `param:"id" validate:"required,uuid"`
+}
+
+type createPermission struct {
+	Code        string `json:"code" validate:"required,max=50,regexp=^[a-zA-Z0-9_]+$"`
+	Description string `json:"description"`
+}
+
+type updatePermission struct {
+	ID          string `param:"id" validate:"required,uuid"`
+	Description string `json:"description"`
+}
+
+type recieveRole struct {
+	ID string `param:"id" validate:"required,uuid"`
+}
+
+// updateRole replaces the role fields; an absent require_mfa keeps the stored
+// value, so a rename doesn't turn MFA off.
+type updateRole struct {
+	ID          string `param:"id" validate:"required,uuid"`
+	Name        string `json:"name" validate:"required,min=3,max=100"`
+	Description string `json:"description"`
+	RequireMFA  *bool  `json:"require_mfa"`
+}
+
+// patchRole changes only the fields present in the body.
+type patchRole struct {
+	ID          string  `param:"id" validate:"required,uuid"`
+	Name        *string `json:"name" validate:"omitempty,min=3,max=100"`
+	Description *string `json:"description"`
+	RequireMFA  *bool   `json:"require_mfa"`
+	Active      *bool   `json:"active"`
+}
+
+type rolePermissions struct {
+	ID          string   `param:"id" validate:"required,uuid"`
+	Permissions []string `json:"permissions" validate:"required,min=1,dive,uuid"`
+}
+
+type rolePermission struct {
+	ID           string `param:"id" validate:"required,uuid"`
+	PermissionID string `param:"permissionId" validate:"required,uuid"`
+}
+
+type roleParents struct {
+	ID      string   `param:"id" validate:"required,uuid"`
+	Parents []string `json:"parents" validate:"required,min=1,dive,uuid"`
+}
+
+type roleParent struct {
+	ID       string `param:"id" validate:"required,uuid"`
+	ParentID string `param:"parentId" validate:"required,uuid"`
 }
 
 type createUser struct {
 	schemaUser
 	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=6"`
+	Password string `json:"password" validate:"required_without=Provider"`
+	// Provider registers a user of an external authenticator, who has no
+	// password.
+	Provider string `json:"provider" validate:"omitempty,max=50"`
 }
 
 type recieveUser struct {
@@ -63,6 +312,76 @@ type listRole struct {
 	Data []Role `json:"data"`
 }
 
+type listServiceClient struct {
+	paginateRes
+	Data []ServiceClient `json:"data"`
+}
+
+// passwordRejected is the 400 body of a password refused by the policy.
+type passwordRejected struct {
+	Error      string                     `json:"error"`
+	Violations []gorote.PasswordViolation `json:"violations"`
+}
+
+type sessionInfo struct {
+	Session
+	Current bool `json:"current"`
+}
+
+type mySession struct {
+	SessionID string `param:"sessionId" validate:"required,uuid"`
+}
+
+type userSession struct {
+	ID        string `param:"id" validate:"required"`
+	SessionID string `param:"sessionId" validate:"required,uuid"`
+}
+
+type createPersonalToken struct {
+	Name        string    `json:"name" validate:"required,max=100"`
+	Permissions []string  `json:"permissions" validate:"required,min=1,dive,required"`
+	ExpiresAt   time.Time `json:"expires_at" validate:"required"`
+}
+
+type personalTokenSecret struct {
+	PersonalAccessToken
+	Token string `json:"token"`
+}
+
+type myPersonalToken struct {
+	TokenID string `param:"tokenId" validate:"required,uuid"`
+}
+
+type listLoginEvents struct {
+	Page    uint   `query:"page" validate:"required,min=1"`
+	Limit   uint   `query:"limit" validate:"required,max=1000"`
+	UserID  string `query:"user_id" validate:"omitempty,uuid"`
+	Outcome string `query:"outcome" validate:"omitempty,oneof=success failure mfa_required"`
+	From    string `query:"from" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	To      string `query:"to" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+}
+
+type impersonate struct {
+	UserID string `param:"userId" validate:"required,uuid"`
+}
+
+type listImpersonationEvents struct {
+	Page    uint   `query:"page" validate:"required,min=1"`
+	Limit   uint   `query:"limit" validate:"required,max=1000"`
+	ActorID string `query:"actor_id" validate:"omitempty,uuid"`
+	UserID  string `query:"user_id" validate:"omitempty,uuid"`
+}
+
+type listImpersonationEvent struct {
+	paginateRes
+	Data []ImpersonationEvent `json:"data"`
+}
+
+type listLoginEvent struct {
+	paginateRes
+	Data []LoginEvent `json:"data"`
+}
+
 type listPermission struct {
 	paginateRes
 	Data []Permission `json:"data"`
@@ -1,28 +1,190 @@
 package core
 
 import (
+	"fmt"
+	"log"
 	"slices"
+	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
 )
 
+// JwtClaims are the claims of the tokens core issues. The user id is the
+// subject (sub); jti identifies the token itself, for rotation and
+// revocation. Before refresh token rotation jti held the user id, so code
+// reading claims.ID as the user must switch to UserID.
 type JwtClaims struct {
-	IsSuperUser bool     `json:"isSuperUser"`
-	Permissions []string `json:"permissions"`
-	Tenants     []string `json:"tenants"`
-	Type        string   `json:"type"`
+	IsSuperUser   bool        `json:"isSuperUser"`
+	Permissions   []string    `json:"permissions"`
+	Tenants       []string    `json:"tenants"`
+	Type          string      `json:"type"`
+	Machine       bool        `json:"machine,omitempty"`
+	EmailVerified bool        `json:"email_verified"`
+	SessionID     string      `json:"sid,omitempty"`
+	Actor         *ActorClaim `json:"act,omitempty"`
+	jwt.RegisteredClaims
+
+	// accepted lists the token types Validate accepts besides access_token.
+	accepted []string
+}
+
+// AcceptTokens returns claims for the JWTProtected middlewares that also
+// accept the given token types, such as personal_access_token on routes
+// enforcing its scope with ProtectedRoute.
+func AcceptTokens(types ...string) *JwtClaims {
+	return &JwtClaims{accepted: types}
+}
+
+// Validate refuses tokens other than access tokens, such as the mfa_token of
+// a login still waiting for its second factor, unless the claims come from
+// AcceptTokens. The jwt parser calls it once the signature is verified, so a
+// route protected with a bare &JwtClaims{} only lets access tokens through.
+func (c *JwtClaims) Validate() error {
+	if c.Type == "access_token" || slices.Contains(c.accepted, c.Type) {
+		return nil
+	}
+	return fmt.Errorf("token type %q not accepted", c.Type)
+}
+
+// UserID returns the id of the user the token was issued to, or the client_id
+// of machine tokens.
+func (c *JwtClaims) UserID() string {
+	return c.Subject
+}
+
+// Audit records a request made with an impersonation token, through the
+// recorder of its issuer. The JWTProtected middlewares call it once the route
+// answers; tokens without an actor or recorder are left alone.
+func (c *JwtClaims) Audit(ctx *fiber.Ctx, status int) {
+	if c.Actor == nil {
+		return
+	}
+	impersonationRecorders.RLock()
+	record := impersonationRecorders.byIssuer[c.Issuer]
+	impersonationRecorders.RUnlock()
+	if record == nil {
+		return
+	}
+	event := impersonationEvent(ctx, c, status)
+	if event == nil {
+		return
+	}
+	if err := record(event); err != nil {
+		log.Printf("audit of impersonated request: %v", err)
+	}
+}
+
+// impersonationRecorders maps each issuer to where the requests made with its
+// impersonation tokens are recorded.
+var impersonationRecorders struct {
+	sync.RWMutex
+	byIssuer map[string]func(*ImpersonationEvent) error
+}
+
+func useImpersonationRecorder(issuer string, record func(*ImpersonationEvent) error) {
+	impersonationRecorders.Lock()
+	defer impersonationRecorders.Unlock()
+	if impersonationRecorders.byIssuer == nil {
+		impersonationRecorders.byIssuer = map[string]func(*ImpersonationEvent) error{}
+	}
+	impersonationRecorders.byIssuer[issuer] = record
+}
+
+// AuditImpersonations records in the core database the requests a
+// microservice running in another process receives with impersonation tokens
+// of issuer (the AppName of core). New already does it for the core routes and
+// the microservices in its process.
+func AuditImpersonations(issuer string, db *gorm.DB) {
+	useImpersonationRecorder(issuer, func(event *ImpersonationEvent) error {
+		return saveImpersonationEvent(db, event, time.Now())
+	})
+}
+
+// ActorClaim is the RFC 8693 act claim: the user acting as the subject of an
+// impersonation token.
+type ActorClaim struct {
+	Subject string `json:"sub"`
+}
+
+type emailVerificationClaims struct {
+	Email string `json:"email"`
+	Type  string `json:"type"`
 	jwt.RegisteredClaims
 }
 
+// providerLoginClaims ties the callback of an external provider to the browser
+// that started the login, in the provider_login cookie.
+type providerLoginClaims struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Type     string `json:"type"`
+	jwt.RegisteredClaims
+}
+
+type IDTokenClaims struct {
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+	GivenName     string `json:"given_name,omitempty"`
+	FamilyName    string `json:"family_name,omitempty"`
+	PhoneNumber   string `json:"phone_number,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// mfaEnrollmentRoute accepts an access token or the mfa_token of a login that
+// still has to enroll, so enforced users can set up TOTP before their first
+// token pair.
+func mfaEnrollmentRoute() func(jwt.Claims) *fiber.Error {
+	return func(c jwt.Claims) *fiber.Error {
+		claims, ok := c.(*JwtClaims)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid claims type")
+		}
+		if claims.Type != "access_token" && claims.Type != "mfa_token" {
+			return fiber.NewError(fiber.StatusUnauthorized, "token is not access token")
+		}
+		return nil
+	}
+}
+
+// NoImpersonation refuses impersonation tokens, for routes support staff must
+// not reach as the user, such as MFA or credential management.
+func NoImpersonation() func(jwt.Claims) *fiber.Error {
+	return func(c jwt.Claims) *fiber.Error {
+		claims, ok := c.(*JwtClaims)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid claims type")
+		}
+		if claims.Actor != nil {
+			return fiber.NewError(fiber.StatusForbidden, "not allowed while impersonating")
+		}
+		return nil
+	}
+}
+
 func ProtectedRoute(p ...PermissionCode) func(jwt.Claims) *fiber.Error {
 	return func(c jwt.Claims) *fiber.Error {
 		claims, ok := c.(*JwtClaims)
 		if !ok {
 			return fiber.NewError(fiber.StatusUnauthorized, "invalid claims type")
 		}
-		if claims.Type == "refresh_token" {
-			return fiber.NewError(fiber.StatusUnauthorized, "token is refresh token")
+		if claims.Type == "personal_access_token" {
+			// Personal access tokens only reach routes that require one of
+			// their permissions, whoever the owner is.
+			for _, permission := range p {
+				if slices.Contains(claims.Permissions, string(permission)) {
+					return nil
+				}
+			}
+			return fiber.NewError(fiber.StatusUnauthorized, "permission not granted to token")
+		}
+		if claims.Type != "access_token" {
+			return fiber.NewError(fiber.StatusUnauthorized, "token is not access token")
 		}
 		if claims.IsSuperUser {
 			return nil
@@ -1,28 +1,128 @@
 package core
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
 	"fmt"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/ronaldalds/gorote-core-rsa/gorote"
 	"gorm.io/gorm"
 )
 
+// Authorization codes are exchanged right after the redirect, so they only
+// live for a minute (RFC 6749 section 4.1.2).
+const authorizationCodeExpire = time.Minute
+
+// The MFA challenge token only bridges the password step and the TOTP step.
+const mfaChallengeExpire = 5 * time.Minute
+
+// A challenge is revoked after this many wrong codes, so the password step
+// (and its lockout) must be gone through again.
+const mfaMaxFailures = 5
+
+const mfaRecoveryCodeCount = 10
+
+const passwordResetExpire = 30 * time.Minute
+
+const emailVerificationExpire = 24 * time.Hour
+
+const magicLinkExpire = 15 * time.Minute
+
+// An external login must come back from the provider page within this time.
+const providerLoginExpire = 10 * time.Minute
+
+// The authorize login page must be submitted within this time, along with the
+// authorize_csrf cookie it set.
+const authorizeFormExpire = 10 * time.Minute
+
+// Impersonation tokens are short and fixed, and never come with a refresh
+// token.
+const impersonationExpire = 15 * time.Minute
+
 type servicer interface {
 	health() (*gorote.Health, error)
 	setCookie(*fiber.Ctx, string, string) error
-	generateJwt(*User, string) (string, error)
-	login(*login) (*User, error)
+	clearCookie(*fiber.Ctx, string) error
+	generateJwt(*User, string, string) (string, error)
+	createSession(*User, string, string, string) (*Session, error)
+	sessions(string) ([]Session, error)
+	revokeSession(string, string) error
+	revokeUserTokens(string) error
+	personalTokens(string) ([]PersonalAccessToken, error)
+	createPersonalToken(string, *createPersonalToken) (*PersonalAccessToken, string, error)
+	revokePersonalToken(string, string) error
+	checkPersonalToken(*JwtClaims) error
+	rotateRefreshToken(*User, *JwtClaims) (string, error)
+	logout(*JwtClaims, string) error
+	logoutAll(*JwtClaims) error
+	forgotPassword(string) error
+	magicLink() bool
+	sendMagicLink(string) error
+	magicLinkLogin(string) (*User, error)
+	sendVerificationEmail(*User) error
+	resendVerification(string) error
+	verifyEmail(string) error
+	resetPassword(*resetPassword) error
+	login(*login, string) (*User, error)
+	startProviderLogin(string, string) (string, string, error)
+	providerLogin(*providerCallback, string, string) (*User, error)
+	recordLoginEvent(*LoginEvent) error
+	loginEvents(*listLoginEvents) ([]LoginEvent, int64, error)
+	impersonate(*JwtClaims, string) (*JwtClaims, string, error)
+	recordImpersonation(*ImpersonationEvent) error
+	impersonationEvents(*listImpersonationEvents) ([]ImpersonationEvent, int64, error)
+	unlockUser(string) error
 	users(...string) ([]User, error)
 	roles(...string) ([]Role, error)
 	permissions(...string) ([]Permission, error)
+	permission(string) (*Permission, error)
+	createPermission(*createPermission) (*Permission, error)
+	updatePermission(*updatePermission) (*Permission, error)
+	setPermissionActive(string, bool) (*Permission, error)
+	deletePermission(string) error
 	createRole(*createRole) (*Role, error)
+	role(string) (*Role, error)
+	updateRole(*patchRole) (*Role, error)
+	addRolePermissions(string, []string) (*Role, error)
+	removeRolePermission(string, string) (*Role, error)
+	addRoleParents(string, []string) (*Role, error)
+	removeRoleParent(string, string) (*Role, error)
+	effectivePermissions([]Role) error
+	deleteRole(string) error
 	createUser(*createUser, bool) (*User, error)
+	checkPassword(*User, string) error
+	hashPassword(string) (string, error)
 	updateUser(*schemaUser, bool, bool) (*User, error)
 	claims(jwt.Claims, string) error
+	jwks() (*gorote.JWKS, error)
+	generateIDToken(*User, string, string) (string, error)
+	openidConfiguration(string) *openidConfiguration
+	userInfo(string) (*userInfo, error)
+	serviceClients(...string) ([]ServiceClient, error)
+	createServiceClient(*createServiceClient) (*ServiceClient, string, error)
+	authenticateClient(string, string) (*ServiceClient, error)
+	introspect(string) *introspection
+	clientCredentialsToken(*ServiceClient, []string) (*oauthToken, error)
+	mfaRequired(*User) bool
+	generateMFAToken(*User) (string, error)
+	verifyMFA(*mfaVerify) (*User, error)
+	enrollMFA(string) (*mfaEnrollment, error)
+	confirmMFA(string, string) ([]string, error)
+	disableMFA(string, string) error
+	oauthClient(string, string) (*ServiceClient, error)
+	authorizeClient(string, string) (*ServiceClient, error)
+	createAuthorizationCode(*ServiceClient, *User, *authorizeRequest) (string, error)
+	redeemAuthorizationCode(*ServiceClient, *tokenRequest) (*User, *AuthorizationCode, error)
+	authorizationCodeToken(*ServiceClient, *User, *AuthorizationCode, *Session) (*oauthToken, error)
 }
 
 func (s *appService) health() (*gorote.Health, error) {
@@ -39,6 +139,28 @@ func (s *appService) setCookie(ctx *fiber.Ctx, typeToken, token string) error {
 	default:
 		return fmt.Errorf("invalid token type")
 	}
+	s.writeCookie(ctx, &fiber.Cookie{
+		Name:   typeToken,
+		Value:  token,
+		MaxAge: int(expire.Seconds()),
+	})
+	return nil
+}
+
+func (s *appService) clearCookie(ctx *fiber.Ctx, typeToken string) error {
+	switch typeToken {
+	case "access_token", "refresh_token":
+	default:
+		return fmt.Errorf("invalid token type")
+	}
+	s.writeCookie(ctx, &fiber.Cookie{
+		Name:    typeToken,
+		Expires: time.Unix(0, 0),
+	})
+	return nil
+}
+
+func (s *appService) writeCookie(ctx *fiber.Ctx, cookie *fiber.Cookie) {
 	domains := s.domain()
 	if domains != "" {
 		for domain := range strings.SplitSeq(domains, ",") {
@@ -47,27 +169,79 @@ func (s *appService) setCookie(ctx *fiber.Ctx, typeToken, token string) error {
 				continue
 			}
 			ctx.Cookie(&fiber.Cookie{
-				Name:     typeToken,
-				Value:    token,
+				Name:     cookie.Name,
+				Value:    cookie.Value,
 				HTTPOnly: true,
 				Secure:   true,
 				SameSite: "None",
 				Domain:   domain,
 				Path:     "/",
-				MaxAge:   int(expire.Seconds()),
+				MaxAge:   cookie.MaxAge,
+				Expires:  cookie.Expires,
 			})
 		}
 	}
-	return nil
 }
 
-func (s *appService) generateJwt(user *User, typeToken string) (string, error) {
-	var permissions []string
-	for _, role := range user.Roles {
-		for _, permission := range role.Permissions {
-			permissions = append(permissions, permission.Code)
+// generateJwt signs a token of the given type; sessionID, when set, becomes
+// the sid claim and owns the refresh token.
+func (s *appService) generateJwt(user *User, typeToken, sessionID string) (string, error) {
+	claims, err := s.newClaims(user, typeToken, sessionID)
+	if err != nil {
+		return "", err
+	}
+	if typeToken == "refresh_token" {
+		if err := s.saveRefreshToken(s.db(), claims, nil); err != nil {
+			return "", err
 		}
 	}
+	return s.signJwt(claims)
+}
+
+// roleLineage pairs each of the active roles in ? with itself and with the
+// active roles it inherits from, as lineage(role_id, id). An inactive role
+// grants nothing, not even what it inherits; UNION ends the walk on cycles.
+const roleLineage = `WITH RECURSIVE lineage(role_id, id) AS (
+	SELECT id, id FROM roles WHERE id IN ? AND active = ? AND deleted_at IS NULL
+	UNION
+	SELECT lineage.role_id, roles.id FROM lineage
+	JOIN roles_parents ON roles_parents.role_id = lineage.id
+	JOIN roles ON roles.id = roles_parents.parent_id
+	WHERE roles.active = ? AND roles.deleted_at IS NULL
+)`
+
+// grantedPermissions returns the active codes granted by the active roles,
+// inherited ones included, without duplicates. The hierarchy is flattened by
+// a single query, whatever the number of roles.
+func (s *appService) grantedPermissions(roles []Role) ([]string, error) {
+	if len(roles) == 0 {
+		return nil, nil
+	}
+	ids := make([]uuid.UUID, 0, len(roles))
+	for _, role := range roles {
+		ids = append(ids, role.ID)
+	}
+	var codes []string
+	if err := s.db().Raw(roleLineage+`
+		SELECT DISTINCT permissions.code FROM lineage
+		JOIN roles_permissions ON roles_permissions.role_id = lineage.id
+		JOIN permissions ON permissions.id = roles_permissions.permission_id
+		WHERE permissions.active = ? AND permissions.deleted_at IS NULL
+		ORDER BY permissions.code`, ids, true, true, true).
+		Scan(&codes).Error; err != nil {
+		return nil, fmt.Errorf("failed to query permissions")
+	}
+	if len(codes) == 0 {
+		return nil, nil
+	}
+	return codes, nil
+}
+
+func (s *appService) newClaims(user *User, typeToken, sessionID string) (*JwtClaims, error) {
+	permissions, err := s.grantedPermissions(user.Roles)
+	if err != nil {
+		return nil, err
+	}
 	var tenants []string
 	for _, tenant := range user.Tenants {
 		tenants = append(tenants, tenant.Name)
@@ -80,257 +254,2483 @@ func (s *appService) generateJwt(user *User, typeToken string) (string, error) {
 	case "refresh_token":
 		expire = s.jwt().JwtExpireRefresh
 	default:
-		return "", fmt.Errorf("invalid token type")
+		return nil, fmt.Errorf("invalid token type")
 	}
 
-	token, err := gorote.GenerateJwtWithRSA(JwtClaims{
-		IsSuperUser: user.IsSuperUser,
-		Permissions: permissions,
-		Tenants:     tenants,
-		Type:        typeToken,
+	return &JwtClaims{
+		IsSuperUser:   user.IsSuperUser,
+		Permissions:   permissions,
+		Tenants:       tenants,
+		Type:          typeToken,
+		EmailVerified: user.EmailVerified,
+		SessionID:     sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ID:        user.ID.String(),
+			ID:        uuid.New().String(),
+			Subject:   user.ID.String(),
 			Issuer:    s.name(),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expire)),
 		},
-	}, s.privateKeyRSA())
+	}, nil
+}
+
+func (s *appService) signJwt(claims *JwtClaims) (string, error) {
+	token, err := s.keys.Sign(claims)
 	if err != nil {
 		return "", err
 	}
 	return token, nil
 }
 
-func (s *appService) login(req *login) (*User, error) {
-	var user User
-	result := s.db().
-		Preload("Roles.Permissions").
-		Preload("Tenants").
-		Where("email = ?", req.Email).
-		First(&user)
-	if result.Error != nil {
-		return nil, fmt.Errorf("failed to login: username or password is incorrect")
+func (s *appService) saveRefreshToken(tx *gorm.DB, claims *JwtClaims, parent *RefreshToken) error {
+	id, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return fmt.Errorf("invalid token id")
 	}
-	if !gorote.CheckPasswordHash(req.Password, user.Password) {
-		return nil, fmt.Errorf("failed to login: username or password is incorrect")
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return fmt.Errorf("invalid token subject")
 	}
-	if !user.Active {
-		return nil, fmt.Errorf("failed to login: user is inactive")
+	refresh := RefreshToken{
+		BaseModel: BaseModel{ID: id},
+		UserID:    userID,
+		FamilyID:  id,
+		ExpiresAt: claims.ExpiresAt.Time,
 	}
-	return &user, nil
+	if claims.SessionID != "" {
+		sessionID, err := uuid.Parse(claims.SessionID)
+		if err != nil {
+			return fmt.Errorf("invalid token session")
+		}
+		refresh.SessionID = &sessionID
+	}
+	if parent != nil {
+		refresh.FamilyID = parent.FamilyID
+		refresh.ParentID = &parent.ID
+	}
+	if err := tx.Create(&refresh).Error; err != nil {
+		return fmt.Errorf("failed to save refresh token")
+	}
+	return nil
 }
 
-func (s *appService) users(ids ...string) ([]User, error) {
-	var data []User
-	if len(ids) == 0 {
-		if err := s.db().
-			Preload("Roles.Permissions").
-			Preload("Tenants").
-			Find(&data).Error; err != nil {
-			return nil, fmt.Errorf("failed to query database list")
+var errRefreshTokenReused = errors.New("failed to refresh token: token reuse detected")
+
+func (s *appService) rotateRefreshToken(user *User, claims *JwtClaims) (string, error) {
+	var parent RefreshToken
+	if err := s.db().Where("id = ? AND user_id = ?", claims.ID, user.ID).First(&parent).Error; err != nil {
+		return "", fmt.Errorf("failed to refresh token: token not found")
+	}
+	if parent.RevokedAt != nil {
+		return "", fmt.Errorf("failed to refresh token: token revoked")
+	}
+	if claims.SessionID != "" {
+		if err := s.touchSession(claims.SessionID); err != nil {
+			return "", err
 		}
-		return data, nil
 	}
 
-	if err := s.db().
-		Preload("Roles.Permissions").
-		Preload("Tenants").
-		Where("id IN ?", ids).
-		Find(&data).Error; err != nil {
-		return nil, fmt.Errorf("failed to query database")
+	next, err := s.newClaims(user, "refresh_token", claims.SessionID)
+	if err != nil {
+		return "", err
 	}
-	return data, nil
+	// The parent is only spent along with saving its child, so a failed save
+	// leaves it usable for a retry instead of reporting the retry as reuse.
+	if err := s.db().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&RefreshToken{}).
+			Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", parent.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return fmt.Errorf("failed to refresh token")
+		}
+		if result.RowsAffected == 0 {
+			return errRefreshTokenReused
+		}
+		return s.saveRefreshToken(tx, next, &parent)
+	}); err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			if err := s.revokeRefreshFamily(parent.FamilyID); err != nil {
+				return "", err
+			}
+		}
+		return "", err
+	}
+	return s.signJwt(next)
 }
 
-func (s *appService) tenants(names ...string) ([]Tenant, error) {
-	var data []Tenant
-	if len(names) == 0 {
-		if err := s.db().
-			Find(&data).Error; err != nil {
-			return nil, fmt.Errorf("failed to query database")
-		}
-		return data, nil
+func (s *appService) revokeRefreshFamily(family uuid.UUID) error {
+	if err := s.db().Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", family).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens")
 	}
-	if err := s.db().
-		Where("name IN ?", names).
-		Find(&data).Error; err != nil {
-		return nil, fmt.Errorf("failed to fetch tenants")
+	return nil
+}
+
+func (s *appService) createSession(user *User, device, ip, userAgent string) (*Session, error) {
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
 	}
-	return data, nil
+	now := time.Now()
+	session := Session{
+		UserID:     user.ID,
+		Device:     device,
+		IP:         ip,
+		UserAgent:  userAgent,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.jwt().JwtExpireRefresh),
+	}
+	if err := s.db().Create(&session).Error; err != nil {
+		return nil, fmt.Errorf("failed to create session")
+	}
+	return &session, nil
 }
 
-func (s *appService) roles(ids ...string) ([]Role, error) {
-	var data []Role
-	if len(ids) == 0 {
-		if err := s.db().
-			Preload("Permissions").
-			Find(&data).Error; err != nil {
-			return nil, fmt.Errorf("failed to query database")
-		}
-		return data, nil
+// touchSession refuses a revoked or expired session and otherwise records the
+// refresh as its last activity.
+func (s *appService) touchSession(sessionID string) error {
+	now := time.Now()
+	result := s.db().Model(&Session{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, now).
+		Updates(map[string]any{
+			"last_seen_at": now,
+			"expires_at":   now.Add(s.jwt().JwtExpireRefresh),
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to refresh token")
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("failed to refresh token: session revoked")
 	}
+	return nil
+}
+
+// sessions lists the active sessions of a user, most recently used first.
+func (s *appService) sessions(userID string) ([]Session, error) {
+	var sessions []Session
 	if err := s.db().
-		Preload("Permissions").
-		Where("id IN ?", ids).
-		Find(&data).Error; err != nil {
-		return nil, fmt.Errorf("failed to fetch roles")
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error; err != nil {
+		return nil, fmt.Errorf("failed to query sessions")
 	}
-	return data, nil
+	return sessions, nil
 }
 
-func (s *appService) permissions(ids ...string) ([]Permission, error) {
-	var permissions []Permission
-	if len(ids) == 0 {
-		if err := s.db().
-			Preload("Roles").
-			Find(&permissions).Error; err != nil {
-			return nil, fmt.Errorf("failed to query database")
+var errSessionNotFound = errors.New("session not found")
+
+// revokeSession ends one session of the user: its refresh tokens stop
+// working and its access tokens are denied by sid.
+func (s *appService) revokeSession(userID, sessionID string) error {
+	now := time.Now()
+	result := s.db().Model(&Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Update("revoked_at", now)
+	if result.Error != nil {
+		return fmt.Errorf("failed to revoke session")
+	}
+	if result.RowsAffected == 0 {
+		return errSessionNotFound
+	}
+	if err := s.revocations.Revoke(context.Background(), gorote.SessionRevocationID(sessionID), now.Add(s.jwt().JwtExpireAccess)); err != nil {
+		return fmt.Errorf("failed to revoke session tokens")
+	}
+	if err := s.db().Model(&RefreshToken{}).
+		Where("session_id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", now).Error; err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens")
+	}
+	return nil
+}
+
+func (s *appService) logout(claims *JwtClaims, refreshToken string) error {
+	ctx := context.Background()
+	if err := s.revocations.Revoke(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return fmt.Errorf("failed to revoke access token")
+	}
+	if claims.SessionID != "" {
+		if err := s.revokeSession(claims.Subject, claims.SessionID); err != nil && !errors.Is(err, errSessionNotFound) {
+			return err
 		}
-		return permissions, nil
 	}
-	if err := s.db().
-		Preload("Roles").
-		Where("id IN ?", ids).
-		Find(&permissions).Error; err != nil {
-		return nil, fmt.Errorf("failed to fetch permissions")
+	if refreshToken == "" {
+		return nil
+	}
+	refreshClaims := AcceptTokens("refresh_token")
+	if err := s.claims(refreshClaims, refreshToken); err != nil {
+		return nil
+	}
+	if refreshClaims.Type != "refresh_token" || refreshClaims.Subject != claims.Subject {
+		return nil
+	}
+	var refresh RefreshToken
+	if err := s.db().Where("id = ?", refreshClaims.ID).First(&refresh).Error; err != nil {
+		return nil
 	}
+	return s.revokeRefreshFamily(refresh.FamilyID)
+}
 
-	return permissions, nil
+func (s *appService) logoutAll(claims *JwtClaims) error {
+	return s.revokeUserTokens(claims.Subject)
 }
 
-func (s *appService) createRole(req *createRole) (*Role, error) {
-	var role Role
-	permissions, err := s.permissions(req.Permissions...)
+// revokeUserTokens ends every session of the user: issued access tokens are
+// denied by subject and all refresh families are revoked.
+func (s *appService) revokeUserTokens(userID string) error {
+	expire := max(s.jwt().JwtExpireAccess, s.jwt().JwtExpireRefresh)
+	if err := s.revocations.RevokeSubject(context.Background(), userID, time.Now().Add(expire)); err != nil {
+		return fmt.Errorf("failed to revoke tokens")
+	}
+	if err := s.db().Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens")
+	}
+	if err := s.db().Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return fmt.Errorf("failed to revoke sessions")
+	}
+	// Personal tokens outlive the subject revocation, so each one is revoked
+	// for good.
+	tokens, err := s.personalTokens(userID)
 	if err != nil {
-		return nil, fmt.Errorf("permission with ids does not exist")
+		return err
 	}
+	return s.revokePersonalTokens(tokens...)
+}
 
-	role.Name = req.Name
-	role.Description = req.Description
-	role.Permissions = permissions
-	role.Active = true
+var errPersonalTokenNotFound = errors.New("personal token not found")
 
-	if err := s.db().Create(&role).Error; err != nil {
-		return nil, fmt.Errorf("failed to create role")
+// createPersonalToken signs a personal access token restricted to permissions
+// the user holds. The token is only returned here; the database keeps its hash.
+func (s *appService) createPersonalToken(userID string, req *createPersonalToken) (*PersonalAccessToken, string, error) {
+	now := time.Now()
+	if !req.ExpiresAt.After(now) {
+		return nil, "", fmt.Errorf("expires_at must be in the future")
+	}
+	if maxLifetime := s.personalTokenMaxLifetime(); req.ExpiresAt.After(now.Add(maxLifetime)) {
+		return nil, "", fmt.Errorf("expires_at must be within %d days", int(maxLifetime.Hours()/24))
 	}
-	return &role, nil
-}
 
-func (s *appService) createUser(req *createUser, editorSuper bool) (*User, error) {
 	var user User
-	if err := s.db().Transaction(func(tx *gorm.DB) error {
-		roles, err := s.roles(req.Roles...)
-		if err != nil {
-			return fmt.Errorf("group with ids does not exist")
+	if err := s.db().
+		Preload("Roles.Permissions").
+		Preload("Tenants").
+		Where("id = ? AND active = ?", userID, true).
+		First(&user).Error; err != nil {
+		return nil, "", fmt.Errorf("user not found")
+	}
+	var held []string
+	if user.IsSuperUser {
+		if err := s.db().Model(&Permission{}).Pluck("code", &held).Error; err != nil {
+			return nil, "", fmt.Errorf("failed to query permissions")
 		}
-
-		user.FirstName = req.FirstName
-		user.LastName = req.LastName
-		user.Active = req.Active
-		if editorSuper {
-			user.IsSuperUser = req.IsSuperUser
+	}
+	granted, err := s.grantedPermissions(user.Roles)
+	if err != nil {
+		return nil, "", err
+	}
+	held = append(held, granted...)
+	codes := slices.Clone(req.Permissions)
+	slices.Sort(codes)
+	codes = slices.Compact(codes)
+	for _, code := range codes {
+		if !slices.Contains(held, code) {
+			return nil, "", fmt.Errorf("permission %s not granted to user", code)
 		}
-		user.Phone1 = &req.Phone1
-		user.Phone2 = &req.Phone2
+	}
+	var permissions []Permission
+	if err := s.db().Where("code IN ?", codes).Find(&permissions).Error; err != nil {
+		return nil, "", fmt.Errorf("failed to query permissions")
+	}
+	var tenants []string
+	for _, tenant := range user.Tenants {
+		tenants = append(tenants, tenant.Name)
+	}
 
-		if len(req.Roles) > 0 {
-			roles, err := s.roles(req.Roles...)
-			if err != nil {
-				return err
-			}
-			user.Roles = roles
-		}
-		if len(req.Tenants) > 0 {
-			tenants, err := s.tenants(req.Tenants...)
-			if err != nil {
-				return err
-			}
-			user.Tenants = tenants
-		}
+	token := PersonalAccessToken{
+		BaseModel:   BaseModel{ID: uuid.New()},
+		UserID:      user.ID,
+		Name:        req.Name,
+		Permissions: permissions,
+		ExpiresAt:   req.ExpiresAt,
+	}
+	secret, err := s.signJwt(&JwtClaims{
+		Permissions:   codes,
+		Tenants:       tenants,
+		Type:          "personal_access_token",
+		EmailVerified: user.EmailVerified,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        token.ID.String(),
+			Subject:   user.ID.String(),
+			Issuer:    s.name(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(req.ExpiresAt),
+		},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	token.TokenHash = gorote.HashToken(secret)
+	if err := s.db().Create(&token).Error; err != nil {
+		return nil, "", fmt.Errorf("failed to create personal token")
+	}
+	return &token, secret, nil
+}
 
-		if err := s.db().Create(&user).Error; err != nil {
-			return fmt.Errorf("failed to create user")
-		}
+// personalTokens lists the usable personal access tokens of a user, newest
+// first.
+func (s *appService) personalTokens(userID string) ([]PersonalAccessToken, error) {
+	var tokens []PersonalAccessToken
+	if err := s.db().
+		Preload("Permissions").
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("created_at DESC").
+		Find(&tokens).Error; err != nil {
+		return nil, fmt.Errorf("failed to query personal tokens")
+	}
+	return tokens, nil
+}
 
-		if err := s.db().Model(&user).Association("Roles").Replace(roles); err != nil {
-			return fmt.Errorf("failed to set roles for user")
+// checkPersonalToken refuses a personal access token whose row was revoked or
+// expired, whose owner is inactive, or whose owner no longer holds all of its
+// permissions. The scope is checked again on every request because roles may
+// change after the token was created.
+func (s *appService) checkPersonalToken(claims *JwtClaims) error {
+	var count int64
+	if err := s.db().Model(&PersonalAccessToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?", claims.ID, claims.Subject, time.Now()).
+		Count(&count).Error; err != nil || count == 0 {
+		return errPersonalTokenNotFound
+	}
+	var user User
+	if err := s.db().Preload("Roles").Where("id = ? AND active = ?", claims.Subject, true).First(&user).Error; err != nil {
+		return fmt.Errorf("user not found")
+	}
+	if user.IsSuperUser {
+		return nil
+	}
+	held, err := s.grantedPermissions(user.Roles)
+	if err != nil {
+		return err
+	}
+	for _, code := range claims.Permissions {
+		if !slices.Contains(held, code) {
+			return fmt.Errorf("permission %s no longer granted to user", code)
 		}
+	}
+	return nil
+}
 
-		if err := tx.Model(&user).Association("Tenants").Replace(user.Tenants); err != nil {
-			return fmt.Errorf("failed to set tenants for user: %w", err)
-		}
+func (s *appService) revokePersonalToken(userID, tokenID string) error {
+	var token PersonalAccessToken
+	if err := s.db().
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", tokenID, userID).
+		First(&token).Error; err != nil {
+		return errPersonalTokenNotFound
+	}
+	return s.revokePersonalTokens(token)
+}
 
+// revokePersonalTokens denies the tokens until they expire and marks them
+// revoked, so New can deny them again after a restart.
+func (s *appService) revokePersonalTokens(tokens ...PersonalAccessToken) error {
+	if len(tokens) == 0 {
 		return nil
-	}); err != nil {
-		return nil, err
 	}
+	ids := make([]uuid.UUID, 0, len(tokens))
+	for _, token := range tokens {
+		if err := s.revocations.Revoke(context.Background(), token.ID.String(), token.ExpiresAt); err != nil {
+			return fmt.Errorf("failed to revoke personal token")
+		}
+		ids = append(ids, token.ID)
+	}
+	if err := s.db().Model(&PersonalAccessToken{}).
+		Where("id IN ?", ids).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return fmt.Errorf("failed to revoke personal tokens")
+	}
+	return nil
+}
 
-	return &user, nil
+// lockedError is returned by login while the account or the client IP is
+// throttled by the lockout policy.
+type lockedError struct {
+	retryAfter time.Duration
 }
 
-func (s *appService) updateUser(req *schemaUser, editorSuper, editorPermission bool) (*User, error) {
-	var user User
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("failed to login: too many failed attempts, retry in %d seconds", e.seconds())
+}
 
-	if err := s.db().Transaction(func(tx *gorm.DB) error {
+// seconds rounds retryAfter up, as sent in the Retry-After header.
+func (e *lockedError) seconds() int {
+	return int((e.retryAfter + time.Second - 1) / time.Second)
+}
+
+// Login event outcomes and reasons stored in LoginEvent.
+const (
+	outcomeSuccess     = "success"
+	outcomeFailure     = "failure"
+	outcomeMFARequired = "mfa_required"
+
+	reasonUnknownUser      = "unknown_user"
+	reasonBadPassword      = "bad_password"
+	reasonInactive         = "inactive"
+	reasonEmailNotVerified = "email_not_verified"
+	reasonLocked           = "locked"
+	reasonInvalidMFA       = "invalid_mfa"
+	reasonInvalidToken     = "invalid_token"
+	reasonStaleToken       = "stale_token"
+	reasonProviderMismatch = "provider_mismatch"
+	reasonProviderError    = "provider_error"
+	reasonError            = "error"
+)
+
+// loginFailure is a refused login together with its audit reason.
+type loginFailure struct {
+	reason string
+	err    error
+}
+
+func (e *loginFailure) Error() string {
+	return e.err.Error()
+}
+
+// failureReason returns the audit reason of a login error.
+func failureReason(err error) string {
+	var failure *loginFailure
+	var locked *lockedError
+	switch {
+	case errors.As(err, &failure):
+		return failure.reason
+	case errors.As(err, &locked):
+		return reasonLocked
+	}
+	return reasonError
+}
+
+func accountAttemptKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// throttle returns a lockedError when either key must still wait.
+func (s *appService) throttle(accountKey, ipKey string, now time.Time) error {
+	policy := s.lockout()
+	account, err := s.attempts.Get(context.Background(), accountKey, now)
+	if err != nil {
+		return err
+	}
+	ip, err := s.attempts.Get(context.Background(), ipKey, now)
+	if err != nil {
+		return err
+	}
+	wait := max(
+		policy.retryAfter(account, policy.FreeAttempts, policy.MaxAttempts, now),
+		policy.retryAfter(ip, policy.IPFreeAttempts, policy.IPMaxAttempts, now),
+	)
+	if wait > 0 {
+		return &lockedError{retryAfter: wait}
+	}
+	return nil
+}
+
+// loginFailed counts a wrong password against the account and the IP.
+// Unknown emails are counted too, so they can't be told apart by timing.
+func (s *appService) loginFailed(accountKey, ipKey, reason string, now time.Time) error {
+	ttl := s.lockout().LockoutDuration
+	if _, err := s.attempts.Fail(context.Background(), accountKey, now, ttl); err != nil {
+		return err
+	}
+	if _, err := s.attempts.Fail(context.Background(), ipKey, now, ttl); err != nil {
+		return err
+	}
+	return &loginFailure{reason, fmt.Errorf("failed to login: username or password is incorrect")}
+}
+
+// login checks the credentials of req against the authenticators. A user
+// that exists is returned along with the error of a refused login so the
+// attempt can be audited.
+func (s *appService) login(req *login, ip string) (*User, error) {
+	now := s.now()
+	accountKey, ipKey := accountAttemptKey(req.Email), ipAttemptKey(ip)
+	if err := s.throttle(accountKey, ipKey, now); err != nil {
+		return nil, err
+	}
+	auth, identity, err := s.authenticate(req.Email, req.Password)
+	switch {
+	case errors.Is(err, ErrUnknownIdentity):
+		return nil, s.loginFailed(accountKey, ipKey, reasonUnknownUser, now)
+	case errors.Is(err, ErrInvalidCredentials):
+		var user User
+		if err := s.db().Where("email = ?", req.Email).First(&user).Error; err != nil {
+			return nil, s.loginFailed(accountKey, ipKey, reasonBadPassword, now)
+		}
+		return &user, s.loginFailed(accountKey, ipKey, reasonBadPassword, now)
+	case err != nil:
+		logProviderError(auth.Provider(), err)
+		return nil, &loginFailure{reasonProviderError, fmt.Errorf("failed to login: %w", errProviderUnavailable)}
+	}
+	user, err := s.provision(auth, identity)
+	if err != nil {
+		return nil, err
+	}
+	// With an MFA step pending the counter is kept, or logging in again
+	// would clear the wrong codes counted by verifyMFA.
+	if !s.mfaRequired(user) || !user.MFAEnabled {
+		if err := s.attempts.Reset(context.Background(), accountKey); err != nil {
+			return nil, err
+		}
+	}
+	return user, s.loginAllowed(user)
+}
+
+// loginAllowed refuses inactive users and, when required, unverified emails.
+func (s *appService) loginAllowed(user *User) error {
+	if !user.Active {
+		return &loginFailure{reasonInactive, fmt.Errorf("failed to login: user is inactive")}
+	}
+	if s.requireEmailVerification() && !user.EmailVerified {
+		return &loginFailure{reasonEmailNotVerified, fmt.Errorf("failed to login: email not verified")}
+	}
+	return nil
+}
+
+func (s *appService) recordLoginEvent(event *LoginEvent) error {
+	event.CreatedAt = s.now()
+	event.UpdatedAt = event.CreatedAt
+	if len(event.UserAgent) > 255 {
+		event.UserAgent = event.UserAgent[:255]
+	}
+	if len(event.Email) > 255 {
+		event.Email = event.Email[:255]
+	}
+	if err := s.db().Create(event).Error; err != nil {
+		return fmt.Errorf("failed to record login event: %v", err)
+	}
+	return nil
+}
+
+// loginEvents returns a page of events, newest first, and the total count
+// matching the filters. Events are paged in the database since the table only
+// grows.
+func (s *appService) loginEvents(req *listLoginEvents) ([]LoginEvent, int64, error) {
+	query := s.db().Model(&LoginEvent{})
+	if req.UserID != "" {
+		query = query.Where("user_id = ?", req.UserID)
+	}
+	if req.Outcome != "" {
+		query = query.Where("outcome = ?", req.Outcome)
+	}
+	if req.From != "" {
+		from, err := time.Parse(time.RFC3339, req.From)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid from")
+		}
+		query = query.Where("created_at >= ?", from)
+	}
+	if req.To != "" {
+		to, err := time.Parse(time.RFC3339, req.To)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid to")
+		}
+		query = query.Where("created_at < ?", to)
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count login events")
+	}
+	var events []LoginEvent
+	if err := query.
+		Order("created_at DESC").
+		Offset(int((req.Page - 1) * req.Limit)).
+		Limit(int(req.Limit)).
+		Find(&events).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to query login events")
+	}
+	return events, total, nil
+}
+
+var (
+	errImpersonationNotFound = errors.New("user not found")
+	errImpersonationDenied   = errors.New("cannot impersonate this user")
+)
+
+// impersonate signs an access token for userID carrying the actor in the act
+// claim. Only interactive tokens of a real user may impersonate, and the
+// target may not hold a permission the actor lacks, so support staff cannot
+// escalate through it. Only a superuser may impersonate another superuser.
+func (s *appService) impersonate(actor *JwtClaims, userID string) (*JwtClaims, string, error) {
+	if actor.Type != "access_token" || actor.Machine || actor.Actor != nil || actor.Subject == userID {
+		return nil, "", errImpersonationDenied
+	}
+	var user User
+	if err := s.db().
+		Preload("Roles.Permissions").
+		Preload("Tenants").
+		Where("id = ? AND active = ?", userID, true).
+		First(&user).Error; err != nil {
+		return nil, "", errImpersonationNotFound
+	}
+	if user.IsSuperUser && !actor.IsSuperUser {
+		return nil, "", errImpersonationDenied
+	}
+	claims, err := s.newClaims(&user, "access_token", "")
+	if err != nil {
+		return nil, "", err
+	}
+	if !actor.IsSuperUser {
+		var current User
+		if err := s.db().Preload("Roles").Where("id = ? AND active = ?", actor.Subject, true).First(&current).Error; err != nil {
+			return nil, "", errImpersonationDenied
+		}
+		held, err := s.grantedPermissions(current.Roles)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, code := range claims.Permissions {
+			if !current.IsSuperUser && !slices.Contains(held, code) {
+				return nil, "", errImpersonationDenied
+			}
+		}
+	}
+	claims.Actor = &ActorClaim{Subject: actor.Subject}
+	claims.ExpiresAt = jwt.NewNumericDate(claims.IssuedAt.Add(impersonationExpire))
+	token, err := s.signJwt(claims)
+	if err != nil {
+		return nil, "", err
+	}
+	return claims, token, nil
+}
+
+func (s *appService) recordImpersonation(event *ImpersonationEvent) error {
+	return saveImpersonationEvent(s.db(), event, s.now())
+}
+
+func saveImpersonationEvent(db *gorm.DB, event *ImpersonationEvent, now time.Time) error {
+	event.CreatedAt = now
+	event.UpdatedAt = now
+	if len(event.Path) > 255 {
+		event.Path = event.Path[:255]
+	}
+	if err := db.Create(event).Error; err != nil {
+		return fmt.Errorf("failed to record impersonation event: %v", err)
+	}
+	return nil
+}
+
+// impersonationEvents returns a page of events, newest first, and the total
+// count matching the filters.
+func (s *appService) impersonationEvents(req *listImpersonationEvents) ([]ImpersonationEvent, int64, error) {
+	query := s.db().Model(&ImpersonationEvent{})
+	if req.ActorID != "" {
+		query = query.Where("actor_id = ?", req.ActorID)
+	}
+	if req.UserID != "" {
+		query = query.Where("user_id = ?", req.UserID)
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count impersonation events")
+	}
+	var events []ImpersonationEvent
+	if err := query.
+		Order("created_at DESC").
+		Offset(int((req.Page - 1) * req.Limit)).
+		Limit(int(req.Limit)).
+		Find(&events).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to query impersonation events")
+	}
+	return events, total, nil
+}
+
+// unlockUser clears the failed login counter of a user's account. IP counters
+// are left to expire.
+func (s *appService) unlockUser(id string) error {
+	var user User
+	if err := s.db().Where("id = ?", id).First(&user).Error; err != nil {
+		return fmt.Errorf("user not found")
+	}
+	return s.attempts.Reset(context.Background(), accountAttemptKey(user.Email))
+}
+
+func (s *appService) users(ids ...string) ([]User, error) {
+	var data []User
+	if len(ids) == 0 {
+		if err := s.db().
+			Preload("Roles.Permissions").
+			Preload("Tenants").
+			Find(&data).Error; err != nil {
+			return nil, fmt.Errorf("failed to query database list")
+		}
+		return data, nil
+	}
+
+	if err := s.db().
+		Preload("Roles.Permissions").
+		Preload("Tenants").
+		Where("id IN ?", ids).
+		Find(&data).Error; err != nil {
+		return nil, fmt.Errorf("failed to query database")
+	}
+	return data, nil
+}
+
+func (s *appService) tenants(names ...string) ([]Tenant, error) {
+	var data []Tenant
+	if len(names) == 0 {
+		if err := s.db().
+			Find(&data).Error; err != nil {
+			return nil, fmt.Errorf("failed to query database")
+		}
+		return data, nil
+	}
+	if err := s.db().
+		Where("name IN ?", names).
+		Find(&data).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch tenants")
+	}
+	return data, nil
+}
+
+func (s *appService) roles(ids ...string) ([]Role, error) {
+	var data []Role
+	if len(ids) == 0 {
+		if err := s.db().
+			Preload("Permissions").
+			Preload("Parents").
+			Find(&data).Error; err != nil {
+			return nil, fmt.Errorf("failed to query database")
+		}
+		return data, nil
+	}
+	if err := s.db().
+		Preload("Permissions").
+		Preload("Parents").
+		Where("id IN ?", ids).
+		Find(&data).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch roles")
+	}
+	return data, nil
+}
+
+func (s *appService) permissions(ids ...string) ([]Permission, error) {
+	var permissions []Permission
+	if len(ids) == 0 {
+		if err := s.db().
+			Preload("Roles").
+			Find(&permissions).Error; err != nil {
+			return nil, fmt.Errorf("failed to query database")
+		}
+		return permissions, nil
+	}
+	if err := s.db().
+		Preload("Roles").
+		Where("id IN ?", ids).
+		Find(&permissions).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch permissions")
+	}
+
+	return permissions, nil
+}
+
+var errRegisteredPermission = errors.New("permissions registered by a module can't be deactivated or deleted")
+
+func (s *appService) permission(id string) (*Permission, error) {
+	var permission Permission
+	if err := s.db().First(&permission, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errPermissionNotFound
+		}
+		return nil, fmt.Errorf("failed to fetch permission")
+	}
+	return &permission, nil
+}
+
+func (s *appService) createPermission(req *createPermission) (*Permission, error) {
+	var taken int64
+	if err := s.db().Unscoped().Model(&Permission{}).Where("code = ?", req.Code).Count(&taken).Error; err != nil {
+		return nil, fmt.Errorf("failed to query permissions")
+	}
+	if taken > 0 {
+		return nil, fmt.Errorf("permission code %s already exists", req.Code)
+	}
+	permission := Permission{Code: req.Code, Description: req.Description, Active: true}
+	if err := s.db().Create(&permission).Error; err != nil {
+		return nil, fmt.Errorf("failed to create permission")
+	}
+	return &permission, nil
+}
+
+// updatePermission edits the description; the code is what routes check, so
+// it never changes.
+func (s *appService) updatePermission(req *updatePermission) (*Permission, error) {
+	permission, err := s.permission(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db().Model(permission).Update("description", req.Description).Error; err != nil {
+		return nil, fmt.Errorf("failed to update permission")
+	}
+	permission.Description = req.Description
+	return permission, nil
+}
+
+// setPermissionActive toggles a permission no module registers. An inactive
+// permission is left out of the tokens of the roles that grant it.
+func (s *appService) setPermissionActive(id string, active bool) (*Permission, error) {
+	permission, err := s.permission(id)
+	if err != nil {
+		return nil, err
+	}
+	if permission.registered() {
+		return nil, errRegisteredPermission
+	}
+	if permission.Active == active {
+		return permission, nil
+	}
+	if err := s.changeRoles(func(tx *gorm.DB) (*roleHolders, error) {
+		if err := tx.Model(permission).Update("active", active).Error; err != nil {
+			return nil, fmt.Errorf("failed to update permission")
+		}
+		return s.stalePermissionHolders(tx, permission.ID)
+	}); err != nil {
+		return nil, err
+	}
+	permission.Active = active
+	return permission, nil
+}
+
+// deletePermission soft deletes a permission no module registers, as the
+// orphaned ones, and detaches it from roles and personal access tokens.
+func (s *appService) deletePermission(id string) error {
+	permission, err := s.permission(id)
+	if err != nil {
+		return err
+	}
+	if permission.registered() {
+		return errRegisteredPermission
+	}
+	return s.changeRoles(func(tx *gorm.DB) (*roleHolders, error) {
+		stale, err := s.stalePermissionHolders(tx, permission.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Exec("DELETE FROM roles_permissions WHERE permission_id = ?", permission.ID).Error; err != nil {
+			return nil, fmt.Errorf("failed to detach roles")
+		}
+		if err := tx.Exec("DELETE FROM personal_access_tokens_permissions WHERE permission_id = ?", permission.ID).Error; err != nil {
+			return nil, fmt.Errorf("failed to detach personal tokens")
+		}
+		if err := tx.Delete(permission).Error; err != nil {
+			return nil, fmt.Errorf("failed to delete permission")
+		}
+		return stale, nil
+	})
+}
+
+func (s *appService) createRole(req *createRole) (*Role, error) {
+	var role Role
+	permissions, err := s.permissions(req.Permissions...)
+	if err != nil {
+		return nil, fmt.Errorf("permission with ids does not exist")
+	}
+	if len(req.Parents) > 0 {
+		parents, err := s.parentRoles(req.Parents)
+		if err != nil {
+			return nil, err
+		}
+		role.Parents = parents
+	}
+
+	role.Name = req.Name
+	role.Description = req.Description
+	role.Permissions = permissions
+	role.RequireMFA = req.RequireMFA
+	role.Active = true
+
+	if err := s.db().Create(&role).Error; err != nil {
+		return nil, fmt.Errorf("failed to create role")
+	}
+	return s.role(role.ID.String())
+}
+
+var (
+	errRoleNotFound       = errors.New("role not found")
+	errPermissionNotFound = errors.New("permission not found")
+	errRoleCycle          = errors.New("role can't inherit from itself or from a role inheriting from it")
+)
+
+func (s *appService) role(id string) (*Role, error) {
+	var role Role
+	if err := s.db().Preload("Permissions").Preload("Parents").First(&role, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errRoleNotFound
+		}
+		return nil, fmt.Errorf("failed to fetch role")
+	}
+	roles := []Role{role}
+	if err := s.effectivePermissions(roles); err != nil {
+		return nil, err
+	}
+	return &roles[0], nil
+}
+
+// effectivePermissions fills the EffectivePermissions of the roles, as
+// grantedPermissions would flatten them, in two queries.
+func (s *appService) effectivePermissions(roles []Role) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, 0, len(roles))
+	for _, role := range roles {
+		ids = append(ids, role.ID)
+	}
+	var grants []struct {
+		RoleID       string
+		PermissionID string
+	}
+	if err := s.db().Raw(roleLineage+`
+		SELECT DISTINCT lineage.role_id, permissions.id AS permission_id FROM lineage
+		JOIN roles_permissions ON roles_permissions.role_id = lineage.id
+		JOIN permissions ON permissions.id = roles_permissions.permission_id
+		WHERE permissions.active = ? AND permissions.deleted_at IS NULL`, ids, true, true, true).
+		Scan(&grants).Error; err != nil {
+		return fmt.Errorf("failed to query permissions")
+	}
+	granted := map[string][]string{}
+	permissionIDs := make([]string, 0, len(grants))
+	for _, grant := range grants {
+		granted[grant.RoleID] = append(granted[grant.RoleID], grant.PermissionID)
+		permissionIDs = append(permissionIDs, grant.PermissionID)
+	}
+	var permissions []Permission
+	if len(permissionIDs) > 0 {
+		if err := s.db().Where("id IN ?", permissionIDs).Find(&permissions).Error; err != nil {
+			return fmt.Errorf("failed to query permissions")
+		}
+	}
+	byID := make(map[string]Permission, len(permissions))
+	for _, permission := range permissions {
+		byID[permission.ID.String()] = permission
+	}
+	for i := range roles {
+		roles[i].EffectivePermissions = nil
+		for _, id := range granted[roles[i].ID.String()] {
+			roles[i].EffectivePermissions = append(roles[i].EffectivePermissions, byID[id])
+		}
+		slices.SortFunc(roles[i].EffectivePermissions, func(a, b Permission) int { return strings.Compare(a.Code, b.Code) })
+	}
+	return nil
+}
+
+// updateRole applies the fields set in req. PUT sets them all, require_mfa
+// only when present.
+func (s *appService) updateRole(req *patchRole) (*Role, error) {
+	role, err := s.role(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	changes := map[string]any{}
+	if req.Name != nil && *req.Name != role.Name {
+		var taken int64
+		if err := s.db().Model(&Role{}).Where("name = ? AND id <> ?", *req.Name, role.ID).Count(&taken).Error; err != nil {
+			return nil, fmt.Errorf("failed to query roles")
+		}
+		if taken > 0 {
+			return nil, fmt.Errorf("role name %s already exists", *req.Name)
+		}
+		changes["name"] = *req.Name
+	}
+	if req.Description != nil && *req.Description != role.Description {
+		changes["description"] = *req.Description
+	}
+	if req.RequireMFA != nil && *req.RequireMFA != role.RequireMFA {
+		changes["require_mfa"] = *req.RequireMFA
+	}
+	if req.Active != nil && *req.Active != role.Active {
+		changes["active"] = *req.Active
+	}
+	if len(changes) == 0 {
+		return role, nil
+	}
+	if err := s.changeRoles(func(tx *gorm.DB) (*roleHolders, error) {
+		if err := tx.Model(&Role{}).Where("id = ?", role.ID).Updates(changes).Error; err != nil {
+			return nil, fmt.Errorf("failed to update role")
+		}
+		return s.staleRoleHolders(tx, role.ID)
+	}); err != nil {
+		return nil, err
+	}
+	return s.role(req.ID)
+}
+
+// addRolePermissions grants the permissions with the given ids; all of them
+// must exist.
+func (s *appService) addRolePermissions(id string, permissionIDs []string) (*Role, error) {
+	role, err := s.role(id)
+	if err != nil {
+		return nil, err
+	}
+	var permissions []Permission
+	if err := s.db().Where("id IN ?", permissionIDs).Find(&permissions).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch permissions")
+	}
+	ids := slices.Clone(permissionIDs)
+	slices.Sort(ids)
+	if len(permissions) != len(slices.Compact(ids)) {
+		return nil, errPermissionNotFound
+	}
+	if err := s.changeRoles(func(tx *gorm.DB) (*roleHolders, error) {
+		if err := tx.Model(role).Association("Permissions").Append(permissions); err != nil {
+			return nil, fmt.Errorf("failed to add permissions")
+		}
+		return s.staleRoleHolders(tx, role.ID)
+	}); err != nil {
+		return nil, err
+	}
+	return s.role(id)
+}
+
+func (s *appService) removeRolePermission(id, permissionID string) (*Role, error) {
+	role, err := s.role(id)
+	if err != nil {
+		return nil, err
+	}
+	index := slices.IndexFunc(role.Permissions, func(p Permission) bool { return p.ID.String() == permissionID })
+	if index < 0 {
+		return nil, errPermissionNotFound
+	}
+	if err := s.changeRoles(func(tx *gorm.DB) (*roleHolders, error) {
+		if err := tx.Model(role).Association("Permissions").Delete(&role.Permissions[index]); err != nil {
+			return nil, fmt.Errorf("failed to remove permission")
+		}
+		return s.staleRoleHolders(tx, role.ID)
+	}); err != nil {
+		return nil, err
+	}
+	return s.role(id)
+}
+
+// parentRoles returns the roles with the given ids; all of them must exist.
+func (s *appService) parentRoles(ids []string) ([]Role, error) {
+	var parents []Role
+	if err := s.db().Where("id IN ?", ids).Find(&parents).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch roles")
+	}
+	unique := slices.Clone(ids)
+	slices.Sort(unique)
+	if len(parents) != len(slices.Compact(unique)) {
+		return nil, errRoleNotFound
+	}
+	return parents, nil
+}
+
+// addRoleParents makes the role inherit the permissions of the roles with the
+// given ids. A parent can't be the role itself or one of its descendants.
+func (s *appService) addRoleParents(id string, parentIDs []string) (*Role, error) {
+	role, err := s.role(id)
+	if err != nil {
+		return nil, err
+	}
+	parents, err := s.parentRoles(parentIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.changeRoles(func(tx *gorm.DB) (*roleHolders, error) {
+		descendants, err := roleDescendants(tx, tx.Session(&gorm.Session{NewDB: true}).
+			Table("roles").
+			Select("id").
+			Where("id = ?", role.ID))
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range parents {
+			if slices.Contains(descendants, parent.ID.String()) {
+				return nil, errRoleCycle
+			}
+		}
+		if err := tx.Model(role).Association("Parents").Append(parents); err != nil {
+			return nil, fmt.Errorf("failed to add parents")
+		}
+		return s.staleRoleHolders(tx, role.ID)
+	}); err != nil {
+		return nil, err
+	}
+	return s.role(id)
+}
+
+func (s *appService) removeRoleParent(id, parentID string) (*Role, error) {
+	role, err := s.role(id)
+	if err != nil {
+		return nil, err
+	}
+	index := slices.IndexFunc(role.Parents, func(r Role) bool { return r.ID.String() == parentID })
+	if index < 0 {
+		return nil, errRoleNotFound
+	}
+	if err := s.changeRoles(func(tx *gorm.DB) (*roleHolders, error) {
+		if err := tx.Model(role).Association("Parents").Delete(&role.Parents[index]); err != nil {
+			return nil, fmt.Errorf("failed to remove parent")
+		}
+		return s.staleRoleHolders(tx, role.ID)
+	}); err != nil {
+		return nil, err
+	}
+	return s.role(id)
+}
+
+// deleteRole soft deletes the role and detaches it from users, service
+// clients and the hierarchy, so it no longer grants anything even if restored.
+func (s *appService) deleteRole(id string) error {
+	role, err := s.role(id)
+	if err != nil {
+		return err
+	}
+	return s.changeRoles(func(tx *gorm.DB) (*roleHolders, error) {
+		stale, err := s.staleRoleHolders(tx, role.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Exec("DELETE FROM users_roles WHERE role_id = ?", role.ID).Error; err != nil {
+			return nil, fmt.Errorf("failed to detach users")
+		}
+		if err := tx.Exec("DELETE FROM service_clients_roles WHERE role_id = ?", role.ID).Error; err != nil {
+			return nil, fmt.Errorf("failed to detach clients")
+		}
+		if err := tx.Exec("DELETE FROM roles_parents WHERE role_id = ? OR parent_id = ?", role.ID, role.ID).Error; err != nil {
+			return nil, fmt.Errorf("failed to detach roles")
+		}
+		if err := tx.Delete(role).Error; err != nil {
+			return nil, fmt.Errorf("failed to delete role")
+		}
+		return stale, nil
+	})
+}
+
+// roleHolders are the users and service clients whose tokens a role change
+// made stale.
+type roleHolders struct {
+	users   []string
+	clients []string
+}
+
+// changeRoles runs change in a transaction and, once it commits, revokes the
+// tokens of the holders it returns.
+func (s *appService) changeRoles(change func(tx *gorm.DB) (*roleHolders, error)) error {
+	var stale *roleHolders
+	if err := s.db().Transaction(func(tx *gorm.DB) error {
+		var err error
+		stale, err = change(tx)
+		return err
+	}); err != nil {
+		return err
+	}
+	return s.revokeStaleTokens(stale)
+}
+
+// staleRoleHolders bumps UpdatedAt of the users and service clients holding
+// the role or a role inheriting from it, so refresh tokens issued with the old
+// permissions are rejected and introspection reports their access tokens
+// inactive. It returns their ids for revokeStaleTokens.
+func (s *appService) staleRoleHolders(tx *gorm.DB, roleID uuid.UUID) (*roleHolders, error) {
+	return s.staleRolesHolders(tx, tx.Session(&gorm.Session{NewDB: true}).
+		Table("roles").
+		Select("id").
+		Where("id = ?", roleID))
+}
+
+// stalePermissionHolders is staleRoleHolders for every role granting the
+// permission.
+func (s *appService) stalePermissionHolders(tx *gorm.DB, permissionID uuid.UUID) (*roleHolders, error) {
+	return s.staleRolesHolders(tx, tx.Session(&gorm.Session{NewDB: true}).
+		Table("roles_permissions").
+		Select("role_id").
+		Where("permission_id = ?", permissionID))
+}
+
+// staleRolesHolders is staleRoleHolders for the roles selected by seed.
+func (s *appService) staleRolesHolders(tx *gorm.DB, seed *gorm.DB) (*roleHolders, error) {
+	ids, err := roleDescendants(tx, seed)
+	if err != nil {
+		return nil, err
+	}
+	users, err := staleHolders(tx, &User{}, tx.Session(&gorm.Session{NewDB: true}).
+		Table("users_roles").
+		Select("user_id").
+		Where("role_id IN ?", ids))
+	if err != nil {
+		return nil, err
+	}
+	clients, err := staleHolders(tx, &ServiceClient{}, tx.Session(&gorm.Session{NewDB: true}).
+		Table("service_clients_roles").
+		Select("service_client_id").
+		Where("role_id IN ?", ids))
+	if err != nil {
+		return nil, err
+	}
+	return &roleHolders{users: users, clients: clients}, nil
+}
+
+// roleDescendants returns the ids of the roles selected by seed, a query of
+// role ids, and of every role inheriting from them.
+func roleDescendants(tx *gorm.DB, seed *gorm.DB) ([]string, error) {
+	var ids []string
+	if err := tx.Raw(`WITH RECURSIVE descendants(id) AS (
+		SELECT id FROM roles WHERE id IN (?)
+		UNION
+		SELECT roles_parents.role_id FROM roles_parents
+		JOIN descendants ON descendants.id = roles_parents.parent_id
+	) SELECT id FROM descendants`, seed).Scan(&ids).Error; err != nil {
+		return nil, fmt.Errorf("failed to query roles")
+	}
+	return ids, nil
+}
+
+// staleHolders stamps the rows of model selected by holders and returns
+// their ids. UpdatedAt is stamped with the clock of the token iat, not
+// Config.Now, so the staleness check compares like with like.
+func staleHolders(tx *gorm.DB, model any, holders *gorm.DB) ([]string, error) {
+	var ids []string
+	if err := tx.Model(model).Where("id IN (?)", holders).Pluck("id", &ids).Error; err != nil {
+		return nil, fmt.Errorf("failed to query role holders")
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if err := tx.Model(model).
+		Where("id IN ?", ids).
+		UpdateColumn("updated_at", time.Now()).Error; err != nil {
+		return nil, fmt.Errorf("failed to update role holders")
+	}
+	return ids, nil
+}
+
+// revokeStaleTokens ends the sessions of the users, denying their access
+// tokens by sid, denies the impersonation tokens issued for them by jti and
+// the tokens of the service clients by subject, so a role change doesn't
+// wait for those tokens to expire. Personal access tokens are left alone:
+// checkPersonalToken checks their scope against the current roles on every
+// request.
+func (s *appService) revokeStaleTokens(stale *roleHolders) error {
+	if stale == nil {
+		return nil
+	}
+	for _, id := range stale.clients {
+		if err := s.revocations.RevokeSubject(context.Background(), id, time.Now().Add(s.jwt().JwtExpireAccess)); err != nil {
+			return fmt.Errorf("failed to revoke role clients tokens")
+		}
+	}
+	userIDs := stale.users
+	if len(userIDs) == 0 {
+		return nil
+	}
+	var sessions []Session
+	if err := s.db().
+		Where("user_id IN ? AND revoked_at IS NULL AND expires_at > ?", userIDs, time.Now()).
+		Find(&sessions).Error; err != nil {
+		return fmt.Errorf("failed to query role users sessions")
+	}
+	for _, session := range sessions {
+		if err := s.revokeSession(session.UserID.String(), session.ID.String()); err != nil && !errors.Is(err, errSessionNotFound) {
+			return err
+		}
+	}
+	now := s.now()
+	var tokenIDs []string
+	if err := s.db().Model(&ImpersonationEvent{}).
+		Distinct("token_id").
+		Where("user_id IN ? AND created_at > ?", userIDs, now.Add(-impersonationExpire)).
+		Pluck("token_id", &tokenIDs).Error; err != nil {
+		return fmt.Errorf("failed to query role users impersonations")
+	}
+	for _, id := range tokenIDs {
+		if err := s.revocations.Revoke(context.Background(), id, now.Add(impersonationExpire)); err != nil {
+			return fmt.Errorf("failed to revoke role users tokens")
+		}
+	}
+	return nil
+}
+
+func (s *appService) createUser(req *createUser, editorSuper bool) (*User, error) {
+	var user User
+	if err := s.db().Transaction(func(tx *gorm.DB) error {
+		user.Email = req.Email
+		user.Password = req.Password
+		user.FirstName = req.FirstName
+		user.LastName = req.LastName
+		user.Active = req.Active
+		if editorSuper {
+			user.IsSuperUser = req.IsSuperUser
+		}
+		user.Phone1 = &req.Phone1
+		user.Phone2 = &req.Phone2
+		if req.Provider != "" {
+			if _, ok := s.authenticator(req.Provider); !ok {
+				return fmt.Errorf("unknown provider %s", req.Provider)
+			}
+			user.Provider = req.Provider
+		}
+
+		if len(req.Roles) > 0 {
+			roles, err := s.roles(req.Roles...)
+			if err != nil {
+				return err
+			}
+			user.Roles = roles
+		}
+		if len(req.Tenants) > 0 {
+			tenants, err := s.tenants(req.Tenants...)
+			if err != nil {
+				return err
+			}
+			user.Tenants = tenants
+		}
+
+		if err := tx.Create(&user).Error; err != nil {
+			return fmt.Errorf("failed to create user")
+		}
+
+		if err := tx.Model(&user).Association("Roles").Replace(user.Roles); err != nil {
+			return fmt.Errorf("failed to set roles for user")
+		}
+
+		if err := tx.Model(&user).Association("Tenants").Replace(user.Tenants); err != nil {
+			return fmt.Errorf("failed to set tenants for user: %w", err)
+		}
+
+		if user.Password != "" {
+			if err := s.savePasswordHistory(tx, user.ID, user.Password); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// checkPassword applies the password policy to a new password of user,
+// banning its email, names and the app name, and refusing the current and the
+// last History passwords. All violations are returned in a
+// *gorote.PasswordError.
+func (s *appService) checkPassword(user *User, password string) error {
+	policy := s.passwordPolicy()
+	err := policy.Validate(password, user.Email, user.FirstName, user.LastName, s.name())
+	if policy.History == 0 || user.ID == uuid.Nil {
+		return err
+	}
+	reused, historyErr := s.passwordReused(user, password, policy.History)
+	if historyErr != nil {
+		return historyErr
+	}
+	if !reused {
+		return err
+	}
+	violation := gorote.PasswordViolation{
+		Code:    "reused",
+		Message: fmt.Sprintf("must not be one of the last %d passwords", policy.History),
+	}
+	var policyErr *gorote.PasswordError
+	if errors.As(err, &policyErr) {
+		policyErr.Violations = append(policyErr.Violations, violation)
+		return policyErr
+	}
+	return &gorote.PasswordError{Violations: []gorote.PasswordViolation{violation}}
+}
+
+func (s *appService) passwordReused(user *User, password string, history int) (bool, error) {
+	hasher := s.passwordHasher()
+	if ok, _ := hasher.Verify(password, user.Password); ok {
+		return true, nil
+	}
+	var previous []PasswordHistory
+	if err := s.db().
+		Where("user_id = ?", user.ID).
+		Order("created_at DESC").
+		Limit(history).
+		Find(&previous).Error; err != nil {
+		return false, fmt.Errorf("failed to query password history")
+	}
+	for _, entry := range previous {
+		if ok, _ := hasher.Verify(password, entry.PasswordHash); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *appService) hashPassword(password string) (string, error) {
+	hashed, err := s.passwordHasher().Hash(password)
+	if err != nil {
+		return "", fmt.Errorf("crypting password failed: %s", err.Error())
+	}
+	return hashed, nil
+}
+
+// rehashPassword upgrades an outdated hash after a successful login. It uses
+// UpdateColumn so UpdatedAt, which invalidates refresh tokens, is kept, and a
+// failure only means trying again on the next login.
+func (s *appService) rehashPassword(user *User, password string) {
+	if !s.passwordHasher().NeedsRehash(user.Password) {
+		return
+	}
+	hashed, err := s.passwordHasher().Hash(password)
+	if err != nil {
+		return
+	}
+	if err := s.db().Model(user).UpdateColumn("password", hashed).Error; err != nil {
+		return
+	}
+	user.Password = hashed
+}
+
+// savePasswordHistory records a new password hash and drops the entries older
+// than the policy keeps.
+func (s *appService) savePasswordHistory(tx *gorm.DB, userID uuid.UUID, hash string) error {
+	history := s.passwordPolicy().History
+	if history == 0 {
+		return nil
+	}
+	if err := tx.Create(&PasswordHistory{UserID: userID, PasswordHash: hash}).Error; err != nil {
+		return fmt.Errorf("failed to save password history")
+	}
+	var ids []uuid.UUID
+	if err := tx.Model(&PasswordHistory{}).
+		Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Pluck("id", &ids).Error; err != nil {
+		return fmt.Errorf("failed to prune password history")
+	}
+	if len(ids) > history {
+		if err := tx.Unscoped().Where("id IN ?", ids[history:]).Delete(&PasswordHistory{}).Error; err != nil {
+			return fmt.Errorf("failed to prune password history")
+		}
+	}
+	return nil
+}
+
+func (s *appService) updateUser(req *schemaUser, editorSuper, editorPermission bool) (*User, error) {
+	var user User
+
+	if err := s.db().Transaction(func(tx *gorm.DB) error {
 		users, err := s.users(req.ID)
 		if err != nil {
 			return err
 		}
-		if len(users) == 0 {
-			return fmt.Errorf("no users found")
+		if len(users) == 0 {
+			return fmt.Errorf("no users found")
+		}
+		user = users[0]
+
+		user.FirstName = req.FirstName
+		user.LastName = req.LastName
+		user.Active = req.Active
+		if editorSuper {
+			user.IsSuperUser = req.IsSuperUser
+		}
+		user.Phone1 = &req.Phone1
+		user.Phone2 = &req.Phone2
+
+		if editorPermission || editorSuper {
+			if len(req.Roles) > 0 {
+				roles, err := s.roles(req.Roles...)
+				if err != nil {
+					return err
+				}
+				user.Roles = roles
+			}
+			if len(req.Tenants) > 0 {
+				tenants, err := s.tenants(req.Tenants...)
+				if err != nil {
+					return err
+				}
+				user.Tenants = tenants
+			}
+		}
+
+		if err := tx.Model(&user).Updates(user).Error; err != nil {
+			return fmt.Errorf("failed to update user: %w", err)
+		}
+
+		if editorPermission || editorSuper {
+			if err := tx.Model(&user).Association("Roles").Replace(user.Roles); err != nil {
+				return fmt.Errorf("failed to update roles: %w", err)
+			}
+			if err := tx.Model(&user).Association("Tenants").Replace(user.Tenants); err != nil {
+				return fmt.Errorf("failed to update tenants: %w", err)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s *appService) claims(claims jwt.Claims, token string) error {
+	if err := gorote.ValidateOrGetJWTKeySet(claims, token, s.keys); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *appService) jwks() (*gorote.JWKS, error) {
+	jwks, err := s.keys.JWKS()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build jwks: %s", err.Error())
+	}
+	return jwks, nil
+}
+
+func (s *appService) generateIDToken(user *User, audience, nonce string) (string, error) {
+	if audience == "" {
+		audience = s.name()
+	}
+	claims := IDTokenClaims{
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		GivenName:     user.FirstName,
+		FamilyName:    user.LastName,
+		Nonce:         nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.ID.String(),
+			Issuer:    s.name(),
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.jwt().JwtExpireAccess)),
+		},
+	}
+	if user.Phone1 != nil {
+		claims.PhoneNumber = *user.Phone1
+	}
+	token, err := s.keys.Sign(claims)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *appService) openidConfiguration(baseURL string) *openidConfiguration {
+	return &openidConfiguration{
+		Issuer:                           s.name(),
+		JwksURI:                          baseURL + "/.well-known/jwks.json",
+		UserinfoEndpoint:                 baseURL + "/userinfo",
+		AuthorizationEndpoint:            baseURL + "/oauth/authorize",
+		TokenEndpoint:                    baseURL + "/auth/token",
+		IntrospectionEndpoint:            baseURL + "/oauth/introspect",
+		ResponseTypesSupported:           []string{"code", "id_token"},
+		GrantTypesSupported:              []string{"authorization_code", "client_credentials"},
+		CodeChallengeMethodsSupported:    []string{"S256"},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{s.keys.Current().Algorithm},
+		ScopesSupported:                  []string{"openid", "email", "profile", "phone"},
+		ClaimsSupported: []string{
+			"sub", "iss", "aud", "exp", "iat", "nonce",
+			"email", "email_verified", "given_name", "family_name", "phone_number",
+		},
+	}
+}
+
+func (s *appService) userInfo(id string) (*userInfo, error) {
+	users, err := s.users(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("id user not found")
+	}
+	user := users[0]
+	info := userInfo{
+		Subject:       user.ID.String(),
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		GivenName:     user.FirstName,
+		FamilyName:    user.LastName,
+	}
+	if user.Phone1 != nil {
+		info.PhoneNumber = *user.Phone1
+	}
+	return &info, nil
+}
+
+func (s *appService) serviceClients(ids ...string) ([]ServiceClient, error) {
+	var data []ServiceClient
+	if len(ids) == 0 {
+		if err := s.db().
+			Preload("Roles.Permissions").
+			Preload("RedirectURIs").
+			Find(&data).Error; err != nil {
+			return nil, fmt.Errorf("failed to query database")
+		}
+		return data, nil
+	}
+	if err := s.db().
+		Preload("Roles.Permissions").
+		Preload("RedirectURIs").
+		Where("id IN ?", ids).
+		Find(&data).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch service clients")
+	}
+	return data, nil
+}
+
+func (s *appService) createServiceClient(req *createServiceClient) (*ServiceClient, string, error) {
+	client := ServiceClient{
+		Name:        req.Name,
+		Description: req.Description,
+		Public:      req.Public,
+		Active:      true,
+	}
+	// Public clients (SPAs, mobile apps) cannot keep a secret and rely on PKCE.
+	var secret string
+	if !req.Public {
+		token, err := gorote.RandomToken(32)
+		if err != nil {
+			return nil, "", err
+		}
+		secret = token
+		client.SecretHash = gorote.HashToken(secret)
+	}
+	for _, uri := range req.RedirectURIs {
+		client.RedirectURIs = append(client.RedirectURIs, ClientRedirectURI{URI: uri})
+	}
+	if len(req.Roles) > 0 {
+		roles, err := s.roles(req.Roles...)
+		if err != nil {
+			return nil, "", err
+		}
+		client.Roles = roles
+	}
+	if err := s.db().Create(&client).Error; err != nil {
+		return nil, "", fmt.Errorf("failed to create service client")
+	}
+	return &client, secret, nil
+}
+
+func (s *appService) authenticateClient(id, secret string) (*ServiceClient, error) {
+	if id == "" || secret == "" {
+		return nil, fmt.Errorf("invalid client credentials")
+	}
+	clients, err := s.serviceClients(id)
+	if err != nil || len(clients) == 0 {
+		return nil, fmt.Errorf("invalid client credentials")
+	}
+	client := clients[0]
+	if !gorote.CompareTokenHash(secret, client.SecretHash) {
+		return nil, fmt.Errorf("invalid client credentials")
+	}
+	if !client.Active {
+		return nil, fmt.Errorf("client is inactive")
+	}
+	return &client, nil
+}
+
+// introspect reports whether token is still usable (RFC 7662). Besides the
+// signature and expiry it checks the denylist, that the user or client is
+// active and, as the refresh does, that the user or client was not updated
+// after the token was issued. Personal access tokens are checked against their
+// own row and the current permissions of the owner instead, so a profile
+// change that keeps their scope does not end them. Any failure is reported as
+// an inactive token.
+func (s *appService) introspect(token string) *introspection {
+	inactive := &introspection{}
+	claims := AcceptTokens("personal_access_token")
+	if err := s.claims(claims, token); err != nil {
+		return inactive
+	}
+	if claims.Type != "access_token" && claims.Type != "personal_access_token" {
+		return inactive
+	}
+	if s.tokenRevoked(claims) {
+		return inactive
+	}
+
+	res := &introspection{
+		Active:        true,
+		Scope:         strings.Join(claims.Permissions, " "),
+		TokenType:     "Bearer",
+		Sub:           claims.Subject,
+		Aud:           claims.Audience,
+		Iss:           claims.Issuer,
+		Jti:           claims.ID,
+		IsSuperUser:   claims.IsSuperUser,
+		Permissions:   claims.Permissions,
+		Tenants:       claims.Tenants,
+		Type:          claims.Type,
+		Machine:       claims.Machine,
+		EmailVerified: claims.EmailVerified,
+		SessionID:     claims.SessionID,
+		Actor:         claims.Actor,
+	}
+	if claims.ExpiresAt != nil {
+		res.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		res.Iat = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		res.Nbf = claims.NotBefore.Unix()
+	}
+
+	if claims.Machine {
+		clients, err := s.serviceClients(claims.Subject)
+		if err != nil || len(clients) == 0 || !clients[0].Active {
+			return inactive
+		}
+		if claims.IssuedAt == nil || clients[0].UpdatedAt.Unix() > claims.IssuedAt.Unix() {
+			return inactive
+		}
+		res.ClientID = claims.Subject
+		return res
+	}
+	var user User
+	if err := s.db().Where("id = ?", claims.Subject).First(&user).Error; err != nil || !user.Active {
+		return inactive
+	}
+	if claims.Type == "personal_access_token" {
+		if err := s.checkPersonalToken(claims); err != nil {
+			return inactive
+		}
+	} else if claims.IssuedAt == nil || user.UpdatedAt.Unix() > claims.IssuedAt.Unix() {
+		return inactive
+	}
+	if claims.Actor != nil {
+		var actor User
+		if err := s.db().Where("id = ?", claims.Actor.Subject).First(&actor).Error; err != nil || !actor.Active {
+			return inactive
+		}
+	}
+	res.Username = user.Email
+	return res
+}
+
+// tokenRevoked checks the denylist like the JWTProtected middlewares do,
+// treating a store failure as revoked.
+func (s *appService) tokenRevoked(claims *JwtClaims) bool {
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	ctx := context.Background()
+	revoked, err := s.revocations.IsRevoked(ctx, claims.ID, claims.Subject, issuedAt)
+	if err != nil || revoked {
+		return true
+	}
+	if claims.SessionID != "" {
+		revoked, err = s.revocations.IsRevoked(ctx, gorote.SessionRevocationID(claims.SessionID), "", issuedAt)
+		return err != nil || revoked
+	}
+	return false
+}
+
+// oauthClient identifies the client calling the token endpoint. Confidential
+// clients must present their secret; public clients only their id.
+func (s *appService) oauthClient(id, secret string) (*ServiceClient, error) {
+	clients, err := s.serviceClients(id)
+	if err != nil || len(clients) == 0 {
+		return nil, fmt.Errorf("invalid client credentials")
+	}
+	if !clients[0].Public {
+		return s.authenticateClient(id, secret)
+	}
+	if !clients[0].Active {
+		return nil, fmt.Errorf("client is inactive")
+	}
+	return &clients[0], nil
+}
+
+// authorizeClient checks that redirectURI is registered for the client,
+// comparing the whole string as required by RFC 6749 section 3.1.2.
+func (s *appService) authorizeClient(id, redirectURI string) (*ServiceClient, error) {
+	clients, err := s.serviceClients(id)
+	if err != nil || len(clients) == 0 {
+		return nil, fmt.Errorf("client not found")
+	}
+	client := clients[0]
+	if !client.Active {
+		return nil, fmt.Errorf("client is inactive")
+	}
+	for _, uri := range client.RedirectURIs {
+		if uri.URI == redirectURI {
+			return &client, nil
+		}
+	}
+	return nil, fmt.Errorf("redirect_uri is not registered for client")
+}
+
+func (s *appService) createAuthorizationCode(client *ServiceClient, user *User, req *authorizeRequest) (string, error) {
+	code, err := gorote.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	if err := s.db().Create(&AuthorizationCode{
+		CodeHash:            gorote.HashToken(code),
+		ClientID:            client.ID,
+		UserID:              user.ID,
+		RedirectURI:         req.RedirectURI,
+		Scope:               req.Scope,
+		Nonce:               req.Nonce,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		ExpiresAt:           time.Now().Add(authorizationCodeExpire),
+	}).Error; err != nil {
+		return "", fmt.Errorf("failed to save authorization code")
+	}
+	return code, nil
+}
+
+func (s *appService) redeemAuthorizationCode(client *ServiceClient, req *tokenRequest) (*User, *AuthorizationCode, error) {
+	var code AuthorizationCode
+	if err := s.db().Where("code_hash = ?", gorote.HashToken(req.Code)).First(&code).Error; err != nil {
+		return nil, nil, fmt.Errorf("authorization code not found")
+	}
+	result := s.db().Model(&AuthorizationCode{}).
+		Where("id = ? AND used_at IS NULL", code.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, nil, fmt.Errorf("failed to redeem authorization code")
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil, fmt.Errorf("authorization code already used")
+	}
+	if time.Now().After(code.ExpiresAt) {
+		return nil, nil, fmt.Errorf("authorization code expired")
+	}
+	if code.ClientID != client.ID || code.RedirectURI != req.RedirectURI {
+		return nil, nil, fmt.Errorf("authorization code was issued to another client")
+	}
+	if !gorote.VerifyCodeChallenge(req.CodeVerifier, code.CodeChallenge, code.CodeChallengeMethod) {
+		return nil, nil, fmt.Errorf("invalid code_verifier")
+	}
+	users, err := s.users(code.UserID.String())
+	if err != nil || len(users) == 0 {
+		return nil, nil, fmt.Errorf("user not found")
+	}
+	if !users[0].Active {
+		return nil, nil, fmt.Errorf("user is inactive")
+	}
+	return &users[0], &code, nil
+}
+
+func (s *appService) authorizationCodeToken(client *ServiceClient, user *User, code *AuthorizationCode, session *Session) (*oauthToken, error) {
+	accessToken, err := s.generateJwt(user, "access_token", session.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := s.generateJwt(user, "refresh_token", session.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	res := oauthToken{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.jwt().JwtExpireAccess.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        code.Scope,
+	}
+	if slices.Contains(strings.Fields(code.Scope), "openid") {
+		idToken, err := s.generateIDToken(user, client.ID.String(), code.Nonce)
+		if err != nil {
+			return nil, err
+		}
+		res.IDToken = idToken
+	}
+	return &res, nil
+}
+
+func (s *appService) clientCredentialsToken(client *ServiceClient, scope []string) (*oauthToken, error) {
+	permissions, err := s.grantedPermissions(client.Roles)
+	if err != nil {
+		return nil, err
+	}
+	if len(scope) > 0 {
+		for _, code := range scope {
+			if !slices.Contains(permissions, code) {
+				return nil, fmt.Errorf("scope %s not granted to client", code)
+			}
+		}
+		permissions = scope
+	}
+
+	expire := s.jwt().JwtExpireAccess
+	accessToken, err := s.signJwt(&JwtClaims{
+		Permissions: permissions,
+		Type:        "access_token",
+		Machine:     true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   client.ID.String(),
+			Issuer:    s.name(),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expire)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &oauthToken{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(expire.Seconds()),
+		Scope:       strings.Join(permissions, " "),
+	}, nil
+}
+
+// mfaRequired reports whether login must go through the TOTP step, either
+// because the user enrolled or because policy enforces it.
+func (s *appService) mfaRequired(user *User) bool {
+	if user.MFAEnabled {
+		return true
+	}
+	if user.IsSuperUser && s.mfaSuperUser() {
+		return true
+	}
+	if len(user.Roles) == 0 {
+		return false
+	}
+	ids := make([]uuid.UUID, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		ids = append(ids, role.ID)
+	}
+	// A role requires MFA when it or any role it inherits from does. A failed
+	// lookup asks for the second factor rather than skipping it.
+	var required int64
+	if err := s.db().Raw(roleLineage+`
+		SELECT COUNT(*) FROM lineage
+		JOIN roles ON roles.id = lineage.id
+		WHERE roles.require_mfa = ?`, ids, true, true, true).
+		Scan(&required).Error; err != nil {
+		return true
+	}
+	return required > 0
+}
+
+func (s *appService) generateMFAToken(user *User) (string, error) {
+	return s.signJwt(&JwtClaims{
+		Type: "mfa_token",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   user.ID.String(),
+			Issuer:    s.name(),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaChallengeExpire)),
+		},
+	})
+}
+
+func (s *appService) verifyMFA(req *mfaVerify) (*User, error) {
+	claims := AcceptTokens("mfa_token")
+	if err := s.claims(claims, req.MFAToken); err != nil {
+		return nil, fmt.Errorf("invalid mfa token")
+	}
+	if claims.Type != "mfa_token" {
+		return nil, fmt.Errorf("token is not mfa token")
+	}
+	ctx := context.Background()
+	revoked, err := s.revocations.IsRevoked(ctx, claims.ID, claims.Subject, claims.IssuedAt.Time)
+	if err != nil || revoked {
+		return nil, fmt.Errorf("invalid mfa token")
+	}
+	users, err := s.users(claims.Subject)
+	if err != nil || len(users) == 0 {
+		return nil, fmt.Errorf("user not found")
+	}
+	user := users[0]
+	if !user.Active {
+		return nil, fmt.Errorf("user is inactive")
+	}
+	if !user.MFAEnabled {
+		return nil, fmt.Errorf("mfa enrollment required")
+	}
+	now := s.now()
+	accountKey := accountAttemptKey(user.Email)
+	policy := s.lockout()
+	attempts, err := s.attempts.Get(ctx, accountKey, now)
+	if err != nil {
+		return nil, err
+	}
+	if wait := policy.retryAfter(attempts, policy.FreeAttempts, policy.MaxAttempts, now); wait > 0 {
+		return nil, &lockedError{retryAfter: wait}
+	}
+	if err := s.checkMFACode(&user, req.Code, req.RecoveryCode); err != nil {
+		if failErr := s.mfaFailed(claims, accountKey, now); failErr != nil {
+			return nil, failErr
+		}
+		return nil, err
+	}
+	if err := s.revocations.Revoke(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return nil, fmt.Errorf("failed to revoke mfa token")
+	}
+	if err := s.attempts.Reset(ctx, accountKey); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// mfaFailed counts a wrong code against the account, like a wrong password,
+// and revokes the challenge once it has seen mfaMaxFailures of them.
+func (s *appService) mfaFailed(claims *JwtClaims, accountKey string, now time.Time) error {
+	ctx := context.Background()
+	if _, err := s.attempts.Fail(ctx, accountKey, now, s.lockout().LockoutDuration); err != nil {
+		return err
+	}
+	attempts, err := s.attempts.Fail(ctx, "mfa:"+claims.ID, now, mfaChallengeExpire)
+	if err != nil {
+		return err
+	}
+	if attempts.Failures >= mfaMaxFailures {
+		if err := s.revocations.Revoke(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+			return fmt.Errorf("failed to revoke mfa token")
+		}
+	}
+	return nil
+}
+
+// checkMFACode accepts a TOTP code newer than the last one used, or an
+// unused recovery code, consuming it either way.
+func (s *appService) checkMFACode(user *User, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		result := s.db().Model(&MFARecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, gorote.HashToken(normalizeRecoveryCode(recoveryCode))).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return fmt.Errorf("failed to check recovery code")
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("invalid recovery code")
+		}
+		return nil
+	}
+	step, ok := gorote.ValidateTOTP(user.MFASecret, code, s.now(), 1)
+	if !ok {
+		return fmt.Errorf("invalid mfa code")
+	}
+	result := s.db().Model(&User{}).
+		Where("id = ? AND mfa_last_step < ?", user.ID, step).
+		UpdateColumn("mfa_last_step", step)
+	if result.Error != nil {
+		return fmt.Errorf("failed to check mfa code")
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("mfa code already used")
+	}
+	user.MFALastStep = step
+	return nil
+}
+
+func (s *appService) enrollMFA(id string) (*mfaEnrollment, error) {
+	users, err := s.users(id)
+	if err != nil || len(users) == 0 {
+		return nil, fmt.Errorf("user not found")
+	}
+	user := users[0]
+	if user.MFAEnabled {
+		return nil, fmt.Errorf("mfa already enabled")
+	}
+	secret, err := gorote.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db().Model(&user).UpdateColumn("mfa_secret", secret).Error; err != nil {
+		return nil, fmt.Errorf("failed to save mfa secret")
+	}
+	return &mfaEnrollment{
+		Secret: secret,
+		URI:    gorote.TOTPURI(s.name(), user.Email, secret),
+	}, nil
+}
+
+func (s *appService) confirmMFA(id, code string) ([]string, error) {
+	users, err := s.users(id)
+	if err != nil || len(users) == 0 {
+		return nil, fmt.Errorf("user not found")
+	}
+	user := users[0]
+	if user.MFAEnabled {
+		return nil, fmt.Errorf("mfa already enabled")
+	}
+	if user.MFASecret == "" {
+		return nil, fmt.Errorf("mfa enrollment not started")
+	}
+	if err := s.checkMFACode(&user, code, ""); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, mfaRecoveryCodeCount)
+	records := make([]MFARecoveryCode, mfaRecoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		records[i] = MFARecoveryCode{UserID: user.ID, CodeHash: gorote.HashToken(normalizeRecoveryCode(code))}
+	}
+	if err := s.db().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&records).Error; err != nil {
+			return err
 		}
-		user = users[0]
+		return tx.Model(&user).UpdateColumn("mfa_enabled", true).Error
+	}); err != nil {
+		return nil, fmt.Errorf("failed to enable mfa")
+	}
+	return codes, nil
+}
 
-		user.FirstName = req.FirstName
-		user.LastName = req.LastName
-		user.Active = req.Active
-		if editorSuper {
-			user.IsSuperUser = req.IsSuperUser
+func (s *appService) disableMFA(id, code string) error {
+	users, err := s.users(id)
+	if err != nil || len(users) == 0 {
+		return fmt.Errorf("user not found")
+	}
+	user := users[0]
+	if !user.MFAEnabled {
+		return fmt.Errorf("mfa is not enabled")
+	}
+	user.MFAEnabled = false
+	if s.mfaRequired(&user) {
+		return fmt.Errorf("mfa is required for this account")
+	}
+	if err := s.checkMFACode(&user, code, ""); err != nil {
+		return err
+	}
+	if err := s.db().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&MFARecoveryCode{}).Error; err != nil {
+			return err
 		}
-		user.Phone1 = &req.Phone1
-		user.Phone2 = &req.Phone2
+		return tx.Model(&user).UpdateColumns(map[string]any{
+			"mfa_enabled":   false,
+			"mfa_secret":    "",
+			"mfa_last_step": 0,
+		}).Error
+	}); err != nil {
+		return fmt.Errorf("failed to disable mfa")
+	}
+	return nil
+}
 
-		if editorPermission || editorSuper {
-			if len(req.Roles) > 0 {
-				roles, err := s.roles(req.Roles...)
-				if err != nil {
-					return err
-				}
-				user.Roles = roles
-			}
-			if len(req.Tenants) > 0 {
-				tenants, err := s.tenants(req.Tenants...)
-				if err != nil {
-					return err
-				}
-				user.Tenants = tenants
-			}
+// newRecoveryCode returns 50 random bits as "xxxxx-xxxxx" in lowercase base32.
+func newRecoveryCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate recovery code")
+	}
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(code, "-", ""))
+}
+
+// issueUserToken creates a single-use token for purpose, discarding the ones
+// the user has not redeemed yet.
+func (s *appService) issueUserToken(user *User, purpose string, expire time.Duration) (string, error) {
+	token, err := gorote.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	if err := s.db().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&UserToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, purpose).
+			Update("used_at", time.Now()).Error; err != nil {
+			return err
 		}
+		return tx.Create(&UserToken{
+			UserID:    user.ID,
+			Purpose:   purpose,
+			TokenHash: gorote.HashToken(token),
+			ExpiresAt: time.Now().Add(expire),
+		}).Error
+	}); err != nil {
+		return "", fmt.Errorf("failed to save %s token", purpose)
+	}
+	return token, nil
+}
 
-		if err := tx.Model(&user).Updates(user).Error; err != nil {
-			return fmt.Errorf("failed to update user: %w", err)
+// redeemUserToken consumes a mailed token and returns its user. check, when
+// set, runs before the token is consumed so a refused request can be retried
+// with the same link.
+func (s *appService) redeemUserToken(token, purpose string, check func(*User) error) (*User, error) {
+	var record UserToken
+	if err := s.db().
+		Where("token_hash = ? AND purpose = ?", gorote.HashToken(token), purpose).
+		First(&record).Error; err != nil {
+		return nil, fmt.Errorf("invalid or expired token")
+	}
+	if time.Now().After(record.ExpiresAt) || record.UsedAt != nil {
+		return nil, fmt.Errorf("invalid or expired token")
+	}
+	users, err := s.users(record.UserID.String())
+	if err != nil || len(users) == 0 {
+		return nil, fmt.Errorf("user not found")
+	}
+	if !users[0].Active {
+		return nil, fmt.Errorf("user is inactive")
+	}
+	if check != nil {
+		if err := check(&users[0]); err != nil {
+			return nil, err
 		}
+	}
+	result := s.db().Model(&UserToken{}).
+		Where("id = ? AND used_at IS NULL", record.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to redeem token")
+	}
+	if result.RowsAffected == 0 {
+		return nil, fmt.Errorf("invalid or expired token")
+	}
+	return &users[0], nil
+}
 
-		if editorPermission || editorSuper {
-			if err := tx.Model(&user).Association("Roles").Replace(user.Roles); err != nil {
-				return fmt.Errorf("failed to update roles: %w", err)
-			}
-			if err := tx.Model(&user).Association("Tenants").Replace(user.Tenants); err != nil {
-				return fmt.Errorf("failed to update tenants: %w", err)
-			}
+// forgotPassword queues the mail of a reset link. Unknown or inactive emails,
+// and users of external providers, are ignored so the endpoint does not reveal
+// which accounts exist.
+func (s *appService) forgotPassword(email string) error {
+	if s.mailer() == nil {
+		return fmt.Errorf("mailer is not configured")
+	}
+	// The job outlives the request, whose strings fiber may reuse.
+	email = strings.Clone(email)
+	s.mails.enqueue(func() error {
+		if err := s.mailPasswordReset(email); err != nil {
+			return fmt.Errorf("failed to send password reset: %v", err)
 		}
+		return nil
+	})
+	return nil
+}
 
+func (s *appService) mailPasswordReset(email string) error {
+	var user User
+	if err := s.db().Where("email = ?", email).First(&user).Error; err != nil {
+		return nil
+	}
+	if !user.Active || !isLocal(&user) {
 		return nil
+	}
+	token, err := s.issueUserToken(&user, "password_reset", passwordResetExpire)
+	if err != nil {
+		return err
+	}
+	content := MailContent{AppName: s.name(), Token: token, Expires: passwordResetExpire}
+	if base := s.passwordResetURL(); base != "" {
+		link, err := url.Parse(base)
+		if err != nil {
+			return fmt.Errorf("invalid password reset url")
+		}
+		query := link.Query()
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+		content.Link = link.String()
+	}
+	subject, body := s.mailTemplates().PasswordReset(content)
+	if err := s.mailer().Send(context.Background(), gorote.Mail{
+		To:      []string{user.Email},
+		Subject: subject,
+		Body:    body,
 	}); err != nil {
-		return nil, err
+		return err
 	}
+	return nil
+}
 
-	return &user, nil
+var errMagicLinkDisabled = errors.New("magic link login is disabled")
+
+// sendMagicLink queues the mail of a single-use login link to MagicLinkURL, or
+// else to the landing page under PublicURL. Unknown, inactive and external
+// accounts are ignored so the endpoint does not reveal which accounts exist;
+// external users sign in through their own provider.
+func (s *appService) sendMagicLink(email string) error {
+	if !s.magicLink() {
+		return errMagicLinkDisabled
+	}
+	email = strings.Clone(email)
+	s.mails.enqueue(func() error {
+		if err := s.mailMagicLink(email); err != nil {
+			return fmt.Errorf("failed to send magic link: %v", err)
+		}
+		return nil
+	})
+	return nil
 }
 
-func (s *appService) claims(claims jwt.Claims, token string) error {
-	if err := gorote.ValidateOrGetJWTRSA(claims, token, &s.privateKeyRSA().PublicKey); err != nil {
+func (s *appService) mailMagicLink(email string) error {
+	var user User
+	if err := s.db().Where("email = ?", email).First(&user).Error; err != nil {
+		return nil
+	}
+	if !user.Active || !isLocal(&user) {
+		return nil
+	}
+	token, err := s.issueUserToken(&user, "magic_link", magicLinkExpire)
+	if err != nil {
+		return err
+	}
+	base := s.magicLinkURL()
+	if base == "" {
+		base = s.publicURL() + "/auth/magic-link/callback"
+	}
+	link, err := url.Parse(base)
+	if err != nil {
+		return fmt.Errorf("invalid magic link url")
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	subject, body := s.mailTemplates().MagicLink(MailContent{AppName: s.name(), Link: link.String(), Token: token, Expires: magicLinkExpire})
+	return s.mailer().Send(context.Background(), gorote.Mail{
+		To:      []string{user.Email},
+		Subject: subject,
+		Body:    body,
+	})
+}
+
+// magicLinkLogin consumes a login link. Opening the mailed link proves the
+// address, so the email is marked verified.
+func (s *appService) magicLinkLogin(token string) (*User, error) {
+	if !s.magicLink() {
+		return nil, errMagicLinkDisabled
+	}
+	user, err := s.redeemUserToken(token, "magic_link", nil)
+	if err != nil {
+		return nil, &loginFailure{reasonInvalidToken, err}
+	}
+	if !user.EmailVerified {
+		if err := s.db().Model(user).UpdateColumn("email_verified", true).Error; err != nil {
+			return nil, fmt.Errorf("failed to verify email")
+		}
+		user.EmailVerified = true
+	}
+	return user, nil
+}
+
+// resetPassword changes the password and ends every session, so refresh
+// tokens issued before the reset are rejected.
+func (s *appService) resetPassword(req *resetPassword) error {
+	user, err := s.redeemUserToken(req.Token, "password_reset", func(user *User) error {
+		return s.checkPassword(user, req.Password)
+	})
+	if err != nil {
+		return err
+	}
+	hashedPassword, err := s.hashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	if err := s.db().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("password", hashedPassword).Error; err != nil {
+			return fmt.Errorf("failed to update password")
+		}
+		return s.savePasswordHistory(tx, user.ID, hashedPassword)
+	}); err != nil {
+		return err
+	}
+	return s.revokeUserTokens(user.ID.String())
+}
+
+// sendVerificationEmail queues the mail of a signed link proving ownership of
+// the address, to EmailVerificationURL or else /auth/verify-email under
+// PublicURL. Without a mailer nothing is sent.
+func (s *appService) sendVerificationEmail(user *User) error {
+	if s.mailer() == nil || user.EmailVerified {
+		return nil
+	}
+	recipient := *user
+	recipient.Email = strings.Clone(user.Email)
+	s.mails.enqueue(func() error {
+		return s.mailVerification(&recipient)
+	})
+	return nil
+}
+
+func (s *appService) mailVerification(user *User) error {
+	token, err := s.keys.Sign(emailVerificationClaims{
+		Email: user.Email,
+		Type:  "email_verification",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   user.ID.String(),
+			Issuer:    s.name(),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(emailVerificationExpire)),
+		},
+	})
+	if err != nil {
 		return err
 	}
+	base := s.emailVerificationURL()
+	if base == "" {
+		base = s.publicURL() + "/auth/verify-email"
+	}
+	link, err := url.Parse(base)
+	if err != nil {
+		return fmt.Errorf("invalid email verification url")
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	subject, body := s.mailTemplates().EmailVerification(MailContent{AppName: s.name(), Link: link.String(), Token: token, Expires: emailVerificationExpire})
+	if err := s.mailer().Send(context.Background(), gorote.Mail{
+		To:      []string{user.Email},
+		Subject: subject,
+		Body:    body,
+	}); err != nil {
+		return fmt.Errorf("failed to send email verification: %v", err)
+	}
+	return nil
+}
+
+// resendVerification queues a new verification mail. Unknown and already
+// verified emails are ignored, on the queue too, so the endpoint does not
+// reveal which accounts exist.
+func (s *appService) resendVerification(email string) error {
+	if s.mailer() == nil {
+		return nil
+	}
+	email = strings.Clone(email)
+	s.mails.enqueue(func() error {
+		var user User
+		if err := s.db().Where("email = ?", email).First(&user).Error; err != nil || user.EmailVerified {
+			return nil
+		}
+		return s.mailVerification(&user)
+	})
+	return nil
+}
+
+func (s *appService) verifyEmail(token string) error {
+	var claims emailVerificationClaims
+	if err := s.claims(&claims, token); err != nil {
+		return fmt.Errorf("invalid or expired token")
+	}
+	if claims.Type != "email_verification" {
+		return fmt.Errorf("token is not email verification token")
+	}
+	users, err := s.users(claims.Subject)
+	if err != nil || len(users) == 0 {
+		return fmt.Errorf("user not found")
+	}
+	if users[0].Email != claims.Email {
+		return fmt.Errorf("invalid or expired token")
+	}
+	if err := s.db().Model(&users[0]).UpdateColumn("email_verified", true).Error; err != nil {
+		return fmt.Errorf("failed to verify email")
+	}
 	return nil
 }
@@ -1,28 +1,33 @@
 package example
 
 import (
-	"crypto/rsa"
-
 	"github.com/gofiber/contrib/websocket"
+	"github.com/ronaldalds/gorote-core-rsa/gorote"
 	"gorm.io/gorm"
 )
 
 type Config struct {
 	*gorm.DB
-	PublicKey *rsa.PublicKey
+	Keys        gorote.KeySet
+	Revocations gorote.RevocationStore
 }
 
 func (c *Config) db() *gorm.DB {
 	return c.DB
 }
 
-func (c *Config) publicKeyRSA() *rsa.PublicKey {
-	return c.PublicKey
+func (c *Config) keySet() gorote.KeySet {
+	return c.Keys
+}
+
+func (c *Config) revocation() gorote.RevocationStore {
+	return c.Revocations
 }
 
 type configLoad interface {
 	db() *gorm.DB
-	publicKeyRSA() *rsa.PublicKey
+	keySet() gorote.KeySet
+	revocation() gorote.RevocationStore
 }
 
 type controller interface {
@@ -36,8 +41,9 @@ type servicer interface {
 }
 
 type appRouter struct {
-	publicKey  *rsa.PublicKey
-	controller controller
+	keys        gorote.KeySet
+	revocations gorote.RevocationStore
+	controller  controller
 }
 
 type appController struct {
@@ -60,8 +66,9 @@ func New(config configLoad) (*appRouter, error) {
 	}
 
 	router := appRouter{
-		publicKey:  config.publicKeyRSA(),
-		controller: &controller,
+		keys:        config.keySet(),
+		revocations: config.revocation(),
+		controller:  &controller,
 	}
 
 	return &router, nil
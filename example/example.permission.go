@@ -7,3 +7,11 @@ const (
 	PermissionExampleView   core.PermissionCode = "view_example"
 	PermissionExampleUpdate core.PermissionCode = "update_example"
 )
+
+func init() {
+	core.RegisterPermissions("example",
+		core.PermissionDef{Code: PermissionExampleCreate, Description: "Create examples", Group: "example"},
+		core.PermissionDef{Code: PermissionExampleView, Description: "View examples", Group: "example"},
+		core.PermissionDef{Code: PermissionExampleUpdate, Description: "Update examples", Group: "example"},
+	)
+}
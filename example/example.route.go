@@ -21,7 +21,7 @@ func (r *appRouter) ws(router fiber.Router) {
 		"/:id",
 		gorote.IsWsMiddleware(),
 		gorote.ValidationMiddleware(&WsConn{}),
-		gorote.JWTProtectedRSA(&core.JwtClaims{}, r.publicKey),
+		gorote.JWTProtectedRevocable(&core.JwtClaims{}, r.keys, r.revocations),
 		websocket.New(r.controller.websocketHandler),
 	)
 }
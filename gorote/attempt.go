@@ -0,0 +1,185 @@
+package gorote
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Attempts counts the failures recorded for a key (an account or an IP)
+// since its counter last expired.
+type Attempts struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// AttemptStore keeps failed login counters. A counter expires ttl after its
+// last failure. now is passed in so callers control the clock.
+type AttemptStore interface {
+	Fail(ctx context.Context, key string, now time.Time, ttl time.Duration) (Attempts, error)
+	Get(ctx context.Context, key string, now time.Time) (Attempts, error)
+	Reset(ctx context.Context, key string) error
+}
+
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]memoryAttempt
+}
+
+type memoryAttempt struct {
+	Attempts
+	expiresAt time.Time
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: make(map[string]memoryAttempt)}
+}
+
+func (m *MemoryAttemptStore) Fail(ctx context.Context, key string, now time.Time, ttl time.Duration) (Attempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, attempt := range m.attempts {
+		if !attempt.expiresAt.After(now) {
+			delete(m.attempts, k)
+		}
+	}
+	attempt := m.attempts[key]
+	attempt.Failures++
+	attempt.LastFailure = now
+	attempt.expiresAt = now.Add(ttl)
+	m.attempts[key] = attempt
+	return attempt.Attempts, nil
+}
+
+func (m *MemoryAttemptStore) Get(ctx context.Context, key string, now time.Time) (Attempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attempt, ok := m.attempts[key]
+	if !ok || !attempt.expiresAt.After(now) {
+		return Attempts{}, nil
+	}
+	return attempt.Attempts, nil
+}
+
+func (m *MemoryAttemptStore) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+type LoginAttempt struct {
+	Identifier  string `gorm:"primaryKey;size:200"`
+	Failures    int
+	LastFailure time.Time
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+type GormAttemptStore struct {
+	db *gorm.DB
+}
+
+func NewGormAttemptStore(db *gorm.DB) (*GormAttemptStore, error) {
+	if err := db.AutoMigrate(&LoginAttempt{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate login attempts: %w", err)
+	}
+	return &GormAttemptStore{db: db}, nil
+}
+
+func (g *GormAttemptStore) Fail(ctx context.Context, key string, now time.Time, ttl time.Duration) (Attempts, error) {
+	db := g.db.WithContext(ctx)
+	if err := db.Where("expires_at <= ?", now).Delete(&LoginAttempt{}).Error; err != nil {
+		return Attempts{}, fmt.Errorf("failed to prune login attempts: %w", err)
+	}
+	table := db.NamingStrategy.TableName("LoginAttempt")
+	if err := db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "identifier"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"failures":     gorm.Expr(table + ".failures + 1"),
+			"last_failure": now,
+			"expires_at":   now.Add(ttl),
+		}),
+	}).Create(&LoginAttempt{
+		Identifier:  key,
+		Failures:    1,
+		LastFailure: now,
+		ExpiresAt:   now.Add(ttl),
+	}).Error; err != nil {
+		return Attempts{}, fmt.Errorf("failed to record login attempt: %w", err)
+	}
+	return g.Get(ctx, key, now)
+}
+
+func (g *GormAttemptStore) Get(ctx context.Context, key string, now time.Time) (Attempts, error) {
+	var attempts []LoginAttempt
+	if err := g.db.WithContext(ctx).
+		Where("identifier = ? AND expires_at > ?", key, now).
+		Limit(1).
+		Find(&attempts).Error; err != nil {
+		return Attempts{}, fmt.Errorf("failed to query login attempts: %w", err)
+	}
+	if len(attempts) == 0 {
+		return Attempts{}, nil
+	}
+	return Attempts{Failures: attempts[0].Failures, LastFailure: attempts[0].LastFailure}, nil
+}
+
+func (g *GormAttemptStore) Reset(ctx context.Context, key string) error {
+	if err := g.db.WithContext(ctx).Where("identifier = ?", key).Delete(&LoginAttempt{}).Error; err != nil {
+		return fmt.Errorf("failed to reset login attempts: %w", err)
+	}
+	return nil
+}
+
+type RedisAttemptStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisAttemptStore(client *redis.Client) *RedisAttemptStore {
+	return &RedisAttemptStore{client: client, prefix: "attempts:"}
+}
+
+func (r *RedisAttemptStore) Fail(ctx context.Context, key string, now time.Time, ttl time.Duration) (Attempts, error) {
+	key = r.prefix + key
+	pipe := r.client.TxPipeline()
+	failures := pipe.HIncrBy(ctx, key, "failures", 1)
+	pipe.HSet(ctx, key, "last", now.UnixNano())
+	pipe.Expire(ctx, key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Attempts{}, fmt.Errorf("failed to record login attempt: %v", err)
+	}
+	return Attempts{Failures: int(failures.Val()), LastFailure: now}, nil
+}
+
+func (r *RedisAttemptStore) Get(ctx context.Context, key string, now time.Time) (Attempts, error) {
+	values, err := r.client.HMGet(ctx, r.prefix+key, "failures", "last").Result()
+	if err != nil {
+		return Attempts{}, fmt.Errorf("failed to query login attempts: %v", err)
+	}
+	if values[0] == nil || values[1] == nil {
+		return Attempts{}, nil
+	}
+	failures, err := strconv.Atoi(fmt.Sprintf("%v", values[0]))
+	if err != nil {
+		return Attempts{}, fmt.Errorf("invalid login attempts: %v", err)
+	}
+	last, err := strconv.ParseInt(fmt.Sprintf("%v", values[1]), 10, 64)
+	if err != nil {
+		return Attempts{}, fmt.Errorf("invalid login attempts: %v", err)
+	}
+	return Attempts{Failures: failures, LastFailure: time.Unix(0, last)}, nil
+}
+
+func (r *RedisAttemptStore) Reset(ctx context.Context, key string) error {
+	if err := r.client.Del(ctx, r.prefix+key).Err(); err != nil {
+		return fmt.Errorf("failed to reset login attempts: %v", err)
+	}
+	return nil
+}
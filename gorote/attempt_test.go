@@ -0,0 +1,62 @@
+package gorote
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestAttemptStores(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:attempts?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err)
+	}
+	gormStore, err := NewGormAttemptStore(db)
+	if err != nil {
+		t.Fatalf("err on gorm store: %v", err)
+	}
+	stores := map[string]AttemptStore{
+		"memory": NewMemoryAttemptStore(),
+		"gorm":   gormStore,
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+			for i := 1; i <= 3; i++ {
+				attempts, err := store.Fail(ctx, "account:a", now, time.Minute)
+				if err != nil {
+					t.Fatalf("err on fail: %v", err)
+				}
+				if attempts.Failures != i {
+					t.Errorf("esperava %d falhas, recebeu %d", i, attempts.Failures)
+				}
+			}
+			attempts, _ := store.Get(ctx, "account:a", now)
+			if attempts.Failures != 3 || !attempts.LastFailure.Equal(now) {
+				t.Errorf("contador inesperado: %+v", attempts)
+			}
+			if attempts, _ := store.Get(ctx, "account:b", now); attempts.Failures != 0 {
+				t.Errorf("chave desconhecida deveria estar zerada: %+v", attempts)
+			}
+			if attempts, _ := store.Get(ctx, "account:a", now.Add(time.Minute)); attempts.Failures != 0 {
+				t.Errorf("contador expirado deveria estar zerado: %+v", attempts)
+			}
+			if attempts, _ := store.Fail(ctx, "account:a", now.Add(2*time.Minute), time.Minute); attempts.Failures != 1 {
+				t.Errorf("contador expirado deveria recomecar: %+v", attempts)
+			}
+			if err := store.Reset(ctx, "account:a"); err != nil {
+				t.Fatalf("err on reset: %v", err)
+			}
+			if attempts, _ := store.Get(ctx, "account:a", now); attempts.Failures != 0 {
+				t.Errorf("contador deveria ser zerado: %+v", attempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package gorote
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrHashFormat is returned by PasswordHasher.Verify for hashes made by
+// another algorithm.
+var ErrHashFormat = errors.New("unsupported password hash format")
+
+// PasswordHasher hashes passwords into self-describing strings, so hashes of
+// different algorithms and parameters can live in the same column.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash reports whether encoded should be replaced by a new Hash,
+	// because of another algorithm, weaker parameters or a missing pepper.
+	NeedsRehash(encoded string) bool
+}
+
+// BcryptHasher keeps the historical bcrypt hashes ($2a$, $2b$, $2y$).
+// bcrypt reads at most 72 bytes, so longer passwords are refused by Hash.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (b *BcryptHasher) cost() int {
+	if b.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return b.Cost
+}
+
+func (b *BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), b.cost())
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %v", err)
+	}
+	return string(hashed), nil
+}
+
+func (b *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	if !isBcrypt(encoded) {
+		return false, ErrHashFormat
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("invalid bcrypt hash: %v", err)
+	}
+	return true, nil
+}
+
+func (b *BcryptHasher) NeedsRehash(encoded string) bool {
+	if !isBcrypt(encoded) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < b.cost()
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// Argon2idHasher writes PHC strings such as
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>. Zero fields take the OWASP
+// minimums. With a Pepper the password is keyed with HMAC-SHA256 before
+// hashing, and the hash carries a keyid of the pepper so hashes made without
+// it (or with another one) are told apart.
+type Argon2idHasher struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+	Pepper      []byte
+}
+
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	keyID       string
+	salt        []byte
+	key         []byte
+}
+
+func (a *Argon2idHasher) params() argon2idParams {
+	p := argon2idParams{memory: a.Memory, iterations: a.Iterations, parallelism: a.Parallelism}
+	if p.memory == 0 {
+		p.memory = 19456
+	}
+	if p.iterations == 0 {
+		p.iterations = 2
+	}
+	if p.parallelism == 0 {
+		p.parallelism = 1
+	}
+	if len(a.Pepper) > 0 {
+		p.keyID = pepperID(a.Pepper)
+	}
+	return p
+}
+
+func (a *Argon2idHasher) Hash(password string) (string, error) {
+	p := a.params()
+	saltLength, keyLength := a.SaltLength, a.KeyLength
+	if saltLength == 0 {
+		saltLength = 16
+	}
+	if keyLength == 0 {
+		keyLength = 32
+	}
+	p.salt = make([]byte, saltLength)
+	if _, err := rand.Read(p.salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt")
+	}
+	p.key = argon2.IDKey(a.input(password, p.keyID), p.salt, p.iterations, p.memory, p.parallelism, keyLength)
+	return p.encode(), nil
+}
+
+func (a *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	p, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	if p.keyID != "" && (len(a.Pepper) == 0 || p.keyID != pepperID(a.Pepper)) {
+		return false, fmt.Errorf("password hash uses an unknown pepper")
+	}
+	key := argon2.IDKey(a.input(password, p.keyID), p.salt, p.iterations, p.memory, p.parallelism, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+}
+
+func (a *Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	want := a.params()
+	return p.memory < want.memory ||
+		p.iterations < want.iterations ||
+		p.parallelism < want.parallelism ||
+		p.keyID != want.keyID
+}
+
+// input peppers the password only when the hash was made with the pepper.
+func (a *Argon2idHasher) input(password, keyID string) []byte {
+	if keyID == "" {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, a.Pepper)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+func pepperID(pepper []byte) string {
+	sum := sha256.Sum256(pepper)
+	return base64.RawStdEncoding.EncodeToString(sum[:6])
+}
+
+func (p argon2idParams) encode() string {
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", p.memory, p.iterations, p.parallelism)
+	if p.keyID != "" {
+		params += ",keyid=" + p.keyID
+	}
+	return fmt.Sprintf("$argon2id$v=%d$%s$%s$%s",
+		argon2.Version,
+		params,
+		base64.RawStdEncoding.EncodeToString(p.salt),
+		base64.RawStdEncoding.EncodeToString(p.key),
+	)
+}
+
+func decodeArgon2id(encoded string) (argon2idParams, error) {
+	var p argon2idParams
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return p, ErrHashFormat
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return p, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	for _, param := range strings.Split(parts[3], ",") {
+		name, value, _ := strings.Cut(param, "=")
+		var err error
+		var n uint64
+		switch name {
+		case "m":
+			n, err = strconv.ParseUint(value, 10, 32)
+			p.memory = uint32(n)
+		case "t":
+			n, err = strconv.ParseUint(value, 10, 32)
+			p.iterations = uint32(n)
+		case "p":
+			n, err = strconv.ParseUint(value, 10, 8)
+			p.parallelism = uint8(n)
+		case "keyid":
+			p.keyID = value
+		default:
+			err = fmt.Errorf("unknown parameter %q", name)
+		}
+		if err != nil {
+			return p, fmt.Errorf("invalid argon2id hash: %v", err)
+		}
+	}
+	if p.memory == 0 || p.iterations == 0 || p.parallelism == 0 {
+		return p, fmt.Errorf("invalid argon2id hash: missing parameters")
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, fmt.Errorf("invalid argon2id salt")
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return p, fmt.Errorf("invalid argon2id key")
+	}
+	return p, nil
+}
+
+// NewPasswordHashers hashes with current and verifies with whichever hasher
+// recognizes the stored format, so old hashes keep working until rehashed.
+func NewPasswordHashers(current PasswordHasher, legacy ...PasswordHasher) PasswordHasher {
+	return &passwordHashers{current: current, hashers: append([]PasswordHasher{current}, legacy...)}
+}
+
+type passwordHashers struct {
+	current PasswordHasher
+	hashers []PasswordHasher
+}
+
+func (h *passwordHashers) Hash(password string) (string, error) {
+	return h.current.Hash(password)
+}
+
+func (h *passwordHashers) Verify(password, encoded string) (bool, error) {
+	for _, hasher := range h.hashers {
+		ok, err := hasher.Verify(password, encoded)
+		if errors.Is(err, ErrHashFormat) {
+			continue
+		}
+		return ok, err
+	}
+	return false, ErrHashFormat
+}
+
+func (h *passwordHashers) NeedsRehash(encoded string) bool {
+	return h.current.NeedsRehash(encoded)
+}
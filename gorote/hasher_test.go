@@ -0,0 +1,92 @@
+package gorote
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	argon := &Argon2idHasher{Memory: 1024, Iterations: 1}
+	bcryptHasher := &BcryptHasher{Cost: 4}
+	hashers := NewPasswordHashers(argon, bcryptHasher)
+
+	encoded, err := hashers.Hash("Senha@123")
+	if err != nil {
+		t.Fatalf("erro ao hashear senha: %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("hash fora do formato PHC: %s", encoded)
+	}
+	if ok, err := hashers.Verify("Senha@123", encoded); !ok || err != nil {
+		t.Errorf("esperava senha valida: %v", err)
+	}
+	if ok, _ := hashers.Verify("senha@123", encoded); ok {
+		t.Error("senha errada nao deveria ser aceita")
+	}
+	if hashers.NeedsRehash(encoded) {
+		t.Error("hash atual nao deveria precisar de rehash")
+	}
+	if !(&Argon2idHasher{Memory: 2048, Iterations: 1}).NeedsRehash(encoded) {
+		t.Error("hash com memoria menor deveria precisar de rehash")
+	}
+
+	legacy, err := bcryptHasher.Hash("Senha@123")
+	if err != nil {
+		t.Fatalf("erro ao hashear com bcrypt: %v", err)
+	}
+	if ok, err := hashers.Verify("Senha@123", legacy); !ok || err != nil {
+		t.Errorf("hash bcrypt deveria continuar valido: %v", err)
+	}
+	if !hashers.NeedsRehash(legacy) {
+		t.Error("hash bcrypt deveria precisar de rehash")
+	}
+	if _, err := hashers.Verify("Senha@123", "$md5$abc"); err != ErrHashFormat {
+		t.Errorf("esperava ErrHashFormat, recebeu %v", err)
+	}
+
+	long := strings.Repeat("cavalo bateria grampo correto ", 3)
+	if _, err := bcryptHasher.Hash(long); err == nil {
+		t.Error("bcrypt deveria recusar mais de 72 bytes")
+	}
+	encoded, err = argon.Hash(long)
+	if err != nil {
+		t.Fatalf("erro ao hashear frase longa: %v", err)
+	}
+	if ok, _ := argon.Verify(long[:80]+"x", encoded); ok {
+		t.Error("argon2id nao deveria truncar a senha")
+	}
+}
+
+func TestArgon2idPepper(t *testing.T) {
+	plain := &Argon2idHasher{Memory: 1024, Iterations: 1}
+	peppered := &Argon2idHasher{Memory: 1024, Iterations: 1, Pepper: []byte("segredo-do-servidor")}
+
+	encoded, err := peppered.Hash("Senha@123")
+	if err != nil {
+		t.Fatalf("erro ao hashear senha: %v", err)
+	}
+	if !strings.Contains(encoded, ",keyid=") {
+		t.Errorf("esperava keyid no hash: %s", encoded)
+	}
+	if ok, err := peppered.Verify("Senha@123", encoded); !ok || err != nil {
+		t.Errorf("esperava senha valida: %v", err)
+	}
+	if _, err := plain.Verify("Senha@123", encoded); err == nil {
+		t.Error("hash com pepper nao deveria ser verificado sem o pepper")
+	}
+	other := &Argon2idHasher{Memory: 1024, Iterations: 1, Pepper: []byte("outro")}
+	if _, err := other.Verify("Senha@123", encoded); err == nil {
+		t.Error("hash com outro pepper nao deveria ser verificado")
+	}
+
+	old, err := plain.Hash("Senha@123")
+	if err != nil {
+		t.Fatalf("erro ao hashear senha: %v", err)
+	}
+	if ok, err := peppered.Verify("Senha@123", old); !ok || err != nil {
+		t.Errorf("hash sem pepper deveria continuar valido: %v", err)
+	}
+	if !peppered.NeedsRehash(old) {
+		t.Error("hash sem pepper deveria precisar de rehash")
+	}
+}
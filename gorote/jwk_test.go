@@ -0,0 +1,54 @@
+package gorote
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJWKThumbprint(t *testing.T) {
+	jwk := JWK{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+	}
+	kid, err := jwk.Thumbprint()
+	if err != nil {
+		t.Fatalf("erro ao calcular thumbprint: %v", err)
+	}
+	if kid != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("thumbprint inesperado: %s", kid)
+	}
+}
+
+func TestGenerateJwtWithRSAKeyID(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("erro ao gerar chave: %v", err)
+	}
+	signed, err := GenerateJwtWithRSA(jwt.RegisteredClaims{Subject: "user"}, privateKey)
+	if err != nil {
+		t.Fatalf("erro ao gerar token: %v", err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(signed, &jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatalf("erro ao ler token: %v", err)
+	}
+	jwks, err := NewJWKS(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("erro ao gerar jwks: %v", err)
+	}
+	jwk, err := jwks.Key(token.Header["kid"].(string))
+	if err != nil {
+		t.Fatalf("kid do token não está no jwks: %v", err)
+	}
+	publicKey, err := jwk.PublicKey()
+	if err != nil {
+		t.Fatalf("erro ao ler chave do jwk: %v", err)
+	}
+	if !privateKey.PublicKey.Equal(publicKey) {
+		t.Error("chave do jwk difere da chave original")
+	}
+}
@@ -0,0 +1,229 @@
+package gorote
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type KeySet interface {
+	PublicKey(kid string) (crypto.PublicKey, error)
+}
+
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey crypto.Signer
+	PublicKey  crypto.PublicKey
+	NotAfter   time.Time
+}
+
+func (k *SigningKey) expired(now time.Time) bool {
+	return !k.NotAfter.IsZero() && now.After(k.NotAfter)
+}
+
+func NewSigningKey(privateKey crypto.Signer) (*SigningKey, error) {
+	if privateKey == nil {
+		return nil, fmt.Errorf("private key is required")
+	}
+	key, err := NewVerificationKey(privateKey.Public(), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	key.PrivateKey = privateKey
+	return key, nil
+}
+
+func NewVerificationKey(publicKey crypto.PublicKey, notAfter time.Time) (*SigningKey, error) {
+	if publicKey == nil {
+		return nil, fmt.Errorf("public key is required")
+	}
+	method, err := SigningMethod(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := KeyID(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{
+		ID:        kid,
+		Algorithm: method.Alg(),
+		PublicKey: publicKey,
+		NotAfter:  notAfter,
+	}, nil
+}
+
+// KeyRing holds the current signing key plus previous keys that are only
+// accepted for verification until their NotAfter date.
+type KeyRing struct {
+	mu       sync.RWMutex
+	current  *SigningKey
+	previous []*SigningKey
+}
+
+func NewKeyRing(privateKey crypto.Signer, previous ...*SigningKey) (*KeyRing, error) {
+	current, err := NewSigningKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	ring := KeyRing{current: current}
+	for _, key := range previous {
+		if key == nil {
+			return nil, fmt.Errorf("verification key is required")
+		}
+		verification, err := NewVerificationKey(key.PublicKey, key.NotAfter)
+		if err != nil {
+			return nil, err
+		}
+		ring.previous = append(ring.previous, verification)
+	}
+	return &ring, nil
+}
+
+func (k *KeyRing) Current() *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// Promote makes privateKey the signing key. The replaced key keeps verifying
+// tokens until now plus retain.
+func (k *KeyRing) Promote(privateKey crypto.Signer, retain time.Duration) error {
+	next, err := NewSigningKey(privateKey)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if next.ID == k.current.ID {
+		return nil
+	}
+	now := time.Now()
+	var previous []*SigningKey
+	for _, key := range k.previous {
+		if key.ID != next.ID && !key.expired(now) {
+			previous = append(previous, key)
+		}
+	}
+	previous = append(previous, &SigningKey{
+		ID:        k.current.ID,
+		Algorithm: k.current.Algorithm,
+		PublicKey: k.current.PublicKey,
+		NotAfter:  now.Add(retain),
+	})
+	k.current = next
+	k.previous = previous
+	return nil
+}
+
+func (k *KeyRing) PublicKey(kid string) (crypto.PublicKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if kid == "" || kid == k.current.ID {
+		return k.current.PublicKey, nil
+	}
+	now := time.Now()
+	for _, key := range k.previous {
+		if key.ID == kid && !key.expired(now) {
+			return key.PublicKey, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id")
+}
+
+func (k *KeyRing) PublicKeys() []crypto.PublicKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := []crypto.PublicKey{k.current.PublicKey}
+	now := time.Now()
+	for _, key := range k.previous {
+		if !key.expired(now) {
+			keys = append(keys, key.PublicKey)
+		}
+	}
+	return keys
+}
+
+func (k *KeyRing) JWKS() (*JWKS, error) {
+	return NewJWKS(k.PublicKeys()...)
+}
+
+func (k *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	return GenerateJwt(claims, k.Current().PrivateKey)
+}
+
+type staticKeySet struct {
+	publicKey crypto.PublicKey
+}
+
+// NewStaticKeySet wraps a single public key; tokens carrying a different kid
+// are rejected.
+func NewStaticKeySet(publicKey crypto.PublicKey) KeySet {
+	return staticKeySet{publicKey}
+}
+
+func (s staticKeySet) PublicKey(kid string) (crypto.PublicKey, error) {
+	if kid != "" {
+		id, err := KeyID(s.publicKey)
+		if err != nil {
+			return nil, err
+		}
+		if id != kid {
+			return nil, fmt.Errorf("unknown key id")
+		}
+	}
+	return s.publicKey, nil
+}
+
+// RemoteKeySet resolves keys from a JWKS endpoint, caching them for ttl and
+// refetching when an unknown kid shows up.
+type RemoteKeySet struct {
+	url       string
+	ttl       time.Duration
+	mu        sync.Mutex
+	jwks      *JWKS
+	fetchedAt time.Time
+}
+
+func NewRemoteKeySet(url string, ttl time.Duration) *RemoteKeySet {
+	return &RemoteKeySet{url: url, ttl: ttl}
+}
+
+func (r *RemoteKeySet) PublicKey(kid string) (crypto.PublicKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.jwks != nil && time.Since(r.fetchedAt) < r.ttl {
+		if key, err := r.find(kid); err == nil {
+			return key, nil
+		}
+		if time.Since(r.fetchedAt) < 10*time.Second {
+			return nil, fmt.Errorf("unknown key id")
+		}
+	}
+	jwks, err := FetchJWKS(context.Background(), r.url)
+	if err != nil {
+		return nil, err
+	}
+	r.jwks = jwks
+	r.fetchedAt = time.Now()
+	return r.find(kid)
+}
+
+func (r *RemoteKeySet) find(kid string) (crypto.PublicKey, error) {
+	if kid == "" {
+		if len(r.jwks.Keys) == 0 {
+			return nil, fmt.Errorf("unknown key id")
+		}
+		return r.jwks.Keys[0].PublicKey()
+	}
+	jwk, err := r.jwks.Key(kid)
+	if err != nil {
+		return nil, fmt.Errorf("unknown key id")
+	}
+	return jwk.PublicKey()
+}
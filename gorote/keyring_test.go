@@ -0,0 +1,64 @@
+package gorote
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestKeyRing(t *testing.T) {
+	first, _ := rsa.GenerateKey(rand.Reader, 2048)
+	second, _ := rsa.GenerateKey(rand.Reader, 2048)
+	expired, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	old, err := NewVerificationKey(&expired.PublicKey, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("erro ao criar chave de verificação: %v", err)
+	}
+	ring, err := NewKeyRing(first, old)
+	if err != nil {
+		t.Fatalf("erro ao criar key ring: %v", err)
+	}
+	signedFirst, err := ring.Sign(jwt.RegisteredClaims{Subject: "user"})
+	if err != nil {
+		t.Fatalf("erro ao assinar: %v", err)
+	}
+	if err := ring.Promote(second, time.Hour); err != nil {
+		t.Fatalf("erro ao promover chave: %v", err)
+	}
+	signedSecond, err := ring.Sign(jwt.RegisteredClaims{Subject: "user"})
+	if err != nil {
+		t.Fatalf("erro ao assinar: %v", err)
+	}
+
+	t.Run("aceita chave anterior e atual", func(t *testing.T) {
+		if err := ValidateOrGetJWTKeySet(&jwt.RegisteredClaims{}, signedFirst, ring); err != nil {
+			t.Errorf("token da chave anterior deveria ser válido: %v", err)
+		}
+		if err := ValidateOrGetJWTKeySet(&jwt.RegisteredClaims{}, signedSecond, ring); err != nil {
+			t.Errorf("token da chave atual deveria ser válido: %v", err)
+		}
+	})
+
+	t.Run("rejeita chave expirada", func(t *testing.T) {
+		signed, _ := GenerateJwtWithRSA(jwt.RegisteredClaims{Subject: "user"}, expired)
+		if err := ValidateOrGetJWTKeySet(&jwt.RegisteredClaims{}, signed, ring); err == nil {
+			t.Error("token de chave expirada deveria ser inválido")
+		}
+		if len(ring.PublicKeys()) != 2 {
+			t.Errorf("esperava 2 chaves publicadas, recebeu %d", len(ring.PublicKeys()))
+		}
+	})
+
+	t.Run("rsa seleciona pelo kid", func(t *testing.T) {
+		if err := ValidateOrGetJWTRSA(&jwt.RegisteredClaims{}, signedSecond, &second.PublicKey); err != nil {
+			t.Errorf("token deveria ser válido: %v", err)
+		}
+		if err := ValidateOrGetJWTRSA(&jwt.RegisteredClaims{}, signedSecond, &first.PublicKey); err == nil {
+			t.Error("token com kid de outra chave deveria ser inválido")
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package gorote
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP accepts a single message and returns its DATA section.
+func fakeSMTP(t *testing.T) (int, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("erro ao abrir porta: %v", err)
+	}
+	data := make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost")
+		var body strings.Builder
+		reading := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if reading {
+				if line == ".\r\n" {
+					reading = false
+					data <- body.String()
+					reply("250 OK")
+					continue
+				}
+				body.WriteString(line)
+				continue
+			}
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case command == "DATA":
+				reading = true
+				reply("354 go ahead")
+			case command == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, data
+}
+
+func TestSMTPMailer(t *testing.T) {
+	port, data := fakeSMTP(t)
+	mailer := NewSMTPMailer(InitSMTP{Host: "127.0.0.1", Port: port, From: "noreply@ralds.com.br"})
+	err := mailer.Send(context.Background(), Mail{
+		To:      []string{"user@ralds.com.br"},
+		Subject: "Redefinição de senha",
+		Body:    "linha 1\nlinha 2",
+	})
+	if err != nil {
+		t.Fatalf("erro ao enviar email: %v", err)
+	}
+	msg := <-data
+	if !strings.Contains(msg, "To: user@ralds.com.br\r\n") || !strings.Contains(msg, "Subject: =?utf-8?q?") {
+		t.Errorf("cabecalhos inesperados: %q", msg)
+	}
+	if !strings.Contains(msg, "\r\n\r\nlinha 1\r\nlinha 2") {
+		t.Errorf("corpo inesperado: %q", msg)
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	mailer := NewMemoryMailer()
+	mailer.Send(context.Background(), Mail{To: []string{"a@ralds.com.br"}, Subject: "primeiro"})
+	mailer.Send(context.Background(), Mail{To: []string{"b@ralds.com.br"}, Subject: "segundo"})
+	mailer.Send(context.Background(), Mail{To: []string{"a@ralds.com.br"}, Subject: "terceiro"})
+	if len(mailer.Mails()) != 3 {
+		t.Errorf("esperava 3 emails, recebeu %d", len(mailer.Mails()))
+	}
+	if mail, ok := mailer.Last("a@ralds.com.br"); !ok || mail.Subject != "terceiro" {
+		t.Errorf("ultimo email inesperado: %+v", mail)
+	}
+	if _, ok := mailer.Last("c@ralds.com.br"); ok {
+		t.Error("nao deveria encontrar email")
+	}
+}
@@ -2,6 +2,7 @@ package gorote
 
 import (
 	"crypto/rsa"
+	"errors"
 	"fmt"
 	"reflect"
 	"time"
@@ -15,6 +16,14 @@ import (
 
 type HandlerJWTProtected func(jwt.Claims) *fiber.Error
 
+// AuditedClaims are claims whose requests must be recorded, such as
+// impersonation tokens. The JWTProtected middlewares call Audit once the
+// route answers, with its status, including requests the handles refused.
+type AuditedClaims interface {
+	jwt.Claims
+	Audit(ctx *fiber.Ctx, status int)
+}
+
 func Check() fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
 		return ctx.Status(fiber.StatusOK).JSON(map[string]string{"status": "OK"})
@@ -31,37 +40,75 @@ func IsWsMiddleware() fiber.Handler {
 }
 
 func JWTProtected(claims jwt.Claims, jwtSecret string, handles ...HandlerJWTProtected) fiber.Handler {
-	return func(ctx *fiber.Ctx) error {
-		if err := ValidateOrGetJWT(claims, GetAccessToken(ctx), jwtSecret); err != nil {
-			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
-		}
-		for _, handle := range handles {
-			if err := handle(claims); err != nil {
-				return err
-			}
-		}
-		ctx.Locals("claimsData", claims)
-		return ctx.Next()
-	}
+	return jwtProtected(claims, func(claims jwt.Claims, token string) error {
+		return ValidateOrGetJWT(claims, token, jwtSecret)
+	}, nil, handles)
 }
 
 func JWTProtectedRSA(claims jwt.Claims, publicKey *rsa.PublicKey, handles ...HandlerJWTProtected) fiber.Handler {
+	return JWTProtectedKeySet(claims, NewStaticKeySet(publicKey), handles...)
+}
+
+func JWTProtectedKeySet(claims jwt.Claims, keys KeySet, handles ...HandlerJWTProtected) fiber.Handler {
+	return jwtProtected(claims, func(claims jwt.Claims, token string) error {
+		return ValidateOrGetJWTKeySet(claims, token, keys)
+	}, nil, handles)
+}
+
+// JWTProtectedRevocable is JWTProtectedKeySet checking revocations instead of
+// the store set with UseRevocationStore.
+func JWTProtectedRevocable(claims jwt.Claims, keys KeySet, revocations RevocationStore, handles ...HandlerJWTProtected) fiber.Handler {
+	return jwtProtected(claims, func(claims jwt.Claims, token string) error {
+		return ValidateOrGetJWTKeySet(claims, token, keys)
+	}, revocations, handles)
+}
+
+// jwtProtected validates the token with validate and checks it against
+// revocations, or the default store when nil.
+func jwtProtected(claims jwt.Claims, validate func(jwt.Claims, string) error, revocations RevocationStore, handles []HandlerJWTProtected) fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
-		if err := ValidateOrGetJWTRSA(claims, GetAccessToken(ctx), publicKey); err != nil {
+		claims := newInstance(claims)
+		if err := validate(claims, GetAccessToken(ctx)); err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+		}
+		store := revocations
+		if store == nil {
+			store = defaultRevocationStore()
+		}
+		if err := checkRevocation(ctx.Context(), store, GetAccessToken(ctx)); err != nil {
 			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
 		}
 		for _, handle := range handles {
 			if err := handle(claims); err != nil {
-				return err
+				return audit(ctx, claims, err)
 			}
 		}
 		ctx.Locals("claimsData", claims)
-		return ctx.Next()
+		return audit(ctx, claims, ctx.Next())
 	}
 }
 
+// audit hands the outcome of the request to claims implementing
+// AuditedClaims and returns err unchanged.
+func audit(ctx *fiber.Ctx, claims jwt.Claims, err error) error {
+	audited, ok := claims.(AuditedClaims)
+	if !ok {
+		return err
+	}
+	status := ctx.Response().StatusCode()
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		status = fiberErr.Code
+	} else if err != nil {
+		status = fiber.StatusInternalServerError
+	}
+	audited.Audit(ctx, status)
+	return err
+}
+
 func ValidationMiddleware(requestStruct any) fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
+		requestStruct := newInstance(requestStruct)
 		v := reflect.ValueOf(requestStruct)
 		if v.Kind() == reflect.Ptr {
 			v = v.Elem()
@@ -104,6 +151,19 @@ func ValidationMiddleware(requestStruct any) fiber.Handler {
 	}
 }
 
+// newInstance returns a copy of the value pointed to by v, so state decoded
+// for one request never leaks into the next while options set on v at route
+// setup, such as the token types a claims type accepts, are kept.
+func newInstance[T any](v T) T {
+	value := reflect.ValueOf(v)
+	if !value.IsValid() || value.Kind() != reflect.Ptr || value.IsNil() {
+		return v
+	}
+	instance := reflect.New(value.Elem().Type())
+	instance.Elem().Set(value.Elem())
+	return instance.Interface().(T)
+}
+
 func Cached(ttl time.Duration) func(ctx *fiber.Ctx) error {
 	config := cache.Config{
 		Expiration: ttl,
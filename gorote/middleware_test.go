@@ -0,0 +1,71 @@
+package gorote
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestMiddlewareFreshInstancePerRequest(t *testing.T) {
+	const secret = "secret"
+	type note struct {
+		Name string `json:"name" validate:"required"`
+		Note string `json:"note"`
+	}
+	app := fiber.New()
+	app.Get("/claims", JWTProtected(&jwt.RegisteredClaims{}, secret), func(ctx *fiber.Ctx) error {
+		claims := ctx.Locals("claimsData").(*jwt.RegisteredClaims)
+		return ctx.JSON(claims)
+	})
+	app.Post("/notes", ValidationMiddleware(&note{}), func(ctx *fiber.Ctx) error {
+		return ctx.JSON(ctx.Locals("validatedData"))
+	})
+
+	t.Run("claims", func(t *testing.T) {
+		var got jwt.RegisteredClaims
+		for _, claims := range []jwt.RegisteredClaims{
+			{Subject: "1", ID: "jti-1"},
+			{Subject: "2"},
+		} {
+			token, err := GenerateJwtWithSecret(claims, secret)
+			if err != nil {
+				t.Fatalf("err on generate token: %v", err)
+			}
+			req := httptest.NewRequest("GET", "/claims", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("err on request: %v", err)
+			}
+			got = jwt.RegisteredClaims{}
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("err on decode: %v", err)
+			}
+		}
+		if got.Subject != "2" || got.ID != "" {
+			t.Errorf("claims da requisição anterior vazaram: %+v", got)
+		}
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		var body string
+		for _, payload := range []string{`{"name":"a","note":"primeira"}`, `{"name":"b"}`} {
+			req := httptest.NewRequest("POST", "/notes", strings.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("err on request: %v", err)
+			}
+			raw, _ := io.ReadAll(resp.Body)
+			body = string(raw)
+		}
+		if body != `{"name":"b","note":""}` {
+			t.Errorf("dados da requisição anterior vazaram: %s", body)
+		}
+	})
+}
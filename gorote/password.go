@@ -0,0 +1,163 @@
+package gorote
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy lists the rules a new password must follow. Zero values
+// disable a rule. Password history is not checked here since it needs the
+// stored hashes; History only tells the caller how many to keep.
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// BannedSubstrings may not appear in the password, ignoring case. Values
+	// passed to Validate (email, names) are added per call.
+	BannedSubstrings []string
+	// Dictionary holds common passwords rejected on exact match, ignoring case.
+	Dictionary PasswordDictionary
+	// History is how many previous passwords can't be reused.
+	History int
+}
+
+// PasswordViolation is one broken rule; Code is stable for UIs to translate.
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordError carries every violation of a password at once.
+type PasswordError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return "password " + strings.Join(messages, ", ")
+}
+
+// Banned substrings shorter than this are ignored, so a one letter name does
+// not forbid half the alphabet.
+const minBannedSubstring = 3
+
+// Validate returns a *PasswordError with all the rules password breaks, or
+// nil. banned adds per-user substrings such as the email and names; an email
+// also bans its local part.
+func (p *PasswordPolicy) Validate(password string, banned ...string) error {
+	var violations []PasswordViolation
+	add := func(code, message string) {
+		violations = append(violations, PasswordViolation{Code: code, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && length < p.MinLength {
+		add("min_length", fmt.Sprintf("must have at least %d characters", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add("max_length", fmt.Sprintf("must have at most %d characters", p.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsSymbol(r) || unicode.IsPunct(r):
+			hasSymbol = true
+		}
+	}
+	if p.RequireUpper && !hasUpper {
+		add("uppercase", "must contain at least one uppercase letter")
+	}
+	if p.RequireLower && !hasLower {
+		add("lowercase", "must contain at least one lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		add("digit", "must contain at least one digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		add("symbol", "must contain at least one symbol")
+	}
+
+	lower := strings.ToLower(password)
+	for _, value := range bannedSubstrings(p.BannedSubstrings, banned) {
+		if strings.Contains(lower, value) {
+			add("banned_substring", "must not contain personal or application information")
+			break
+		}
+	}
+	if p.Dictionary.Contains(password) {
+		add("common", "is too common")
+	}
+
+	if len(violations) > 0 {
+		return &PasswordError{Violations: violations}
+	}
+	return nil
+}
+
+func bannedSubstrings(lists ...[]string) []string {
+	var values []string
+	for _, list := range lists {
+		for _, value := range list {
+			value = strings.ToLower(strings.TrimSpace(value))
+			if local, _, ok := strings.Cut(value, "@"); ok {
+				values = append(values, local)
+			}
+			values = append(values, value)
+		}
+	}
+	filtered := values[:0]
+	for _, value := range values {
+		if utf8.RuneCountInString(value) >= minBannedSubstring {
+			filtered = append(filtered, value)
+		}
+	}
+	return filtered
+}
+
+// PasswordDictionary is a set of common passwords, stored lowercased.
+type PasswordDictionary map[string]struct{}
+
+// LoadPasswordDictionary reads one password per line, skipping blank lines and
+// lines starting with #.
+func LoadPasswordDictionary(path string) (PasswordDictionary, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open password dictionary: %v", err)
+	}
+	defer file.Close()
+	dictionary := make(PasswordDictionary)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		dictionary[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read password dictionary: %v", err)
+	}
+	return dictionary, nil
+}
+
+func (d PasswordDictionary) Contains(password string) bool {
+	_, ok := d[strings.ToLower(password)]
+	return ok
+}
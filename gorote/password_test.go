@@ -0,0 +1,80 @@
+package gorote
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func violationCodes(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var policyErr *PasswordError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("esperava PasswordError, recebeu %T", err)
+	}
+	var codes []string
+	for _, violation := range policyErr.Violations {
+		codes = append(codes, violation.Code)
+	}
+	return codes
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "common.txt")
+	if err := os.WriteFile(path, []byte("# senhas comuns\nPassword1!\n\nqwerty\n"), 0o600); err != nil {
+		t.Fatalf("erro ao escrever dicionario: %v", err)
+	}
+	dictionary, err := LoadPasswordDictionary(path)
+	if err != nil {
+		t.Fatalf("erro ao carregar dicionario: %v", err)
+	}
+	if len(dictionary) != 2 {
+		t.Errorf("esperava 2 senhas no dicionario, recebeu %d", len(dictionary))
+	}
+
+	policy := PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        20,
+		RequireUpper:     true,
+		RequireLower:     true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+		BannedSubstrings: []string{"ralds"},
+		Dictionary:       dictionary,
+	}
+	tests := []struct {
+		name     string
+		password string
+		banned   []string
+		want     []string
+	}{
+		{"senha valida", "Cavalo#Bateria9", []string{"maria@ralds.com.br", "Maria"}, nil},
+		{"todas as violacoes de uma vez", "abc", nil, []string{"min_length", "uppercase", "digit", "symbol"}},
+		{"longa demais", "Cavalo#Bateria9Grampo", nil, []string{"max_length"}},
+		{"contem o nome da aplicacao", "Senha#Ralds9", nil, []string{"banned_substring"}},
+		{"contem a parte local do email", "Joaquim#2025", []string{"joaquim@ralds.com.br"}, []string{"banned_substring"}},
+		{"ignora valores curtos", "Cavalo#Bateria9", []string{"a", "Bo"}, nil},
+		{"senha comum", "PassWord1!", nil, []string{"common"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := violationCodes(t, policy.Validate(tt.password, tt.banned...))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("esperava %v, recebeu %v", tt.want, got)
+			}
+		})
+	}
+
+	err = policy.Validate("abc")
+	if err.Error() != "password must have at least 8 characters, must contain at least one uppercase letter, must contain at least one digit, must contain at least one symbol" {
+		t.Errorf("mensagem inesperada: %v", err)
+	}
+	if _, err := LoadPasswordDictionary(filepath.Join(t.TempDir(), "nao-existe.txt")); err == nil {
+		t.Error("esperava erro com dicionario inexistente")
+	}
+}
@@ -0,0 +1,264 @@
+package gorote
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RevocationStore interface {
+	Revoke(ctx context.Context, jti string, expiresAt time.Time) error
+	RevokeSubject(ctx context.Context, subject string, expiresAt time.Time) error
+	IsRevoked(ctx context.Context, jti, subject string, issuedAt time.Time) (bool, error)
+}
+
+var revocationStore struct {
+	sync.RWMutex
+	store RevocationStore
+}
+
+// UseRevocationStore sets the default denylist consulted by the JWTProtected
+// middlewares. JWTProtectedRevocable takes its own store instead, for
+// several apps in one process.
+func UseRevocationStore(store RevocationStore) {
+	revocationStore.Lock()
+	defer revocationStore.Unlock()
+	revocationStore.store = store
+}
+
+// UseRevocationStoreIfUnset sets the default denylist only when none is set
+// yet, so the first app of a process keeps it and later ones leave it alone.
+func UseRevocationStoreIfUnset(store RevocationStore) {
+	revocationStore.Lock()
+	defer revocationStore.Unlock()
+	if revocationStore.store == nil {
+		revocationStore.store = store
+	}
+}
+
+func defaultRevocationStore() RevocationStore {
+	revocationStore.RLock()
+	defer revocationStore.RUnlock()
+	return revocationStore.store
+}
+
+// SessionRevocationID is the identifier revoked with Revoke to deny every token
+// carrying the sid claim of a session.
+func SessionRevocationID(sid string) string {
+	return "sid:" + sid
+}
+
+type revocationClaims struct {
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+func checkRevocation(ctx context.Context, revocations RevocationStore, hash string) error {
+	if revocations == nil {
+		return nil
+	}
+	var claims revocationClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(strings.TrimPrefix(hash, "Bearer "), &claims); err != nil {
+		return fmt.Errorf("invalid token")
+	}
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	revoked, err := revocations.IsRevoked(ctx, claims.ID, claims.Subject, issuedAt)
+	if err != nil {
+		return fmt.Errorf("failed to check token revocation")
+	}
+	if !revoked && claims.SessionID != "" {
+		revoked, err = revocations.IsRevoked(ctx, SessionRevocationID(claims.SessionID), "", issuedAt)
+		if err != nil {
+			return fmt.Errorf("failed to check token revocation")
+		}
+	}
+	if revoked {
+		return fmt.Errorf("token revoked")
+	}
+	return nil
+}
+
+// Tokens carry second precision, so one issued in the same second as the
+// subject revocation is treated as revoked.
+func revokedBefore(issuedAt, revokedAt time.Time) bool {
+	return !issuedAt.After(revokedAt.Truncate(time.Second))
+}
+
+type MemoryRevocationStore struct {
+	mu       sync.RWMutex
+	tokens   map[string]time.Time
+	subjects map[string]memorySubjectRevocation
+}
+
+type memorySubjectRevocation struct {
+	revokedAt time.Time
+	expiresAt time.Time
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		tokens:   make(map[string]time.Time),
+		subjects: make(map[string]memorySubjectRevocation),
+	}
+}
+
+func (m *MemoryRevocationStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+	m.tokens[jti] = expiresAt
+	return nil
+}
+
+func (m *MemoryRevocationStore) RevokeSubject(ctx context.Context, subject string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+	m.subjects[subject] = memorySubjectRevocation{
+		revokedAt: time.Now(),
+		expiresAt: expiresAt,
+	}
+	return nil
+}
+
+func (m *MemoryRevocationStore) IsRevoked(ctx context.Context, jti, subject string, issuedAt time.Time) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	if expiresAt, ok := m.tokens[jti]; ok && jti != "" && expiresAt.After(now) {
+		return true, nil
+	}
+	if revocation, ok := m.subjects[subject]; ok && subject != "" && revocation.expiresAt.After(now) {
+		return revokedBefore(issuedAt, revocation.revokedAt), nil
+	}
+	return false, nil
+}
+
+func (m *MemoryRevocationStore) prune() {
+	now := time.Now()
+	for jti, expiresAt := range m.tokens {
+		if !expiresAt.After(now) {
+			delete(m.tokens, jti)
+		}
+	}
+	for subject, revocation := range m.subjects {
+		if !revocation.expiresAt.After(now) {
+			delete(m.subjects, subject)
+		}
+	}
+}
+
+type RevokedToken struct {
+	Identifier string `gorm:"primaryKey;size:150"`
+	RevokedAt  time.Time
+	ExpiresAt  time.Time `gorm:"index"`
+}
+
+type GormRevocationStore struct {
+	db *gorm.DB
+}
+
+func NewGormRevocationStore(db *gorm.DB) (*GormRevocationStore, error) {
+	if err := db.AutoMigrate(&RevokedToken{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate revoked tokens: %w", err)
+	}
+	return &GormRevocationStore{db: db}, nil
+}
+
+func (g *GormRevocationStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	return g.save(ctx, "jti:"+jti, expiresAt)
+}
+
+func (g *GormRevocationStore) RevokeSubject(ctx context.Context, subject string, expiresAt time.Time) error {
+	return g.save(ctx, "sub:"+subject, expiresAt)
+}
+
+func (g *GormRevocationStore) save(ctx context.Context, identifier string, expiresAt time.Time) error {
+	db := g.db.WithContext(ctx)
+	if err := db.Where("expires_at <= ?", time.Now()).Delete(&RevokedToken{}).Error; err != nil {
+		return fmt.Errorf("failed to prune revoked tokens: %w", err)
+	}
+	if err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&RevokedToken{
+		Identifier: identifier,
+		RevokedAt:  time.Now(),
+		ExpiresAt:  expiresAt,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	return nil
+}
+
+func (g *GormRevocationStore) IsRevoked(ctx context.Context, jti, subject string, issuedAt time.Time) (bool, error) {
+	var revoked []RevokedToken
+	if err := g.db.WithContext(ctx).
+		Where("identifier IN ? AND expires_at > ?", []string{"jti:" + jti, "sub:" + subject}, time.Now()).
+		Find(&revoked).Error; err != nil {
+		return false, fmt.Errorf("failed to query revoked tokens: %w", err)
+	}
+	for _, r := range revoked {
+		if jti != "" && r.Identifier == "jti:"+jti {
+			return true, nil
+		}
+		if subject != "" && r.Identifier == "sub:"+subject && revokedBefore(issuedAt, r.RevokedAt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type RedisRevocationStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisRevocationStore(client *redis.Client) *RedisRevocationStore {
+	return &RedisRevocationStore{client: client, prefix: "revoked:"}
+}
+
+func (r *RedisRevocationStore) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	return r.save(ctx, r.prefix+"jti:"+jti, expiresAt)
+}
+
+func (r *RedisRevocationStore) RevokeSubject(ctx context.Context, subject string, expiresAt time.Time) error {
+	return r.save(ctx, r.prefix+"sub:"+subject, expiresAt)
+}
+
+func (r *RedisRevocationStore) save(ctx context.Context, key string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	if err := r.client.Set(ctx, key, time.Now().Unix(), ttl).Err(); err != nil {
+		return fmt.Errorf("failed to revoke token: %v", err)
+	}
+	return nil
+}
+
+func (r *RedisRevocationStore) IsRevoked(ctx context.Context, jti, subject string, issuedAt time.Time) (bool, error) {
+	values, err := r.client.MGet(ctx, r.prefix+"jti:"+jti, r.prefix+"sub:"+subject).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to query revoked tokens: %v", err)
+	}
+	if jti != "" && values[0] != nil {
+		return true, nil
+	}
+	if subject != "" && values[1] != nil {
+		revokedAt, err := strconv.ParseInt(fmt.Sprintf("%v", values[1]), 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid subject revocation: %v", err)
+		}
+		return revokedBefore(issuedAt, time.Unix(revokedAt, 0)), nil
+	}
+	return false, nil
+}
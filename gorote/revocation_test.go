@@ -0,0 +1,116 @@
+package gorote
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestRevocationStores(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:revocation?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("err on open db: %v", err)
+	}
+	gormStore, err := NewGormRevocationStore(db)
+	if err != nil {
+		t.Fatalf("err on gorm store: %v", err)
+	}
+	stores := map[string]RevocationStore{
+		"memory": NewMemoryRevocationStore(),
+		"gorm":   gormStore,
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			issued := time.Now().Add(-time.Minute)
+			if err := store.Revoke(ctx, "jti-1", time.Now().Add(time.Hour)); err != nil {
+				t.Fatalf("err on revoke: %v", err)
+			}
+			if revoked, _ := store.IsRevoked(ctx, "jti-1", "", issued); !revoked {
+				t.Error("esperava jti revogado")
+			}
+			if revoked, _ := store.IsRevoked(ctx, "jti-2", "", issued); revoked {
+				t.Error("jti não deveria estar revogado")
+			}
+			if err := store.Revoke(ctx, "jti-3", time.Now().Add(-time.Second)); err != nil {
+				t.Fatalf("err on revoke: %v", err)
+			}
+			if revoked, _ := store.IsRevoked(ctx, "jti-3", "", issued); revoked {
+				t.Error("revogação expirada não deveria valer")
+			}
+			if err := store.RevokeSubject(ctx, "user-1", time.Now().Add(time.Hour)); err != nil {
+				t.Fatalf("err on revoke subject: %v", err)
+			}
+			if revoked, _ := store.IsRevoked(ctx, "jti-4", "user-1", issued); !revoked {
+				t.Error("esperava token anterior do usuário revogado")
+			}
+			if revoked, _ := store.IsRevoked(ctx, "jti-5", "user-1", time.Now().Add(2*time.Second)); revoked {
+				t.Error("token emitido após a revogação não deveria estar revogado")
+			}
+		})
+	}
+}
+
+func TestJWTProtectedRevocable(t *testing.T) {
+	_, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	ring, err := NewKeyRing(privateKey)
+	if err != nil {
+		t.Fatalf("erro ao criar key ring: %v", err)
+	}
+	token, err := ring.Sign(jwt.RegisteredClaims{
+		ID:        "jti-1",
+		Subject:   "user-1",
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	if err != nil {
+		t.Fatalf("erro ao assinar: %v", err)
+	}
+	own := NewMemoryRevocationStore()
+	if err := own.Revoke(context.Background(), "jti-1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("err on revoke: %v", err)
+	}
+	UseRevocationStore(NewMemoryRevocationStore())
+	t.Cleanup(func() { UseRevocationStore(nil) })
+
+	app := fiber.New()
+	ok := func(ctx *fiber.Ctx) error { return ctx.SendStatus(fiber.StatusOK) }
+	app.Get("/own", JWTProtectedRevocable(&jwt.RegisteredClaims{}, ring, own), ok)
+	app.Get("/default", JWTProtectedKeySet(&jwt.RegisteredClaims{}, ring), ok)
+	for path, want := range map[string]int{"/own": fiber.StatusUnauthorized, "/default": fiber.StatusOK} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("err on test: %v", err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("esperava status %d em %s, recebeu %d", want, path, resp.StatusCode)
+		}
+	}
+}
+
+func TestUseRevocationStoreIfUnset(t *testing.T) {
+	t.Cleanup(func() { UseRevocationStore(nil) })
+	first, second := NewMemoryRevocationStore(), NewMemoryRevocationStore()
+	UseRevocationStoreIfUnset(first)
+	UseRevocationStoreIfUnset(second)
+	if defaultRevocationStore() != first {
+		t.Error("esperava manter o primeiro store padrao")
+	}
+	UseRevocationStore(second)
+	if defaultRevocationStore() != second {
+		t.Error("UseRevocationStore deveria substituir o store padrao")
+	}
+}
@@ -1,6 +1,10 @@
 package gorote
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -14,7 +18,31 @@ import (
 )
 
 func GenerateJwtWithRSA(claims jwt.Claims, privateKey *rsa.PrivateKey) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	return GenerateJwt(claims, privateKey)
+}
+
+func GenerateJwtWithECDSA(claims jwt.Claims, privateKey *ecdsa.PrivateKey) (string, error) {
+	return GenerateJwt(claims, privateKey)
+}
+
+func GenerateJwtWithEd25519(claims jwt.Claims, privateKey ed25519.PrivateKey) (string, error) {
+	return GenerateJwt(claims, privateKey)
+}
+
+func GenerateJwt(claims jwt.Claims, privateKey crypto.Signer) (string, error) {
+	if privateKey == nil {
+		return "", fmt.Errorf("private key is required")
+	}
+	method, err := SigningMethod(privateKey.Public())
+	if err != nil {
+		return "", err
+	}
+	kid, err := KeyID(privateKey.Public())
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
 	signedToken, err := token.SignedString(privateKey)
 	if err != nil {
 		return "", err
@@ -23,6 +51,24 @@ func GenerateJwtWithRSA(claims jwt.Claims, privateKey *rsa.PrivateKey) (string,
 	return signedToken, nil
 }
 
+func SigningMethod(publicKey crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		}
+		return nil, fmt.Errorf("unsupported curve: %s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %T", publicKey)
+}
+
 func GenerateJwtWithSecret(claims jwt.Claims, secret string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	signedToken, err := token.SignedString([]byte(secret))
@@ -34,12 +80,29 @@ func GenerateJwtWithSecret(claims jwt.Claims, secret string) (string, error) {
 }
 
 func ValidateOrGetJWTRSA(claims jwt.Claims, hash string, publicKey *rsa.PublicKey) error {
+	return ValidateOrGetJWTKeySet(claims, hash, NewStaticKeySet(publicKey))
+}
+
+func ValidateOrGetJWTECDSA(claims jwt.Claims, hash string, publicKey *ecdsa.PublicKey) error {
+	return ValidateOrGetJWTKeySet(claims, hash, NewStaticKeySet(publicKey))
+}
+
+func ValidateOrGetJWTEd25519(claims jwt.Claims, hash string, publicKey ed25519.PublicKey) error {
+	return ValidateOrGetJWTKeySet(claims, hash, NewStaticKeySet(publicKey))
+}
+
+func ValidateOrGetJWTKeySet(claims jwt.Claims, hash string, keys KeySet) error {
 	tokenString := strings.TrimPrefix(hash, "Bearer ")
 	if tokenString == "" {
 		return fmt.Errorf("authorization header is empty or malformed")
 	}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (any, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+		kid, _ := t.Header["kid"].(string)
+		publicKey, err := keys.PublicKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		if !compatibleSigningMethod(t.Method, publicKey) {
 			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
 		}
 		return publicKey, nil
@@ -50,6 +113,18 @@ func ValidateOrGetJWTRSA(claims jwt.Claims, hash string, publicKey *rsa.PublicKe
 	return nil
 }
 
+func compatibleSigningMethod(method jwt.SigningMethod, publicKey crypto.PublicKey) bool {
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		_, ok := method.(*jwt.SigningMethodRSA)
+		return ok
+	}
+	expected, err := SigningMethod(publicKey)
+	if err != nil {
+		return false
+	}
+	return method.Alg() == expected.Alg()
+}
+
 func ValidateOrGetJWT(claims jwt.Claims, hash string, secret string) error {
 	tokenString := strings.TrimPrefix(hash, "Bearer ")
 	if tokenString == "" {
@@ -192,3 +267,111 @@ func MustReadPrivateKeyFromString(key string) *rsa.PrivateKey {
 
 	return rsaPriv
 }
+
+func MustReadECDSAPrivateKeyFromFile(filePath string) *ecdsa.PrivateKey {
+	privateKey, ok := parsePrivateKey(mustReadPEM(filePath)).(*ecdsa.PrivateKey)
+	if !ok {
+		panic("not an ECDSA private key")
+	}
+	return privateKey
+}
+
+func MustReadECDSAPublicKeyFromFile(filePath string) *ecdsa.PublicKey {
+	publicKey, ok := parsePublicKey(mustReadPEM(filePath)).(*ecdsa.PublicKey)
+	if !ok {
+		panic("not an ECDSA public key")
+	}
+	return publicKey
+}
+
+func MustReadECDSAPrivateKeyFromString(key string) *ecdsa.PrivateKey {
+	privateKey, ok := parsePrivateKey(mustDecodeBase64(key)).(*ecdsa.PrivateKey)
+	if !ok {
+		panic("not an ECDSA private key")
+	}
+	return privateKey
+}
+
+func MustReadECDSAPublicKeyFromString(key string) *ecdsa.PublicKey {
+	publicKey, ok := parsePublicKey(mustDecodeBase64(key)).(*ecdsa.PublicKey)
+	if !ok {
+		panic("not an ECDSA public key")
+	}
+	return publicKey
+}
+
+func MustReadEd25519PrivateKeyFromFile(filePath string) ed25519.PrivateKey {
+	privateKey, ok := parsePrivateKey(mustReadPEM(filePath)).(ed25519.PrivateKey)
+	if !ok {
+		panic("not an Ed25519 private key")
+	}
+	return privateKey
+}
+
+func MustReadEd25519PublicKeyFromFile(filePath string) ed25519.PublicKey {
+	publicKey, ok := parsePublicKey(mustReadPEM(filePath)).(ed25519.PublicKey)
+	if !ok {
+		panic("not an Ed25519 public key")
+	}
+	return publicKey
+}
+
+func MustReadEd25519PrivateKeyFromString(key string) ed25519.PrivateKey {
+	privateKey, ok := parsePrivateKey(mustDecodeBase64(key)).(ed25519.PrivateKey)
+	if !ok {
+		panic("not an Ed25519 private key")
+	}
+	return privateKey
+}
+
+func MustReadEd25519PublicKeyFromString(key string) ed25519.PublicKey {
+	publicKey, ok := parsePublicKey(mustDecodeBase64(key)).(ed25519.PublicKey)
+	if !ok {
+		panic("not an Ed25519 public key")
+	}
+	return publicKey
+}
+
+func mustReadPEM(filePath string) []byte {
+	pemBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		panic("failed to read key file")
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		panic("failed to decode PEM block")
+	}
+	return block.Bytes
+}
+
+func mustDecodeBase64(key string) []byte {
+	derBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		panic("failed to decode key")
+	}
+	return derBytes
+}
+
+func parsePrivateKey(derBytes []byte) any {
+	if privateKey, err := x509.ParsePKCS8PrivateKey(derBytes); err == nil {
+		return privateKey
+	}
+	if privateKey, err := x509.ParseECPrivateKey(derBytes); err == nil {
+		return privateKey
+	}
+	if privateKey, err := x509.ParsePKCS1PrivateKey(derBytes); err == nil {
+		return privateKey
+	}
+	panic("failed to parse private key")
+}
+
+func parsePublicKey(derBytes []byte) any {
+	if publicKey, err := x509.ParsePKIXPublicKey(derBytes); err == nil {
+		return publicKey
+	}
+	if publicKey, err := x509.ParsePKCS1PublicKey(derBytes); err == nil {
+		return publicKey
+	}
+	panic("failed to parse public key")
+}
@@ -0,0 +1,96 @@
+package gorote
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestGenerateJwtAlgorithms(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	cases := map[string]crypto.Signer{
+		"ES256": p256,
+		"ES384": p384,
+		"EdDSA": edKey,
+	}
+	for alg, key := range cases {
+		t.Run(alg, func(t *testing.T) {
+			signed, err := GenerateJwt(jwt.RegisteredClaims{Subject: "user"}, key)
+			if err != nil {
+				t.Fatalf("erro ao gerar token: %v", err)
+			}
+			token, _, err := jwt.NewParser().ParseUnverified(signed, &jwt.RegisteredClaims{})
+			if err != nil {
+				t.Fatalf("erro ao ler token: %v", err)
+			}
+			if token.Method.Alg() != alg {
+				t.Errorf("esperava alg %s, recebeu %s", alg, token.Method.Alg())
+			}
+			if err := ValidateOrGetJWTKeySet(&jwt.RegisteredClaims{}, signed, NewStaticKeySet(key.Public())); err != nil {
+				t.Errorf("token deveria ser válido: %v", err)
+			}
+			jwks, err := NewJWKS(key.Public())
+			if err != nil {
+				t.Fatalf("erro ao gerar jwks: %v", err)
+			}
+			publicKey, err := jwks.Keys[0].PublicKey()
+			if err != nil {
+				t.Fatalf("erro ao ler chave do jwks: %v", err)
+			}
+			if err := ValidateOrGetJWTKeySet(&jwt.RegisteredClaims{}, signed, NewStaticKeySet(publicKey)); err != nil {
+				t.Errorf("token deveria ser válido com a chave do jwks: %v", err)
+			}
+		})
+	}
+
+	t.Run("rejeita algoritmo diferente da chave", func(t *testing.T) {
+		signed, _ := GenerateJwtWithECDSA(jwt.RegisteredClaims{Subject: "user"}, p256)
+		if err := ValidateOrGetJWTEd25519(&jwt.RegisteredClaims{}, signed, edKey.Public().(ed25519.PublicKey)); err == nil {
+			t.Error("token ES256 não deveria validar com chave Ed25519")
+		}
+	})
+}
+
+func TestReadKeysFromFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("erro ao gravar pem: %v", err)
+		}
+		return path
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDer, _ := x509.MarshalECPrivateKey(ecKey)
+	ecPubDer, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if !MustReadECDSAPrivateKeyFromFile(write("ec.pem", "EC PRIVATE KEY", ecDer)).Equal(ecKey) {
+		t.Error("chave privada ECDSA difere")
+	}
+	if !MustReadECDSAPublicKeyFromFile(write("ec_pub.pem", "PUBLIC KEY", ecPubDer)).Equal(&ecKey.PublicKey) {
+		t.Error("chave pública ECDSA difere")
+	}
+
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edDer, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	edPubDer, _ := x509.MarshalPKIXPublicKey(edPub)
+	if !MustReadEd25519PrivateKeyFromFile(write("ed.pem", "PRIVATE KEY", edDer)).Equal(edKey) {
+		t.Error("chave privada Ed25519 difere")
+	}
+	if !MustReadEd25519PublicKeyFromFile(write("ed_pub.pem", "PUBLIC KEY", edPubDer)).Equal(edPub) {
+		t.Error("chave pública Ed25519 difere")
+	}
+}
@@ -0,0 +1,47 @@
+package gorote
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238, Appendix B (SHA1 seed "12345678901234567890"), truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := TOTPCode(secret, TOTPStep(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatalf("erro ao gerar codigo: %v", err)
+		}
+		if code != expected {
+			t.Errorf("tempo %d: esperava %s, recebeu %s", unix, expected, code)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	if step, ok := ValidateTOTP(secret, "081804", now.Add(30*time.Second), 1); !ok || step != TOTPStep(now) {
+		t.Error("codigo do passo anterior deveria ser aceito com skew 1")
+	}
+	if _, ok := ValidateTOTP(secret, "081804", now.Add(90*time.Second), 1); ok {
+		t.Error("codigo expirado nao deveria ser aceito")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("erro ao gerar segredo: %v", err)
+	}
+	uri := TOTPURI("core", "admin@admin.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/core:admin@admin.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("uri inesperada: %s", uri)
+	}
+}
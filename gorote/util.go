@@ -1,11 +1,20 @@
 package gorote
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"reflect"
+	"regexp"
 	"strconv"
+	"sync"
 	"time"
 	"unicode"
 
@@ -14,6 +23,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// HashPassword hashes with bcrypt; see PasswordHasher for Argon2id.
 func HashPassword(password string) (string, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -27,6 +37,41 @@ func CheckPasswordHash(password, hashedPassword string) bool {
 	return err == nil
 }
 
+func RandomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func CompareTokenHash(token, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(hash)) == 1
+}
+
+// CodeChallengeS256 derives the RFC 7636 S256 code_challenge of a verifier.
+func CodeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyCodeChallenge checks a PKCE code_verifier against the stored challenge.
+// Only the S256 method is accepted.
+func VerifyCodeChallenge(verifier, challenge, method string) bool {
+	if method != "S256" || len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(CodeChallengeS256(verifier)), []byte(challenge)) == 1
+}
+
+// ValidatePassword checks for one uppercase letter and one symbol.
+//
+// Deprecated: use PasswordPolicy, which reports every violation at once.
 func ValidatePassword(password string) error {
 	hasUpper := false
 	hasSymbol := false
@@ -103,8 +148,29 @@ func splitJSONTag(tag string) string {
 	return tag
 }
 
+var validate = newValidator()
+
+var validationPatterns sync.Map
+
+// newValidator adds the regexp tag, as in `validate:"regexp=^[a-z_]+$"`, to
+// the default validations. The pattern can't contain commas.
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterValidation("regexp", func(fl validator.FieldLevel) bool {
+		pattern, ok := validationPatterns.Load(fl.Param())
+		if !ok {
+			compiled, err := regexp.Compile(fl.Param())
+			if err != nil {
+				return false
+			}
+			pattern, _ = validationPatterns.LoadOrStore(fl.Param(), compiled)
+		}
+		return pattern.(*regexp.Regexp).MatchString(fl.Field().String())
+	})
+	return v
+}
+
 func validateStruct(data any) error {
-	validate := validator.New()
 	err := validate.Struct(data)
 	if err != nil {
 		if validationErrors, ok := err.(validator.ValidationErrors); ok {
@@ -174,3 +240,35 @@ func MustEnvPrivateKeyRSA(key string) *rsa.PrivateKey {
 	}
 	return MustReadPrivateKeyFromString(value)
 }
+
+func MustEnvPublicKeyECDSA(key string) *ecdsa.PublicKey {
+	value := os.Getenv(key)
+	if value == "" {
+		panic(fmt.Sprintf("variable %s is required", key))
+	}
+	return MustReadECDSAPublicKeyFromString(value)
+}
+
+func MustEnvPrivateKeyECDSA(key string) *ecdsa.PrivateKey {
+	value := os.Getenv(key)
+	if value == "" {
+		panic(fmt.Sprintf("variable %s is required", key))
+	}
+	return MustReadECDSAPrivateKeyFromString(value)
+}
+
+func MustEnvPublicKeyEd25519(key string) ed25519.PublicKey {
+	value := os.Getenv(key)
+	if value == "" {
+		panic(fmt.Sprintf("variable %s is required", key))
+	}
+	return MustReadEd25519PublicKeyFromString(value)
+}
+
+func MustEnvPrivateKeyEd25519(key string) ed25519.PrivateKey {
+	value := os.Getenv(key)
+	if value == "" {
+		panic(fmt.Sprintf("variable %s is required", key))
+	}
+	return MustReadEd25519PrivateKeyFromString(value)
+}
@@ -1,6 +1,7 @@
 package gorote
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -54,3 +55,35 @@ func TestEnvAsString(t *testing.T) {
 		t.Error("hash deveria falhar para senha errada")
 	}
 }
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mJ92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "ngF5GsXcbwljx6u133FFr3Xht9xooA_DuaX_3QwODtc"
+	if got := CodeChallengeS256(verifier); got != challenge {
+		t.Fatalf("esperava challenge %s, recebeu %s", challenge, got)
+	}
+	if !VerifyCodeChallenge(verifier, challenge, "S256") {
+		t.Error("verifier deveria ser aceito")
+	}
+	if VerifyCodeChallenge(verifier, challenge, "plain") {
+		t.Error("metodo plain nao deveria ser aceito")
+	}
+	if VerifyCodeChallenge(verifier[:42], CodeChallengeS256(verifier[:42]), "S256") {
+		t.Error("verifier curto nao deveria ser aceito")
+	}
+}
+
+func TestValidateStructRegexp(t *testing.T) {
+	type permission struct {
+		Code string `json:"code" validate:"required,regexp=^[a-zA-Z0-9_]+$"`
+	}
+	if err := validateStruct(&permission{Code: "view_report"}); err != nil {
+		t.Errorf("esperava codigo valido, mas retornou erro: %v", err)
+	}
+	for _, code := range []string{"view-report", "view report", "relatório"} {
+		err := validateStruct(&permission{Code: code})
+		if err == nil || !strings.Contains(err.Error(), "'code' is regexp") {
+			t.Errorf("esperava erro de regexp para %q, mas retornou: %v", code, err)
+		}
+	}
+}